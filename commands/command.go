@@ -1,6 +1,10 @@
 package commands
 
-import "flag"
+import (
+	"flag"
+	"os"
+	"os/user"
+)
 
 type Command interface {
 	Check() error
@@ -9,3 +13,17 @@ type Command interface {
 	Name() string
 	FlagSet() *flag.FlagSet
 }
+
+// cliUser is who ran the command, wag records it in the audit log for any changes made
+func cliUser() string {
+	// Wag is usually managed with sudo, so the user behind it is more useful than root
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser + " (cli)"
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username + " (cli)"
+	}
+
+	return "cli"
+}
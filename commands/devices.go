@@ -15,6 +15,8 @@ type devices struct {
 	fs *flag.FlagSet
 
 	address, username, socket string
+	class, group              string
+	all                       bool
 	action                    string
 }
 
@@ -36,6 +38,13 @@ func Devices() *devices {
 	gc.fs.Bool("unlock", false, "Unlock device")
 	gc.fs.Bool("lock", false, "Lock device access to mfa routes")
 
+	gc.fs.StringVar(&gc.class, "class", "", "Session class from DeviceClasses, empty uses the global session settings (use with -set-class)")
+	gc.fs.Bool("set-class", false, "Set the session class of a device, applies from the next time the device authorises")
+
+	gc.fs.Bool("deauthenticate", false, "Force devices to do MFA again, acts on -username, -group or -all")
+	gc.fs.StringVar(&gc.group, "group", "", "Group whose members' devices to act on (use with -deauthenticate)")
+	gc.fs.BoolVar(&gc.all, "all", false, "Act on every device (use with -deauthenticate)")
+
 	return gc
 }
 
@@ -55,7 +64,7 @@ func (g *devices) PrintUsage() {
 func (g *devices) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "unlock", "del", "list", "lock", "mfa_sessions":
+		case "unlock", "del", "list", "lock", "mfa_sessions", "set-class", "deauthenticate":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
@@ -65,6 +74,21 @@ func (g *devices) Check() error {
 		if g.address == "" && g.username == "" {
 			return errors.New("address or username must be supplied")
 		}
+	case "set-class":
+		if g.address == "" && g.username == "" {
+			return errors.New("address or username must be supplied")
+		}
+	case "deauthenticate":
+		targets := 0
+		for _, set := range []bool{g.username != "", g.group != "", g.all} {
+			if set {
+				targets++
+			}
+		}
+
+		if targets != 1 || g.address != "" {
+			return errors.New("exactly one of username, group or all must be supplied")
+		}
 	case "list", "mfa_sessions":
 	default:
 		return errors.New("Unknown flag: " + g.action)
@@ -75,7 +99,7 @@ func (g *devices) Check() error {
 
 func (g *devices) Run() error {
 
-	ctl := wagctl.NewControlClient(g.socket)
+	ctl := wagctl.NewControlClient(g.socket).As(cliUser())
 
 	switch g.action {
 	case "del":
@@ -113,9 +137,9 @@ func (g *devices) Run() error {
 			return err
 		}
 
-		fmt.Println("username,address,publickey,authattempts,endpoint")
+		fmt.Println("username,address,publickey,authattempts,endpoint,class")
 		for _, device := range ds {
-			fmt.Printf("%s,%s,%s,%d,%s\n", device.Username, device.Address, device.Publickey, device.Attempts, device.Endpoint.String())
+			fmt.Printf("%s,%s,%s,%d,%s,%s\n", device.Username, device.Address, device.Publickey, device.Attempts, device.Endpoint.String(), device.Class)
 		}
 	case "mfa_sessions":
 		sessions, err := ctl.Sessions()
@@ -151,6 +175,58 @@ func (g *devices) Run() error {
 
 		fmt.Println("OK")
 
+	case "set-class":
+
+		if g.username != "" {
+			ds, err := ctl.ListDevice(g.username)
+			if err != nil {
+				return err
+			}
+
+			for _, device := range ds {
+				err := ctl.SetDeviceClass(device.Address, g.class)
+				if err != nil {
+					return err
+				}
+			}
+
+			fmt.Println("OK")
+			return nil
+		}
+
+		err := ctl.SetDeviceClass(g.address, g.class)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "deauthenticate":
+
+		var (
+			deauthenticated []string
+			err             error
+		)
+
+		switch {
+		case g.username != "":
+			deauthenticated, err = ctl.DeauthenticateUser(g.username, cliUser())
+		case g.group != "":
+			deauthenticated, err = ctl.DeauthenticateGroup(g.group, cliUser())
+		default:
+			deauthenticated, err = ctl.DeauthenticateAll(cliUser())
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, address := range deauthenticated {
+			fmt.Println("deauthenticated ", address)
+		}
+
+		fmt.Println("OK")
+
 	case "unlock":
 
 		if g.username != "" {
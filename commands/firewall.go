@@ -5,8 +5,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
+	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/control/wagctl"
 )
@@ -14,6 +17,10 @@ import (
 type firewallCmd struct {
 	fs             *flag.FlagSet
 	action, socket string
+
+	username, destination, protocol string
+	port, sourcePort                int
+	inbound                         bool
 }
 
 func Firewall() *firewallCmd {
@@ -22,8 +29,18 @@ func Firewall() *firewallCmd {
 	}
 
 	gc.fs.Bool("list", false, "List firewall rules")
+	gc.fs.Bool("stats", false, "Show allowed and dropped traffic counters per device and per rule")
+	gc.fs.Bool("events", false, "Stream dropped packets and the reason they were dropped, see DropEventSampleRate")
+	gc.fs.Bool("test", false, "Check whether a packet from a users devices would be allowed, requires -user and -dst")
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
 
+	gc.fs.StringVar(&gc.username, "user", "", "User to test (-test)")
+	gc.fs.StringVar(&gc.destination, "dst", "", "Destination address to test (-test)")
+	gc.fs.IntVar(&gc.port, "port", 0, "Destination port, or icmp/icmpv6 type, to test (-test)")
+	gc.fs.IntVar(&gc.sourcePort, "sport", 0, "Port on the device to test (-test)")
+	gc.fs.BoolVar(&gc.inbound, "inbound", false, "Test a packet sent from -dst to the users devices, rather than from them (-test)")
+	gc.fs.StringVar(&gc.protocol, "proto", "tcp", "Protocol to test, tcp, udp, sctp, icmp, icmpv6, gre, esp, proto/<number> or any (-test)")
+
 	return gc
 }
 
@@ -43,13 +60,17 @@ func (g *firewallCmd) PrintUsage() {
 func (g *firewallCmd) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "list":
+		case "list", "stats", "events", "test":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "list":
+	case "test":
+		if g.username == "" || g.destination == "" {
+			return errors.New("-user and -dst must be supplied")
+		}
+	case "list", "stats", "events":
 	default:
 		return errors.New("invalid action choice")
 	}
@@ -59,7 +80,7 @@ func (g *firewallCmd) Check() error {
 
 func (g *firewallCmd) Run() error {
 
-	ctl := wagctl.NewControlClient(g.socket)
+	ctl := wagctl.NewControlClient(g.socket).As(cliUser())
 
 	switch g.action {
 	case "list":
@@ -72,6 +93,65 @@ func (g *firewallCmd) Run() error {
 		b, _ := json.Marshal(rules)
 
 		fmt.Println(string(b))
+	case "stats":
+
+		stats, err := ctl.FirewallStats()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("username,address,allowedpackets,allowedbytes,droppedpackets,droppedbytes")
+		for _, device := range stats.Devices {
+			fmt.Printf("%s,%s,%d,%d,%d,%d\n", device.Username, device.Address, device.AllowedPackets, device.AllowedBytes, device.DroppedPackets, device.DroppedBytes)
+		}
+
+		fmt.Println()
+
+		fmt.Println("username,route,policy,allowedpackets,allowedbytes,droppedpackets,droppedbytes")
+		for _, rule := range stats.Rules {
+			fmt.Printf("%s,%s,%s,%d,%d,%d,%d\n", rule.Username, rule.Route, rule.Policy, rule.AllowedPackets, rule.AllowedBytes, rule.DroppedPackets, rule.DroppedBytes)
+		}
+	case "test":
+
+		decisions, err := ctl.FirewallTest(g.username, g.destination, g.protocol, g.port, g.sourcePort, g.inbound)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("device,destination,protocol,inbound,established,allowed,verdict,route,policy,accountlocked,authorised,timedout,sessionexpired,steppedup")
+		for _, d := range decisions {
+			device := d.Device
+			if device != "" {
+				device = net.JoinHostPort(device, fmt.Sprint(d.SourcePort))
+			}
+
+			fmt.Printf("%s,%s,%s,%t,%t,%t,%s,%s,%s,%t,%t,%t,%t,%t\n", device,
+				net.JoinHostPort(d.Destination, fmt.Sprint(d.Port)),
+				d.Protocol,
+				d.Inbound,
+				d.Established,
+				d.Allowed,
+				d.Verdict,
+				d.Route,
+				d.Policy,
+				d.AccountLocked,
+				d.Authorised,
+				d.TimedOut,
+				d.SessionExpired,
+				d.SteppedUp)
+		}
+	case "events":
+
+		fmt.Println("time,username,source,destination,protocol,reason")
+		return ctl.FirewallEvents(func(event router.DropEvent) error {
+			fmt.Printf("%s,%s,%s,%s,%s,%s\n", event.Time.Format(time.RFC3339),
+				event.Username,
+				net.JoinHostPort(event.Source, fmt.Sprint(event.SourcePort)),
+				net.JoinHostPort(event.Destination, fmt.Sprint(event.DestinationPort)),
+				event.Protocol,
+				event.Reason)
+			return nil
+		})
 	}
 	return nil
 
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+type mfaKey struct {
+	fs *flag.FlagSet
+
+	socket, keyFile string
+	action          string
+}
+
+func MfaKey() *mfaKey {
+	gc := &mfaKey{
+		fs: flag.NewFlagSet("mfa-key", flag.ContinueOnError),
+	}
+
+	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag instance control socket")
+	gc.fs.StringVar(&gc.keyFile, "key-file", "", "File containing the new key to encrypt mfa secrets with (-rotate), wag writes it to MFAEncryptionKeyFile. If not set the current key is kept and only the data key is changed")
+
+	gc.fs.Bool("generate", false, "Print a new random key, suitable for MFAEncryptionKeyFile or "+data.MfaKeyEnvVariable)
+	gc.fs.Bool("rotate", false, "Re-encrypt all mfa secrets with a new data key, also enables encryption if -key-file is set and it was not already enabled")
+
+	return gc
+}
+
+func (g *mfaKey) FlagSet() *flag.FlagSet {
+	return g.fs
+}
+
+func (g *mfaKey) Name() string {
+
+	return g.fs.Name()
+}
+
+func (g *mfaKey) PrintUsage() {
+	g.fs.Usage()
+}
+
+func (g *mfaKey) Check() error {
+	g.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "generate", "rotate":
+			g.action = strings.ToLower(f.Name)
+		}
+	})
+
+	switch g.action {
+	case "generate":
+	case "rotate":
+		if g.keyFile == "" {
+			return nil
+		}
+
+		if _, err := os.Stat(g.keyFile); err != nil {
+			return err
+		}
+	default:
+		return errors.New("Unknown flag: " + g.action)
+	}
+
+	return nil
+}
+
+func (g *mfaKey) Run() error {
+	switch g.action {
+	case "generate":
+		key, err := data.GenerateMfaKey()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(key)
+
+	case "rotate":
+		var key string
+		if g.keyFile != "" {
+			contents, err := os.ReadFile(g.keyFile)
+			if err != nil {
+				return err
+			}
+
+			if _, err := data.ParseMfaKey(string(contents)); err != nil {
+				return err
+			}
+
+			key = strings.TrimSpace(string(contents))
+		}
+
+		err := wagctl.NewControlClient(g.socket).As(cliUser()).RotateMfaKey(key)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+		if key != "" {
+			fmt.Println("The new key was written to MFAEncryptionKeyFile, keep a copy of it somewhere safe")
+		}
+	}
+
+	return nil
+}
@@ -112,7 +112,7 @@ func (g *registration) Check() error {
 
 func (g *registration) Run() error {
 
-	ctl := wagctl.NewControlClient(g.socket)
+	ctl := wagctl.NewControlClient(g.socket).As(cliUser())
 
 	switch g.action {
 	case "add":
@@ -45,5 +45,5 @@ func (g *reload) Check() error {
 
 func (g *reload) Run() error {
 
-	return wagctl.NewControlClient(g.socket).FullConfigReload()
+	return wagctl.NewControlClient(g.socket).As(cliUser()).FullConfigReload()
 }
@@ -10,8 +10,11 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/NHAS/wag/internal/api"
+	"github.com/NHAS/wag/internal/audit"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/metrics"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/internal/webserver"
 	"github.com/NHAS/wag/pkg/control/server"
@@ -97,7 +100,13 @@ func (g *start) Run() error {
 
 	error := make(chan error)
 
-	err := router.Setup(error, !g.noIptables)
+	err := audit.Start()
+	if err != nil {
+		return fmt.Errorf("unable to start audit log: %v", err)
+	}
+	defer audit.Stop()
+
+	err = router.Setup(error, !g.noIptables)
 	if err != nil {
 		return fmt.Errorf("unable to start router: %v", err)
 	}
@@ -128,6 +137,16 @@ func (g *start) Run() error {
 		return fmt.Errorf("unable to start management web server: %v", err)
 	}
 
+	err = metrics.Start(error)
+	if err != nil {
+		return fmt.Errorf("unable to start metrics listener: %v", err)
+	}
+
+	err = api.Start(error)
+	if err != nil {
+		return fmt.Errorf("unable to start api listener: %v", err)
+	}
+
 	go func() {
 		cancel := make(chan os.Signal, 1)
 		signal.Notify(cancel, syscall.SIGTERM, syscall.SIGINT, os.Interrupt, syscall.SIGQUIT)
@@ -15,6 +15,7 @@ type users struct {
 
 	username, socket string
 	action           string
+	factor           int
 }
 
 func Users() *users {
@@ -33,6 +34,10 @@ func Users() *users {
 
 	gc.fs.Bool("reset-mfa", false, "Reset MFA details, invalids all session and set MFA to be shown")
 
+	gc.fs.IntVar(&gc.factor, "factor", 0, "MFA factor id to act upon, from -list-mfa")
+	gc.fs.Bool("list-mfa", false, "List the MFA factors a user has enrolled")
+	gc.fs.Bool("revoke-mfa", false, "Remove a single MFA factor from a user, invalids all sessions. If it is their last factor MFA will be shown again")
+
 	return gc
 }
 
@@ -52,16 +57,24 @@ func (g *users) PrintUsage() {
 func (g *users) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa":
+		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa", "list-mfa", "revoke-mfa":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "del", "unlockaccount", "lockaccount", "reset-mfa":
+	case "del", "unlockaccount", "lockaccount", "reset-mfa", "list-mfa":
 		if g.username == "" {
 			return errors.New("username must be supplied")
 		}
+	case "revoke-mfa":
+		if g.username == "" {
+			return errors.New("username must be supplied")
+		}
+
+		if g.factor == 0 {
+			return errors.New("factor id must be supplied")
+		}
 	case "list":
 	default:
 		return errors.New("Unknown flag: " + g.action)
@@ -71,7 +84,7 @@ func (g *users) Check() error {
 }
 
 func (g *users) Run() error {
-	ctl := wagctl.NewControlClient(g.socket)
+	ctl := wagctl.NewControlClient(g.socket).As(cliUser())
 
 	switch g.action {
 	case "del":
@@ -117,6 +130,24 @@ func (g *users) Run() error {
 			return err
 		}
 		fmt.Println("OK")
+
+	case "list-mfa":
+		factors, err := ctl.ListUserMFA(g.username)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("id,type,date_added,last_used")
+		for _, factor := range factors {
+			fmt.Printf("%d,%s,%s,%s\n", factor.ID, factor.Type, factor.DateAdded, factor.LastUsed)
+		}
+
+	case "revoke-mfa":
+		err := ctl.RevokeUserMFA(g.username, g.factor)
+		if err != nil {
+			return err
+		}
+		fmt.Println("OK")
 	}
 
 	return nil
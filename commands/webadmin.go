@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/control/wagctl"
 )
@@ -15,7 +16,13 @@ type webadmin struct {
 
 	username, password, socket string
 	action                     string
+	role                       string
 	isTempPass                 bool
+	resetMfa                   bool
+
+	tokenName, scopes string
+
+	subject string
 }
 
 func Webadmin() *webadmin {
@@ -25,6 +32,7 @@ func Webadmin() *webadmin {
 
 	gc.fs.StringVar(&gc.username, "username", "", "Admin Username to act upon")
 	gc.fs.StringVar(&gc.password, "password", "", "Password to set")
+	gc.fs.StringVar(&gc.role, "role", data.AdminRoleAdmin, "Admin role, one of: "+strings.Join(data.AdminRoles, ", "))
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag instance control socket")
 
 	gc.fs.Bool("add", false, "Add web administrator user (requires -password)")
@@ -33,10 +41,23 @@ func Webadmin() *webadmin {
 	gc.fs.Bool("del", false, "Delete admin user")
 	gc.fs.Bool("list", false, "List web administration users, if '-username' supply will filter by user")
 	gc.fs.Bool("reset", false, "Reset admin user account password (requires -password and -username)")
+	gc.fs.Bool("mfa", false, "Also remove the admin users mfa, so they register it again on next login, -password is optional with this (requires -reset)")
+	gc.fs.Bool("setrole", false, "Change what an admin user is allowed to do in the web UI (requires -username and -role)")
+
+	gc.fs.StringVar(&gc.subject, "subject", "", "OIDC subject (the 'sub' claim) to link an admin to")
+	gc.fs.Bool("linkoidc", false, "Let an existing admin sign in with OIDC as the subject (requires -username and -subject)")
+	gc.fs.Bool("unlinkoidc", false, "Stop an admin signing in with OIDC (requires -username)")
 
 	gc.fs.Bool("lockaccount", false, "Lock admin account disable login for this web administrator user")
 	gc.fs.Bool("unlockaccount", false, "Unlock a web administrator account")
 
+	gc.fs.StringVar(&gc.tokenName, "name", "", "API token name to act upon")
+	gc.fs.StringVar(&gc.scopes, "scopes", "", "Comma separated scopes for the API token, e.g users:read,devices:write or * for everything")
+
+	gc.fs.Bool("addtoken", false, "Create a REST API token, printed once (requires -name and -scopes)")
+	gc.fs.Bool("deltoken", false, "Delete a REST API token (requires -name)")
+	gc.fs.Bool("listtokens", false, "List REST API tokens")
+
 	return gc
 }
 
@@ -56,21 +77,47 @@ func (g *webadmin) PrintUsage() {
 func (g *webadmin) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "lockaccount", "unlockaccount", "del", "list", "add", "reset":
+		case "lockaccount", "unlockaccount", "del", "list", "add", "reset", "setrole", "addtoken", "deltoken", "listtokens", "linkoidc", "unlinkoidc":
 			g.action = strings.ToLower(f.Name)
 		case "temp":
 			g.isTempPass = true
+		case "mfa":
+			g.resetMfa = true
 		}
 	})
 
 	switch g.action {
-	case "del", "unlockaccount", "lockaccount":
+	case "del", "unlockaccount", "lockaccount", "setrole", "unlinkoidc":
 		if g.username == "" {
 			return errors.New("address must be supplied")
 		}
-	case "list":
+	case "list", "listtokens":
+
+	case "addtoken":
+		if g.tokenName == "" || g.scopes == "" {
+			return errors.New("both name and scopes must be specified to create an api token")
+		}
+
+	case "linkoidc":
+		if g.username == "" || g.subject == "" {
+			return errors.New("both username and subject must be specified to link an admin")
+		}
+
+	case "deltoken":
+		if g.tokenName == "" {
+			return errors.New("name must be supplied")
+		}
+
+	case "reset":
+		if g.username == "" {
+			return errors.New("username must be supplied")
+		}
+
+		if g.password == "" && !g.resetMfa {
+			return errors.New("password must be supplied, unless only resetting mfa with -mfa")
+		}
 
-	case "add", "reset":
+	case "add":
 		if g.username == "" || g.password == "" {
 			return errors.New("both username and password must be specified for this command")
 		}
@@ -83,13 +130,13 @@ func (g *webadmin) Check() error {
 }
 
 func (g *webadmin) Run() error {
-	ctl := wagctl.NewControlClient(g.socket)
+	ctl := wagctl.NewControlClient(g.socket).As(cliUser())
 
 	switch g.action {
 
 	case "add":
 
-		err := ctl.AddAdminUser(g.username, g.password, g.isTempPass)
+		err := ctl.AddAdminUser(g.username, g.password, g.isTempPass, g.role)
 		if err != nil {
 			return err
 		}
@@ -97,7 +144,39 @@ func (g *webadmin) Run() error {
 		fmt.Println("OK")
 
 	case "reset":
-		err := ctl.SetAdminUserPassword(g.username, g.password)
+		if g.password != "" {
+			err := ctl.SetAdminUserPassword(g.username, g.password)
+			if err != nil {
+				return err
+			}
+		}
+
+		if g.resetMfa {
+			err := ctl.ResetAdminUserMFA(g.username)
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Println("OK")
+
+	case "setrole":
+
+		err := ctl.SetAdminUserRole(g.username, g.role)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "linkoidc", "unlinkoidc":
+
+		subject := g.subject
+		if g.action == "unlinkoidc" {
+			subject = ""
+		}
+
+		err := ctl.LinkAdminUserOIDC(g.username, subject)
 		if err != nil {
 			return err
 		}
@@ -120,9 +199,9 @@ func (g *webadmin) Run() error {
 			return err
 		}
 
-		fmt.Println("username,attempts,date_added,last_login,ip")
+		fmt.Println("username,role,mfa,oidc,attempts,date_added,last_login,ip")
 		for _, user := range users {
-			fmt.Printf("%s,%d,%s,%s,%s\n", user.Username, user.Attempts, user.DateAdded, user.LastLogin, user.IP)
+			fmt.Printf("%s,%s,%s,%s,%d,%s,%s,%s\n", user.Username, user.Role, user.MfaType, user.OIDC, user.Attempts, user.DateAdded, user.LastLogin, user.IP)
 		}
 	case "lockaccount":
 
@@ -141,6 +220,36 @@ func (g *webadmin) Run() error {
 		}
 
 		fmt.Println("OK")
+
+	case "addtoken":
+
+		token, err := ctl.CreateAPIToken(g.tokenName, strings.Split(g.scopes, ","))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(token)
+
+	case "deltoken":
+
+		err := ctl.DeleteAPIToken(g.tokenName)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+
+	case "listtokens":
+
+		tokens, err := ctl.ListAPITokens()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("name,scopes,date_added,last_used")
+		for _, token := range tokens {
+			fmt.Printf("%s,%s,%s,%s\n", token.Name, strings.Join(token.Scopes, " "), token.DateAdded, token.LastUsed)
+		}
 	}
 
 	return nil
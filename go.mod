@@ -8,6 +8,7 @@ require (
 	github.com/boombuler/barcode v1.0.1
 	github.com/cilium/ebpf v0.12.2
 	github.com/coreos/go-iptables v0.7.0
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/mattn/go-sqlite3 v1.14.18
 	github.com/mdlayher/netlink v1.7.2
 	github.com/msteinert/pam v1.2.0
@@ -17,10 +18,13 @@ require (
 	golang.org/x/net v0.17.0
 	golang.org/x/sys v0.13.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6
+	layeh.com/radius v0.0.0-20231213012653-1006025d24f8
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/fxamacker/cbor/v2 v2.5.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.5 // indirect
 	github.com/go-webauthn/x v0.1.4 // indirect
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/audit"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control/wagctl"
+)
+
+const prefix = "/api/v1/"
+
+// Largest request body accepted
+const maxBodySize = 1 << 20
+
+//go:embed openapi.yaml
+var openAPI []byte
+
+var ctrl *wagctl.CtrlClient
+
+type tokenKey struct{}
+
+// Start serves the REST api on API.ListenAddress if it is enabled
+func Start(errs chan<- error) error {
+	if !config.Values().API.Enabled {
+		return nil
+	}
+
+	ctrl = wagctl.NewControlClient(config.Values().Socket)
+
+	resources := map[string]http.HandlerFunc{
+		"users":         users,
+		"devices":       devices,
+		"registrations": registrations,
+		"policies":      policies,
+		"groups":        groups,
+		"sessions":      sessions,
+		"firewall":      firewall,
+	}
+
+	mux := http.NewServeMux()
+	for name, handler := range resources {
+		mux.Handle(prefix+name, authorised(name, handler))
+		mux.Handle(prefix+name+"/", authorised(name, handler))
+	}
+
+	mux.HandleFunc(prefix+"openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPI)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		notFound(w)
+	})
+
+	srv := &http.Server{
+		Addr:         config.Values().API.ListenAddress,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		Handler:      mux,
+	}
+
+	if config.Values().API.SupportsTLS() {
+		go func() {
+			errs <- fmt.Errorf("TLS api listener failed: %v", srv.ListenAndServeTLS(config.Values().API.CertPath, config.Values().API.KeyPath))
+		}()
+	} else {
+		go func() {
+			errs <- fmt.Errorf("api listener failed: %v", srv.ListenAndServe())
+		}()
+	}
+
+	log.Println("Started REST API:\n\t\t\tListening:", config.Values().API.ListenAddress)
+
+	return nil
+}
+
+// authorised checks the bearer token has the resource:read scope for GETs, and resource:write for everything else
+func authorised(resource string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		token, err := data.CheckAPIToken(bearer)
+		if err != nil {
+			tokenFailures.add(audit.Event{
+				Type:    audit.Control,
+				Outcome: audit.Failure,
+				Address: r.RemoteAddr,
+				Action:  r.Method + " " + r.URL.Path,
+				Details: map[string]string{"error": err.Error()},
+			})
+
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		scope := resource + ":write"
+		if r.Method == "GET" {
+			scope = resource + ":read"
+		}
+
+		if !token.Allows(scope) {
+			writeError(w, http.StatusForbidden, "token does not have the "+scope+" scope")
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
+
+// client makes changes through the control socket as the api token, so the audit log shows which token made them
+func client(r *http.Request) *wagctl.CtrlClient {
+	token, ok := r.Context().Value(tokenKey{}).(data.APIToken)
+	if !ok {
+		return ctrl
+	}
+
+	return ctrl.As("api token " + token.Name)
+}
+
+// subPath splits the path after /api/v1/resource/, e.g /api/v1/users/toaster/lock gives [toaster lock]
+func subPath(r *http.Request, resource string) []string {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix+resource), "/")
+	if rest == "" {
+		return nil
+	}
+
+	return strings.Split(rest, "/")
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return false
+		}
+
+		writeError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println("api unable to marshal response: ", err)
+		writeError(w, http.StatusInternalServerError, "server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// controlError reports a change the control socket refused, these are almost always caused by bad input
+func controlError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, strings.TrimSpace(err.Error()))
+}
+
+func noContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serverError(w http.ResponseWriter, err error) {
+	log.Println("api error: ", err)
+	writeError(w, http.StatusInternalServerError, "server error")
+}
+
+func notFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, "not found")
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/audit"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+// recorder collects the audit events an aggregator would have written
+type recorder struct {
+	lock   sync.Mutex
+	events []audit.Event
+}
+
+func (rec *recorder) record(e audit.Event) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	rec.events = append(rec.events, e)
+}
+
+func (rec *recorder) recorded() []audit.Event {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return slices.Clone(rec.events)
+}
+
+func TestSubPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		resource string
+		expected []string
+	}{
+		{"/api/v1/users", "users", nil},
+		{"/api/v1/users/", "users", nil},
+		{"/api/v1/users/toaster", "users", []string{"toaster"}},
+		{"/api/v1/users/toaster/", "users", []string{"toaster"}},
+		{"/api/v1/users/toaster/lock", "users", []string{"toaster", "lock"}},
+		{"/api/v1/users/toaster/mfa/3", "users", []string{"toaster", "mfa", "3"}},
+		{"/api/v1/devices/10.2.43.2", "devices", []string{"10.2.43.2"}},
+		{"/api/v1/policies/group:nerds", "policies", []string{"group:nerds"}},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if got := subPath(r, test.resource); !slices.Equal(got, test.expected) {
+			t.Errorf("%s: got %q, expected %q", test.path, got, test.expected)
+		}
+	}
+}
+
+func TestAuthorised(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(data.MfaKeyEnvVariable, "")
+	if err := data.Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec recorder
+	tokenFailures = newFailureAggregator(time.Minute, rec.record)
+
+	tokens := map[string]string{}
+	for name, scopes := range map[string][]string{
+		"reader": {"users:read"},
+		"writer": {"users:write"},
+		"all":    {"*"},
+		"other":  {"devices:write"},
+	} {
+		token, err := data.CreateAPIToken(name, scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[name] = token
+	}
+
+	var reached string
+	handler := authorised("users", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := r.Context().Value(tokenKey{}).(data.APIToken)
+		reached = token.Name
+	}))
+
+	tests := []struct {
+		method        string
+		authorization string
+		status        int
+		reached       string
+	}{
+		{"GET", "", http.StatusUnauthorized, ""},
+		{"GET", tokens["reader"], http.StatusUnauthorized, ""}, // Not a bearer token
+		{"GET", "Bearer wag_notatoken", http.StatusUnauthorized, ""},
+		{"GET", "Bearer " + tokens["reader"], http.StatusOK, "reader"},
+		{"POST", "Bearer " + tokens["reader"], http.StatusForbidden, ""},
+		{"DELETE", "Bearer " + tokens["reader"], http.StatusForbidden, ""},
+		{"GET", "Bearer " + tokens["writer"], http.StatusOK, "writer"},
+		{"POST", "Bearer " + tokens["writer"], http.StatusOK, "writer"},
+		{"DELETE", "Bearer " + tokens["all"], http.StatusOK, "all"},
+		{"GET", "Bearer " + tokens["other"], http.StatusForbidden, ""},
+		{"POST", "Bearer " + tokens["other"], http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		reached = ""
+
+		r := httptest.NewRequest(test.method, "/api/v1/users/toaster", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status || reached != test.reached {
+			t.Errorf("%s with %q: got %d (reached handler as %q), expected %d (%q)", test.method, test.authorization, w.Code, reached, test.status, test.reached)
+		}
+	}
+
+	// Only the invalid token is a failed check, a missing token never touches the database
+	if events := rec.recorded(); len(events) != 1 || events[0].Outcome != audit.Failure {
+		t.Fatalf("expected one failed token check to be recorded: %+v", events)
+	}
+}
+
+func TestTokenFailuresAggregated(t *testing.T) {
+	var rec recorder
+	failures := newFailureAggregator(50*time.Millisecond, rec.record)
+
+	for i := 0; i < 100; i++ {
+		failures.add(audit.Event{Outcome: audit.Failure, Address: fmt.Sprintf("192.0.2.1:%d", 1000+i), Details: map[string]string{"error": "invalid api token"}})
+	}
+
+	if events := rec.recorded(); len(events) != 1 {
+		t.Fatalf("expected only the first failure to be recorded straight away, got %d", len(events))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	events := rec.recorded()
+	if len(events) != 2 {
+		t.Fatalf("expected the rest to be recorded as one event, got %d", len(events))
+	}
+
+	if events[1].Details["failures"] != "99" || events[1].Details["error"] != "invalid api token" {
+		t.Fatalf("summary event was wrong: %+v", events[1])
+	}
+
+	// After the window the next failure is recorded straight away again
+	failures.add(audit.Event{Outcome: audit.Failure, Address: "192.0.2.1:1000"})
+	if events := rec.recorded(); len(events) != 3 {
+		t.Fatalf("expected a failure after the window to be recorded, got %d", len(events))
+	}
+}
+
+func TestTokenFailuresManyAddresses(t *testing.T) {
+	var rec recorder
+	failures := newFailureAggregator(50*time.Millisecond, rec.record)
+
+	for i := 0; i < 1000; i++ {
+		failures.add(audit.Event{Outcome: audit.Failure, Address: fmt.Sprintf("2001:db8::%x", i)})
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	events := rec.recorded()
+	if len(events) > 2*(maxFailureAddresses+1) {
+		t.Fatalf("rotating addresses caused %d writes", len(events))
+	}
+
+	counted := 0
+	for _, e := range events {
+		if e.Details["failures"] == "" {
+			counted++
+			continue
+		}
+
+		var n int
+		fmt.Sscan(e.Details["failures"], &n)
+		counted += n
+
+		if e.Address != otherAddresses {
+			t.Fatalf("only the overflow should have had repeated failures: %+v", e)
+		}
+	}
+
+	if counted != 1000 {
+		t.Fatalf("failures were lost, counted %d", counted)
+	}
+}
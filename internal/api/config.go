@@ -0,0 +1,165 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/NHAS/wag/pkg/control"
+)
+
+// GET    /policies
+// POST   /policies                       PolicyData
+// GET    /policies/{effects}
+// PUT    /policies/{effects}             PolicyData, effects is taken from the path
+// DELETE /policies/{effects}
+func policies(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "policies")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		all, err := ctrl.GetPolicies()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		if all == nil {
+			all = []control.PolicyData{}
+		}
+
+		writeJSON(w, http.StatusOK, all)
+
+	case len(path) == 0 && r.Method == "POST":
+		var policy control.PolicyData
+		if !decode(w, r, &policy) {
+			return
+		}
+
+		if err := client(r).AddPolicy(policy); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, policy)
+
+	case len(path) == 1 && r.Method == "GET":
+		all, err := ctrl.GetPolicies()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, policy := range all {
+			if policy.Effects == path[0] {
+				writeJSON(w, http.StatusOK, policy)
+				return
+			}
+		}
+
+		notFound(w)
+
+	case len(path) == 1 && r.Method == "PUT":
+		var policy control.PolicyData
+		if !decode(w, r, &policy) {
+			return
+		}
+
+		policy.Effects = path[0]
+
+		if err := client(r).EditPolicies(policy); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, policy)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if err := client(r).RemovePolicies([]string{path[0]}); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	default:
+		notFound(w)
+	}
+}
+
+// GET    /groups
+// POST   /groups                         GroupData
+// GET    /groups/{group}
+// PUT    /groups/{group}                 GroupData, group is taken from the path
+// DELETE /groups/{group}
+func groups(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "groups")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		all, err := ctrl.GetGroups()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		if all == nil {
+			all = []control.GroupData{}
+		}
+
+		writeJSON(w, http.StatusOK, all)
+
+	case len(path) == 0 && r.Method == "POST":
+		var group control.GroupData
+		if !decode(w, r, &group) {
+			return
+		}
+
+		if err := client(r).AddGroup(group); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, group)
+
+	case len(path) == 1 && r.Method == "GET":
+		all, err := ctrl.GetGroups()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, group := range all {
+			if group.Group == path[0] {
+				writeJSON(w, http.StatusOK, group)
+				return
+			}
+		}
+
+		notFound(w)
+
+	case len(path) == 1 && r.Method == "PUT":
+		var group control.GroupData
+		if !decode(w, r, &group) {
+			return
+		}
+
+		group.Group = path[0]
+
+		if err := client(r).EditGroup(group); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, group)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if err := client(r).RemoveGroup([]string{path[0]}); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	default:
+		notFound(w)
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+type Device struct {
+	Address      string `json:"address"`
+	Username     string `json:"username"`
+	PublicKey    string `json:"public_key"`
+	LastEndpoint string `json:"last_endpoint"`
+	Locked       bool   `json:"locked"`
+	Active       bool   `json:"active"`
+	Class        string `json:"class"`
+}
+
+// GET    /devices?username=
+// GET    /devices/{address}
+// DELETE /devices/{address}
+// POST   /devices/{address}/lock
+// POST   /devices/{address}/unlock
+// PUT    /devices/{address}/class        {"class": ""}
+func devices(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "devices")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		all, err := ctrl.ListDevice(r.URL.Query().Get("username"))
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		result := []Device{}
+		for _, d := range all {
+			result = append(result, describeDevice(d))
+		}
+
+		writeJSON(w, http.StatusOK, result)
+
+	case len(path) == 1 && r.Method == "GET":
+		all, err := ctrl.ListDevice("")
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, d := range all {
+			if d.Address == path[0] {
+				writeJSON(w, http.StatusOK, describeDevice(d))
+				return
+			}
+		}
+
+		notFound(w)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if err := client(r).DeleteDevice(path[0]); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	case len(path) == 2 && r.Method == "POST" && (path[1] == "lock" || path[1] == "unlock"):
+		var err error
+		if path[1] == "lock" {
+			err = client(r).LockDevice(path[0])
+		} else {
+			err = client(r).UnlockDevice(path[0])
+		}
+
+		if err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	case len(path) == 2 && path[1] == "class" && r.Method == "PUT":
+		var body struct {
+			Class string `json:"class"`
+		}
+
+		if !decode(w, r, &body) {
+			return
+		}
+
+		if err := client(r).SetDeviceClass(path[0], body.Class); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	default:
+		notFound(w)
+	}
+}
+
+func describeDevice(d data.Device) Device {
+	device := Device{
+		Address:   d.Address,
+		Username:  d.Username,
+		PublicKey: d.Publickey,
+		Locked:    d.Attempts >= config.Values().Lockout,
+		Active:    d.Active,
+		Class:     d.Class,
+	}
+
+	if d.Endpoint != nil {
+		device.LastEndpoint = d.Endpoint.String()
+	}
+
+	return device
+}
+
+type Session struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+}
+
+// GET    /sessions
+// POST   /sessions/deauthenticate        {"usernames": [], "groups": [], "all": false}
+func sessions(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "sessions")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		authorised, err := ctrl.Sessions()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		devices, err := ctrl.ListDevice("")
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		owners := map[string]string{}
+		for _, device := range devices {
+			owners[device.Address] = device.Username
+		}
+
+		result := []Session{}
+		for _, address := range authorised {
+			result = append(result, Session{Address: address, Username: owners[address]})
+		}
+
+		writeJSON(w, http.StatusOK, result)
+
+	case len(path) == 1 && path[0] == "deauthenticate" && r.Method == "POST":
+		var targets struct {
+			Usernames []string `json:"usernames"`
+			Groups    []string `json:"groups"`
+			All       bool     `json:"all"`
+		}
+
+		if !decode(w, r, &targets) {
+			return
+		}
+
+		if !targets.All && len(targets.Usernames) == 0 && len(targets.Groups) == 0 {
+			writeError(w, http.StatusBadRequest, "no usernames, groups or all specified")
+			return
+		}
+
+		// The control socket takes who forced it from the actor
+		deauthenticated := []string{}
+
+		if targets.All {
+			addresses, err := client(r).DeauthenticateAll("")
+			if err != nil {
+				controlError(w, err)
+				return
+			}
+			deauthenticated = append(deauthenticated, addresses...)
+		}
+
+		for _, username := range targets.Usernames {
+			addresses, err := client(r).DeauthenticateUser(username, "")
+			if err != nil {
+				controlError(w, err)
+				return
+			}
+			deauthenticated = append(deauthenticated, addresses...)
+		}
+
+		for _, group := range targets.Groups {
+			addresses, err := client(r).DeauthenticateGroup(group, "")
+			if err != nil {
+				controlError(w, err)
+				return
+			}
+			deauthenticated = append(deauthenticated, addresses...)
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			Deauthenticated []string `json:"deauthenticated"`
+		}{deauthenticated})
+
+	default:
+		notFound(w)
+	}
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/audit"
+)
+
+// Most addresses whose failures are counted separately, past this they are all counted together
+// so rotating addresses cannot be used to write to the database more often
+const maxFailureAddresses = 64
+
+const otherAddresses = "multiple addresses"
+
+// tokenFailures records failed token checks. They are unauthenticated, so each one writing to the database would let anyone
+// who can reach the api make wag do work, instead the first failure from an address is recorded and the rest are counted
+// and recorded as one event at the end of the window
+var tokenFailures = newFailureAggregator(time.Minute, audit.Record)
+
+type failureAggregator struct {
+	window time.Duration
+	record func(audit.Event)
+
+	lock    sync.Mutex
+	pending map[string]*failureCount
+}
+
+type failureCount struct {
+	count int
+	last  audit.Event
+}
+
+func newFailureAggregator(window time.Duration, record func(audit.Event)) *failureAggregator {
+	return &failureAggregator{
+		window:  window,
+		record:  record,
+		pending: make(map[string]*failureCount),
+	}
+}
+
+func (f *failureAggregator) add(event audit.Event) {
+	key, _, err := net.SplitHostPort(event.Address)
+	if err != nil {
+		key = event.Address
+	}
+
+	f.lock.Lock()
+
+	if _, ok := f.pending[key]; !ok && len(f.pending) >= maxFailureAddresses {
+		key = otherAddresses
+	}
+
+	if p, ok := f.pending[key]; ok {
+		p.count++
+		p.last = event
+		f.lock.Unlock()
+		return
+	}
+
+	f.pending[key] = &failureCount{}
+	f.lock.Unlock()
+
+	time.AfterFunc(f.window, func() {
+		f.flush(key)
+	})
+
+	f.record(event)
+}
+
+// flush records the failures counted during the window, if there were any
+func (f *failureAggregator) flush(key string) {
+	f.lock.Lock()
+	p := f.pending[key]
+	delete(f.pending, key)
+	f.lock.Unlock()
+
+	if p == nil || p.count == 0 {
+		return
+	}
+
+	event := p.last
+
+	details := map[string]string{"failures": strconv.Itoa(p.count)}
+	for k, v := range event.Details {
+		details[k] = v
+	}
+	event.Details = details
+
+	if key == otherAddresses {
+		event.Address = otherAddresses
+	}
+
+	f.record(event)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// GET    /firewall/rules
+// GET    /firewall/stats
+// GET    /firewall/test?username=&destination=&protocol=&port=&sport=&inbound=
+func firewall(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "firewall")
+
+	if len(path) != 1 || r.Method != "GET" {
+		notFound(w)
+		return
+	}
+
+	switch path[0] {
+	case "rules":
+		rules, err := ctrl.FirewallRules()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, rules)
+
+	case "stats":
+		stats, err := ctrl.FirewallStats()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+
+	case "test":
+		query := r.URL.Query()
+
+		port := 0
+		if query.Get("port") != "" {
+			var err error
+			port, err = strconv.Atoi(query.Get("port"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid port: "+query.Get("port"))
+				return
+			}
+		}
+
+		sourcePort := 0
+		if query.Get("sport") != "" {
+			var err error
+			sourcePort, err = strconv.Atoi(query.Get("sport"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid source port: "+query.Get("sport"))
+				return
+			}
+		}
+
+		inbound, err := strconv.ParseBool(query.Get("inbound"))
+		if err != nil && query.Get("inbound") != "" {
+			writeError(w, http.StatusBadRequest, "invalid inbound: "+query.Get("inbound"))
+			return
+		}
+
+		decisions, err := ctrl.FirewallTest(query.Get("username"), query.Get("destination"), query.Get("protocol"), port, sourcePort, inbound)
+		if err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, decisions)
+
+	default:
+		notFound(w)
+	}
+}
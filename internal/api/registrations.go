@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/NHAS/wag/pkg/control"
+)
+
+type Registration struct {
+	Token      string   `json:"token"`
+	Username   string   `json:"username"`
+	Groups     []string `json:"groups"`
+	Overwrites string   `json:"overwrites"`
+	Uses       int      `json:"uses"`
+}
+
+// GET    /registrations
+// POST   /registrations                  Registration, token is generated if empty and uses defaults to 1
+// DELETE /registrations/{token}
+func registrations(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "registrations")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		all, err := ctrl.Registrations()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		result := []Registration{}
+		for _, reg := range all {
+			result = append(result, describeRegistration(reg))
+		}
+
+		writeJSON(w, http.StatusOK, result)
+
+	case len(path) == 0 && r.Method == "POST":
+		var reg Registration
+		if !decode(w, r, &reg) {
+			return
+		}
+
+		if reg.Uses == 0 {
+			reg.Uses = 1
+		}
+
+		if reg.Uses < 0 {
+			writeError(w, http.StatusBadRequest, "cannot create token with < 0 uses")
+			return
+		}
+
+		created, err := client(r).NewRegistration(reg.Token, reg.Username, reg.Overwrites, reg.Uses, reg.Groups...)
+		if err != nil {
+			controlError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, describeRegistration(created))
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if err := client(r).DeleteRegistration(path[0]); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	default:
+		notFound(w)
+	}
+}
+
+func describeRegistration(reg control.RegistrationResult) Registration {
+	groups := reg.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+
+	return Registration{
+		Token:      reg.Token,
+		Username:   reg.Username,
+		Groups:     groups,
+		Overwrites: reg.Overwrites,
+		Uses:       reg.NumUses,
+	}
+}
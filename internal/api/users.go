@@ -0,0 +1,179 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+type User struct {
+	Username string      `json:"username"`
+	Locked   bool        `json:"locked"`
+	Groups   []string    `json:"groups"`
+	Devices  []string    `json:"devices"`
+	Mfa      []MfaFactor `json:"mfa"`
+}
+
+type MfaFactor struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	DateAdded string `json:"date_added"`
+	LastUsed  string `json:"last_used"`
+}
+
+// GET    /users
+// GET    /users/{username}
+// DELETE /users/{username}
+// POST   /users/{username}/lock
+// POST   /users/{username}/unlock
+// GET    /users/{username}/mfa
+// DELETE /users/{username}/mfa           resets the users mfa so they must register it again
+// DELETE /users/{username}/mfa/{id}
+func users(w http.ResponseWriter, r *http.Request) {
+	path := subPath(r, "users")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		all, err := ctrl.ListUsers("")
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		result := []User{}
+		for _, u := range all {
+			user, err := describeUser(u)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+
+			result = append(result, user)
+		}
+
+		writeJSON(w, http.StatusOK, result)
+
+	case len(path) == 1 && r.Method == "GET":
+		all, err := ctrl.ListUsers("")
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		for _, u := range all {
+			if u.Username != path[0] {
+				continue
+			}
+
+			user, err := describeUser(u)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+
+			writeJSON(w, http.StatusOK, user)
+			return
+		}
+
+		notFound(w)
+
+	case len(path) == 1 && r.Method == "DELETE":
+		if err := client(r).DeleteUser(path[0]); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	case len(path) == 2 && r.Method == "POST" && (path[1] == "lock" || path[1] == "unlock"):
+		var err error
+		if path[1] == "lock" {
+			err = client(r).LockUser(path[0])
+		} else {
+			err = client(r).UnlockUser(path[0])
+		}
+
+		if err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	case len(path) == 2 && path[1] == "mfa" && r.Method == "GET":
+		factors, err := ctrl.ListUserMFA(path[0])
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, mfaFactors(factors))
+
+	case len(path) == 2 && path[1] == "mfa" && r.Method == "DELETE":
+		if err := client(r).ResetUserMFA(path[0]); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	case len(path) == 3 && path[1] == "mfa" && r.Method == "DELETE":
+		id, err := strconv.Atoi(path[2])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid mfa factor id: "+path[2])
+			return
+		}
+
+		if err := client(r).RevokeUserMFA(path[0], id); err != nil {
+			controlError(w, err)
+			return
+		}
+
+		noContent(w)
+
+	default:
+		notFound(w)
+	}
+}
+
+func describeUser(u data.UserModel) (User, error) {
+	devices, err := ctrl.ListDevice(u.Username)
+	if err != nil {
+		return User{}, err
+	}
+
+	factors, err := ctrl.ListUserMFA(u.Username)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{
+		Username: u.Username,
+		Locked:   u.Locked,
+		Groups:   append([]string{"*"}, config.Values().Acls.GetUserGroups(u.Username)...),
+		Devices:  []string{},
+		Mfa:      mfaFactors(factors),
+	}
+
+	for _, device := range devices {
+		user.Devices = append(user.Devices, device.Address)
+	}
+
+	return user, nil
+}
+
+func mfaFactors(factors []data.MfaFactor) []MfaFactor {
+	result := []MfaFactor{}
+	for _, f := range factors {
+		result = append(result, MfaFactor{
+			ID:        f.ID,
+			Type:      f.Type,
+			DateAdded: f.DateAdded,
+			LastUsed:  f.LastUsed,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+type Event = data.AuditEvent
+
+// Event types
+const (
+	Registration   = "registration"
+	MFA            = "mfa"
+	Lockout        = "lockout"
+	Recovery       = "recovery"
+	EndpointChange = "endpoint_change"
+	Control        = "control"
+	Admin          = "admin"
+)
+
+// Event outcomes
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Events waiting to be sent to a slow sink before new ones are dropped
+const sinkQueueLength = 1024
+
+type sink struct {
+	name  string
+	queue chan Event
+	write func(Event, []byte) error
+	close func() error
+}
+
+var (
+	sinksLock sync.RWMutex
+	sinks     []*sink
+)
+
+// Start opens the sinks set in the config and begins pruning old events from the database
+func Start() error {
+	var started []*sink
+
+	if config.Values().Audit.File != "" {
+		s, err := newFileSink(config.Values().Audit.File)
+		if err != nil {
+			return fmt.Errorf("could not open audit file: %s", err)
+		}
+		started = append(started, s)
+	}
+
+	if config.Values().Audit.Syslog.Address != "" {
+		s, err := newSyslogSink(config.Values().Audit.Syslog.Network, config.Values().Audit.Syslog.Address)
+		if err != nil {
+			return fmt.Errorf("could not connect to audit syslog server: %s", err)
+		}
+		started = append(started, s)
+	}
+
+	if config.Values().Audit.HTTP.URL != "" {
+		started = append(started, newHTTPSink(config.Values().Audit.HTTP.URL, config.Values().Audit.HTTP.Headers))
+	}
+
+	for _, s := range started {
+		go s.drain()
+	}
+
+	sinksLock.Lock()
+	sinks = started
+	sinksLock.Unlock()
+
+	go pruneEvents()
+
+	return nil
+}
+
+// Stop closes the sinks, events that have not been sent yet are lost
+func Stop() {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	for _, s := range sinks {
+		close(s.queue)
+	}
+	sinks = nil
+}
+
+// Record stores event in the database and queues it for every sink
+func Record(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if err := data.AddAuditEvent(event); err != nil {
+		log.Println("unable to store audit event: ", err)
+	}
+
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+
+	for _, s := range sinks {
+		select {
+		case s.queue <- event:
+		default:
+			log.Println("audit", s.name, "is not keeping up, dropped", event.Type, "event")
+		}
+	}
+}
+
+// Query returns recorded events matching filter, newest first
+func Query(filter data.AuditFilter) ([]Event, error) {
+	return data.GetAuditEvents(filter)
+}
+
+func (s *sink) drain() {
+	for event := range s.queue {
+		line, err := json.Marshal(event)
+		if err != nil {
+			log.Println("unable to marshal audit event: ", err)
+			continue
+		}
+
+		if err := s.write(event, line); err != nil {
+			log.Println("unable to write event to audit", s.name, ": ", err)
+		}
+	}
+
+	if s.close != nil {
+		if err := s.close(); err != nil {
+			log.Println("unable to close audit", s.name, ": ", err)
+		}
+	}
+}
+
+func pruneEvents() {
+	for {
+		if days := config.Values().Audit.RetentionDays; days > 0 {
+			removed, err := data.DeleteAuditEventsBefore(time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				log.Println("unable to remove old audit events: ", err)
+			} else if removed > 0 {
+				log.Println("removed", removed, "audit events older than", days, "days")
+			}
+		}
+
+		time.Sleep(6 * time.Hour)
+	}
+}
@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func newFileSink(path string) (*sink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sink{
+		name:  "file " + path,
+		queue: make(chan Event, sinkQueueLength),
+		write: func(_ Event, line []byte) error {
+			_, err := f.Write(append(line, '\n'))
+			return err
+		},
+		close: f.Close,
+	}, nil
+}
+
+// Facility 10 is authpriv
+const (
+	syslogInfo    = 10*8 + 6
+	syslogWarning = 10*8 + 4
+)
+
+type syslogWriter struct {
+	sync.Mutex
+
+	network, address string
+	hostname         string
+	conn             net.Conn
+}
+
+func newSyslogSink(network, address string) (*sink, error) {
+	if network == "" {
+		network = "udp"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	w := &syslogWriter{
+		network:  network,
+		address:  address,
+		hostname: hostname,
+	}
+
+	// Fail on startup if the server cannot be reached at all, later failures reconnect
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+
+	return &sink{
+		name:  "syslog " + network + "://" + address,
+		queue: make(chan Event, sinkQueueLength),
+		write: w.write,
+		close: w.close,
+	}, nil
+}
+
+func (w *syslogWriter) connect() (err error) {
+	w.conn, err = net.DialTimeout(w.network, w.address, 10*time.Second)
+	return err
+}
+
+func (w *syslogWriter) write(event Event, line []byte) error {
+	w.Lock()
+	defer w.Unlock()
+
+	message := formatSyslog(event, line, w.hostname, os.Getpid())
+
+	// Stream transports need framing (RFC6587 octet counting), datagrams are one message each
+	if w.network == "tcp" || w.network == "unix" {
+		message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if err = w.connect(); err != nil {
+				continue
+			}
+		}
+
+		if _, err = w.conn.Write(message); err == nil {
+			return nil
+		}
+
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	return err
+}
+
+func (w *syslogWriter) close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	return w.conn.Close()
+}
+
+// formatSyslog builds an RFC5424 message with the event type as the MSGID and the JSON event as the message
+func formatSyslog(event Event, line []byte, hostname string, pid int) []byte {
+	priority := syslogInfo
+	if event.Outcome == Failure {
+		priority = syslogWarning
+	}
+
+	header := fmt.Sprintf("<%d>1 %s %s wag %d %s - ", priority, event.Time.UTC().Format(time.RFC3339Nano), hostname, pid, event.Type)
+
+	return append([]byte(header), line...)
+}
+
+func newHTTPSink(url string, headers map[string]string) *sink {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	return &sink{
+		name:  "http " + url,
+		queue: make(chan Event, sinkQueueLength),
+		write: func(_ Event, line []byte) error {
+			req, err := http.NewRequest("POST", url, bytes.NewReader(line))
+			if err != nil {
+				return err
+			}
+
+			req.Header.Set("Content-Type", "application/json")
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return fmt.Errorf("server returned %s", resp.Status)
+			}
+
+			return nil
+		},
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -46,16 +47,62 @@ type Acl struct {
 	Mfa   []string `json:",omitempty"`
 	Allow []string `json:",omitempty"`
 	Deny  []string `json:",omitempty"`
+
+	// Overrides the global session settings for users this policy applies to, 0 uses the global value and -1 disables it
+	// If more than one policy applies to a user the shortest is used
+	MaxSessionLifetimeMinutes       int `json:",omitempty"`
+	SessionInactivityTimeoutMinutes int `json:",omitempty"`
+}
+
+func (a *Acl) mergeSessions(other *Acl) {
+	a.MaxSessionLifetimeMinutes = ShortestSession(a.MaxSessionLifetimeMinutes, other.MaxSessionLifetimeMinutes)
+	a.SessionInactivityTimeoutMinutes = ShortestSession(a.SessionInactivityTimeoutMinutes, other.SessionInactivityTimeoutMinutes)
+}
+
+func (a Acl) validateSessions() error {
+	if a.MaxSessionLifetimeMinutes < -1 || a.SessionInactivityTimeoutMinutes < -1 {
+		return errors.New("session settings cannot be negative, use -1 to disable them")
+	}
+
+	return nil
+}
+
+// ShortestSession returns the shorter of two session settings in minutes, where 0 is unset and -1 is disabled
+func ShortestSession(a, b int) int {
+	switch {
+	case a == 0 || a < 0 && b != 0:
+		return b
+	case b == 0 || b < 0:
+		return a
+	}
+
+	return min(a, b)
 }
 
 type Acls struct {
 	Groups map[string][]string `json:",omitempty"`
 	//Username -> groups name
 	rGroupLookup map[string]map[string]bool
-	Policies     map[string]*Acl
+	//Username -> groups name, only those set from a directory by SyncVirtualUser
+	rSyncedGroups map[string]map[string]bool
+	Policies      map[string]*Acl
+
+	// Named port/protocol lists and addresses that can be used in policy rules, e.g "ssh": ["22/tcp"] and "db-tier": ["10.1.0.0/24"]
+	Services map[string][]string `json:",omitempty"`
+	Hosts    map[string][]string `json:",omitempty"`
+}
+
+func (a Acls) aliases() routetypes.Aliases {
+	return routetypes.Aliases{
+		Services: a.Services,
+		Hosts:    a.Hosts,
+	}
 }
 
 func (a Acls) GetUserGroups(username string) (result []string) {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
 	if values.Acls.rGroupLookup == nil {
 		return []string{}
 	}
@@ -68,6 +115,27 @@ func (a Acls) GetUserGroups(username string) (result []string) {
 	return
 }
 
+// GetGroupMembers returns every user in group, including users whose groups were set by an authenticator
+// The lookup is shared with the live config and changed by logins, so it is read under the lock
+func (a Acls) GetGroupMembers(group string) (result []string) {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	for username, groups := range values.Acls.rGroupLookup {
+		if groups[group] {
+			result = append(result, username)
+		}
+	}
+
+	return
+}
+
+// DeviceClass overrides the session settings for devices in that class, 0 uses the global value and -1 disables it
+type DeviceClass struct {
+	MaxSessionLifetimeMinutes       int `json:",omitempty"`
+	SessionInactivityTimeoutMinutes int `json:",omitempty"`
+}
+
 type Config struct {
 	path         string
 	Socket       string `json:",omitempty"`
@@ -85,9 +153,74 @@ type Config struct {
 	MaxSessionLifetimeMinutes       int
 	SessionInactivityTimeoutMinutes int
 
+	// Session settings for classes of device (e.g "phone"), set on a device with `wag devices -set-class`
+	DeviceClasses map[string]DeviceClass `json:",omitempty"`
+
+	// How long after completing mfa a device can reach routes marked stepup, defaults to 5 minutes
+	StepUpLifetimeMinutes int `json:",omitempty"`
+
+	DropEventSampleRate int `json:",omitempty"`
+
+	// Audit events are always kept in the database, these send them elsewhere as JSON as well
+	Audit struct {
+		// Days to keep events in the database, defaults to 90, -1 keeps them forever
+		RetentionDays int `json:",omitempty"`
+
+		// File to append events to, one per line
+		File string `json:",omitempty"`
+
+		// RFC5424 syslog, Network is udp (default), tcp, unix or unixgram
+		Syslog struct {
+			Network string `json:",omitempty"`
+			Address string
+		} `json:",omitempty"`
+
+		// Each event is POSTed to URL, Headers can be used for authorisation
+		HTTP struct {
+			URL     string
+			Headers map[string]string `json:",omitempty"`
+		} `json:",omitempty"`
+	} `json:",omitempty"`
+
 	DownloadConfigFileName string `json:",omitempty"`
 
+	// EnforceMFA makes administrators register totp (or webauthn, when Domain is set to the https url of the management ui) before they can log in
 	ManagementUI struct {
+		usualWeb
+		Enabled    bool
+		EnforceMFA bool   `json:",omitempty"`
+		Domain     string `json:",omitempty"`
+
+		// Sign in with an OIDC provider, the callback is Domain/login/oidc/callback
+		// Admins must be in AdminGroup (if set), and are created with Role on first sign in if AutoProvision is set
+		// Existing admins must be linked to their OIDC subject with "wag webadmin -linkoidc"
+		OIDC struct {
+			IssuerURL       string
+			ClientSecret    string
+			ClientID        string
+			Scopes          []string `json:",omitempty"`
+			GroupsClaimName string   `json:",omitempty"`
+			AdminGroup      string   `json:",omitempty"`
+			AutoProvision   bool     `json:",omitempty"`
+			Role            string   `json:",omitempty"`
+		} `json:",omitempty"`
+
+		// Only allow admins to sign in with OIDC
+		DisablePasswordLogin bool `json:",omitempty"`
+
+		//Not externally configurable
+		Webauthn *webauthn.WebAuthn `json:"-"`
+	} `json:",omitempty"`
+
+	// Prometheus metrics served on /metrics, Token requires scrapers to send it as a bearer token
+	Metrics struct {
+		usualWeb
+		Enabled bool
+		Token   string `json:",omitempty"`
+	} `json:",omitempty"`
+
+	// JSON REST api on /api/v1/, clients authenticate with tokens created by "wag webadmin -addtoken"
+	API struct {
 		usualWeb
 		Enabled bool
 	} `json:",omitempty"`
@@ -114,6 +247,30 @@ type Config struct {
 			ServiceName string
 		} `json:",omitempty"`
 
+		LDAP struct {
+			URL             string
+			StartTLS        bool   `json:",omitempty"`
+			CACertPath      string `json:",omitempty"`
+			UserDN          string
+			BaseDN          string
+			UserFilter      string `json:",omitempty"`
+			GroupsAttribute string `json:",omitempty"`
+		} `json:",omitempty"`
+
+		Webhook struct {
+			URL            string
+			SigningKey     string
+			CallbackURL    string
+			Ntfy           bool `json:",omitempty"`
+			TimeoutSeconds int  `json:",omitempty"`
+		} `json:",omitempty"`
+
+		RADIUS struct {
+			Server        string
+			Secret        string
+			NASIdentifier string `json:",omitempty"`
+		} `json:",omitempty"`
+
 		//Not externally configurable
 		Webauthn *webauthn.WebAuthn `json:"-"`
 	}
@@ -129,11 +286,17 @@ type Config struct {
 		Range         *net.IPNet `json:"-"`
 		ServerAddress net.IP     `json:"-"`
 
+		// Every range on the tunnel interface, Range is the first. An existing interface may have both an IPv4 and IPv6 range
+		Ranges []*net.IPNet `json:"-"`
+
 		DNS []string `json:",omitempty"`
 	}
 
 	DatabaseLocation string
 
+	// File containing the base64 encoded key used to encrypt mfa secrets in the database, the WAG_MFA_ENCRYPTION_KEY environment variable takes precedence
+	MFAEncryptionKeyFile string `json:",omitempty"`
+
 	Acls Acls
 }
 
@@ -173,6 +336,29 @@ func SetSessionLifetimeMinutes(SessionLifetimeMinutes int) error {
 	return save()
 }
 
+// SessionLimits returns the max session lifetime and inactivity timeout in minutes for a users device of class
+// The shortest of the device class and the users policies is used, falling back to the global settings if neither sets them
+func SessionLimits(username, class string) (maxSessionLifetimeMinutes, inactivityTimeoutMinutes int) {
+	acl := GetEffectiveAcl(username)
+
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	deviceClass := values.DeviceClasses[class]
+
+	maxSessionLifetimeMinutes = ShortestSession(deviceClass.MaxSessionLifetimeMinutes, acl.MaxSessionLifetimeMinutes)
+	if maxSessionLifetimeMinutes == 0 {
+		maxSessionLifetimeMinutes = values.MaxSessionLifetimeMinutes
+	}
+
+	inactivityTimeoutMinutes = ShortestSession(deviceClass.SessionInactivityTimeoutMinutes, acl.SessionInactivityTimeoutMinutes)
+	if inactivityTimeoutMinutes == 0 {
+		inactivityTimeoutMinutes = values.SessionInactivityTimeoutMinutes
+	}
+
+	return
+}
+
 func SetHelpMail(HelpMail string) error {
 	valuesLock.Lock()
 	defer valuesLock.Unlock()
@@ -221,11 +407,15 @@ func AddAcl(effects string, Rule Acl) error {
 		return fmt.Errorf("%s was already defined", effects)
 	}
 
-	err := routetypes.ValidateRules(Rule.Mfa, Rule.Allow, Rule.Deny)
+	err := values.Acls.aliases().ValidateRules(Rule.Mfa, Rule.Allow, Rule.Deny)
 	if err != nil {
 		return fmt.Errorf("rules were invalid: %s", err)
 	}
 
+	if err := Rule.validateSessions(); err != nil {
+		return err
+	}
+
 	values.Acls.Policies[effects] = &Rule
 
 	return save()
@@ -240,11 +430,15 @@ func EditAcl(effects string, Rule Acl) error {
 		return fmt.Errorf("%s acl was not defined", effects)
 	}
 
-	err := routetypes.ValidateRules(Rule.Mfa, Rule.Allow, Rule.Deny)
+	err := values.Acls.aliases().ValidateRules(Rule.Mfa, Rule.Allow, Rule.Deny)
 	if err != nil {
 		return fmt.Errorf("rules were invalid: %s", err)
 	}
 
+	if err := Rule.validateSessions(); err != nil {
+		return err
+	}
+
 	values.Acls.Policies[effects] = &Rule
 
 	return save()
@@ -373,7 +567,7 @@ func GetEffectiveAcl(username string) Acl {
 
 	var resultingACLs Acl
 	//Add the server address by default
-	resultingACLs.Allow = []string{values.Wireguard.ServerAddress.String() + "/32"}
+	resultingACLs.Allow = []string{values.Wireguard.ServerAddress.String()}
 
 	// Add dns servers if defined
 	// Make sure we resolve the dns servers in case someone added them as domains, so that clients dont get stuck trying to use the domain dns servers to look up the dns servers
@@ -385,12 +579,14 @@ func GetEffectiveAcl(username string) Acl {
 	if allPolicy, ok := values.Acls.Policies["*"]; ok {
 		resultingACLs.Allow = append(resultingACLs.Allow, allPolicy.Allow...)
 		resultingACLs.Mfa = append(resultingACLs.Mfa, allPolicy.Mfa...)
+		resultingACLs.mergeSessions(allPolicy)
 	}
 
 	//If the user has any user specific rules, add those
 	if acl, ok := values.Acls.Policies[username]; ok {
 		resultingACLs.Allow = append(resultingACLs.Allow, acl.Allow...)
 		resultingACLs.Mfa = append(resultingACLs.Mfa, acl.Mfa...)
+		resultingACLs.mergeSessions(acl)
 	}
 
 	//This may get expensive if the user belongs to a large number of
@@ -399,12 +595,33 @@ func GetEffectiveAcl(username string) Acl {
 		if acl, ok := values.Acls.Policies[group]; ok {
 			resultingACLs.Allow = append(resultingACLs.Allow, acl.Allow...)
 			resultingACLs.Mfa = append(resultingACLs.Mfa, acl.Mfa...)
+			resultingACLs.mergeSessions(acl)
 		}
 	}
 
 	return resultingACLs
 }
 
+// GetAllRules returns every rule from all policies, plus the dns servers, regardless of which users they apply to
+func GetAllRules() (rules []string) {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	rules = append(rules, values.Wireguard.DNS...)
+
+	for _, acl := range values.Acls.Policies {
+		if acl == nil {
+			continue
+		}
+
+		rules = append(rules, acl.Mfa...)
+		rules = append(rules, acl.Allow...)
+		rules = append(rules, acl.Deny...)
+	}
+
+	return
+}
+
 // Used in authentication methods that can specify user groups directly (for the moment just oidc)
 // Adds groups to username, even if user does not exist in the config.json file, so GetEffectiveAcls works
 func AddVirtualUser(username string, groups []string) {
@@ -420,6 +637,33 @@ func AddVirtualUser(username string, groups []string) {
 	}
 }
 
+// SyncVirtualUser replaces the groups last synced for username from a directory (e.g ldap memberOf) with groups
+// Unlike AddVirtualUser, groups the user has left are removed, unless the user is also a member in config.json
+func SyncVirtualUser(username string, groups []string) {
+	valuesLock.Lock()
+	defer valuesLock.Unlock()
+
+	if values.Acls.rGroupLookup[username] == nil {
+		values.Acls.rGroupLookup[username] = make(map[string]bool)
+	}
+
+	if values.Acls.rSyncedGroups == nil {
+		values.Acls.rSyncedGroups = make(map[string]map[string]bool)
+	}
+
+	for group := range values.Acls.rSyncedGroups[username] {
+		if !slices.Contains(values.Acls.Groups[group], username) {
+			delete(values.Acls.rGroupLookup[username], group)
+		}
+	}
+
+	values.Acls.rSyncedGroups[username] = make(map[string]bool)
+	for _, group := range groups {
+		values.Acls.rGroupLookup[username][group] = true
+		values.Acls.rSyncedGroups[username][group] = true
+	}
+}
+
 func load(path string) (c Config, err error) {
 	configFile, err := os.Open(path)
 	if err != nil {
@@ -473,6 +717,20 @@ func load(path string) (c Config, err error) {
 			return c, errors.New("unable to parse VPN range from tune device address: " + addresses[0].String() + " : " + err.Error())
 		}
 
+		c.Wireguard.Ranges = []*net.IPNet{c.Wireguard.Range}
+		for _, address := range addresses[1:] {
+			ip, network, err := net.ParseCIDR(address.String())
+			if err != nil {
+				return c, errors.New("unable to parse VPN range from tune device address: " + address.String() + " : " + err.Error())
+			}
+
+			if ip.IsLinkLocalUnicast() {
+				continue
+			}
+
+			c.Wireguard.Ranges = append(c.Wireguard.Ranges, network)
+		}
+
 	} else {
 		// A device doesnt already exist
 		c.Wireguard.ServerAddress, c.Wireguard.Range, err = net.ParseCIDR(c.Wireguard.Address)
@@ -480,6 +738,8 @@ func load(path string) (c Config, err error) {
 			return c, errors.New("wireguard address invalid: " + err.Error())
 		}
 
+		c.Wireguard.Ranges = []*net.IPNet{c.Wireguard.Range}
+
 		_, err = wgtypes.ParseKey(c.Wireguard.PrivateKey)
 		if err != nil {
 			return c, errors.New("cannot parse wireguard key: " + err.Error())
@@ -528,6 +788,121 @@ func load(path string) (c Config, err error) {
 		return c, errors.New("session inactivity timeout policy is not set (may be disabled by setting it to -1)")
 	}
 
+	for name, class := range c.DeviceClasses {
+		if name == "" || strings.ContainsAny(name, " ,") {
+			return c, fmt.Errorf("device class name %q is invalid", name)
+		}
+
+		if class.MaxSessionLifetimeMinutes < -1 || class.SessionInactivityTimeoutMinutes < -1 {
+			return c, fmt.Errorf("device class %q has a negative session setting, use -1 to disable it", name)
+		}
+	}
+
+	if c.StepUpLifetimeMinutes < 0 {
+		return c, errors.New("step up lifetime cannot be negative")
+	}
+
+	if c.StepUpLifetimeMinutes == 0 {
+		c.StepUpLifetimeMinutes = 5
+	}
+
+	if c.DropEventSampleRate == 0 {
+		c.DropEventSampleRate = 1
+	}
+
+	if c.Audit.RetentionDays < -1 {
+		return c, errors.New("Audit.RetentionDays cannot be negative, use -1 to keep events forever")
+	}
+
+	if c.Audit.RetentionDays == 0 {
+		c.Audit.RetentionDays = 90
+	}
+
+	switch c.Audit.Syslog.Network {
+	case "", "udp", "tcp", "unix", "unixgram":
+	default:
+		return c, fmt.Errorf("Audit.Syslog.Network (%q) must be udp, tcp, unix or unixgram", c.Audit.Syslog.Network)
+	}
+
+	if c.Audit.HTTP.URL != "" {
+		auditURL, err := url.Parse(c.Audit.HTTP.URL)
+		if err != nil || (auditURL.Scheme != "http" && auditURL.Scheme != "https") {
+			return c, fmt.Errorf("Audit.HTTP.URL (%q) was not a HTTP/HTTPS url", c.Audit.HTTP.URL)
+		}
+	}
+
+	if c.ManagementUI.Domain != "" {
+		managementURL, err := url.Parse(c.ManagementUI.Domain)
+		if err != nil {
+			return c, errors.New("unable to parse ManagementUI.Domain: " + err.Error())
+		}
+
+		if managementURL.Scheme != "https" {
+			return c, errors.New("ManagementUI.Domain was not HTTPS, webauthn for administrators requires it")
+		}
+
+		c.ManagementUI.Webauthn, err = webauthn.New(&webauthn.Config{
+			RPDisplayName: c.Authenticators.Issuer,
+			RPID:          strings.Split(managementURL.Host, ":")[0],
+			RPOrigin:      c.ManagementUI.Domain,
+		})
+
+		if err != nil {
+			return c, errors.New("could not configure management ui webauthn domain: " + err.Error())
+		}
+	}
+
+	if c.ManagementUI.OIDC.IssuerURL != "" {
+		if c.ManagementUI.Domain == "" {
+			return c, errors.New("ManagementUI.Domain unset, needed for ManagementUI.OIDC")
+		}
+
+		issuerURL, err := url.Parse(c.ManagementUI.OIDC.IssuerURL)
+		if err != nil || (issuerURL.Scheme != "http" && issuerURL.Scheme != "https") {
+			return c, fmt.Errorf("ManagementUI.OIDC.IssuerURL (%q) was not a HTTP/HTTPS url", c.ManagementUI.OIDC.IssuerURL)
+		}
+
+		if c.ManagementUI.OIDC.ClientID == "" {
+			return c, errors.New("ManagementUI.OIDC.ClientID unset, but management ui oidc is enabled")
+		}
+
+		if c.ManagementUI.OIDC.GroupsClaimName == "" {
+			c.ManagementUI.OIDC.GroupsClaimName = "groups"
+		}
+
+		if c.ManagementUI.OIDC.Role == "" {
+			c.ManagementUI.OIDC.Role = "auditor"
+		}
+
+		if len(c.ManagementUI.OIDC.Scopes) == 0 {
+			c.ManagementUI.OIDC.Scopes = []string{"openid", "profile"}
+			// Many providers only send the groups claim when asked for it
+			if c.ManagementUI.OIDC.AdminGroup != "" {
+				c.ManagementUI.OIDC.Scopes = append(c.ManagementUI.OIDC.Scopes, "groups")
+			}
+		}
+
+		if !slices.Contains(c.ManagementUI.OIDC.Scopes, "openid") {
+			return c, errors.New("ManagementUI.OIDC.Scopes must include openid")
+		}
+
+		if c.ManagementUI.OIDC.AutoProvision && c.ManagementUI.OIDC.AdminGroup == "" {
+			log.Println("[WARNING] ManagementUI.OIDC.AutoProvision is set without an AdminGroup, anyone who can sign in to the OIDC provider will be given access to the management ui")
+		}
+	}
+
+	if c.ManagementUI.DisablePasswordLogin && c.ManagementUI.OIDC.IssuerURL == "" {
+		return c, errors.New("ManagementUI.DisablePasswordLogin is set, but ManagementUI.OIDC is not configured so admins would be unable to sign in")
+	}
+
+	if c.Metrics.Enabled && c.Metrics.ListenAddress == "" {
+		return c, errors.New("metrics are enabled but Metrics.ListenAddress is not set")
+	}
+
+	if c.API.Enabled && c.API.ListenAddress == "" {
+		return c, errors.New("the api is enabled but API.ListenAddress is not set")
+	}
+
 	if c.Webserver.Tunnel.Port == "" {
 		return c, fmt.Errorf("tunnel listener port is not set (Tunnel.ListenAddress.Port)")
 	}
@@ -582,6 +957,7 @@ func load(path string) (c Config, err error) {
 	}
 
 	c.Acls.rGroupLookup = map[string]map[string]bool{}
+	c.Acls.rSyncedGroups = map[string]map[string]bool{}
 
 	for group, members := range c.Acls.Groups {
 		if !strings.HasPrefix(group, "group:") {
@@ -597,11 +973,20 @@ func load(path string) (c Config, err error) {
 		}
 	}
 
+	aliases := c.Acls.aliases()
+	if err = aliases.Validate(); err != nil {
+		return c, fmt.Errorf("acl aliases were invalid: %s", err)
+	}
+
 	for _, acl := range c.Acls.Policies {
-		err = routetypes.ValidateRules(acl.Mfa, acl.Allow, acl.Deny)
+		err = aliases.ValidateRules(acl.Mfa, acl.Allow, acl.Deny)
 		if err != nil {
 			return c, fmt.Errorf("policy was invalid: %s", err)
 		}
+
+		if err = acl.validateSessions(); err != nil {
+			return c, fmt.Errorf("policy was invalid: %s", err)
+		}
 	}
 
 	if len(c.MFATemplatesDirectory) != 0 {
@@ -672,6 +1057,88 @@ func load(path string) (c Config, err error) {
 			settings["IssuerURL"] = c.Authenticators.OIDC.IssuerURL
 			settings["DomainURL"] = c.Authenticators.DomainURL
 
+		case "ldap":
+			ldapURL, err := url.Parse(c.Authenticators.LDAP.URL)
+			if err != nil || c.Authenticators.LDAP.URL == "" {
+				return c, fmt.Errorf("unable to parse Authenticators.LDAP.URL (%q), but ldap authentication method is enabled", c.Authenticators.LDAP.URL)
+			}
+
+			switch ldapURL.Scheme {
+			case "ldaps":
+				if c.Authenticators.LDAP.StartTLS {
+					return c, errors.New("Authenticators.LDAP.StartTLS cannot be used with an ldaps:// url")
+				}
+			case "ldap":
+				// Users passwords are sent in the bind, so they must never go over the wire in the clear
+				if !c.Authenticators.LDAP.StartTLS {
+					return c, errors.New("Authenticators.LDAP.URL is ldap:// but StartTLS is not enabled, use ldaps:// or set StartTLS")
+				}
+			default:
+				return c, errors.New("Authenticators.LDAP.URL was not ldap:// or ldaps://")
+			}
+
+			if !strings.Contains(c.Authenticators.LDAP.UserDN, "%s") {
+				return c, errors.New("Authenticators.LDAP.UserDN must contain %s to be replaced with the username, e.g uid=%s,ou=people,dc=example,dc=com or %s@example.com")
+			}
+
+			if c.Authenticators.LDAP.BaseDN == "" {
+				return c, errors.New("Authenticators.LDAP.BaseDN is empty, but ldap authentication method is enabled")
+			}
+
+			if c.Authenticators.LDAP.UserFilter == "" {
+				c.Authenticators.LDAP.UserFilter = "(|(uid=%s)(sAMAccountName=%s))"
+			}
+
+			if c.Authenticators.LDAP.GroupsAttribute == "" {
+				c.Authenticators.LDAP.GroupsAttribute = "memberOf"
+			}
+
+			if c.Authenticators.LDAP.CACertPath != "" {
+				if _, err := os.Stat(c.Authenticators.LDAP.CACertPath); err != nil {
+					return c, fmt.Errorf("could not read Authenticators.LDAP.CACertPath (%s): %s", c.Authenticators.LDAP.CACertPath, err)
+				}
+			}
+
+		case "webhook":
+			webhookURL, err := url.Parse(c.Authenticators.Webhook.URL)
+			if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") {
+				return c, fmt.Errorf("Authenticators.Webhook.URL (%q) was not a HTTP/HTTPS url, but webhook authentication method is enabled", c.Authenticators.Webhook.URL)
+			}
+
+			callbackURL, err := url.Parse(c.Authenticators.Webhook.CallbackURL)
+			if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") {
+				return c, fmt.Errorf("Authenticators.Webhook.CallbackURL (%q) was not a HTTP/HTTPS url, it should be where the public listener is reachable", c.Authenticators.Webhook.CallbackURL)
+			}
+
+			if callbackURL.Scheme == "http" {
+				log.Println("[WARNING] Authenticators.Webhook.CallbackURL is http, approvals may be intercepted")
+			}
+
+			if len(c.Authenticators.Webhook.SigningKey) < 16 {
+				return c, errors.New("Authenticators.Webhook.SigningKey must be at least 16 characters")
+			}
+
+			if c.Authenticators.Webhook.TimeoutSeconds <= 0 {
+				c.Authenticators.Webhook.TimeoutSeconds = 60
+			}
+
+		case "radius":
+			if c.Authenticators.RADIUS.Server == "" {
+				return c, errors.New("Authenticators.RADIUS.Server is empty, but radius authentication method is enabled")
+			}
+
+			if c.Authenticators.RADIUS.Secret == "" {
+				return c, errors.New("Authenticators.RADIUS.Secret is empty, but radius authentication method is enabled")
+			}
+
+			if c.Authenticators.RADIUS.NASIdentifier == "" {
+				c.Authenticators.RADIUS.NASIdentifier = c.Authenticators.Issuer
+			}
+
+			settings["Server"] = c.Authenticators.RADIUS.Server
+			settings["Secret"] = c.Authenticators.RADIUS.Secret
+			settings["NASIdentifier"] = c.Authenticators.RADIUS.NASIdentifier
+
 		case "webauthn":
 
 			if c.Authenticators.DomainURL == "" {
@@ -707,6 +1174,14 @@ func load(path string) (c Config, err error) {
 		}
 	}
 
+	if _, ok := resultMFAMap[authenticators.RecoveryMFA]; ok && len(resultMFAMap) == 1 {
+		return c, errors.New("recovery codes can only be used alongside another mfa method")
+	}
+
+	if c.Authenticators.DefaultMethod == authenticators.RecoveryMFA {
+		return c, errors.New("default mfa method cannot be recovery codes, they can only be registered after another method")
+	}
+
 	if c.Authenticators.DefaultMethod != "" {
 		_, ok := resultMFAMap[c.Authenticators.DefaultMethod]
 		if !ok {
@@ -768,6 +1243,8 @@ func Load(path string) error {
 	values = newConfig
 	values.path = path
 
+	routetypes.SetAliases(values.Acls.aliases())
+
 	return nil
 }
 
@@ -783,6 +1260,8 @@ func Reload() error {
 	values = newConfig
 	values.path = previousPath
 
+	routetypes.SetAliases(values.Acls.aliases())
+
 	return nil
 }
 
@@ -804,16 +1283,8 @@ func parseAddress(address string) ([]string, error) {
 			}
 
 			output := []string{}
-			addedSomething := false
 			for _, addr := range addresses {
-				if addr.To4() != nil {
-					addedSomething = true
-					output = append(output, addr.String()+"/32")
-				}
-			}
-
-			if !addedSomething {
-				return nil, fmt.Errorf("no addresses for domain %s were added, potentially because they were all ipv6 which is unsupported", address)
+				output = append(output, hostAddress(addr))
 			}
 
 			return output, nil
@@ -822,5 +1293,13 @@ func parseAddress(address string) ([]string, error) {
 		return []string{cidr.String()}, nil
 	}
 
-	return []string{ip.To4().String() + "/32"}, nil
+	return []string{hostAddress(ip)}, nil
+}
+
+func hostAddress(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.To4().String() + "/32"
+	}
+
+	return ip.String() + "/128"
 }
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestGetGroupMembers(t *testing.T) {
+	if err := Load("test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	members := Values().Acls.GetGroupMembers("group:nerds")
+	slices.Sort(members)
+
+	if !slices.Equal(members, []string{"abc", "tester", "toaster"}) {
+		t.Fatal("wrong members: ", members)
+	}
+
+	AddVirtualUser("virtual", []string{"group:nerds"})
+
+	if !slices.Contains(Values().Acls.GetGroupMembers("group:nerds"), "virtual") {
+		t.Fatal("user added by an authenticator was not a member")
+	}
+
+	if len(Values().Acls.GetGroupMembers("group:nobody")) != 0 {
+		t.Fatal("group with no members returned members")
+	}
+}
+
+// Run with -race, listing members while logins sync groups used to read the lookup while it was written
+func TestGetGroupMembersConcurrentSync(t *testing.T) {
+	if err := Load("test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	acls := Values().Acls
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				SyncVirtualUser(fmt.Sprintf("ldap%d-%d", i, j), []string{"group:nerds"})
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				acls.GetGroupMembers("group:nerds")
+				acls.GetUserGroups("toaster")
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := len(acls.GetGroupMembers("group:nerds")); n != 3+4*200 {
+		t.Fatal("wrong number of members after syncing: ", n)
+	}
+}
+
+func TestSyncVirtualUser(t *testing.T) {
+	if err := Load("test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each sync follows on from the last, as logins by the same user would
+	tests := []struct {
+		username string
+		groups   []string
+		expected []string
+	}{
+		{"ldapuser", []string{"group:nerds", "group:vpn"}, []string{"group:nerds", "group:vpn"}},
+		{"ldapuser", []string{"group:vpn"}, []string{"group:vpn"}},
+		{"ldapuser", nil, []string{}},
+		{"ldapuser", []string{"group:nerds", "group:nerds"}, []string{"group:nerds"}},
+		// Groups from config.json are kept even if the directory no longer lists them
+		{"toaster", []string{"group:vpn"}, []string{"group:administrators", "group:nerds", "group:vpn"}},
+		{"toaster", []string{"group:nerds"}, []string{"group:administrators", "group:nerds"}},
+		{"toaster", nil, []string{"group:administrators", "group:nerds"}},
+	}
+
+	for i, test := range tests {
+		SyncVirtualUser(test.username, test.groups)
+
+		groups := Values().Acls.GetUserGroups(test.username)
+		slices.Sort(groups)
+
+		if !slices.Equal(groups, test.expected) {
+			t.Errorf("%d: %s synced %q: got %q, expected %q", i, test.username, test.groups, groups, test.expected)
+		}
+	}
+
+	// Groups added by other authenticators are not synced, so are not removed by a sync
+	AddVirtualUser("oidcuser", []string{"group:oidc"})
+	SyncVirtualUser("oidcuser", []string{"group:vpn"})
+	SyncVirtualUser("oidcuser", nil)
+
+	if groups := Values().Acls.GetUserGroups("oidcuser"); !slices.Equal(groups, []string{"group:oidc"}) {
+		t.Errorf("sync removed groups it did not add: %q", groups)
+	}
+
+	if slices.Contains(Values().Acls.GetGroupMembers("group:vpn"), "ldapuser") {
+		t.Error("user is still a member of a group they left")
+	}
+}
+
+func TestWireguardRanges(t *testing.T) {
+	if err := Load("test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := Values().Wireguard
+	if wg.External {
+		t.Skip("wireguard interface already exists, so its addresses are used")
+	}
+
+	if len(wg.Ranges) != 1 || wg.Ranges[0].String() != wg.Range.String() {
+		t.Fatal("tunnel ranges should be the configured range: ", wg.Ranges)
+	}
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// APIScopes are the permissions an api token can be given, a :write scope also allows the matching :read
+// "*" allows everything
+var APIScopes = []string{
+	"users:read", "users:write",
+	"devices:read", "devices:write",
+	"registrations:read", "registrations:write",
+	"policies:read", "policies:write",
+	"groups:read", "groups:write",
+	"sessions:read", "sessions:write",
+	"firewall:read",
+}
+
+// Prefix of every api token, so they can be picked out by secret scanners
+const apiTokenPrefix = "wag_"
+
+type APIToken struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	DateAdded string   `json:"date_added"`
+	LastUsed  string   `json:"last_used"`
+}
+
+// Allows reports whether the token has been granted scope
+func (t APIToken) Allows(scope string) bool {
+	if slices.Contains(t.Scopes, "*") || slices.Contains(t.Scopes, scope) {
+		return true
+	}
+
+	resource, access, _ := strings.Cut(scope, ":")
+
+	return access == "read" && slices.Contains(t.Scopes, resource+":write")
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateAPIToken adds a token called name with scopes, the token itself is returned and only its hash is stored so it cannot be shown again
+func CreateAPIToken(name string, scopes []string) (string, error) {
+	if name == "" {
+		return "", errors.New("api token name cannot be empty")
+	}
+
+	if len(scopes) == 0 {
+		return "", errors.New("api token must have at least one scope")
+	}
+
+	for _, scope := range scopes {
+		if scope != "*" && !slices.Contains(APIScopes, scope) {
+			return "", fmt.Errorf("unknown api scope %q, valid scopes are: * %s", scope, strings.Join(APIScopes, " "))
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := apiTokenPrefix + hex.EncodeToString(b)
+
+	_, err := database.Exec(`
+	INSERT INTO
+		APITokens (name, hash, scopes, date_added)
+	VALUES
+		(?, ?, ?, ?)`, name, hashAPIToken(token), strings.Join(scopes, ","), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return "", fmt.Errorf("unable to create api token %q: %v", name, err)
+	}
+
+	return token, nil
+}
+
+func GetAPITokens() (tokens []APIToken, err error) {
+	rows, err := database.Query(`
+	SELECT
+		name, scopes, date_added, last_used
+	FROM
+		APITokens
+	ORDER BY
+		name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			t      APIToken
+			scopes string
+		)
+
+		err = rows.Scan(&t.Name, &scopes, &t.DateAdded, &t.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+
+		t.Scopes = strings.Split(scopes, ",")
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+func DeleteAPIToken(name string) error {
+	result, err := database.Exec(`DELETE FROM APITokens WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("api token %q not found", name)
+	}
+
+	return nil
+}
+
+// CheckAPIToken returns the details of token if it exists, and marks it as used
+func CheckAPIToken(token string) (t APIToken, err error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return t, errors.New("invalid api token")
+	}
+
+	var scopes string
+	err = database.QueryRow(`
+	SELECT
+		name, scopes, date_added
+	FROM
+		APITokens
+	WHERE
+		hash = ?`, hashAPIToken(token)).Scan(&t.Name, &scopes, &t.DateAdded)
+	if err != nil {
+		return t, errors.New("invalid api token")
+	}
+
+	t.Scopes = strings.Split(scopes, ",")
+	t.LastUsed = time.Now().Format(time.RFC3339)
+
+	_, err = database.Exec(`UPDATE APITokens SET last_used = ? WHERE name = ?`, t.LastUsed, t.Name)
+
+	return t, err
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Fixed width so that times stored in the database sort correctly as strings
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// AuditEvent is a single security relevant event, e.g an mfa attempt or an admin changing a policy
+type AuditEvent struct {
+	ID int `json:"-"`
+
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// success or failure
+	Outcome string `json:"outcome"`
+
+	// Who caused the event, empty for events caused by a vpn user themselves
+	Actor string `json:"actor,omitempty"`
+
+	// The vpn user (or admin) the event is about, and the address they came from
+	Username string `json:"username,omitempty"`
+	Address  string `json:"address,omitempty"`
+
+	// What was done, e.g the control socket path or "authorise"
+	Action string `json:"action,omitempty"`
+
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// AuditFilter limits the events returned by GetAuditEvents, empty fields match everything
+type AuditFilter struct {
+	Type     string
+	Username string
+	Actor    string
+	Since    time.Time
+
+	// Defaults to 1000
+	Limit int
+}
+
+func AddAuditEvent(event AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`
+	INSERT INTO
+		AuditEvents (time, type, outcome, actor, username, address, action, details)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Time.UTC().Format(auditTimeFormat), event.Type, event.Outcome, event.Actor, event.Username, event.Address, event.Action, string(details))
+
+	return err
+}
+
+// GetAuditEvents returns the events matching filter, newest first
+func GetAuditEvents(filter AuditFilter) (events []AuditEvent, err error) {
+	if filter.Limit <= 0 {
+		filter.Limit = 1000
+	}
+
+	since := ""
+	if !filter.Since.IsZero() {
+		since = filter.Since.UTC().Format(auditTimeFormat)
+	}
+
+	rows, err := database.Query(`
+	SELECT
+		id, time, type, outcome, actor, username, address, action, details
+	FROM
+		AuditEvents
+	WHERE
+		(? = '' OR type = ?) AND (? = '' OR username = ?) AND (? = '' OR actor = ?) AND time >= ?
+	ORDER BY
+		id DESC
+	LIMIT ?`,
+		filter.Type, filter.Type, filter.Username, filter.Username, filter.Actor, filter.Actor, since, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			e                  AuditEvent
+			eventTime, details string
+		)
+
+		err = rows.Scan(&e.ID, &eventTime, &e.Type, &e.Outcome, &e.Actor, &e.Username, &e.Address, &e.Action, &details)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Time, err = time.Parse(auditTimeFormat, eventTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// DeleteAuditEventsBefore removes events older than before, returning how many were removed
+func DeleteAuditEventsBefore(before time.Time) (int64, error) {
+	result, err := database.Exec(`DELETE FROM AuditEvents WHERE time < ?`, before.UTC().Format(auditTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
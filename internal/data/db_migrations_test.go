@@ -2,8 +2,13 @@ package data
 
 import (
 	"database/sql"
+	"encoding/json"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data/migrations"
@@ -80,3 +85,852 @@ func TestMigrationFromVersion1(t *testing.T) {
 	}
 
 }
+
+func TestMfaEncryption(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "otpauth://totp/wag:tester?secret=JBSWY3DPEHPK3PXP"
+
+	path := filepath.Join(t.TempDir(), "devices.db")
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"tester", "other"} {
+		if _, err := CreateUserDataAccount(username); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := SetUserMfa(username, secret+username, "totp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rawMfa := func(username string) (value string) {
+		if err := database.QueryRow("SELECT mfa FROM Users WHERE username = ?", username).Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if rawMfa("tester") != secret+"tester" {
+		t.Fatal("without a key secrets should be stored as is")
+	}
+
+	key, err := GenerateMfaKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing rows are encrypted when a key is first set
+	t.Setenv(MfaKeyEnvVariable, key)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := rawMfa("tester")
+	if !strings.HasPrefix(encrypted, encryptedMfaPrefix) || strings.Contains(encrypted, "JBSWY3DPEHPK3PXP") {
+		t.Fatal("mfa secret was not encrypted: ", encrypted)
+	}
+
+	u, err := GetUserData("tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Mfa != secret+"tester" {
+		t.Fatal("decrypted secret was wrong: ", u.Mfa)
+	}
+
+	// Secrets are bound to the user they belong to
+	if _, err := database.Exec("UPDATE Users SET mfa = ? WHERE username = ?", encrypted, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetUserData("other"); err == nil {
+		t.Fatal("should not be able to decrypt another users secret")
+	}
+
+	// Counting users does not touch their secrets
+	if count, err := CountUsers(); err != nil || count != 2 {
+		t.Fatal("wrong user count with an unreadable secret: ", count, err)
+	}
+
+	if err := SetUserMfa("other", secret+"other", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	wrongKey, _ := GenerateMfaKey()
+	t.Setenv(MfaKeyEnvVariable, wrongKey)
+	if err := Load(path); err == nil {
+		t.Fatal("loading with the wrong key should fail")
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(path); err == nil {
+		t.Fatal("loading an encrypted database without a key should fail")
+	}
+
+	// Rotation changes both the data key and the key that wraps it
+	t.Setenv(MfaKeyEnvVariable, key)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, _ := ParseMfaKey(wrongKey)
+	if err := RotateMfaKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if rawMfa("tester") == encrypted {
+		t.Fatal("secret was not re-encrypted")
+	}
+
+	if err := Load(path); err == nil {
+		t.Fatal("old key should no longer work after rotation")
+	}
+
+	t.Setenv(MfaKeyEnvVariable, wrongKey)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := GetAllUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range users {
+		if u.Mfa != secret+u.Username {
+			t.Fatalf("secret for %s was wrong after rotation: %s", u.Username, u.Mfa)
+		}
+	}
+}
+
+// loads the test config with MFAEncryptionKeyFile set to keyPath
+func loadConfigWithKeyFile(t *testing.T, keyPath string) {
+	contents, err := os.ReadFile("../config/test_in_memory_db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(contents, &values); err != nil {
+		t.Fatal(err)
+	}
+
+	values["MFAEncryptionKeyFile"] = keyPath
+	contents, _ = json.Marshal(values)
+
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.Load(configPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeMfaKey(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "mfa.key")
+
+	loadConfigWithKeyFile(t, keyPath)
+
+	oldKey, _ := GenerateMfaKey()
+	if err := os.WriteFile(keyPath, []byte(oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "devices.db")
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateUserDataAccount("tester"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetUserMfa("tester", "tester-secret", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, _ := GenerateMfaKey()
+	rawNewKey, _ := ParseMfaKey(newKey)
+	if err := ChangeMfaKey(rawNewKey); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := ReadMfaKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(saved) != string(rawNewKey) {
+		t.Fatal("new key was not written to MFAEncryptionKeyFile")
+	}
+
+	if info, _ := os.Stat(keyPath); info.Mode().Perm() != 0600 {
+		t.Fatal("key file should only be readable by its owner: ", info.Mode())
+	}
+
+	// As if wag was restarted
+	if err := Load(path); err != nil {
+		t.Fatal("could not load with the saved key: ", err)
+	}
+
+	if u, err := GetUserData("tester"); err != nil || u.Mfa != "tester-secret" {
+		t.Fatal("secret was wrong after changing keys: ", u.Mfa, err)
+	}
+
+	// If the rotation fails the database still uses the saved key, so the file must not change
+	if _, err := database.Exec("UPDATE Users SET mfa = ? WHERE username = 'tester'", encryptedMfaPrefix+"broken"); err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, _ := GenerateMfaKey()
+	rawOtherKey, _ := ParseMfaKey(otherKey)
+	if err := ChangeMfaKey(rawOtherKey); err == nil {
+		t.Fatal("rotating with an unreadable secret should fail")
+	}
+
+	if saved, _ := ReadMfaKey(); string(saved) != string(rawNewKey) {
+		t.Fatal("failed rotation changed the key file")
+	}
+
+	if tmp, _ := filepath.Glob(keyPath + ".*.tmp"); len(tmp) != 0 {
+		t.Fatal("temporary key files were left behind: ", tmp)
+	}
+
+	if err := SetUserMfa("tester", "tester-secret", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// If the key cannot be saved the database must keep using the old one
+	loadConfigWithKeyFile(t, filepath.Join(dir, "missing", "mfa.key"))
+	if err := ChangeMfaKey(rawOtherKey); err == nil {
+		t.Fatal("should fail when the key file cannot be written")
+	}
+
+	loadConfigWithKeyFile(t, keyPath)
+	if err := Load(path); err != nil {
+		t.Fatal("database changed keys without saving the new one: ", err)
+	}
+
+	// wag cannot change its environment, so the new key would be lost on restart
+	t.Setenv(MfaKeyEnvVariable, newKey)
+	if err := ChangeMfaKey(rawOtherKey); err == nil {
+		t.Fatal("should not change keys set in the environment")
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ChangeMfaKey(rawOtherKey); err == nil {
+		t.Fatal("should not change keys without somewhere to save the new one")
+	}
+}
+
+func TestMfaFactors(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "devices.db")
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"legacy", "registering"} {
+		if _, err := CreateUserDataAccount(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SetUserMfa("legacy", "legacy-secret", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetEnforceMFAOn("legacy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetUserMfa("registering", "pending-secret", "webauthn"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Go back to before factors existed, so the migration copies the single mfa column
+	if _, err := database.Exec("DROP TABLE MfaFactors"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("ALTER TABLE Devices DROP COLUMN class"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("ALTER TABLE AdminUsers DROP COLUMN role"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("ALTER TABLE AdminUsers DROP COLUMN mfa_type"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("ALTER TABLE AdminUsers DROP COLUMN mfa"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("DROP INDEX AdminUsers_oidc_identity"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("ALTER TABLE AdminUsers DROP COLUMN oidc_identity"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("PRAGMA user_version = 11"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	factors, err := GetMfaFactors("legacy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(factors) != 1 || factors[0].Type != "totp" || factors[0].Secret != "legacy-secret" {
+		t.Fatalf("registered mfa was not migrated to a factor: %+v", factors)
+	}
+
+	if u, _ := GetUserData("legacy"); u.MfaType != "unset" || u.Mfa != "" {
+		t.Fatalf("migrated mfa should no longer be pending: %+v", u)
+	}
+
+	if u, _ := GetUserData("registering"); u.MfaType != "webauthn" || u.Mfa != "pending-secret" {
+		t.Fatalf("unfinished registration should be left alone: %+v", u)
+	}
+
+	if factors, _ := GetMfaFactors("registering", ""); len(factors) != 0 {
+		t.Fatal("unfinished registration should not be a factor")
+	}
+
+	if err := EnrolMfaFactor("legacy", "webauthn", "key-one"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EnrolMfaFactor("legacy", "webauthn", "key-two"); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := GetMfaFactors("legacy", "webauthn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || keys[0].Secret != "key-one" || keys[1].Secret != "key-two" {
+		t.Fatalf("expected both webauthn keys: %+v", keys)
+	}
+
+	if types, _ := GetMfaFactorTypes("legacy"); strings.Join(types, ",") != "webauthn,totp" {
+		t.Fatal("types should be most recently used first: ", types)
+	}
+
+	if err := EnrolMfaFactor("registering", "totp", "other-secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := GetAllMfaFactors()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 4 || all[0].Username != "legacy" || all[3].Username != "registering" || all[3].Type != "totp" {
+		t.Fatalf("expected every users factors: %+v", all)
+	}
+
+	for _, f := range all {
+		if f.Secret != "" {
+			t.Fatal("listing all factors should not read secrets")
+		}
+	}
+
+	if err := DeleteMfaFactors("registering"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.Exec("UPDATE MfaFactors SET last_used = ? WHERE type = 'webauthn'", "2000-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetMfaFactorUsed("legacy", factors[0].ID, "legacy-secret-updated"); err != nil {
+		t.Fatal(err)
+	}
+
+	if types, _ := GetMfaFactorTypes("legacy"); types[0] != "totp" {
+		t.Fatal("totp was just used so should be first: ", types)
+	}
+
+	// Factors are encrypted and rotated like the pending secret
+	key, _ := GenerateMfaKey()
+	t.Setenv(MfaKeyEnvVariable, key)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw string
+	if err := database.QueryRow("SELECT secret FROM MfaFactors WHERE id = ?", factors[0].ID).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(raw, encryptedMfaPrefix) {
+		t.Fatal("factor secret was not encrypted: ", raw)
+	}
+
+	rawKey, _ := ParseMfaKey(key)
+	if err := RotateMfaKey(rawKey); err != nil {
+		t.Fatal(err)
+	}
+
+	factors, err = GetMfaFactors("legacy", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(factors) != 1 || factors[0].Secret != "legacy-secret-updated" {
+		t.Fatalf("factor secret wrong after rotation: %+v", factors)
+	}
+
+	if err := DeleteMfaFactor("registering", factors[0].ID); err == nil {
+		t.Fatal("should not be able to delete another users factor")
+	}
+
+	if err := DeleteMfaFactor("legacy", factors[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if types, _ := GetMfaFactorTypes("legacy"); strings.Join(types, ",") != "webauthn" {
+		t.Fatal("totp should have been removed: ", types)
+	}
+
+	if err := DeleteUser("legacy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if factors, _ := GetMfaFactors("legacy", ""); len(factors) != 0 {
+		t.Fatal("deleting a user should remove their factors")
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	events := []AuditEvent{
+		{Time: now.Add(-48 * time.Hour), Type: "mfa", Outcome: "failure", Username: "toaster", Address: "192.168.1.2", Action: "authorise"},
+		{Time: now.Add(-time.Hour), Type: "mfa", Outcome: "success", Username: "toaster", Address: "192.168.1.2", Action: "authorise", Details: map[string]string{"method": "totp"}},
+		{Time: now, Type: "control", Outcome: "success", Actor: "admin (ui)", Username: "toaster", Action: "/users/lock"},
+	}
+
+	for _, e := range events {
+		if err := AddAuditEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := GetAuditEvents(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 3 || all[0].Action != "/users/lock" {
+		t.Fatalf("expected all events newest first, got: %+v", all)
+	}
+
+	if !all[0].Time.Equal(now.Truncate(time.Microsecond)) {
+		t.Fatalf("time did not survive the database: %s != %s", all[0].Time, now)
+	}
+
+	mfa, err := GetAuditEvents(AuditFilter{Type: "mfa", Since: now.Add(-24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mfa) != 1 || mfa[0].Outcome != "success" || mfa[0].Details["method"] != "totp" {
+		t.Fatalf("expected only the recent mfa success, got: %+v", mfa)
+	}
+
+	byActor, err := GetAuditEvents(AuditFilter{Actor: "admin (ui)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(byActor) != 1 || byActor[0].Type != "control" {
+		t.Fatalf("expected only the admins change, got: %+v", byActor)
+	}
+
+	removed, err := DeleteAuditEventsBefore(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 1 {
+		t.Fatalf("expected the old event to be removed, removed %d", removed)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateAPIToken("pipeline", []string{"users:everything"}); err == nil {
+		t.Fatal("should not be able to create a token with an unknown scope")
+	}
+
+	token, err := CreateAPIToken("pipeline", []string{"users:write", "firewall:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateAPIToken("pipeline", []string{"users:read"}); err == nil {
+		t.Fatal("should not be able to create two tokens with the same name")
+	}
+
+	if _, err := CheckAPIToken(token + "a"); err == nil {
+		t.Fatal("modified token should not be accepted")
+	}
+
+	details, err := CheckAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if details.Name != "pipeline" || !details.Allows("users:read") || !details.Allows("firewall:read") || details.Allows("devices:read") {
+		t.Fatalf("token had the wrong scopes: %+v", details)
+	}
+
+	tokens, err := GetAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 1 || tokens[0].LastUsed == "" || len(tokens[0].Scopes) != 2 {
+		t.Fatalf("unexpected token listing: %+v", tokens)
+	}
+
+	if err := DeleteAPIToken("pipeline"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CheckAPIToken(token); err == nil {
+		t.Fatal("deleted token should not be accepted")
+	}
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		allows bool
+	}{
+		{[]string{"*"}, "users:write", true},
+		{[]string{"*"}, "firewall:read", true},
+		{[]string{"users:read"}, "users:read", true},
+		{[]string{"users:read"}, "users:write", false},
+		{[]string{"users:write"}, "users:read", true},
+		{[]string{"users:write"}, "users:write", true},
+		{[]string{"users:write"}, "devices:read", false},
+		{[]string{"users:write"}, "devices:write", false},
+		{[]string{"users:read", "devices:write"}, "devices:read", true},
+		{[]string{"users:read", "devices:write"}, "users:write", false},
+		{[]string{"firewall:read"}, "firewall:write", false},
+		// Only a whole scope matches
+		{[]string{"users"}, "users:read", false},
+		{[]string{"users:"}, "users:read", false},
+		{[]string{"users:write"}, "users", false},
+		{[]string{"users:write"}, "", false},
+		{nil, "users:read", false},
+	}
+
+	for _, test := range tests {
+		if got := (APIToken{Scopes: test.scopes}).Allows(test.scope); got != test.allows {
+			t.Errorf("token with %v allows %q: got %v, expected %v", test.scopes, test.scope, got, test.allows)
+		}
+	}
+}
+
+func TestAdminRoles(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Admins from before roles existed keep full access
+	if _, err := database.Exec(`INSERT INTO AdminUsers (username, passwd_hash, date_added) VALUES ('old', '', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := GetAdminUser("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if old.Role != AdminRoleAdmin {
+		t.Fatalf("existing admin should default to the admin role, got %q", old.Role)
+	}
+
+	if err := CreateAdminUser("viewer", "a very long password", false, "superuser"); err == nil {
+		t.Fatal("should not be able to create an admin with an unknown role")
+	}
+
+	if err := CreateAdminUser("viewer", "a very long password", false, AdminRoleAuditor); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAdminRole("viewer", AdminRoleHelpdesk); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAdminRole("nobody", AdminRoleHelpdesk); err == nil {
+		t.Fatal("setting the role of a missing admin should fail")
+	}
+
+	admins, err := GetAllAdminUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(admins) != 2 || admins[0].Username != "viewer" || admins[0].Role != AdminRoleHelpdesk {
+		t.Fatalf("unexpected admins: %+v", admins)
+	}
+}
+
+func TestAdminMfa(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "devices.db")
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateAdminUser("admin", "a very long password", false, AdminRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if mfaType, secret, err := GetAdminMfa("admin"); err != nil || mfaType != "" || secret != "" {
+		t.Fatal("new admin should not have mfa: ", mfaType, secret, err)
+	}
+
+	if err := SetAdminMfa("nobody", "totp", "secret"); err == nil {
+		t.Fatal("setting mfa of a missing admin should fail")
+	}
+
+	if err := SetAdminMfa("admin", "totp", "otpauth://totp/wag:admin?secret=JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Admin secrets are encrypted along with user secrets once a key is set
+	key, err := GenerateMfaKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, key)
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var raw string
+	if err := database.QueryRow("SELECT mfa FROM AdminUsers WHERE username = 'admin'").Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(raw, encryptedMfaPrefix) {
+		t.Fatal("admin mfa secret was not encrypted: ", raw)
+	}
+
+	mfaType, secret, err := GetAdminMfa("admin")
+	if err != nil || mfaType != "totp" || secret != "otpauth://totp/wag:admin?secret=JBSWY3DPEHPK3PXP" {
+		t.Fatal("admin mfa did not round trip: ", mfaType, secret, err)
+	}
+
+	admin, err := GetAdminUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if admin.MfaType != "totp" {
+		t.Fatal("admin model did not include mfa type: ", admin.MfaType)
+	}
+
+	if err := ResetAdminMfa("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mfaType, secret, _ := GetAdminMfa("admin"); mfaType != "" || secret != "" {
+		t.Fatal("admin mfa was not reset: ", mfaType, secret)
+	}
+}
+
+func TestAdminMfaLockout(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	const password = "a very long password"
+
+	if err := CreateAdminUser("admin", password, false, AdminRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := func() int {
+		admin, err := GetAdminUser("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return admin.Attempts
+	}
+
+	// Without mfa a correct password clears failed attempts
+	CompareAdminKeys("admin", "wrong password")
+	if err := CompareAdminKeys("admin", password); err != nil || attempts() != 0 {
+		t.Fatal("password login did not clear attempts: ", err, attempts())
+	}
+
+	if err := SetAdminMfa("admin", "totp", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With mfa the password attempt is kept until mfa is passed, so each round of guesses adds up
+	for i := 0; i < 2; i++ {
+		if err := CompareAdminKeys("admin", password); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := IncrementAdminAttempts("admin"); err != nil {
+			t.Fatal("locked too early: ", err)
+		}
+	}
+
+	if err := CompareAdminKeys("admin", password); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := IncrementAdminAttempts("admin"); err == nil {
+		t.Fatal("admin was not locked after repeatedly failing mfa, attempts: ", attempts())
+	}
+
+	if err := CompareAdminKeys("admin", password); err == nil {
+		t.Fatal("admin was not locked after repeatedly failing mfa, attempts: ", attempts())
+	}
+
+	if err := CheckAdminLocked("admin"); err == nil {
+		t.Fatal("admin should be locked")
+	}
+
+	if err := SetAdminUserUnlock("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckAdminLocked("admin"); err != nil {
+		t.Fatal("admin should be unlocked: ", err)
+	}
+}
+
+func TestAdminOIDC(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MfaKeyEnvVariable, "")
+	if err := Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"alice", "bob"} {
+		if err := CreateAdminUser(username, "a very long password", false, AdminRoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	identity := OIDCIdentity("https://idp.test/", "1234")
+	if identity != OIDCIdentity("https://idp.test", "1234") {
+		t.Fatal("trailing slash on the issuer should not change the identity")
+	}
+
+	if _, err := GetAdminUserByOIDC(identity); err == nil {
+		t.Fatal("no admin should be linked yet")
+	}
+
+	if _, err := GetAdminUserByOIDC(""); err == nil {
+		t.Fatal("empty identity should never match, as unlinked admins have an empty identity")
+	}
+
+	if err := SetAdminOIDC("alice", identity); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAdminOIDC("bob", identity); err == nil {
+		t.Fatal("an identity should only be linked to one admin")
+	}
+
+	if err := SetAdminOIDC("nobody", identity); err == nil {
+		t.Fatal("linking a missing admin should fail")
+	}
+
+	admin, err := GetAdminUserByOIDC(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if admin.Username != "alice" || admin.OIDC != identity {
+		t.Fatalf("unexpected admin: %+v", admin)
+	}
+
+	if err := SetAdminOIDC("alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetAdminUserByOIDC(identity); err == nil {
+		t.Fatal("unlinked identity still matched")
+	}
+}
@@ -19,6 +19,9 @@ type Device struct {
 	Endpoint     *net.UDPAddr
 	Attempts     int
 	Active       bool
+
+	// Session class from the DeviceClasses config, empty uses the global session settings
+	Class string
 }
 
 func stringToUDPaddr(address string) (r *net.UDPAddr) {
@@ -63,7 +66,7 @@ func GetDevice(username, id string) (device Device, err error) {
 								username = ? 
 									AND 
 								(address = $2 OR publickey = $2)`,
-		username, id).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey)
+		username, id).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey, &device.Class)
 
 	if err != nil {
 		return Device{}, err
@@ -93,9 +96,22 @@ func SetDeviceAuthenticationAttempts(username, address string, attempts int) err
 	return nil
 }
 
+func SetDeviceClass(address, class string) error {
+	result, err := database.Exec(`UPDATE Devices SET class = ? WHERE address = ?`, class, address)
+	if err != nil {
+		return errors.New("Unable to set device class: " + err.Error())
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
 func GetAllDevices() (devices []Device, err error) {
 
-	rows, err := database.Query("SELECT address, publickey, username, endpoint, attempts, preshared_key FROM Devices ORDER by ROWID DESC")
+	rows, err := database.Query("SELECT address, publickey, username, endpoint, attempts, preshared_key, class FROM Devices ORDER by ROWID DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -106,7 +122,7 @@ func GetAllDevices() (devices []Device, err error) {
 			endpoint sql.NullString
 			d        Device
 		)
-		err = rows.Scan(&d.Address, &d.Publickey, &d.Username, &endpoint, &d.Attempts, &d.PresharedKey)
+		err = rows.Scan(&d.Address, &d.Publickey, &d.Username, &endpoint, &d.Attempts, &d.PresharedKey, &d.Class)
 		if err != nil {
 			return nil, err
 		}
@@ -187,7 +203,7 @@ func GetDeviceByAddress(address string) (device Device, err error) {
 								Devices 
 							WHERE 
 								address = ?`,
-		address).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey)
+		address).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey, &device.Class)
 
 	if err != nil {
 		return Device{}, err
@@ -215,7 +231,7 @@ func GetDevicesByUser(username string) (devices []Device, err error) {
 		var d Device
 		//Devices(address string primary key,
 		//username string not null, publickey string not null unique, endpoint string, attempts integer not null
-		err = rows.Scan(&d.Address, &d.Username, &d.Publickey, &endpoint, &d.Attempts, &d.PresharedKey)
+		err = rows.Scan(&d.Address, &d.Username, &d.Publickey, &endpoint, &d.Attempts, &d.PresharedKey, &d.Class)
 		if err != nil {
 			return nil, err
 		}
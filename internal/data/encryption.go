@@ -0,0 +1,423 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+// MfaKeyEnvVariable holds the base64 encoded key used to encrypt mfa secrets, it is used instead of config.MFAEncryptionKeyFile if set
+const MfaKeyEnvVariable = "WAG_MFA_ENCRYPTION_KEY"
+
+// Prefix of encrypted values in the mfa column, anything without it is plaintext
+const encryptedMfaPrefix = "enc:v1:"
+
+// The mfa column is encrypted with a random data key, which is stored in the database wrapped (encrypted) by the key the administrator supplies.
+// So changing the administrators key only requires the data key to be rewrapped, and a database backup on its own does not reveal the secrets.
+var (
+	mfaKeyLock sync.RWMutex
+	mfaDataKey cipher.AEAD
+)
+
+// GenerateMfaKey returns a new random key in the format MFAEncryptionKeyFile and WAG_MFA_ENCRYPTION_KEY expect
+func GenerateMfaKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadMfaKey reads the key that wraps the data key from the environment or the configured file, returning nil if neither are set
+func ReadMfaKey() ([]byte, error) {
+	encoded := os.Getenv(MfaKeyEnvVariable)
+	if encoded == "" {
+		path := config.Values().MFAEncryptionKeyFile
+		if path == "" {
+			return nil, nil
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read mfa encryption key file: %s", err)
+		}
+
+		encoded = string(contents)
+	}
+
+	return ParseMfaKey(encoded)
+}
+
+// ParseMfaKey decodes a base64 encoded 256 bit key
+func ParseMfaKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("mfa encryption key was not valid base64: %s", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("mfa encryption key must be 32 bytes, was %d", len(key))
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
+
+// loadMfaEncryption unwraps the data key with key, creating one if the database has none, and encrypts any plaintext mfa secrets
+func loadMfaEncryption(key []byte) error {
+	mfaKeyLock.Lock()
+	mfaDataKey = nil
+	mfaKeyLock.Unlock()
+
+	var wrapped string
+	err := database.QueryRow("SELECT wrapped_key FROM MfaEncryption WHERE id = 0").Scan(&wrapped)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unable to read mfa data key: %s", err)
+	}
+
+	if key == nil {
+		if err == nil {
+			return fmt.Errorf("mfa secrets in the database are encrypted, but no key was set in %s or MFAEncryptionKeyFile", MfaKeyEnvVariable)
+		}
+
+		log.Printf("MFA secrets are stored unencrypted, set MFAEncryptionKeyFile or %s to encrypt them", MfaKeyEnvVariable)
+		return nil
+	}
+
+	if err != nil {
+		// First time a key has been set
+		return RotateMfaKey(key)
+	}
+
+	dataKey, err := unwrapDataKey(key, wrapped)
+	if err != nil {
+		return err
+	}
+
+	mfaKeyLock.Lock()
+	defer mfaKeyLock.Unlock()
+
+	mfaDataKey = dataKey
+
+	return encryptPlaintextMfa()
+}
+
+// Every column that holds an mfa secret, the secrets are always bound to the owning username
+var mfaColumns = []struct {
+	table, id, value string
+}{
+	{"Users", "username", "mfa"},
+	{"MfaFactors", "id", "secret"},
+	{"AdminUsers", "username", "mfa"},
+}
+
+type mfaRow struct {
+	id       string
+	username string
+	value    string
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func readMfaRows(db queryer, table, id, value string, plaintextOnly bool) (result []mfaRow, err error) {
+	query := fmt.Sprintf("SELECT %s, username, %s FROM %s", id, value, table)
+	args := []interface{}{}
+	if plaintextOnly {
+		query += fmt.Sprintf(" WHERE %s != '' AND %s NOT LIKE ?", value, value)
+		args = append(args, encryptedMfaPrefix+"%")
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row mfaRow
+		if err := rows.Scan(&row.id, &row.username, &row.value); err != nil {
+			return nil, err
+		}
+
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// encryptPlaintextMfa encrypts secrets that were stored before encryption was enabled, or restored from an old backup
+func encryptPlaintextMfa() error {
+	for _, column := range mfaColumns {
+		plaintexts, err := readMfaRows(database, column.table, column.id, column.value, true)
+		if err != nil {
+			return err
+		}
+
+		if len(plaintexts) == 0 {
+			continue
+		}
+
+		log.Println("encrypting", len(plaintexts), "plaintext mfa secrets in", column.table)
+
+		for _, row := range plaintexts {
+			ciphertext, err := encryptMfa(mfaDataKey, row.username, row.value)
+			if err != nil {
+				return err
+			}
+
+			_, err = database.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", column.table, column.value, column.id), ciphertext, row.id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func unwrapDataKey(key []byte, wrapped string) (cipher.AEAD, error) {
+	kek, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("stored mfa data key was malformed: %s", err)
+	}
+
+	dataKey, err := open(kek, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt mfa data key, the mfa encryption key is not the one the database was encrypted with")
+	}
+
+	return newAEAD(dataKey)
+}
+
+// RotateMfaKey generates a new data key, re-encrypts every mfa secret with it and stores it wrapped by key
+// This also encrypts any secrets that were stored in plaintext
+func RotateMfaKey(key []byte) error {
+	return rotateMfaKey(key, nil)
+}
+
+// ChangeMfaKey rotates the data key and wraps it with a new key, which is written to MFAEncryptionKeyFile in the same step.
+// Otherwise wag would start with the old key after a restart, and be unable to decrypt any secrets
+func ChangeMfaKey(key []byte) error {
+	if os.Getenv(MfaKeyEnvVariable) != "" {
+		return fmt.Errorf("the mfa encryption key is set by %s which wag cannot update, use MFAEncryptionKeyFile to change keys", MfaKeyEnvVariable)
+	}
+
+	path := config.Values().MFAEncryptionKeyFile
+	if path == "" {
+		return errors.New("MFAEncryptionKeyFile is not set, so the new key could not be saved")
+	}
+
+	previous, err := os.ReadFile(path)
+	existed := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read mfa encryption key file: %s", err)
+	}
+
+	written := false
+	err = rotateMfaKey(key, func() error {
+		if err := writeMfaKeyFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n")); err != nil {
+			return fmt.Errorf("unable to write mfa encryption key file: %s", err)
+		}
+
+		written = true
+		return nil
+	})
+
+	// The database still uses the old key, so the file has to as well
+	if err != nil && written {
+		if existed {
+			if restoreErr := writeMfaKeyFile(path, previous); restoreErr != nil {
+				log.Println("unable to restore previous mfa encryption key file: ", restoreErr)
+			}
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	return err
+}
+
+// writeMfaKeyFile replaces the key file with a rename, so it never contains a partly written key
+func writeMfaKeyFile(path string, contents []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// rotateMfaKey does the rotation, beforeCommit is run once every secret is re-encrypted and the change is discarded if it fails
+func rotateMfaKey(key []byte, beforeCommit func() error) error {
+	mfaKeyLock.Lock()
+	defer mfaKeyLock.Unlock()
+
+	kek, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	rawDataKey := make([]byte, 32)
+	if _, err := rand.Read(rawDataKey); err != nil {
+		return err
+	}
+
+	newDataKey, err := newAEAD(rawDataKey)
+	if err != nil {
+		return err
+	}
+
+	wrapped, err := seal(kek, rawDataKey, nil)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, column := range mfaColumns {
+		secrets, err := readMfaRows(tx, column.table, column.id, column.value, false)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range secrets {
+			plaintext, err := decryptMfa(mfaDataKey, row.username, row.value)
+			if err != nil {
+				return fmt.Errorf("unable to decrypt mfa secret for %q: %s", row.username, err)
+			}
+
+			ciphertext, err := encryptMfa(newDataKey, row.username, plaintext)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", column.table, column.value, column.id), ciphertext, row.id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO MfaEncryption (id, wrapped_key) VALUES (0, ?)", base64.StdEncoding.EncodeToString(wrapped))
+	if err != nil {
+		return err
+	}
+
+	if beforeCommit != nil {
+		if err := beforeCommit(); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	mfaDataKey = newDataKey
+
+	return nil
+}
+
+// encryptMfa encrypts an mfa secret bound to the username, so it cannot be copied to another user. Empty values are left as is, as they mean no mfa is registered
+func encryptMfa(dataKey cipher.AEAD, username, plaintext string) (string, error) {
+	if dataKey == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plaintext), []byte(username))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedMfaPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func decryptMfa(dataKey cipher.AEAD, username, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedMfaPrefix) {
+		return value, nil
+	}
+
+	if dataKey == nil {
+		return "", errors.New("mfa secret is encrypted but no key is loaded")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedMfaPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, ciphertext, []byte(username))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
@@ -41,5 +41,15 @@ func Load(path string) error {
 		}
 	}
 
-	return migrations.Do(db)
+	err = migrations.Do(db)
+	if err != nil {
+		return err
+	}
+
+	key, err := ReadMfaKey()
+	if err != nil {
+		return err
+	}
+
+	return loadMfaEncryption(key)
 }
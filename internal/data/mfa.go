@@ -0,0 +1,217 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MfaFactor is a single enrolled authenticator, a user may have several of the same or differing types
+type MfaFactor struct {
+	ID        int
+	Username  string
+	Type      string
+	Secret    string `json:"-"`
+	DateAdded string
+	LastUsed  string
+}
+
+// GetMfaFactors returns the users enrolled factors of mfaType, or all of them if mfaType is empty
+func GetMfaFactors(username, mfaType string) (factors []MfaFactor, err error) {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
+
+	rows, err := database.Query(`
+	SELECT
+		id, username, type, secret, date_added, last_used
+	FROM
+		MfaFactors
+	WHERE
+		username = ? AND (? = '' OR type = ?)
+	ORDER BY
+		id ASC`, username, mfaType, mfaType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			f        MfaFactor
+			lastUsed sql.NullString
+		)
+
+		err = rows.Scan(&f.ID, &f.Username, &f.Type, &f.Secret, &f.DateAdded, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+
+		f.LastUsed = lastUsed.String
+
+		f.Secret, err = decryptMfa(mfaDataKey, f.Username, f.Secret)
+		if err != nil {
+			return nil, err
+		}
+
+		factors = append(factors, f)
+	}
+
+	return factors, rows.Err()
+}
+
+// GetAllMfaFactors returns every users enrolled factors for listing, secrets are not read so they are left empty
+func GetAllMfaFactors() (factors []MfaFactor, err error) {
+	rows, err := database.Query(`
+	SELECT
+		id, username, type, date_added, last_used
+	FROM
+		MfaFactors
+	ORDER BY
+		username ASC, id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			f        MfaFactor
+			lastUsed sql.NullString
+		)
+
+		err = rows.Scan(&f.ID, &f.Username, &f.Type, &f.DateAdded, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+
+		f.LastUsed = lastUsed.String
+
+		factors = append(factors, f)
+	}
+
+	return factors, rows.Err()
+}
+
+// GetMfaFactorTypes returns the distinct types of factor a user has enrolled, most recently used first
+func GetMfaFactorTypes(username string) (types []string, err error) {
+	rows, err := database.Query(`
+	SELECT
+		type
+	FROM
+		MfaFactors
+	WHERE
+		username = ?
+	GROUP BY
+		type
+	ORDER BY
+		MAX(COALESCE(last_used, date_added)) DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mfaType string
+		if err := rows.Scan(&mfaType); err != nil {
+			return nil, err
+		}
+
+		types = append(types, mfaType)
+	}
+
+	return types, rows.Err()
+}
+
+// EnrolMfaFactor stores secret as a new factor and clears the pending registration from the users table
+func EnrolMfaFactor(username, mfaType, secret string) error {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
+
+	secret, err := encryptMfa(mfaDataKey, username, secret)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Format(time.RFC3339)
+
+	_, err = tx.Exec(`
+	INSERT INTO
+		MfaFactors (username, type, secret, date_added, last_used)
+	VALUES
+		(?, ?, ?, ?, ?)`, username, mfaType, secret, now, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+	UPDATE
+		Users
+	SET
+		mfa = '', mfa_type = 'unset'
+	WHERE
+		username = ?`, username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetMfaFactorUsed records that the factor was used to authenticate, and replaces its secret if updatedSecret is not empty
+func SetMfaFactorUsed(username string, id int, updatedSecret string) error {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
+
+	now := time.Now().Format(time.RFC3339)
+
+	if updatedSecret == "" {
+		_, err := database.Exec(`UPDATE MfaFactors SET last_used = ? WHERE id = ? AND username = ?`, now, id, username)
+		return err
+	}
+
+	secret, err := encryptMfa(mfaDataKey, username, updatedSecret)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`UPDATE MfaFactors SET last_used = ?, secret = ? WHERE id = ? AND username = ?`, now, secret, id, username)
+	return err
+}
+
+func DeleteMfaFactor(username string, id int) error {
+	result, err := database.Exec(`
+		DELETE FROM
+			MfaFactors
+		WHERE
+			id = ? AND username = ?`, id, username)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errors.New("user has no mfa factor with that id")
+	}
+
+	return nil
+}
+
+func DeleteMfaFactors(username string) error {
+	_, err := database.Exec(`
+		DELETE FROM
+			MfaFactors
+		WHERE
+			username = ?`, username)
+
+	return err
+}
@@ -0,0 +1,2 @@
+-- version 11
+CREATE TABLE IF NOT EXISTS MfaEncryption ( id integer primary key check (id = 0), wrapped_key string not null );
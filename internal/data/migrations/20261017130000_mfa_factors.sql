@@ -0,0 +1,6 @@
+-- version 12
+CREATE TABLE IF NOT EXISTS MfaFactors ( id integer primary key autoincrement, username string not null, type string not null, secret string not null, date_added string not null, last_used string );
+INSERT INTO MfaFactors (username, type, secret, date_added) SELECT username, mfa_type, mfa, enforcing FROM Users WHERE enforcing IS NOT NULL AND mfa_type != 'unset' AND mfa != '';
+
+-- Users.mfa now only holds an mfa secret that is part way through being registered
+UPDATE Users SET mfa = '', mfa_type = 'unset' WHERE enforcing IS NOT NULL;
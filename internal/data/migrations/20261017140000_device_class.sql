@@ -0,0 +1,2 @@
+-- version 13
+ALTER TABLE Devices ADD class TEXT DEFAULT "" NOT NULL;
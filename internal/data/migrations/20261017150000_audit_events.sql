@@ -0,0 +1,3 @@
+-- version 14
+CREATE TABLE IF NOT EXISTS AuditEvents ( id integer primary key autoincrement, time string not null, type string not null, outcome string not null, actor string not null, username string not null, address string not null, action string not null, details string not null );
+CREATE INDEX IF NOT EXISTS AuditEventsTime ON AuditEvents (time);
@@ -0,0 +1,2 @@
+-- version 15
+CREATE TABLE IF NOT EXISTS APITokens ( name string primary key not null, hash string not null unique, scopes string not null, date_added string not null, last_used string not null default '' );
@@ -0,0 +1,2 @@
+-- version 16
+ALTER TABLE AdminUsers ADD role TEXT DEFAULT "admin" NOT NULL;
@@ -0,0 +1,3 @@
+-- version 17
+ALTER TABLE AdminUsers ADD mfa_type TEXT DEFAULT "" NOT NULL;
+ALTER TABLE AdminUsers ADD mfa TEXT DEFAULT "" NOT NULL;
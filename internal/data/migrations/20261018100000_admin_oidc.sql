@@ -0,0 +1,3 @@
+-- version 18
+ALTER TABLE AdminUsers ADD oidc_identity TEXT DEFAULT "" NOT NULL;
+CREATE UNIQUE INDEX AdminUsers_oidc_identity ON AdminUsers(oidc_identity) WHERE oidc_identity != '';
@@ -7,6 +7,8 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/argon2"
@@ -14,6 +16,18 @@ import (
 
 const minPasswordLength = 14
 
+// Roles limit what an admin can do in the management ui
+const (
+	// Can view everything, but change nothing
+	AdminRoleAuditor = "auditor"
+	// Can also lock and unlock users and devices, reset mfa, force reauthentication and issue registration tokens
+	AdminRoleHelpdesk = "helpdesk"
+	// Can do everything
+	AdminRoleAdmin = "admin"
+)
+
+var AdminRoles = []string{AdminRoleAuditor, AdminRoleHelpdesk, AdminRoleAdmin}
+
 type AdminModel struct {
 	Username  string `json:"username"`
 	Attempts  int    `json:"attempts"`
@@ -21,6 +35,17 @@ type AdminModel struct {
 	LastLogin string `json:"last_login"`
 	IP        string `json:"ip"`
 	Change    bool   `json:"change"`
+	Role      string `json:"role"`
+	MfaType   string `json:"mfa_type"`
+	OIDC      string `json:"oidc_identity"`
+}
+
+func checkAdminRole(role string) error {
+	if !slices.Contains(AdminRoles, role) {
+		return fmt.Errorf("unknown admin role %q, valid roles are: %s", role, strings.Join(AdminRoles, ", "))
+	}
+
+	return nil
 }
 
 func generateSalt() ([]byte, error) {
@@ -33,7 +58,11 @@ func generateSalt() ([]byte, error) {
 	return randomData, nil
 }
 
-func CreateAdminUser(username, password string, changeOnFirstUse bool) error {
+func CreateAdminUser(username, password string, changeOnFirstUse bool, role string) error {
+	if err := checkAdminRole(role); err != nil {
+		return err
+	}
+
 	if len(password) < minPasswordLength {
 		return fmt.Errorf("password is too short for administrative console (must be greater than %d characters)", minPasswordLength)
 	}
@@ -47,10 +76,10 @@ func CreateAdminUser(username, password string, changeOnFirstUse bool) error {
 
 	_, err = database.Exec(`
 	INSERT INTO
-		AdminUsers (username, passwd_hash, date_added, change)
+		AdminUsers (username, passwd_hash, date_added, change, role)
 	VALUES
-		(?,?,?, ?)
-`, username, base64.RawStdEncoding.EncodeToString(append(hash, salt...)), time.Now().Format(time.RFC3339), changeOnFirstUse)
+		(?,?,?, ?, ?)
+`, username, base64.RawStdEncoding.EncodeToString(append(hash, salt...)), time.Now().Format(time.RFC3339), changeOnFirstUse, role)
 
 	return err
 }
@@ -111,12 +140,13 @@ func CompareAdminKeys(username, password string) error {
 		return errors.New("account locked")
 	}
 
+	// Admins with mfa keep the attempt until they pass it, so failing mfa counts towards the same lockout
 	_, err = database.Exec(`UPDATE 
 		AdminUsers 
 	SET 
 		attempts = 0 
 	WHERE 
-		username = ?`,
+		username = ? AND mfa_type = ''`,
 		username)
 	if err != nil {
 		return err
@@ -144,6 +174,44 @@ func SetAdminUserLock(username string) error {
 	return nil
 }
 
+// IncrementAdminAttempts counts a failed mfa attempt, returning an error if the admin is now locked
+func IncrementAdminAttempts(username string) error {
+	_, err := database.Exec(`UPDATE 
+		AdminUsers 
+	SET 
+		attempts = attempts + 1 
+	WHERE 
+		attempts <= ? AND username = ?`,
+		5, username)
+	if err != nil {
+		return err
+	}
+
+	return CheckAdminLocked(username)
+}
+
+// CheckAdminLocked returns an error if the admin has failed to log in too many times
+func CheckAdminLocked(username string) error {
+	var attempts int
+	err := database.QueryRow(`
+	SELECT 
+		attempts
+	FROM 
+		AdminUsers
+	WHERE
+		username = ?
+`, username).Scan(&attempts)
+	if err != nil {
+		return err
+	}
+
+	if attempts > 5 {
+		return errors.New("account locked")
+	}
+
+	return nil
+}
+
 // Unlock admin account
 func SetAdminUserUnlock(username string) error {
 	_, err := database.Exec(`
@@ -185,11 +253,11 @@ func GetAdminUser(username string) (a AdminModel, err error) {
 
 	err = database.QueryRow(`
 	SELECT 
-		username, attempts, last_login, ip, date_added, change
+		username, attempts, last_login, ip, date_added, change, role, mfa_type, oidc_identity
 	FROM 
 		AdminUsers
 	WHERE
-		username = ?`, username).Scan(&a.Username, &a.Attempts, &LastLogin, &IP, &a.DateAdded, &a.Change)
+		username = ?`, username).Scan(&a.Username, &a.Attempts, &LastLogin, &IP, &a.DateAdded, &a.Change, &a.Role, &a.MfaType, &a.OIDC)
 	if err != nil {
 		return
 	}
@@ -202,7 +270,7 @@ func GetAdminUser(username string) (a AdminModel, err error) {
 
 func GetAllAdminUsers() (adminUsers []AdminModel, err error) {
 
-	rows, err := database.Query("SELECT username, attempts, last_login, ip, date_added, change FROM AdminUsers ORDER by ROWID DESC")
+	rows, err := database.Query("SELECT username, attempts, last_login, ip, date_added, change, role, mfa_type, oidc_identity FROM AdminUsers ORDER by ROWID DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -214,7 +282,7 @@ func GetAllAdminUsers() (adminUsers []AdminModel, err error) {
 			IP        sql.NullString
 			au        AdminModel
 		)
-		err = rows.Scan(&au.Username, &au.Attempts, &LastLogin, &IP, &au.DateAdded, &au.Change)
+		err = rows.Scan(&au.Username, &au.Attempts, &LastLogin, &IP, &au.DateAdded, &au.Change, &au.Role, &au.MfaType, &au.OIDC)
 		if err != nil {
 			return nil, err
 		}
@@ -257,6 +325,31 @@ func SetAdminPassword(username, password string) error {
 	return nil
 }
 
+// SetAdminRole changes what the admin is allowed to do in the management ui
+func SetAdminRole(username, role string) error {
+	if err := checkAdminRole(role); err != nil {
+		return err
+	}
+
+	result, err := database.Exec(`
+	UPDATE
+		AdminUsers
+	SET
+		role = ?
+	WHERE
+		username = ?
+	`, role, username)
+	if err != nil {
+		return errors.New("Unable to set admin role: " + err.Error())
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("admin user %q not found", username)
+	}
+
+	return nil
+}
+
 func SetLastLoginInformation(username, ip string) error {
 	_, err := database.Exec(`
 	UPDATE 
@@ -274,3 +367,105 @@ func SetLastLoginInformation(username, ip string) error {
 
 	return nil
 }
+
+// SetAdminMfa stores the admins mfa secret, which is encrypted like user mfa secrets
+func SetAdminMfa(username, mfaType, secret string) error {
+	// Held until the value is written, so a key rotation cannot happen in between
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
+
+	secret, err := encryptMfa(mfaDataKey, username, secret)
+	if err != nil {
+		return err
+	}
+
+	result, err := database.Exec(`
+	UPDATE
+		AdminUsers
+	SET
+		mfa_type = ?, mfa = ?
+	WHERE
+		username = ?
+	`, mfaType, secret, username)
+	if err != nil {
+		return errors.New("Unable to set admin mfa: " + err.Error())
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("admin user %q not found", username)
+	}
+
+	return nil
+}
+
+// GetAdminMfa returns the admins mfa type and secret, both are empty if the admin has not registered mfa
+func GetAdminMfa(username string) (mfaType, secret string, err error) {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
+
+	err = database.QueryRow(`
+	SELECT
+		mfa_type, mfa
+	FROM
+		AdminUsers
+	WHERE
+		username = ?`, username).Scan(&mfaType, &secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err = decryptMfa(mfaDataKey, username, secret)
+	return
+}
+
+// ResetAdminMfa removes the admins mfa, so they have to register it again on their next login
+func ResetAdminMfa(username string) error {
+	return SetAdminMfa(username, "", "")
+}
+
+// OIDCIdentity identifies a user of an OIDC provider, the subject is only unique per issuer and unlike the username cannot be changed by the user
+func OIDCIdentity(issuer, subject string) string {
+	return strings.TrimSuffix(issuer, "/") + "#" + subject
+}
+
+// GetAdminUserByOIDC finds the admin linked to an OIDC identity
+func GetAdminUserByOIDC(identity string) (a AdminModel, err error) {
+	if identity == "" {
+		return a, errors.New("no oidc identity given")
+	}
+
+	var username string
+	err = database.QueryRow(`
+	SELECT
+		username
+	FROM
+		AdminUsers
+	WHERE
+		oidc_identity = ?`, identity).Scan(&username)
+	if err != nil {
+		return a, err
+	}
+
+	return GetAdminUser(username)
+}
+
+// SetAdminOIDC links an admin to an OIDC identity so they can sign in with it, an empty identity removes the link
+func SetAdminOIDC(username, identity string) error {
+	result, err := database.Exec(`
+	UPDATE
+		AdminUsers
+	SET
+		oidc_identity = ?
+	WHERE
+		username = ?
+	`, identity, username)
+	if err != nil {
+		return errors.New("Unable to link admin to oidc identity: " + err.Error())
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("admin user %q not found", username)
+	}
+
+	return nil
+}
@@ -10,7 +10,8 @@ import (
 )
 
 type UserModel struct {
-	Username  string
+	Username string
+	// The mfa secret that is being registered, once verified it is moved to the MfaFactors table
 	Mfa       string
 	MfaType   string
 	Locked    bool
@@ -37,7 +38,10 @@ func IncrementAuthenticationAttempt(username, device string) error {
 	return nil
 }
 
+// GetAuthenticationDetails returns the mfa secret being registered (if any) along with the devices lockout state
 func GetAuthenticationDetails(username, device string) (mfa, mfaType string, attempts int, locked bool, err error) {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
 
 	err = database.QueryRow(`SELECT 
 								mfa, mfa_type, attempts, locked 
@@ -53,6 +57,8 @@ func GetAuthenticationDetails(username, device string) (mfa, mfaType string, att
 		return
 	}
 
+	mfa, err = decryptMfa(mfaDataKey, username, mfa)
+
 	return
 }
 
@@ -139,31 +145,7 @@ func SetEnforceMFAOff(username string) error {
 	return err
 }
 
-func GetMFASecret(username string) (string, error) {
-	var (
-		url, mfaType string
-		enforcing    sql.NullString
-	)
-	err := database.QueryRow(`
-		SELECT 
-			mfa, mfa_type, enforcing 
-		FROM 
-			Users
-		WHERE
-			username = ?
-	`, username).Scan(&url, &mfaType, &enforcing)
-	if err != nil {
-		return "", err
-	}
-
-	// The webauthn "secret" needs to be used, but isnt returned to the client
-	if enforcing.Valid && mfaType != "webauthn" {
-		return "", errors.New("MFA is set to enforcing, cannot reveal totp secret")
-	}
-
-	return url, nil
-}
-
+// GetMFAType returns the type of mfa the user is part way through registering, enrolled factors are in MfaFactors
 func GetMFAType(username string) (string, error) {
 	var (
 		mfaType string
@@ -199,11 +181,16 @@ func DeleteUser(username string) error {
 			Devices
 		WHERE
 			username = ?`, username)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return DeleteMfaFactors(username)
 }
 
 func GetUserData(username string) (u UserModel, err error) {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
 
 	var enforcing sql.NullString
 
@@ -220,6 +207,11 @@ func GetUserData(username string) (u UserModel, err error) {
 
 	u.Enforcing = enforcing.Valid
 
+	u.Mfa, err = decryptMfa(mfaDataKey, u.Username, u.Mfa)
+	if err != nil {
+		return UserModel{}, err
+	}
+
 	return
 }
 
@@ -241,8 +233,16 @@ func GetUserDataFromAddress(address string) (u UserModel, err error) {
 }
 
 func SetUserMfa(username, value, mfaType string) error {
+	// Held until the value is written, so a key rotation cannot happen in between
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
 
-	_, err := database.Exec(`
+	value, err := encryptMfa(mfaDataKey, username, value)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`
 	UPDATE 
 		Users
 	SET
@@ -269,7 +269,15 @@ func CreateUserDataAccount(username string) (UserModel, error) {
 	}, err
 }
 
+// CountUsers returns the number of users with an account, without reading (and decrypting) their mfa details
+func CountUsers() (count int, err error) {
+	err = database.QueryRow("SELECT COUNT(*) FROM Users").Scan(&count)
+	return
+}
+
 func GetAllUsers() (users []UserModel, err error) {
+	mfaKeyLock.RLock()
+	defer mfaKeyLock.RUnlock()
 
 	rows, err := database.Query("SELECT username, mfa, mfa_type, enforcing, locked FROM Users ORDER by ROWID DESC")
 	if err != nil {
@@ -289,6 +297,11 @@ func GetAllUsers() (users []UserModel, err error) {
 
 		u.Enforcing = enforcing.Valid
 
+		u.Mfa, err = decryptMfa(mfaDataKey, u.Username, u.Mfa)
+		if err != nil {
+			return nil, err
+		}
+
 		users = append(users, u)
 	}
 
@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+)
+
+type labelPair struct {
+	first, second string
+}
+
+var (
+	countersLock sync.Mutex
+
+	// method, result
+	mfaAttempts = map[labelPair]uint64{}
+	lockouts    uint64
+
+	registrations uint64
+
+	// kind, result
+	configReloads = map[labelPair]uint64{}
+)
+
+func result(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// RecordMFA counts an mfa attempt with method
+func RecordMFA(method string, success bool) {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	mfaAttempts[labelPair{method, result(success)}]++
+}
+
+// RecordLockout counts a device being locked for too many failed mfa attempts
+func RecordLockout() {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	lockouts++
+}
+
+// RecordRegistration counts a registration token being used
+func RecordRegistration() {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	registrations++
+}
+
+// RecordConfigReload counts a reload of kind (full or acls), err is the reason it failed if it did
+func RecordConfigReload(kind string, err error) {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+
+	configReloads[labelPair{kind, result(err == nil)}]++
+}
+
+// Start serves metrics in the prometheus text format on Metrics.ListenAddress if they are enabled
+func Start(errs chan<- error) error {
+	if !config.Values().Metrics.Enabled {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	srv := &http.Server{
+		Addr:         config.Values().Metrics.ListenAddress,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		Handler:      mux,
+	}
+
+	if config.Values().Metrics.SupportsTLS() {
+		go func() {
+			errs <- fmt.Errorf("TLS metrics listener failed: %v", srv.ListenAndServeTLS(config.Values().Metrics.CertPath, config.Values().Metrics.KeyPath))
+		}()
+	} else {
+		go func() {
+			errs <- fmt.Errorf("metrics listener failed: %v", srv.ListenAndServe())
+		}()
+	}
+
+	log.Println("Started metrics:\n\t\t\tListening:", config.Values().Metrics.ListenAddress)
+
+	return nil
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if token := config.Values().Metrics.Token; token != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var m exposition
+
+	devices, err := data.GetAllDevices()
+	if err != nil {
+		log.Println("metrics unable to get devices: ", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
+
+	users, err := data.CountUsers()
+	if err != nil {
+		log.Println("metrics unable to get users: ", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
+
+	authorised, err := router.GetAllAuthorised()
+	if err != nil {
+		log.Println("metrics unable to get authorised devices: ", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
+
+	m.metric("wag_devices", "gauge", "Registered devices")
+	m.sample("wag_devices", nil, float64(len(devices)))
+
+	m.metric("wag_users", "gauge", "Users with an account")
+	m.sample("wag_users", nil, float64(users))
+
+	m.metric("wag_authorised_sessions", "gauge", "Devices with an active mfa session")
+	m.sample("wag_authorised_sessions", nil, float64(len(authorised)))
+
+	countersLock.Lock()
+
+	m.metric("wag_mfa_attempts_total", "counter", "Mfa attempts by method and result")
+	for _, labels := range sortedKeys(mfaAttempts) {
+		m.sample("wag_mfa_attempts_total", []string{"method", labels.first, "result", labels.second}, float64(mfaAttempts[labels]))
+	}
+
+	m.metric("wag_lockouts_total", "counter", "Devices locked for too many failed mfa attempts")
+	m.sample("wag_lockouts_total", nil, float64(lockouts))
+
+	m.metric("wag_registrations_total", "counter", "Registration tokens used")
+	m.sample("wag_registrations_total", nil, float64(registrations))
+
+	m.metric("wag_config_reloads_total", "counter", "Configuration reloads by kind (full or acls) and result")
+	for _, labels := range sortedKeys(configReloads) {
+		m.sample("wag_config_reloads_total", []string{"kind", labels.first, "result", labels.second}, float64(configReloads[labels]))
+	}
+
+	countersLock.Unlock()
+
+	peers, err := router.ListPeers()
+	if err != nil {
+		// Still useful without wireguard stats, so dont fail the whole scrape
+		log.Println("metrics unable to list wireguard peers: ", err)
+	}
+
+	owners := map[string]string{}
+	for _, device := range devices {
+		owners[device.Address] = device.Username
+	}
+
+	now := time.Now()
+	peerLabels := make([][]string, len(peers))
+	for i, peer := range peers {
+		address := ""
+		if len(peer.AllowedIPs) > 0 {
+			address = peer.AllowedIPs[0].IP.String()
+		}
+
+		peerLabels[i] = []string{"public_key", peer.PublicKey.String(), "address", address, "username", owners[address]}
+	}
+
+	// Samples of a metric must be together, so each is written in its own pass over the peers
+	m.metric("wag_wireguard_peer_handshake_age_seconds", "gauge", "Seconds since the last wireguard handshake, peers that have never connected are left out")
+	for i, peer := range peers {
+		if !peer.LastHandshakeTime.IsZero() {
+			m.sample("wag_wireguard_peer_handshake_age_seconds", peerLabels[i], now.Sub(peer.LastHandshakeTime).Seconds())
+		}
+	}
+
+	m.metric("wag_wireguard_peer_receive_bytes_total", "counter", "Bytes received from the peer")
+	for i, peer := range peers {
+		m.sample("wag_wireguard_peer_receive_bytes_total", peerLabels[i], float64(peer.ReceiveBytes))
+	}
+
+	m.metric("wag_wireguard_peer_transmit_bytes_total", "counter", "Bytes sent to the peer")
+	for i, peer := range peers {
+		m.sample("wag_wireguard_peer_transmit_bytes_total", peerLabels[i], float64(peer.TransmitBytes))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.Bytes())
+}
+
+func sortedKeys(counters map[labelPair]uint64) []labelPair {
+	keys := make([]labelPair, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].first != keys[j].first {
+			return keys[i].first < keys[j].first
+		}
+		return keys[i].second < keys[j].second
+	})
+
+	return keys
+}
+
+// exposition builds the prometheus text format
+type exposition struct {
+	bytes.Buffer
+}
+
+func (e *exposition) metric(name, kind, help string) {
+	fmt.Fprintf(e, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value for name, labels are name value pairs
+func (e *exposition) sample(name string, labels []string, value float64) {
+	e.WriteString(name)
+
+	if len(labels) > 0 {
+		pairs := []string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+		}
+
+		e.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	fmt.Fprintf(e, " %v\n", value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestEscapeLabel(t *testing.T) {
+	tests := map[string]string{
+		"toaster":            "toaster",
+		`back\slash`:         `back\\slash`,
+		`"quoted"`:           `\"quoted\"`,
+		"new\nline":          `new\nline`,
+		`\"` + "\n":          `\\\"\n`,
+		"tab\tand unicode ✓": "tab\tand unicode ✓",
+		"":                   "",
+	}
+
+	for input, expected := range tests {
+		if got := escapeLabel(input); got != expected {
+			t.Errorf("%q: got %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestExposition(t *testing.T) {
+	var m exposition
+
+	m.metric("wag_users", "gauge", "Users with an account")
+	m.sample("wag_users", nil, 3)
+
+	m.metric("wag_mfa_attempts_total", "counter", "Mfa attempts by method and result")
+	m.sample("wag_mfa_attempts_total", []string{"method", "totp", "result", "success"}, 12)
+	m.sample("wag_mfa_attempts_total", []string{"method", `we"ird\` + "\n", "result", "failure"}, 0.5)
+
+	// A label without a value is dropped rather than writing a broken line
+	m.sample("wag_devices", []string{"username", "toaster", "dangling"}, 1)
+
+	expected := `# HELP wag_users Users with an account
+# TYPE wag_users gauge
+wag_users 3
+# HELP wag_mfa_attempts_total Mfa attempts by method and result
+# TYPE wag_mfa_attempts_total counter
+wag_mfa_attempts_total{method="totp",result="success"} 12
+wag_mfa_attempts_total{method="we\"ird\\\n",result="failure"} 0.5
+wag_devices{username="toaster"} 1
+`
+
+	if m.String() != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", m.String(), expected)
+	}
+}
+
+func TestExpositionLargeCounter(t *testing.T) {
+	var m exposition
+	m.sample("wag_wireguard_peer_receive_bytes_total", nil, float64(1<<40))
+
+	// Prometheus accepts exponents, but the value has to round trip
+	if got := m.String(); got != "wag_wireguard_peer_receive_bytes_total 1.099511627776e+12\n" {
+		t.Fatal("large counter written wrong: ", got)
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	counters := map[labelPair]uint64{
+		{"webauthn", "success"}: 1,
+		{"totp", "success"}:     1,
+		{"totp", "failure"}:     1,
+		{"oidc", "failure"}:     1,
+	}
+
+	expected := []labelPair{
+		{"oidc", "failure"},
+		{"totp", "failure"},
+		{"totp", "success"},
+		{"webauthn", "success"},
+	}
+
+	got := sortedKeys(counters)
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("samples are not in a stable order: %v", got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package radius
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const defaultTimeout = 10 * time.Second
+
+var ErrRejected = errors.New("radius server rejected the request")
+
+// ChallengeError is returned when the server needs more from the user (e.g the code from a hardware token) before it will accept them.
+// The State must be sent back with the users answer to the challenge
+type ChallengeError struct {
+	Message string
+	State   []byte
+}
+
+func (c *ChallengeError) Error() string {
+	return "radius server sent a challenge: " + c.Message
+}
+
+// Client sends PAP Access-Requests to a single RADIUS server
+type Client struct {
+	// host:port, the port defaults to 1812
+	Server        string
+	Secret        string
+	NASIdentifier string
+
+	// How long to wait for the server to respond (including retries), defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// Authenticate returns nil if the server accepted username and password, ErrRejected if it refused them, or a *ChallengeError.
+// state should be nil unless password is the answer to a previous challenge
+func (c *Client) Authenticate(username, password string, state []byte) error {
+	if c.Server == "" {
+		return errors.New("radius server is not set")
+	}
+
+	packet := radius.New(radius.CodeAccessRequest, []byte(c.Secret))
+
+	if err := rfc2865.UserName_SetString(packet, username); err != nil {
+		return err
+	}
+
+	if err := rfc2865.UserPassword_SetString(packet, password); err != nil {
+		return err
+	}
+
+	if c.NASIdentifier != "" {
+		if err := rfc2865.NASIdentifier_SetString(packet, c.NASIdentifier); err != nil {
+			return err
+		}
+	}
+
+	if state != nil {
+		if err := rfc2865.State_Set(packet, state); err != nil {
+			return err
+		}
+	}
+
+	if err := signRequest(packet); err != nil {
+		return err
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	response, err := radius.Exchange(ctx, packet, serverAddress(c.Server))
+	if err != nil {
+		return fmt.Errorf("radius exchange with %s failed: %s", c.Server, err)
+	}
+
+	// Without this an attacker on the path can forge an accept or challenge from a reject (BlastRADIUS)
+	if err := verifyResponse(packet, response); err != nil {
+		return err
+	}
+
+	switch response.Code {
+	case radius.CodeAccessAccept:
+		return nil
+	case radius.CodeAccessReject:
+		return ErrRejected
+	case radius.CodeAccessChallenge:
+		responseState := rfc2865.State_Get(response)
+		if responseState == nil {
+			return errors.New("radius server sent a challenge without a state")
+		}
+
+		return &ChallengeError{
+			Message: rfc2865.ReplyMessage_GetString(response),
+			State:   responseState,
+		}
+	}
+
+	return fmt.Errorf("radius server sent unexpected response: %s", response.Code)
+}
+
+// signRequest adds a Message-Authenticator to the request, as servers may require it on every Access-Request
+func signRequest(packet *radius.Packet) error {
+	mac, err := messageAuthenticator(packet)
+	if err != nil {
+		return err
+	}
+
+	return rfc2869.MessageAuthenticator_Set(packet, mac)
+}
+
+// verifyResponse checks the Message-Authenticator of a response, which is calculated with the authenticator of the request it answers (rfc3579 3.2)
+// Responses without one are rejected
+func verifyResponse(request, response *radius.Packet) error {
+	sent := rfc2869.MessageAuthenticator_Get(response)
+	if len(sent) != md5.Size {
+		return errors.New("radius server response did not have a Message-Authenticator")
+	}
+
+	check := *response
+	check.Attributes = append(radius.Attributes(nil), response.Attributes...)
+	check.Authenticator = request.Authenticator
+
+	expected, err := messageAuthenticator(&check)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(sent, expected) {
+		return errors.New("radius server response had an invalid Message-Authenticator")
+	}
+
+	return nil
+}
+
+// messageAuthenticator calculates the hmac over the whole packet with the Message-Authenticator attribute zeroed, packet is modified to contain the zeroed attribute
+func messageAuthenticator(packet *radius.Packet) ([]byte, error) {
+	if err := rfc2869.MessageAuthenticator_Set(packet, make([]byte, md5.Size)); err != nil {
+		return nil, err
+	}
+
+	// The authenticator is written as is, rather than being replaced with a response authenticator
+	wire, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(md5.New, packet.Secret)
+	mac.Write(wire)
+
+	return mac.Sum(nil), nil
+}
+
+func serverAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "1812")
+	}
+
+	return server
+}
@@ -0,0 +1,236 @@
+package radius
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	testSecret   = "testing123"
+	testNAS      = "wag-test"
+	testUser     = "toaster"
+	testPassword = "hunter2"
+	testToken    = "123456"
+)
+
+var testState = []byte("awaiting-token")
+
+// standIn behaves like a RADIUS server fronting a hardware token, the password is accepted with a challenge and the token code completes the login
+func standIn(t *testing.T) (address string) {
+	return standInSigning(t, signResponse)
+}
+
+// standInSigning is standIn with sign adding (or not) the Message-Authenticator to each response
+func standInSigning(t *testing.T, sign func(*radius.Packet)) (address string) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unable to listen for stand in radius server: ", err)
+	}
+
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte(testSecret)),
+		Handler: radius.HandlerFunc(func(rw radius.ResponseWriter, r *radius.Request) {
+			w := signingWriter{rw, sign}
+
+			if !validMessageAuthenticator(r.Packet) || rfc2865.NASIdentifier_GetString(r.Packet) != testNAS || rfc2865.UserName_GetString(r.Packet) != testUser {
+				w.Write(r.Response(radius.CodeAccessReject))
+				return
+			}
+
+			password := rfc2865.UserPassword_GetString(r.Packet)
+			state := rfc2865.State_Get(r.Packet)
+
+			switch {
+			case state == nil && password == testPassword:
+				response := r.Response(radius.CodeAccessChallenge)
+				rfc2865.State_Set(response, testState)
+				rfc2865.ReplyMessage_SetString(response, "Enter your token code")
+				w.Write(response)
+			case bytes.Equal(state, testState) && password == testToken:
+				w.Write(r.Response(radius.CodeAccessAccept))
+			default:
+				w.Write(r.Response(radius.CodeAccessReject))
+			}
+		}),
+	}
+
+	go server.Serve(conn)
+
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+
+	return conn.LocalAddr().String()
+}
+
+type signingWriter struct {
+	radius.ResponseWriter
+	sign func(*radius.Packet)
+}
+
+func (s signingWriter) Write(packet *radius.Packet) error {
+	s.sign(packet)
+	return s.ResponseWriter.Write(packet)
+}
+
+// hmac of the packet as it is, with the Message-Authenticator zeroed
+func testMac(packet *radius.Packet, secret []byte) []byte {
+	check := *packet
+	check.Attributes = append(radius.Attributes(nil), packet.Attributes...)
+	rfc2869.MessageAuthenticator_Set(&check, make([]byte, md5.Size))
+
+	wire, err := check.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	mac := hmac.New(md5.New, secret)
+	mac.Write(wire)
+
+	return mac.Sum(nil)
+}
+
+func validMessageAuthenticator(packet *radius.Packet) bool {
+	sent := rfc2869.MessageAuthenticator_Get(packet)
+	if len(sent) != md5.Size {
+		return false
+	}
+
+	// The request authenticator is random for Access-Requests, so the packet can be checked as it was sent
+	return hmac.Equal(testMac(packet, packet.Secret), sent)
+}
+
+// Responses still carry the request authenticator until they are written, which is what the Message-Authenticator is calculated with
+func signResponse(response *radius.Packet) {
+	rfc2869.MessageAuthenticator_Set(response, testMac(response, response.Secret))
+}
+
+func TestChallengeFlow(t *testing.T) {
+	c := Client{Server: standIn(t), Secret: testSecret, NASIdentifier: testNAS}
+
+	err := c.Authenticate(testUser, testPassword, nil)
+
+	var challenge *ChallengeError
+	if !errors.As(err, &challenge) {
+		t.Fatal("expected a challenge, got: ", err)
+	}
+
+	if challenge.Message != "Enter your token code" {
+		t.Fatal("challenge had incorrect reply message: ", challenge.Message)
+	}
+
+	if !bytes.Equal(challenge.State, testState) {
+		t.Fatal("challenge had incorrect state: ", string(challenge.State))
+	}
+
+	err = c.Authenticate(testUser, testToken, challenge.State)
+	if err != nil {
+		t.Fatal("answering the challenge should have succeeded: ", err)
+	}
+}
+
+func TestRejected(t *testing.T) {
+	c := Client{Server: standIn(t), Secret: testSecret, NASIdentifier: testNAS}
+
+	err := c.Authenticate(testUser, "wrong", nil)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("wrong password should have been rejected, got: ", err)
+	}
+
+	err = c.Authenticate("not_a_user", testPassword, nil)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("unknown user should have been rejected, got: ", err)
+	}
+
+	// The token code is only accepted as the answer to a challenge
+	err = c.Authenticate(testUser, testToken, nil)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("token without challenge state should have been rejected, got: ", err)
+	}
+
+	err = c.Authenticate(testUser, testToken, []byte("wrong-state"))
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("token with incorrect challenge state should have been rejected, got: ", err)
+	}
+}
+
+func TestShortPassword(t *testing.T) {
+	c := Client{Server: standIn(t), Secret: testSecret, NASIdentifier: testNAS}
+
+	for _, password := range []string{"", "a", "sixteen-bytes-ok", "seventeen-bytes-x"} {
+		if err := c.Authenticate(testUser, password, nil); !errors.Is(err, ErrRejected) {
+			t.Fatalf("%q should have been sent and rejected, got: %v", password, err)
+		}
+	}
+}
+
+func TestUnsignedResponse(t *testing.T) {
+	tests := map[string]func(*radius.Packet){
+		"missing": func(*radius.Packet) {},
+		"wrong secret": func(response *radius.Packet) {
+			rfc2869.MessageAuthenticator_Set(response, testMac(response, []byte("not the secret")))
+		},
+		// Calculated over the response authenticator, rather than the request authenticator
+		"wrong authenticator": func(response *radius.Packet) {
+			forged := *response
+			forged.Authenticator = [16]byte{1}
+			rfc2869.MessageAuthenticator_Set(response, testMac(&forged, response.Secret))
+		},
+	}
+
+	for name, sign := range tests {
+		c := Client{Server: standInSigning(t, sign), Secret: testSecret, NASIdentifier: testNAS}
+
+		// Even a challenge, which would otherwise move the login on, must not be trusted
+		err := c.Authenticate(testUser, testPassword, nil)
+
+		var challenge *ChallengeError
+		if err == nil || errors.As(err, &challenge) || errors.Is(err, ErrRejected) {
+			t.Fatalf("%s: response without a valid Message-Authenticator was accepted: %v", name, err)
+		}
+	}
+}
+
+func TestNASIdentifier(t *testing.T) {
+	c := Client{Server: standIn(t), Secret: testSecret, NASIdentifier: "someone-else"}
+
+	err := c.Authenticate(testUser, testPassword, nil)
+	if !errors.Is(err, ErrRejected) {
+		t.Fatal("stand in only accepts its own nas identifier, got: ", err)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	// The server drops requests it cannot verify, so the client should time out rather than get a response
+	c := Client{Server: standIn(t), Secret: "not the secret", NASIdentifier: testNAS, Timeout: 2 * time.Second}
+
+	err := c.Authenticate(testUser, testPassword, nil)
+	if err == nil || errors.Is(err, ErrRejected) {
+		t.Fatal("request with the wrong shared secret should not have been answered, got: ", err)
+	}
+}
+
+func TestServerAddress(t *testing.T) {
+	if serverAddress("radius.internal") != "radius.internal:1812" {
+		t.Fatal("default port not added: ", serverAddress("radius.internal"))
+	}
+
+	if serverAddress("10.0.0.1:1645") != "10.0.0.1:1645" {
+		t.Fatal("explicit port was changed: ", serverAddress("10.0.0.1:1645"))
+	}
+
+	if serverAddress("fd00::1") != "[fd00::1]:1812" {
+		t.Fatal("ipv6 default port not added: ", serverAddress("fd00::1"))
+	}
+}
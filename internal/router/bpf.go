@@ -1,6 +1,7 @@
 package router
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"log"
 	"math"
 	"net"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -41,11 +43,11 @@ var (
 		Type: ebpf.LPMTrie,
 
 		// 4 byte, prefix length;
-		// 4 byte, ipv4 addr;
-		KeySize: 8,
+		// 16 byte, ipv6 addr (ipv4 addresses are ipv4-mapped);
+		KeySize: 20,
 
-		//policies array
-		ValueSize: 8 * 128,
+		// policy set id, the policies themselves are in the policy_sets map
+		ValueSize: 4,
 
 		// This flag is required for dynamically sized inner maps.
 		// Added in linux 5.10.
@@ -82,6 +84,10 @@ func loadXDP() error {
 	}
 
 	spec.Maps["policies_table"].InnerMap = routesMapSpec
+
+	// Fresh maps, so nothing from before is in policy_sets
+	resetPolicySets()
+
 	// Load pre-compiled programs into the kernel.
 	if err = spec.LoadAndAssign(&xdpObjects, nil); err != nil {
 
@@ -105,7 +111,7 @@ func loadXDP() error {
 		return fmt.Errorf("could not set inactivity timeout: %s", err)
 	}
 
-	return nil
+	return setDropEventSampleRate()
 }
 
 func attachXDP() error {
@@ -209,7 +215,7 @@ func isAuthed(address string) bool {
 
 	var deviceStruct fwentry
 
-	deviceBytes, err := xdpObjects.Devices.LookupBytes([]byte(ip.To4()))
+	deviceBytes, err := xdpObjects.Devices.LookupBytes([]byte(ip.To16()))
 	if err != nil {
 		return false
 	}
@@ -227,11 +233,68 @@ func isAuthed(address string) bool {
 
 	sessionValid := (deviceStruct.sessionExpiry > currentTime || deviceStruct.sessionExpiry == math.MaxUint64)
 
-	sessionActive := ((currentTime-deviceStruct.lastPacketTime) < uint64(config.Values().SessionInactivityTimeoutMinutes)*60000000000 || config.Values().SessionInactivityTimeoutMinutes < 0)
+	var userInactivityTimeout uint64 // Left as 0 if the user has no timeout of their own
+	xdpObjects.UserInactivityTimeout.Lookup(deviceStruct.user_id, &userInactivityTimeout)
+
+	timeout := inactivityTimeout(deviceStruct, userInactivityTimeout, minutesToNs(config.Values().SessionInactivityTimeoutMinutes))
+
+	sessionActive := timeout == math.MaxUint64 || (currentTime-deviceStruct.lastPacketTime) < timeout
 
 	return isAccountLocked == 0 && sessionValid && sessionActive
 }
 
+// IsSteppedUp returns true if the device is authorised and completed mfa recently enough to reach step up routes
+func IsSteppedUp(address string) bool {
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if !isAuthed(address) {
+		return false
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	var deviceStruct fwentry
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes([]byte(ip.To16()))
+	if err != nil {
+		return false
+	}
+
+	if deviceStruct.Unpack(deviceBytes) != nil {
+		return false
+	}
+
+	return GetTimeStamp() < deviceStruct.stepUpExpiry
+}
+
+// inactivityTimeout picks the timeout the same way check_policies in xdp.c does, the shortest of the devices and users own timeouts, or the global timeout if neither has one
+func inactivityTimeout(device fwentry, user, global uint64) uint64 {
+	timeout := device.inactivityTimeout
+	if user != 0 && (timeout == 0 || user < timeout) {
+		timeout = user
+	}
+
+	if timeout == 0 {
+		timeout = global
+	}
+
+	return timeout
+}
+
+// minutesToNs converts a minutes setting to the nano seconds used in the maps, where less than 0 means disabled
+func minutesToNs(minutes int) uint64 {
+	if minutes < 0 {
+		return math.MaxUint64
+	}
+
+	return uint64(minutes) * 60000000000
+}
+
 func xdpRemoveDevice(address string) error {
 	ip := net.ParseIP(address)
 	if ip == nil {
@@ -244,11 +307,22 @@ func xdpRemoveDevice(address string) error {
 	var deviceStruct fwentry
 	deviceBytes := make([]byte, deviceStruct.Size())
 
-	deviceTableErr := xdpObjects.Devices.LookupAndDelete(ip.To4(), deviceBytes)
+	deviceTableErr := xdpObjects.Devices.LookupAndDelete(ip.To16(), deviceBytes)
 	if deviceTableErr != nil && !strings.Contains(deviceTableErr.Error(), ebpf.ErrKeyNotExist.Error()) {
 		finalError = errors.New(finalError.Error() + "removing from devices table failed: " + deviceTableErr.Error() + " ")
 	}
 
+	statsTableErr := xdpObjects.DeviceStats.Delete(ip.To16())
+	if statsTableErr != nil && !strings.Contains(statsTableErr.Error(), ebpf.ErrKeyNotExist.Error()) {
+		finalError = errors.New(finalError.Error() + "removing from device stats table failed: " + statsTableErr.Error() + " ")
+	}
+
+	// Otherwise a new device given this address could receive replies to connections the old one started
+	flowsErr := removeFlows(ip.To16())
+	if flowsErr != nil {
+		finalError = errors.New(finalError.Error() + "removing from flows table failed: " + flowsErr.Error() + " ")
+	}
+
 	if finalError.Error() == msg {
 		finalError = nil
 	}
@@ -265,7 +339,7 @@ func xdpAddDevice(username, address string) error {
 
 	var deviceStruct fwentry
 	deviceBytes := make([]byte, deviceStruct.Size())
-	err := xdpObjects.Devices.Lookup(ip.To4(), &deviceBytes)
+	err := xdpObjects.Devices.Lookup(ip.To16(), &deviceBytes)
 	if err == nil {
 		return errors.New("attempted to add a device with address that already exists")
 	}
@@ -279,28 +353,40 @@ func xdpAddDevice(username, address string) error {
 		return err
 	}
 
-	return xdpObjects.Devices.Put(ip.To4(), deviceStruct.Bytes())
+	return xdpObjects.Devices.Put(ip.To16(), deviceStruct.Bytes())
 }
 
-// Takes the LPM table and associates a route to a policy
-func xdpAddRoute(usersRouteTable *ebpf.Map, userAcls config.Acl) error {
+// Takes the LPM table and associates a route to a policy set, returning the ids of the policy sets that were used
+func xdpAddRoute(usersRouteTable *ebpf.Map, userAcls config.Acl) (policySets []uint32, err error) {
 
 	rules, err := routetypes.ParseRules(userAcls.Mfa, userAcls.Allow, userAcls.Deny)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	rules, err = routetypes.MergeSchedules(rules)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, rule := range rules {
+
+		id, err := acquirePolicySet(rule.Values)
+		if err != nil {
+			return policySets, err
+		}
+		policySets = append(policySets, id)
+
 		for i := range rule.Keys {
 
-			err := usersRouteTable.Put(&rule.Keys[i], &rule.Values)
+			err := usersRouteTable.Put(&rule.Keys[i], id)
 			if err != nil {
-				return fmt.Errorf("error putting route key in inner map: %s", err)
+				return policySets, fmt.Errorf("error putting route key in inner map: %s", err)
 			}
 		}
 	}
 
-	return nil
+	return policySets, nil
 }
 
 // If err != nil then user does not exist
@@ -315,21 +401,6 @@ func xdpUserExists(userid [20]byte) error {
 	return nil
 }
 
-// Returns the inner LPM trie map that was created for the user
-func addInnerMapTo(key interface{}, spec *ebpf.MapSpec, table *ebpf.Map) (*ebpf.Map, error) {
-	inner, err := ebpf.NewMap(spec)
-	if err != nil {
-		return nil, fmt.Errorf("%s creating new map: %s", table.String(), err)
-	}
-
-	err = table.Put(key, uint32(inner.FD()))
-	if err != nil {
-		return nil, fmt.Errorf("%s adding new map to table: %s", table.String(), err)
-	}
-
-	return inner, nil
-}
-
 func AddUser(username string, acls config.Acl) error {
 
 	lock.Lock()
@@ -346,21 +417,47 @@ func AddUser(username string, acls config.Acl) error {
 		return err
 	}
 
+	rememberUsername(username)
+
 	return setMaps(userid, acls)
 }
 
 func setMaps(userid [20]byte, userAcls config.Acl) error {
-	// Adds LPM trie to existing map (hashmap to map)
-	policiesInnerTable, err := addInnerMapTo(userid, routesMapSpec, xdpObjects.PoliciesTable)
+
+	var userInactivityTimeout uint64
+	if userAcls.SessionInactivityTimeoutMinutes != 0 {
+		userInactivityTimeout = minutesToNs(userAcls.SessionInactivityTimeoutMinutes)
+	}
+
+	err := xdpObjects.UserInactivityTimeout.Put(userid, userInactivityTimeout)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s setting inactivity timeout: %s", xdpObjects.UserInactivityTimeout.String(), err)
 	}
 
-	if err := xdpAddRoute(policiesInnerTable, userAcls); err != nil {
+	policiesInnerTable, err := ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		return fmt.Errorf("%s creating new map: %s", xdpObjects.PoliciesTable.String(), err)
+	}
+	// The outer table keeps its own reference, so we dont leak a file descriptor every time the rules are refreshed
+	defer policiesInnerTable.Close()
+
+	policySets, err := xdpAddRoute(policiesInnerTable, userAcls)
+	if err != nil {
+		releasePolicySets(policySets)
 		return err
 	}
 
-	return nil
+	// Swap in the fully populated LPM trie (hashmap to map), so there is no point where the user has partial rules
+	err = xdpObjects.PoliciesTable.Put(userid, uint32(policiesInnerTable.FD()))
+	if err != nil {
+		releasePolicySets(policySets)
+		return fmt.Errorf("%s adding new map to table: %s", xdpObjects.PoliciesTable.String(), err)
+	}
+
+	previous := userPolicySets[userid]
+	userPolicySets[userid] = policySets
+
+	return releasePolicySets(previous)
 }
 
 func RemoveUser(username string) error {
@@ -375,12 +472,22 @@ func RemoveUser(username string) error {
 		return err
 	}
 
+	forgetUsername(userid)
+
 	err = xdpObjects.PoliciesTable.Delete(userid)
 	if err != nil && !strings.Contains(err.Error(), ebpf.ErrKeyNotExist.Error()) {
 		return errors.New("removing user from policies table failed: " + err.Error())
 	}
 
-	return nil
+	err = xdpObjects.UserInactivityTimeout.Delete(userid)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return errors.New("removing user inactivity timeout failed: " + err.Error())
+	}
+
+	previous := userPolicySets[userid]
+	delete(userPolicySets, userid)
+
+	return releasePolicySets(previous)
 }
 
 // RefreshConfiguration updates acls on all users, and updates the inactivity timeout
@@ -406,6 +513,11 @@ func RefreshConfiguration() []error {
 		return []error{fmt.Errorf("could not set inactivity timeout: %s", err)}
 	}
 
+	err = setDropEventSampleRate()
+	if err != nil {
+		return []error{err}
+	}
+
 	for _, user := range users {
 		err := refreshUserAcls(user.Username)
 		if err != nil {
@@ -436,26 +548,43 @@ func refreshUserAcls(username string) error {
 }
 
 // SetAuthroized correctly sets the timestamps for a device with internal IP address as internalAddress
+// The session lifetime comes from the devices class and the users policies, and as mfa was just done step up routes are opened for StepUpLifetimeMinutes
 func SetAuthorized(internalAddress, username string) error {
 
-	if net.ParseIP(internalAddress).To4() == nil {
-		return errors.New("internalAddress could not be parsed as an IPv4 address")
+	ip := net.ParseIP(internalAddress)
+	if ip == nil {
+		return errors.New("internalAddress could not be parsed as an IP address")
+	}
+
+	// A device that cannot be found gets the global session settings, the same as a device without a class
+	var class string
+	if device, err := data.GetDeviceByAddress(internalAddress); err == nil {
+		class = device.Class
 	}
 
+	maxSessionLifetimeMinutes, _ := config.SessionLimits(username, class)
+
 	lock.Lock()
 	defer lock.Unlock()
 
 	var deviceStruct fwentry
 	deviceStruct.lastPacketTime = GetTimeStamp()
 
-	deviceStruct.sessionExpiry = GetTimeStamp() + uint64(config.Values().MaxSessionLifetimeMinutes)*60000000000
-	if config.Values().MaxSessionLifetimeMinutes < 0 {
+	deviceStruct.sessionExpiry = GetTimeStamp() + uint64(maxSessionLifetimeMinutes)*60000000000
+	if maxSessionLifetimeMinutes < 0 {
 		deviceStruct.sessionExpiry = math.MaxUint64 // If the session timeout is disabled, (<0) then we set to max value
 	}
 
+	deviceStruct.stepUpExpiry = GetTimeStamp() + uint64(config.Values().StepUpLifetimeMinutes)*60000000000
+
+	// Only the device class timeout is kept with the device, the users timeout is in user_inactivity_timeout so changes to their policies apply straight away
+	if classTimeout := config.Values().DeviceClasses[class].SessionInactivityTimeoutMinutes; classTimeout != 0 {
+		deviceStruct.inactivityTimeout = minutesToNs(classTimeout)
+	}
+
 	deviceStruct.user_id = sha1.Sum([]byte(username))
 
-	return xdpObjects.Devices.Update(net.ParseIP(internalAddress).To4(), deviceStruct.Bytes(), ebpf.UpdateExist)
+	return xdpObjects.Devices.Update(ip.To16(), deviceStruct.Bytes(), ebpf.UpdateExist)
 }
 
 func Deauthenticate(address string) error {
@@ -465,14 +594,10 @@ func Deauthenticate(address string) error {
 		return errors.New("Unable to get IP address from: " + address)
 	}
 
-	if ip.To4() == nil {
-		return errors.New("IP address was not ipv4")
-	}
-
 	lock.Lock()
 	defer lock.Unlock()
 
-	deviceBytes, err := xdpObjects.Devices.LookupBytes(ip.To4())
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(ip.To16())
 	if err != nil {
 		return err
 	}
@@ -485,12 +610,81 @@ func Deauthenticate(address string) error {
 
 	devicesStruct.lastPacketTime = 0
 	devicesStruct.sessionExpiry = 0
+	devicesStruct.stepUpExpiry = 0
 
-	return xdpObjects.Devices.Update(ip.To4(), devicesStruct.Bytes(), ebpf.UpdateExist)
+	return xdpObjects.Devices.Update(ip.To16(), devicesStruct.Bytes(), ebpf.UpdateExist)
+}
+
+// DeauthenticateUsers clears the session of every device belonging to usernames, returning the addresses of devices that had a session
+func DeauthenticateUsers(usernames []string) ([]string, error) {
+	userids := map[[20]byte]bool{}
+	for _, username := range usernames {
+		userids[sha1.Sum([]byte(username))] = true
+	}
+
+	return deauthenticateWhere(func(device fwentry) bool {
+		return userids[device.user_id]
+	})
+}
+
+// DeauthenticateAll clears the session of every device, returning the addresses of devices that had a session
+func DeauthenticateAll() ([]string, error) {
+	return deauthenticateWhere(func(device fwentry) bool {
+		return true
+	})
+}
+
+// deauthenticateWhere holds the lock for the whole sweep, so no matching device can authorise again part way through
+func deauthenticateWhere(match func(device fwentry) bool) (deauthenticated []string, err error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	var (
+		deviceStruct fwentry
+		deviceBytes  = make([]byte, deviceStruct.Size())
+		ipBytes      = make([]byte, net.IPv6len)
+		matched      = map[string]fwentry{}
+	)
+
+	// Changing the map while iterating it can restart the iteration, so collect the devices first
+	iter := xdpObjects.Devices.Iterate()
+	for iter.Next(&ipBytes, &deviceBytes) {
+		if err := deviceStruct.Unpack(deviceBytes); err != nil {
+			return nil, err
+		}
+
+		if match(deviceStruct) {
+			matched[string(ipBytes)] = deviceStruct
+		}
+	}
+
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	for ip, device := range matched {
+		if device.sessionExpiry != 0 {
+			deauthenticated = append(deauthenticated, net.IP(ip).String())
+		}
+
+		device.lastPacketTime = 0
+		device.sessionExpiry = 0
+		device.stepUpExpiry = 0
+
+		if err := xdpObjects.Devices.Update([]byte(ip), device.Bytes(), ebpf.UpdateExist); err != nil {
+			return deauthenticated, fmt.Errorf("could not deauthenticate %s: %s", net.IP(ip).String(), err)
+		}
+	}
+
+	sort.Strings(deauthenticated)
+
+	return deauthenticated, nil
 }
 
 type FirewallRules struct {
 	Policies      []string
+	Schedules     []string
 	Devices       []fwDevice
 	AccountLocked uint32
 }
@@ -518,12 +712,12 @@ func GetRoutes(username string) ([]string, error) {
 		}
 
 		var (
-			k        routetypes.Key
-			policies [routetypes.MAX_POLICIES]routetypes.Policy
+			k           routetypes.Key
+			policySetID uint32
 		)
 		innerIter := innerMap.Iterate()
 
-		for innerIter.Next(&k, &policies) {
+		for innerIter.Next(&k, &policySetID) {
 			result[k.String()] = true
 		}
 
@@ -574,12 +768,18 @@ func GetRules() (map[string]FirewallRules, error) {
 		}
 
 		var (
-			k        routetypes.Key
-			policies [routetypes.MAX_POLICIES]routetypes.Policy
+			k           routetypes.Key
+			policySetID uint32
 		)
 		innerIter := innerMap.Iterate()
 
-		for innerIter.Next(&k, &policies) {
+		for innerIter.Next(&k, &policySetID) {
+			policies, err := lookupPolicySet(policySetID)
+			if err != nil {
+				innerMap.Close()
+				return nil, fmt.Errorf("policy set %d for %s: %s", policySetID, k.String(), err)
+			}
+
 			var actualPolicies []routetypes.Policy
 			for i := range policies {
 				if policies[i].PolicyType == routetypes.STOP {
@@ -598,7 +798,7 @@ func GetRules() (map[string]FirewallRules, error) {
 
 	var deviceStruct fwentry
 	deviceBytes := make([]byte, deviceStruct.Size())
-	ipBytes := make([]byte, 4)
+	ipBytes := make([]byte, net.IPv6len)
 	iter := xdpObjects.Devices.Iterate()
 
 	for iter.Next(&ipBytes, &deviceBytes) {
@@ -638,7 +838,38 @@ func GetRules() (map[string]FirewallRules, error) {
 
 	}
 
-	return result, iter.Err()
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	// Scheduled rules are only in the maps while active, so list them all with their current state
+	now := time.Now()
+	for username, fwRule := range result {
+		acls := config.GetEffectiveAcl(username)
+
+		var rules []string
+		rules = append(rules, acls.Mfa...)
+		rules = append(rules, acls.Allow...)
+		rules = append(rules, acls.Deny...)
+
+		scheduled, err := routetypes.ScheduledRules(rules)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rule := range scheduled {
+			state := "inactive"
+			if rule.Schedule.Active(now) {
+				state = "active"
+			}
+
+			fwRule.Schedules = append(fwRule.Schedules, rule.Rule+" ("+state+")")
+		}
+
+		result[username] = fwRule
+	}
+
+	return result, nil
 }
 
 func GetBPFHash() string {
@@ -648,3 +879,31 @@ func GetBPFHash() string {
 	hash := sha256.Sum256(_BpfBytes)
 	return hex.EncodeToString(hash[:])
 }
+
+// removeFlows deletes all connections started by the device with this address
+func removeFlows(address net.IP) error {
+	var (
+		key      [40]byte
+		lastSeen uint64
+		keys     [][40]byte
+	)
+
+	iter := xdpObjects.Flows.Iterate()
+	for iter.Next(&key, &lastSeen) {
+		if bytes.Equal(key[:16], address) {
+			keys = append(keys, key)
+		}
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := xdpObjects.Flows.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
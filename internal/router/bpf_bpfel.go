@@ -61,9 +61,16 @@ type bpfProgramSpecs struct {
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
 	AccountLocked            *ebpf.MapSpec `ebpf:"account_locked"`
+	DeviceStats              *ebpf.MapSpec `ebpf:"device_stats"`
 	Devices                  *ebpf.MapSpec `ebpf:"devices"`
+	DropEventSampleRate      *ebpf.MapSpec `ebpf:"drop_event_sample_rate"`
+	DropEvents               *ebpf.MapSpec `ebpf:"drop_events"`
+	Flows                    *ebpf.MapSpec `ebpf:"flows"`
 	InactivityTimeoutMinutes *ebpf.MapSpec `ebpf:"inactivity_timeout_minutes"`
 	PoliciesTable            *ebpf.MapSpec `ebpf:"policies_table"`
+	PolicySets               *ebpf.MapSpec `ebpf:"policy_sets"`
+	RuleStats                *ebpf.MapSpec `ebpf:"rule_stats"`
+	UserInactivityTimeout    *ebpf.MapSpec `ebpf:"user_inactivity_timeout"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -86,17 +93,31 @@ func (o *bpfObjects) Close() error {
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
 	AccountLocked            *ebpf.Map `ebpf:"account_locked"`
+	DeviceStats              *ebpf.Map `ebpf:"device_stats"`
 	Devices                  *ebpf.Map `ebpf:"devices"`
+	DropEventSampleRate      *ebpf.Map `ebpf:"drop_event_sample_rate"`
+	DropEvents               *ebpf.Map `ebpf:"drop_events"`
+	Flows                    *ebpf.Map `ebpf:"flows"`
 	InactivityTimeoutMinutes *ebpf.Map `ebpf:"inactivity_timeout_minutes"`
 	PoliciesTable            *ebpf.Map `ebpf:"policies_table"`
+	PolicySets               *ebpf.Map `ebpf:"policy_sets"`
+	RuleStats                *ebpf.Map `ebpf:"rule_stats"`
+	UserInactivityTimeout    *ebpf.Map `ebpf:"user_inactivity_timeout"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.AccountLocked,
+		m.DeviceStats,
 		m.Devices,
+		m.DropEventSampleRate,
+		m.DropEvents,
+		m.Flows,
 		m.InactivityTimeoutMinutes,
 		m.PoliciesTable,
+		m.PolicySets,
+		m.RuleStats,
+		m.UserInactivityTimeout,
 	)
 }
 
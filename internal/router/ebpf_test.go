@@ -3,11 +3,13 @@ package router
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"net/netip"
 	"strings"
 	"testing"
 	"time"
@@ -17,6 +19,7 @@ import (
 	"github.com/NHAS/wag/internal/routetypes"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
 	"golang.org/x/net/ipv4"
 )
 
@@ -495,7 +498,7 @@ func TestSlidingWindow(t *testing.T) {
 	}
 
 	var beforeDevice fwentry
-	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To16())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -526,7 +529,7 @@ func TestSlidingWindow(t *testing.T) {
 	}
 
 	var afterDevice fwentry
-	deviceBytes, err = xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	deviceBytes, err = xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To16())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -812,7 +815,7 @@ func TestDisablingMaxLifetime(t *testing.T) {
 	}
 
 	var maxSessionLifeDevice fwentry
-	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To16())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -914,14 +917,31 @@ func (p *pkthdr) Udp() []byte {
 	return r
 }
 
+func (p *pkthdr) UnpackSctp(b []byte) {
+	p.pktType = "SCTP"
+	p.src = binary.BigEndian.Uint16(b)
+	p.dst = binary.BigEndian.Uint16(b[2:])
+}
+
+func (p *pkthdr) Sctp() []byte {
+	r := make([]byte, 13) // 1 byte over as we need to fake some data
+
+	binary.BigEndian.PutUint16(r, p.src)
+	binary.BigEndian.PutUint16(r[2:], p.dst)
+
+	return r
+}
+
 func (p *pkthdr) UnpackIcmp(b []byte) {
 	p.pktType = "ICMP"
+	p.dst = binary.BigEndian.Uint16(b)
 }
 
 func (p *pkthdr) Icmp() []byte {
 	r := make([]byte, 9) // 1 byte over as we need to fake some data
 
-	//icmp isnt parsed, other than proto and length
+	// The "port" is the type and code, see routetypes.ICMPPort
+	binary.BigEndian.PutUint16(r, p.dst)
 
 	return r
 }
@@ -943,20 +963,43 @@ func (p *pkthdr) Any() []byte {
 	return r
 }
 
+func createIPv6Header(src, dst net.IP, proto int) []byte {
+	// ipv6 has no marshaller in x/net, so build the fixed 40 byte header by hand
+	r := make([]byte, 40)
+	r[0] = 6 << 4
+	r[6] = byte(proto)
+	r[7] = 64
+
+	copy(r[8:24], src.To16())
+	copy(r[24:40], dst.To16())
+
+	return r
+}
+
 func createPacket(src, dst net.IP, proto, port int) []byte {
-	iphdr := ipv4.Header{
-		Version:  4,
-		Dst:      dst,
-		Src:      src,
-		Len:      ipv4.HeaderLen,
-		Protocol: proto,
-	}
+	return createPacketWithPorts(src, dst, proto, 3884, port)
+}
+
+func createPacketWithPorts(src, dst net.IP, proto, srcPort, dstPort int) []byte {
+
+	var hdrbytes []byte
+	if src.To4() == nil {
+		hdrbytes = createIPv6Header(src, dst, proto)
+	} else {
+		iphdr := ipv4.Header{
+			Version:  4,
+			Dst:      dst,
+			Src:      src,
+			Len:      ipv4.HeaderLen,
+			Protocol: proto,
+		}
 
-	hdrbytes, _ := iphdr.Marshal()
+		hdrbytes, _ = iphdr.Marshal()
+	}
 
 	pkt := pkthdr{
-		src: 3884,
-		dst: uint16(port),
+		src: uint16(srcPort),
+		dst: uint16(dstPort),
 	}
 
 	switch proto {
@@ -965,7 +1008,10 @@ func createPacket(src, dst net.IP, proto, port int) []byte {
 	case routetypes.TCP:
 		hdrbytes = append(hdrbytes, pkt.Tcp()...)
 
-	case routetypes.ICMP:
+	case routetypes.SCTP:
+		hdrbytes = append(hdrbytes, pkt.Sctp()...)
+
+	case routetypes.ICMP, routetypes.ICMPv6:
 		hdrbytes = append(hdrbytes, pkt.Icmp()...)
 
 	default:
@@ -1024,7 +1070,7 @@ func TestPortRestrictions(t *testing.T) {
 			}
 
 			// Add matching/passing packet
-			packets = append(packets, createPacket(net.ParseIP(out[0].Address), net.IP(rule.Keys[0].IP[:]), int(successProto), int(policy.LowerPort)))
+			packets = append(packets, createPacket(net.ParseIP(out[0].Address), rule.Keys[0].AsIP(), int(successProto), int(policy.LowerPort)))
 			expectedResults = append(expectedResults, XDP_PASS)
 
 			if policy.Proto == routetypes.ANY && policy.LowerPort == routetypes.ANY && policy.Is(routetypes.SINGLE) {
@@ -1049,14 +1095,14 @@ func TestPortRestrictions(t *testing.T) {
 				flip = !flip
 			}
 
-			packets = append(packets, createPacket(net.ParseIP(out[0].Address), net.IP(rule.Keys[0].IP[:]), proto, port))
+			packets = append(packets, createPacket(net.ParseIP(out[0].Address), rule.Keys[0].AsIP(), proto, port))
 			expectedResults = append(expectedResults, XDP_DROP)
 
 			var bogusDstIp net.IP = net.ParseIP("1.1.1.1").To4()
 
 			binary.LittleEndian.PutUint32(bogusDstIp, rand.Uint32())
 
-			if net.IP.Equal(bogusDstIp, net.IP(rule.Keys[0].IP[:])) {
+			if net.IP.Equal(bogusDstIp, rule.Keys[0].AsIP()) {
 				continue
 			}
 
@@ -1111,151 +1157,1226 @@ func TestPortRestrictions(t *testing.T) {
 
 }
 
-func TestAgnosticRuleOrdering(t *testing.T) {
-	if err := setup("../config/test_port_based_rules.json"); err != nil {
+func TestProtocolRules(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
 		t.Fatal(err)
 	}
 	defer xdpObjects.Close()
 
-	out, err := addDevices()
+	const (
+		username = "protocoltester"
+		address  = "192.168.1.50"
+		address6 = "fd00::50"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var packets [][]byte
-
-	for _, user := range out {
-		acl := config.GetEffectiveAcl(user.Username)
+	err = AddUser(username, config.Acl{
+		Allow: []string{
+			"7.7.7.7 22/sctp 100-200/sctp",
+			"7.7.7.8 proto/47",
+			"7.7.7.9 icmp/8",
+			"7.7.7.10 icmp/3/4",
+			"7.7.7.11 1-100/any",
+			"7.7.7.12 esp",
+			"fd00:9::1 icmpv6/128",
+			"fd00:9::2 proto/58",
+			"fd00:9::3 icmpv6/1 icmp/3",
+			"fd00:9::4 icmp",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow, nil)
-		if err != nil {
+	for _, device := range []string{address, address6} {
+		if err := xdpAddDevice(username, device); err != nil {
 			t.Fatal(err)
 		}
+	}
 
-		// Populate expected
-		for _, rule := range rules {
+	src, src6 := net.ParseIP(address), net.ParseIP(address6)
 
-			for _, policy := range rule.Values {
-				if policy.Is(routetypes.STOP) {
-					break
-				}
+	echo, echoReply := int(routetypes.ICMPPort(8, 0)), int(routetypes.ICMPPort(0, 0))
 
-				// If we've got an any single port rule e.g 55/any, make sure that the proto is something that has ports otherwise the test fails
-				successProto := policy.Proto
-				if policy.Proto == routetypes.ANY && policy.LowerPort != routetypes.ANY {
-					successProto = routetypes.UDP
-				}
+	tests := []struct {
+		packet   []byte
+		expected uint32
+	}{
+		{createPacket(src, net.ParseIP("7.7.7.7"), routetypes.SCTP, 22), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.7"), routetypes.SCTP, 150), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.7"), routetypes.SCTP, 23), XDP_DROP},
+		{createPacket(src, net.ParseIP("7.7.7.7"), routetypes.TCP, 22), XDP_DROP},
 
-				// Add matching/passing packet
-				packets = append(packets, createPacket(net.ParseIP(user.Address), net.IP(rule.Keys[0].IP[:]), int(successProto), int(policy.LowerPort)))
-			}
+		{createPacket(src, net.ParseIP("7.7.7.8"), routetypes.GRE, 0), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.8"), routetypes.ESP, 0), XDP_DROP},
+		{createPacket(src, net.ParseIP("7.7.7.12"), routetypes.ESP, 0), XDP_PASS},
+
+		{createPacket(src, net.ParseIP("7.7.7.9"), routetypes.ICMP, echo), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.9"), routetypes.ICMP, int(routetypes.ICMPPort(8, 1))), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.9"), routetypes.ICMP, echoReply), XDP_DROP},
+		{createPacket(src, net.ParseIP("7.7.7.9"), routetypes.ICMP, int(routetypes.ICMPPort(13, 0))), XDP_DROP},
+		// Replies towards the device are matched as the request they answer
+		{createPacket(net.ParseIP("7.7.7.9"), src, routetypes.ICMP, echoReply), XDP_PASS},
+		{createPacket(net.ParseIP("7.7.7.9"), src, routetypes.ICMP, int(routetypes.ICMPPort(14, 0))), XDP_DROP},
+
+		{createPacket(src, net.ParseIP("7.7.7.10"), routetypes.ICMP, int(routetypes.ICMPPort(3, 4))), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.10"), routetypes.ICMP, int(routetypes.ICMPPort(3, 1))), XDP_DROP},
+
+		// Port ranges for any protocol do not match icmp types and codes
+		{createPacket(src, net.ParseIP("7.7.7.11"), routetypes.SCTP, 50), XDP_PASS},
+		{createPacket(src, net.ParseIP("7.7.7.11"), routetypes.ICMP, int(routetypes.ICMPPort(0, 50))), XDP_DROP},
+
+		// icmpv6 keeps its own protocol and type numbers
+		{createPacket(src6, net.ParseIP("fd00:9::1"), routetypes.ICMPv6, int(routetypes.ICMPPort(128, 0))), XDP_PASS},
+		{createPacket(src6, net.ParseIP("fd00:9::1"), routetypes.ICMPv6, int(routetypes.ICMPPort(129, 0))), XDP_DROP},
+		{createPacket(net.ParseIP("fd00:9::1"), src6, routetypes.ICMPv6, int(routetypes.ICMPPort(129, 0))), XDP_PASS},
+		{createPacket(src6, net.ParseIP("fd00:9::1"), routetypes.ICMPv6, echo), XDP_DROP},
+
+		{createPacket(src6, net.ParseIP("fd00:9::2"), routetypes.ICMPv6, int(routetypes.ICMPPort(135, 0))), XDP_PASS},
+		{createPacket(src6, net.ParseIP("fd00:9::2"), routetypes.ICMP, echo), XDP_DROP},
+
+		// Destination unreachable is type 1 in icmpv6, type 3 in icmpv6 is time exceeded
+		{createPacket(src6, net.ParseIP("fd00:9::3"), routetypes.ICMPv6, int(routetypes.ICMPPort(1, 3))), XDP_PASS},
+		{createPacket(src6, net.ParseIP("fd00:9::3"), routetypes.ICMPv6, int(routetypes.ICMPPort(3, 0))), XDP_DROP},
+
+		{createPacket(src6, net.ParseIP("fd00:9::4"), routetypes.ICMPv6, int(routetypes.ICMPPort(128, 0))), XDP_DROP},
+	}
+
+	for i, test := range tests {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(test.packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("packet %d did not match expected result %s got %s", i, result(test.expected), result(value))
 		}
+	}
+}
 
+func TestOutboundRules(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
 	}
-	// We check that for both users, that they all pass. This effectively enables us to check that reordered rules are equal
-	for i := range packets {
+	defer xdpObjects.Close()
 
-		packet := packets[i]
+	const (
+		username = "outboundtester"
+		address  = "192.168.1.60"
+	)
 
-		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Allow: []string{"7.7.7.7 53/udp outbound", "7.7.7.8 53/udp"},
+		Mfa:   []string{"7.7.7.9 outbound"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpAddDevice(username, address); err != nil {
+		t.Fatal(err)
+	}
+
+	device := net.ParseIP(address)
+
+	tests := []struct {
+		packet   []byte
+		expected uint32
+	}{
+		// The server cannot start a connection
+		{createPacketWithPorts(net.ParseIP("7.7.7.7"), device, routetypes.UDP, 53, 4000), XDP_DROP},
+		{createPacketWithPorts(device, net.ParseIP("7.7.7.7"), routetypes.UDP, 4000, 53), XDP_PASS},
+		// But can reply to one the device started
+		{createPacketWithPorts(net.ParseIP("7.7.7.7"), device, routetypes.UDP, 53, 4000), XDP_PASS},
+		{createPacketWithPorts(net.ParseIP("7.7.7.7"), device, routetypes.UDP, 53, 4001), XDP_DROP},
+		{createPacketWithPorts(device, net.ParseIP("7.7.7.7"), routetypes.TCP, 4000, 53), XDP_DROP},
+
+		// Bidirectional is unchanged
+		{createPacketWithPorts(net.ParseIP("7.7.7.8"), device, routetypes.UDP, 53, 5000), XDP_PASS},
+
+		// Flows are not started unless the packet was allowed
+		{createPacketWithPorts(device, net.ParseIP("7.7.7.9"), routetypes.TCP, 4000, 22), XDP_DROP},
+		{createPacketWithPorts(net.ParseIP("7.7.7.9"), device, routetypes.TCP, 22, 4000), XDP_DROP},
+	}
+
+	for i, test := range tests {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(test.packet)
 		if err != nil {
 			t.Fatalf("program failed %s", err)
 		}
 
-		var iphdr ipv4.Header
-		err = iphdr.Parse(packet)
+		if value != test.expected {
+			t.Fatalf("packet %d did not match expected result %s got %s", i, result(test.expected), result(value))
+		}
+	}
+
+	err = SetAuthorized(address, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		packet   []byte
+		expected uint32
+	}{
+		{createPacketWithPorts(net.ParseIP("7.7.7.9"), device, routetypes.TCP, 22, 4000), XDP_DROP},
+		{createPacketWithPorts(device, net.ParseIP("7.7.7.9"), routetypes.TCP, 4000, 22), XDP_PASS},
+		{createPacketWithPorts(net.ParseIP("7.7.7.9"), device, routetypes.TCP, 22, 4000), XDP_PASS},
+	} {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(test.packet)
 		if err != nil {
-			t.Fatal("packet didnt parse as an IP header: ", err)
+			t.Fatalf("program failed %s", err)
 		}
-		packet = packet[20:]
 
-		var pkt pkthdr
-		pkt.pktType = "unknown"
+		if value != test.expected {
+			t.Fatalf("authorised packet %d did not match expected result %s got %s", i, result(test.expected), result(value))
+		}
+	}
 
-		switch iphdr.Protocol {
-		case routetypes.UDP:
-			pkt.UnpackUdp(packet)
-		case routetypes.TCP:
-			pkt.UnpackTcp(packet)
-		case routetypes.ICMP:
-			pkt.UnpackIcmp(packet)
-		case routetypes.ANY:
-			pkt.UnpackAny(packet)
+	if err := xdpRemoveDevice(address); err != nil {
+		t.Fatal(err)
+	}
 
+	var (
+		key      [40]byte
+		lastSeen uint64
+	)
+	iter := xdpObjects.Flows.Iterate()
+	for iter.Next(&key, &lastSeen) {
+		if net.IP(key[:16]).Equal(device) {
+			t.Fatal("flows were not removed with the device")
 		}
-		t.Log(iphdr.Src.String(), " -> ", iphdr.Dst.String(), ", proto "+pkt.String())
+	}
+}
 
-		if value != XDP_PASS {
+func TestStepUpRules(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
 
-			t.Fatalf("program did not XDP_PASS packet instead did: %s", result(value))
+	const (
+		username = "stepuptester"
+		address  = "192.168.1.61"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Mfa: []string{"7.7.8.1", "7.7.8.1 22/tcp stepup"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpAddDevice(username, address); err != nil {
+		t.Fatal(err)
+	}
+
+	device := net.ParseIP(address)
+	ssh := createPacket(device, net.ParseIP("7.7.8.1"), routetypes.TCP, 22)
+	web := createPacket(device, net.ParseIP("7.7.8.1"), routetypes.TCP, 443)
+
+	expect := func(what string, packet []byte, expected uint32) {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expected {
+			t.Fatalf("%s: expected %s got %s", what, result(expected), result(value))
 		}
 	}
+
+	expect("unauthorised step up", ssh, XDP_DROP)
+
+	if err := SetAuthorized(address, username); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsSteppedUp(address) {
+		t.Fatal("device should be stepped up straight after authorising")
+	}
+
+	expect("fresh mfa step up", ssh, XDP_PASS)
+	expect("fresh mfa", web, XDP_PASS)
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(device.To16())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deviceStruct fwentry
+	if err := deviceStruct.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	// The step up window has passed, but the session has not
+	deviceStruct.stepUpExpiry = GetTimeStamp() - 1
+	if err := xdpObjects.Devices.Update(device.To16(), deviceStruct.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(address) || IsSteppedUp(address) {
+		t.Fatal("device should be authorised but no longer stepped up")
+	}
+
+	expect("old mfa step up", ssh, XDP_DROP)
+	expect("old mfa", web, XDP_PASS)
+
+	// A devices own inactivity timeout is used instead of the global one
+	deviceStruct.inactivityTimeout = 1
+	deviceStruct.stepUpExpiry = math.MaxUint64
+	if err := xdpObjects.Devices.Update(device.To16(), deviceStruct.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	expect("device timed out", web, XDP_DROP)
+
+	if IsAuthed(address) {
+		t.Fatal("device should have timed out with its own inactivity timeout")
+	}
 }
 
-func TestLookupDifferentKeyTypesInMap(t *testing.T) {
-	if err := setup("../config/test_port_based_rules.json"); err != nil {
+func TestUserInactivityTimeout(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
 		t.Fatal(err)
 	}
 	defer xdpObjects.Close()
 
-	out, err := addDevices()
+	const (
+		username = "contractor"
+		address  = "192.168.1.62"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	userPublicRoutes, err := getInnerMap(out[0].Username, xdpObjects.PoliciesTable)
+	err = AddUser(username, config.Acl{
+		Mfa:                             []string{"7.7.9.1"},
+		SessionInactivityTimeoutMinutes: 30,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Check negative case
-	err = userPublicRoutes.Lookup([]byte("3470239uy4skljhd"), nil)
-	if err == nil {
-		t.Fatal("searched garbage string, should not match")
+	userid := sha1.Sum([]byte(username))
+
+	var timeout uint64
+	if err := xdpObjects.UserInactivityTimeout.Lookup(userid, &timeout); err != nil {
+		t.Fatal(err)
 	}
 
-	/*
-	   "Allow": [
-	       "1.1.0.0/16",
-	       "2.2.2.2",
-	       "3.3.3.3 33/tcp",
-	       "4.4.4.4 43/udp",
-	       "5.5.5.5 55/any",
-	       "6.6.6.6 100-150/tcp"
-	   ]
-	*/
+	if timeout != 30*60000000000 {
+		t.Fatalf("user inactivity timeout was not set from their policy, was %d", timeout)
+	}
 
-	k := routetypes.Key{
-		IP:        [4]byte{1, 1, 1, 1},
-		Prefixlen: 32,
+	if err := xdpAddDevice(username, address); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAuthorized(address, username); err != nil {
+		t.Fatal(err)
+	}
+
+	packet := createPacket(net.ParseIP(address), net.ParseIP("7.7.9.1"), routetypes.TCP, 443)
+
+	expect := func(what string, expected uint32) {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expected {
+			t.Fatalf("%s: expected %s got %s", what, result(expected), result(value))
+		}
+	}
+
+	expect("within users timeout", XDP_PASS)
+
+	// The global timeout is disabled in this config, so only the users own timeout can time the device out
+	if err := xdpObjects.UserInactivityTimeout.Put(userid, uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	expect("past users timeout", XDP_DROP)
+
+	if IsAuthed(address) {
+		t.Fatal("device should have timed out with the users inactivity timeout")
 	}
 
-	var policies [routetypes.MAX_POLICIES]routetypes.Policy
-	err = userPublicRoutes.Lookup(k.Bytes(), &policies)
+	// The device class timeout is used when it is shorter than the users
+	if err := SetAuthorized(address, username); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpObjects.UserInactivityTimeout.Put(userid, uint64(math.MaxUint64)); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(address).To16())
 	if err != nil {
-		t.Fatal("searched for valid subnet")
+		t.Fatal(err)
 	}
 
-	if !policies[0].Is(routetypes.SINGLE) {
-		t.Fatal("the route type was not single: ", policies[0])
+	var deviceStruct fwentry
+	if err := deviceStruct.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
 	}
 
-	if policies[0].LowerPort != 0 || policies[0].Proto != 0 {
-		t.Fatal("policy was not marked as allow all despite having no rules defined")
+	deviceStruct.inactivityTimeout = 1
+	if err := xdpObjects.Devices.Update(net.ParseIP(address).To16(), deviceStruct.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
 	}
 
-	if !policies[1].Is(routetypes.STOP) {
-		t.Fatal("policy should only contain one any/any rule")
+	expect("past device class timeout", XDP_DROP)
+
+	if err := RemoveUser(username); err != nil {
+		t.Fatal(err)
 	}
 
-	k = routetypes.Key{
-		IP:        [4]byte{3, 3, 3, 3},
-		Prefixlen: 32,
+	if err := xdpObjects.UserInactivityTimeout.Lookup(userid, &timeout); err == nil {
+		t.Fatal("user inactivity timeout was not removed with the user")
+	}
+}
+
+func TestForcedReauthentication(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
 	}
+	defer xdpObjects.Close()
 
-	err = userPublicRoutes.Lookup(k.Bytes(), &policies)
+	out, err := addDevices()
 	if err != nil {
-		t.Fatal("searched for ip failed")
+		t.Fatal(err)
+	}
+
+	for _, device := range out {
+		err = SetAuthorized(device.Address, device.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deauthenticated, err := DeauthenticateUsers([]string{out[0].Username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deauthenticated) != 1 || deauthenticated[0] != out[0].Address {
+		t.Fatalf("expected only %s to be deauthenticated, got %v", out[0].Address, deauthenticated)
+	}
+
+	if IsAuthed(out[0].Address) {
+		t.Fatal("device should have to authorise again")
+	}
+
+	if !IsAuthed(out[1].Address) {
+		t.Fatal("other users devices should not have been touched")
+	}
+
+	deauthenticated, err = DeauthenticateAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first device no longer had a session so isnt reported again
+	if len(deauthenticated) != 1 || deauthenticated[0] != out[1].Address {
+		t.Fatalf("expected only %s to be deauthenticated, got %v", out[1].Address, deauthenticated)
+	}
+
+	for _, device := range out {
+		if IsAuthed(device.Address) {
+			t.Fatal(device.Address, "should have to authorise again")
+		}
+	}
+}
+
+func TestAgnosticRuleOrdering(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets [][]byte
+
+	for _, user := range out {
+		acl := config.GetEffectiveAcl(user.Username)
+
+		rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Populate expected
+		for _, rule := range rules {
+
+			for _, policy := range rule.Values {
+				if policy.Is(routetypes.STOP) {
+					break
+				}
+
+				// If we've got an any single port rule e.g 55/any, make sure that the proto is something that has ports otherwise the test fails
+				successProto := policy.Proto
+				if policy.Proto == routetypes.ANY && policy.LowerPort != routetypes.ANY {
+					successProto = routetypes.UDP
+				}
+
+				// Add matching/passing packet
+				packets = append(packets, createPacket(net.ParseIP(user.Address), rule.Keys[0].AsIP(), int(successProto), int(policy.LowerPort)))
+			}
+		}
+
+	}
+	// We check that for both users, that they all pass. This effectively enables us to check that reordered rules are equal
+	for i := range packets {
+
+		packet := packets[i]
+
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		var iphdr ipv4.Header
+		err = iphdr.Parse(packet)
+		if err != nil {
+			t.Fatal("packet didnt parse as an IP header: ", err)
+		}
+		packet = packet[20:]
+
+		var pkt pkthdr
+		pkt.pktType = "unknown"
+
+		switch iphdr.Protocol {
+		case routetypes.UDP:
+			pkt.UnpackUdp(packet)
+		case routetypes.TCP:
+			pkt.UnpackTcp(packet)
+		case routetypes.ICMP:
+			pkt.UnpackIcmp(packet)
+		case routetypes.ANY:
+			pkt.UnpackAny(packet)
+
+		}
+		t.Log(iphdr.Src.String(), " -> ", iphdr.Dst.String(), ", proto "+pkt.String())
+
+		if value != XDP_PASS {
+
+			t.Fatalf("program did not XDP_PASS packet instead did: %s", result(value))
+		}
+	}
+}
+
+func TestIPv6Rules(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	const (
+		username = "ipv6tester"
+		address  = "fd00::2"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Allow: []string{"fd00:1::/64 443/tcp", "fd00:3::1"},
+		Mfa:   []string{"fd00:2::/48"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = xdpAddDevice(username, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := net.ParseIP(address)
+
+	packets := [][]byte{
+		createPacket(src, net.ParseIP("fd00:1::5"), routetypes.TCP, 443),
+		createPacket(src, net.ParseIP("fd00:1::5"), routetypes.TCP, 80),
+		createPacket(src, net.ParseIP("fd00:1::5"), routetypes.UDP, 443),
+		createPacket(src, net.ParseIP("fd00:3::1"), routetypes.UDP, 53),
+		createPacket(src, net.ParseIP("fd00:3::2"), routetypes.UDP, 53),
+		createPacket(src, net.ParseIP("fd00:2::1"), routetypes.TCP, 22),
+		createPacket(src, net.ParseIP("fd01::1"), routetypes.TCP, 443),
+	}
+
+	expectedResults := []uint32{
+		XDP_PASS,
+		XDP_DROP,
+		XDP_DROP,
+		XDP_PASS,
+		XDP_DROP,
+		XDP_DROP,
+		XDP_DROP,
+	}
+
+	for i := range packets {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packets[i])
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expectedResults[i] {
+			t.Fatalf("packet %d did not match expected result %s got %s", i, result(expectedResults[i]), result(value))
+		}
+	}
+
+	err = SetAuthorized(address, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(address) {
+		t.Fatal("after setting ipv6 device as authorized it should be authorized")
+	}
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(src, net.ParseIP("fd00:2::1"), routetypes.TCP, 22))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatalf("authorized ipv6 device could not reach mfa route, got %s", result(value))
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	const (
+		username = "statstester"
+		address  = "192.168.1.20"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Allow: []string{"10.10.0.0/16 443/tcp", "10.10.1.1 22/tcp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = xdpAddDevice(username, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := net.ParseIP(address)
+
+	allowed := createPacket(src, net.ParseIP("10.10.5.5"), routetypes.TCP, 443)
+	dropped := createPacket(src, net.ParseIP("10.10.1.1"), routetypes.TCP, 80)
+	noRoute := createPacket(src, net.ParseIP("11.11.11.11"), routetypes.TCP, 443)
+
+	packets := [][]byte{allowed, allowed, dropped, noRoute}
+	for i := range packets {
+		_, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packets[i])
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+	}
+
+	stats, err := GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var device *DeviceStats
+	for i := range stats.Devices {
+		if stats.Devices[i].Address == address {
+			device = &stats.Devices[i]
+		}
+	}
+
+	if device == nil {
+		t.Fatal("device was not in stats")
+	}
+
+	if device.Username != username {
+		t.Fatal("device stats had wrong username: ", device.Username)
+	}
+
+	if device.AllowedPackets != 2 || device.AllowedBytes != uint64(2*len(allowed)) {
+		t.Fatalf("allowed counters were incorrect: %+v", device.TrafficCounters)
+	}
+
+	if device.DroppedPackets != 2 || device.DroppedBytes != uint64(len(dropped)+len(noRoute)) {
+		t.Fatalf("dropped counters were incorrect: %+v", device.TrafficCounters)
+	}
+
+	rules := map[string]TrafficCounters{}
+	for _, rule := range stats.Rules {
+		if rule.Username == username {
+			rules[rule.Route] = rule.TrafficCounters
+		}
+	}
+
+	if len(rules) != 2 {
+		t.Fatalf("expected traffic on 2 rules (no route packets are not attributed) got: %+v", rules)
+	}
+
+	if rules["10.10.0.0/16"].AllowedPackets != 2 || rules["10.10.0.0/16"].DroppedPackets != 0 {
+		t.Fatalf("10.10.0.0/16 counters were incorrect: %+v", rules["10.10.0.0/16"])
+	}
+
+	if rules["10.10.1.1/32"].AllowedPackets != 0 || rules["10.10.1.1/32"].DroppedPackets != 1 {
+		t.Fatalf("10.10.1.1/32 counters were incorrect: %+v", rules["10.10.1.1/32"])
+	}
+}
+
+func TestDropEvents(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	const (
+		username = "eventstester"
+		address  = "192.168.1.21"
+	)
+
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Allow: []string{"10.20.0.0/16 443/tcp", "10.20.1.1 22/tcp"},
+		Mfa:   []string{"10.30.0.0/16"},
+		Deny:  []string{"10.20.2.2 443/tcp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = xdpAddDevice(username, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ringbuf.NewReader(xdpObjects.DropEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	src := net.ParseIP(address)
+
+	expected := []struct {
+		packet   []byte
+		reason   string
+		username string
+	}{
+		{createPacket(src, net.ParseIP("10.20.1.1"), routetypes.TCP, 80), "no matching policy", username},
+		{createPacket(src, net.ParseIP("11.11.11.11"), routetypes.TCP, 443), "no matching route", username},
+		{createPacket(src, net.ParseIP("10.20.2.2"), routetypes.TCP, 443), "deny rule", username},
+		{createPacket(src, net.ParseIP("10.30.0.1"), routetypes.UDP, 53), "mfa required", username},
+		{createPacket(net.ParseIP("192.168.99.99"), net.ParseIP("10.20.5.5"), routetypes.TCP, 443), "no device", ""},
+	}
+
+	// Allowed traffic must not produce an event
+	_, _, err = xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(src, net.ParseIP("10.20.5.5"), routetypes.TCP, 443))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	for i := range expected {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(expected[i].packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if result(value) != "XDP_DROP" {
+			t.Fatalf("expected packet %d to be dropped got %s", i, result(value))
+		}
+
+		reader.SetDeadline(time.Now().Add(time.Second))
+		record, err := reader.Read()
+		if err != nil {
+			t.Fatalf("did not get drop event for packet %d: %s", i, err)
+		}
+
+		event, err := parseDropEvent(record.RawSample)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Reason != expected[i].reason {
+			t.Fatalf("packet %d expected reason %q got %q (%+v)", i, expected[i].reason, event.Reason, event)
+		}
+
+		if event.Username != expected[i].username {
+			t.Fatalf("packet %d expected username %q got %q", i, expected[i].username, event.Username)
+		}
+	}
+
+	// Disabling sampling stops events entirely
+	err = xdpObjects.DropEventSampleRate.Put(uint32(0), uint32(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = xdpObjects.bpfPrograms.XdpWagFirewall.Test(expected[0].packet)
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	reader.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := reader.Read(); err == nil {
+		t.Fatal("got drop event when sampling was disabled")
+	}
+}
+
+func TestDropEventUsernames(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	// Not in the database, names come from the users added to the firewall
+	const username = "eventsnamer"
+	userid := sha1.Sum([]byte(username))
+
+	if err := AddUser(username, config.Acl{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := usernameFromID(userid); got != username {
+		t.Fatalf("expected %q got %q", username, got)
+	}
+
+	if err := RemoveUser(username); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := usernameFromID(userid); got != hex.EncodeToString(userid[:]) {
+		t.Fatalf("removed user should be shown by id, got %q", got)
+	}
+}
+
+func TestSimulatorMatchesXDP(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	const username = "simtester"
+
+	_, err := data.CreateUserDataAccount(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddUser(username, config.Acl{
+		Allow: []string{"10.40.0.0/16 443/tcp 53/udp", "10.40.1.1 22/tcp", "10.40.3.0/24", "fd00:40::/64 443/tcp", "10.40.6.6 53/udp outbound", "10.40.7.7 123/udp sport/123", "10.40.8.8 outbound", "fd00:40::8 icmpv6/128 outbound"},
+		Mfa:   []string{"10.41.0.0/16", "10.40.3.3 8080/tcp", "10.40.3.3 8443/tcp stepup", "fd00:41::1"},
+		Deny:  []string{"10.40.2.2 443/tcp", "10.40.3.4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorised, unauthorised, expired := "192.168.1.30", "192.168.1.31", "fd00::31"
+	for _, address := range []string{authorised, unauthorised, expired} {
+		if err := xdpAddDevice(username, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := SetAuthorized(authorised, username); err != nil {
+		t.Fatal(err)
+	}
+
+	expiredDevice := fwentry{
+		sessionExpiry:  1,
+		lastPacketTime: GetTimeStamp(),
+		user_id:        sha1.Sum([]byte(username)),
+	}
+	if err := xdpObjects.Devices.Update(net.ParseIP(expired).To16(), expiredDevice.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := ringbuf.NewReader(xdpObjects.DropEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// port is the destinations, sport the devices, inbound packets are sent from the destination to the device
+	type probe struct {
+		dst     string
+		proto   int
+		port    int
+		sport   int
+		inbound bool
+	}
+
+	probes := []probe{
+		{"10.40.5.5", routetypes.TCP, 443, 3884, false},
+		{"10.40.5.5", routetypes.TCP, 80, 3884, false},
+		{"10.40.5.5", routetypes.UDP, 53, 3884, false},
+		{"10.40.1.1", routetypes.TCP, 22, 3884, false},
+		{"10.40.1.1", routetypes.TCP, 443, 3884, false},
+		{"10.40.2.2", routetypes.TCP, 443, 3884, false},
+		{"10.40.3.1", routetypes.UDP, 9999, 3884, false},
+		{"10.40.3.3", routetypes.TCP, 8080, 3884, false},
+		{"10.40.3.3", routetypes.TCP, 8081, 3884, false},
+		{"10.40.3.3", routetypes.TCP, 8443, 3884, false},
+		{"10.40.3.4", routetypes.ICMP, 0, 3884, false},
+		{"10.41.9.9", routetypes.ICMP, 0, 3884, false},
+		{"10.41.9.9", routetypes.TCP, 3389, 3884, false},
+		{"11.11.11.11", routetypes.TCP, 443, 3884, false},
+		{"fd00:40::5", routetypes.TCP, 443, 3884, false},
+		{"fd00:40::5", routetypes.UDP, 443, 3884, false},
+		{"fd00:41::1", routetypes.TCP, 22, 3884, false},
+		{"fd00:42::1", routetypes.TCP, 22, 3884, false},
+		// Outbound only, the first inbound packet is not part of a flow the devices started, the second is as it follows an allowed outbound packet
+		{"10.40.6.6", routetypes.UDP, 53, 4000, true},
+		{"10.40.6.6", routetypes.UDP, 53, 4000, false},
+		{"10.40.6.6", routetypes.UDP, 53, 4000, true},
+		{"10.40.6.6", routetypes.UDP, 53, 4001, true},
+		{"10.40.6.6", routetypes.TCP, 53, 4000, true},
+		{"10.40.8.8", routetypes.ICMP, int(routetypes.ICMPPort(0, 0)), 0, true},
+		{"10.40.8.8", routetypes.ICMP, int(routetypes.ICMPPort(8, 0)), 0, false},
+		{"10.40.8.8", routetypes.ICMP, int(routetypes.ICMPPort(0, 0)), 0, true},
+		{"fd00:40::8", routetypes.ICMPv6, int(routetypes.ICMPPort(129, 0)), 0, true},
+		{"fd00:40::8", routetypes.ICMPv6, int(routetypes.ICMPPort(128, 0)), 0, false},
+		{"fd00:40::8", routetypes.ICMPv6, int(routetypes.ICMPPort(129, 0)), 0, true},
+		{"fd00:40::8", routetypes.ICMPv6, int(routetypes.ICMPPort(1, 0)), 0, false},
+		{"fd00:40::8", routetypes.ICMP, int(routetypes.ICMPPort(8, 0)), 0, false},
+		// Source ports
+		{"10.40.7.7", routetypes.UDP, 123, 123, false},
+		{"10.40.7.7", routetypes.UDP, 123, 3884, false},
+		{"10.40.7.7", routetypes.UDP, 123, 123, true},
+		{"10.40.7.7", routetypes.UDP, 123, 124, true},
+		// Bidirectional rules allow the destination to start connections
+		{"10.40.5.5", routetypes.TCP, 443, 3884, true},
+		{"10.41.9.9", routetypes.TCP, 3389, 5000, true},
+	}
+
+	check := func(round string) {
+		for _, device := range []string{authorised, unauthorised, expired} {
+			for _, p := range probes {
+
+				src, dst := net.ParseIP(device), net.ParseIP(p.dst)
+				if (src.To4() == nil) != (dst.To4() == nil) {
+					continue
+				}
+
+				decisions, err := Simulate(username, dst, uint16(p.proto), uint16(p.port), uint16(p.sport), p.inbound)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var decision *Decision
+				for i := range decisions {
+					if decisions[i].Device == device {
+						decision = &decisions[i]
+					}
+				}
+
+				if decision == nil {
+					t.Fatalf("%s: no decision for device %s", round, device)
+				}
+
+				packet := createPacketWithPorts(src, dst, p.proto, p.sport, p.port)
+				if p.inbound {
+					// The icmp type and code are always in the destination "port"
+					packet = createPacketWithPorts(dst, src, p.proto, p.port, p.sport)
+					if routetypes.IsICMP(uint16(p.proto)) {
+						packet = createPacketWithPorts(dst, src, p.proto, 0, p.port)
+					}
+				}
+
+				value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+				if err != nil {
+					t.Fatalf("program failed %s", err)
+				}
+
+				if (result(value) == "XDP_PASS") != decision.Allowed {
+					t.Fatalf("%s: %s -> %+v simulator said allowed=%t (%s) xdp said %s", round, device, p, decision.Allowed, decision.Verdict, result(value))
+				}
+
+				if decision.Allowed {
+					continue
+				}
+
+				reader.SetDeadline(time.Now().Add(time.Second))
+				record, err := reader.Read()
+				if err != nil {
+					t.Fatalf("%s: no drop event for %s -> %+v: %s", round, device, p, err)
+				}
+
+				event, err := parseDropEvent(record.RawSample)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if event.Reason != decision.Verdict {
+					t.Fatalf("%s: %s -> %+v simulator verdict %q xdp reason %q", round, device, p, decision.Verdict, event.Reason)
+				}
+			}
+		}
+	}
+
+	check("initial")
+
+	// Replies to traffic the device started are allowed by outbound rules, anything else from the destination is not
+	for sport, established := range map[uint16]bool{4000: true, 4001: false} {
+		decisions, err := Simulate(username, net.ParseIP("10.40.6.6"), routetypes.UDP, 53, sport, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, decision := range decisions {
+			if decision.Device != authorised {
+				continue
+			}
+
+			if decision.Established != established || decision.Allowed != established || (!established && decision.Verdict != "not started by device") {
+				t.Fatalf("inbound reply to device port %d: %+v", sport, decision)
+			}
+		}
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(authorised).To16())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var steppedDown fwentry
+	if err := steppedDown.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	steppedDown.stepUpExpiry = 0
+	if err := xdpObjects.Devices.Update(net.ParseIP(authorised).To16(), steppedDown.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	check("stepped down")
+
+	if err := xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("timed out")
+
+	if err := xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), uint64(math.MaxUint64)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpObjects.UserInactivityTimeout.Put(sha1.Sum([]byte(username)), uint64(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("user timed out")
+
+	if err := xdpObjects.UserInactivityTimeout.Put(sha1.Sum([]byte(username)), uint64(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := xdpObjects.AccountLocked.Put(sha1.Sum([]byte(username)), uint32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("locked")
+
+	decisions, err := Simulate("simtester_nodevices", net.ParseIP("10.40.5.5"), routetypes.TCP, 443, 3884, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decisions) != 1 || decisions[0].Allowed || decisions[0].Verdict != "no device" {
+		t.Fatalf("user without devices should not be allowed: %+v", decisions)
+	}
+}
+
+func TestPolicySets(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	// Enough policies on one route to span multiple chunks in xdp.c
+	var allow []string
+	for i := 0; i < 300; i++ {
+		allow = append(allow, fmt.Sprintf("10.50.0.0/16 %d/tcp", 1000+i*2))
+	}
+
+	acl := config.Acl{Allow: allow, Mfa: []string{"10.51.0.0/16"}}
+
+	for _, username := range []string{"setsharer1", "setsharer2"} {
+		_, err := data.CreateUserDataAccount(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := AddUser(username, acl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, second := userPolicySets[sha1.Sum([]byte("setsharer1"))], userPolicySets[sha1.Sum([]byte("setsharer2"))]
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("expected each user to have two policy sets: %v %v", first, second)
+	}
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal("users with identical rules should share policy sets")
+		}
+
+		if policySetRefs[first[i]] != 2 {
+			t.Fatal("shared policy set should have two references: ", policySetRefs[first[i]])
+		}
+	}
+
+	if err := xdpAddDevice("setsharer1", "192.168.1.40"); err != nil {
+		t.Fatal(err)
+	}
+
+	src := net.ParseIP("192.168.1.40")
+	for port, expected := range map[int]string{1000: "XDP_PASS", 1598: "XDP_PASS", 1599: "XDP_DROP", 1600: "XDP_DROP"} {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(src, net.ParseIP("10.50.1.1"), routetypes.TCP, port))
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if result(value) != expected {
+			t.Fatalf("port %d expected %s got %s", port, expected, result(value))
+		}
+	}
+
+	if err := RemoveUser("setsharer2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range first {
+		if policySetRefs[id] != 1 {
+			t.Fatal("removing a user should release its policy sets")
+		}
+	}
+
+	if err := RemoveUser("setsharer1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range first {
+		if _, err := lookupPolicySet(id); err == nil {
+			t.Fatal("policy set should have been removed once nothing referenced it")
+		}
+	}
+}
+
+func TestLookupDifferentKeyTypesInMap(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userPublicRoutes, err := getInnerMap(out[0].Username, xdpObjects.PoliciesTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check negative case
+	err = userPublicRoutes.Lookup([]byte("3470239uy4skljhd"), nil)
+	if err == nil {
+		t.Fatal("searched garbage string, should not match")
+	}
+
+	/*
+	   "Allow": [
+	       "1.1.0.0/16",
+	       "2.2.2.2",
+	       "3.3.3.3 33/tcp",
+	       "4.4.4.4 43/udp",
+	       "5.5.5.5 55/any",
+	       "6.6.6.6 100-150/tcp"
+	   ]
+	*/
+
+	k := routetypes.Key{
+		IP:        netip.MustParseAddr("1.1.1.1").As16(),
+		Prefixlen: 32,
+	}
+
+	var policySetID uint32
+	err = userPublicRoutes.Lookup(k.Bytes(), &policySetID)
+	if err != nil {
+		t.Fatal("searched for valid subnet")
+	}
+
+	policies, err := lookupPolicySet(policySetID)
+	if err != nil {
+		t.Fatal("route pointed to missing policy set: ", err)
+	}
+
+	if !policies[0].Is(routetypes.SINGLE) {
+		t.Fatal("the route type was not single: ", policies[0])
+	}
+
+	if policies[0].LowerPort != 0 || policies[0].Proto != 0 {
+		t.Fatal("policy was not marked as allow all despite having no rules defined")
+	}
+
+	if !policies[1].Is(routetypes.STOP) {
+		t.Fatal("policy should only contain one any/any rule")
+	}
+
+	k = routetypes.Key{
+		IP:        netip.MustParseAddr("3.3.3.3").As16(),
+		Prefixlen: 32,
+	}
+
+	err = userPublicRoutes.Lookup(k.Bytes(), &policySetID)
+	if err != nil {
+		t.Fatal("searched for ip failed")
+	}
+
+	policies, err = lookupPolicySet(policySetID)
+	if err != nil {
+		t.Fatal("route pointed to missing policy set: ", err)
 	}
 
 	if !policies[0].Is(routetypes.SINGLE) {
@@ -1347,7 +2468,7 @@ func checkLPMMap(username string, m *ebpf.Map) ([]string, error) {
 	result := []string{}
 
 	var innerKey []byte
-	var val [routetypes.MAX_POLICIES]routetypes.Policy
+	var val uint32
 	innerIter := innerMap.Iterate()
 	kv := routetypes.Key{}
 	for innerIter.Next(&innerKey, &val) {
@@ -0,0 +1,250 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+const maxRecentDropEvents = 100
+
+// Verdicts, these must match the ALLOWED and DROP_* definitions in xdp.c
+const (
+	verdictAllowed uint32 = iota
+	dropMalformed
+	dropNoDevice
+	dropUnknownUser
+	dropNoRoute
+	dropNoMatchingPolicy
+	dropDenyRule
+	dropAccountLocked
+	dropMfaRequired
+	dropTimedOut
+	dropSessionExpired
+	dropInternalError
+	dropNotEstablished
+	dropStepUpRequired
+)
+
+var verdicts = map[uint32]string{
+	verdictAllowed:       "allowed",
+	dropMalformed:        "malformed packet",
+	dropNoDevice:         "no device",
+	dropUnknownUser:      "unknown user",
+	dropNoRoute:          "no matching route",
+	dropNoMatchingPolicy: "no matching policy",
+	dropDenyRule:         "deny rule",
+	dropAccountLocked:    "account locked",
+	dropMfaRequired:      "mfa required",
+	dropTimedOut:         "session timed out",
+	dropSessionExpired:   "session expired",
+	dropInternalError:    "internal error",
+	dropNotEstablished:   "not started by device",
+	dropStepUpRequired:   "step up required",
+}
+
+func verdictString(verdict uint32) string {
+	if s, ok := verdicts[verdict]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("unknown(%d)", verdict)
+}
+
+// Mirrors struct drop_event in xdp.c
+type dropEvent struct {
+	SrcIP   [16]byte
+	DstIP   [16]byte
+	SrcPort uint16
+	DstPort uint16
+	Proto   uint32
+	Reason  uint32
+	UserID  [20]byte
+}
+
+type DropEvent struct {
+	Time            time.Time
+	Reason          string
+	Username        string
+	Source          string
+	SourcePort      uint16
+	Destination     string
+	DestinationPort uint16
+	Protocol        string
+}
+
+var (
+	eventsLock       sync.RWMutex
+	eventSubscribers = map[chan DropEvent]bool{}
+	recentDropEvents []DropEvent
+
+	dropEventsReader *ringbuf.Reader
+
+	// user ids are the sha1 of the username, this maps them back for every user added to the firewall
+	usernamesLock sync.RWMutex
+	usernames     = map[[20]byte]string{}
+)
+
+// SubscribeDropEvents returns a channel that receives every drop event read from the xdp program until cancel is called
+// Events are discarded rather than blocking if the subscriber does not keep up
+func SubscribeDropEvents() (events <-chan DropEvent, cancel func()) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	c := make(chan DropEvent, 64)
+	eventSubscribers[c] = true
+
+	return c, func() {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+
+		if eventSubscribers[c] {
+			delete(eventSubscribers, c)
+			close(c)
+		}
+	}
+}
+
+// RecentDropEvents returns the last drop events, newest first
+func RecentDropEvents() []DropEvent {
+	eventsLock.RLock()
+	defer eventsLock.RUnlock()
+
+	result := make([]DropEvent, 0, len(recentDropEvents))
+	for i := len(recentDropEvents) - 1; i >= 0; i-- {
+		result = append(result, recentDropEvents[i])
+	}
+
+	return result
+}
+
+func setDropEventSampleRate() error {
+	rate := uint32(0)
+	if config.Values().DropEventSampleRate > 0 {
+		rate = uint32(config.Values().DropEventSampleRate)
+	}
+
+	err := xdpObjects.DropEventSampleRate.Put(uint32(0), rate)
+	if err != nil {
+		return fmt.Errorf("could not set drop event sample rate: %s", err)
+	}
+
+	return nil
+}
+
+func startDropEventReader() (err error) {
+	dropEventsReader, err = ringbuf.NewReader(xdpObjects.DropEvents)
+	if err != nil {
+		return fmt.Errorf("could not open drop events ring buffer: %s", err)
+	}
+
+	go func() {
+		for {
+			record, err := dropEventsReader.Read()
+			if err != nil {
+				if errors.Is(err, ringbuf.ErrClosed) {
+					return
+				}
+
+				log.Println("unable to read drop event: ", err)
+				continue
+			}
+
+			event, err := parseDropEvent(record.RawSample)
+			if err != nil {
+				log.Println("unable to parse drop event: ", err)
+				continue
+			}
+
+			publishDropEvent(event)
+		}
+	}()
+
+	return nil
+}
+
+func parseDropEvent(raw []byte) (DropEvent, error) {
+	var e dropEvent
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &e); err != nil {
+		return DropEvent{}, err
+	}
+
+	event := DropEvent{
+		Time:            time.Now(),
+		Reason:          verdictString(e.Reason),
+		Source:          eventAddress(e.SrcIP),
+		SourcePort:      e.SrcPort,
+		Destination:     eventAddress(e.DstIP),
+		DestinationPort: e.DstPort,
+		Protocol:        routetypes.LookupProtocol(uint16(e.Proto)),
+	}
+
+	if e.UserID != [20]byte{} {
+		event.Username = usernameFromID(e.UserID)
+	}
+
+	return event, nil
+}
+
+func publishDropEvent(event DropEvent) {
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	recentDropEvents = append(recentDropEvents, event)
+	if len(recentDropEvents) > maxRecentDropEvents {
+		recentDropEvents = recentDropEvents[len(recentDropEvents)-maxRecentDropEvents:]
+	}
+
+	for subscriber := range eventSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+func eventAddress(address [16]byte) string {
+	ip := net.IP(address[:])
+	if ip.To4() != nil {
+		return ip.To4().String()
+	}
+
+	return ip.String()
+}
+
+// rememberUsername keeps the username for a user id, so drop events can be attributed without going to the database
+func rememberUsername(username string) {
+	usernamesLock.Lock()
+	defer usernamesLock.Unlock()
+
+	usernames[sha1.Sum([]byte(username))] = username
+}
+
+func forgetUsername(userid [20]byte) {
+	usernamesLock.Lock()
+	defer usernamesLock.Unlock()
+
+	delete(usernames, userid)
+}
+
+func usernameFromID(userid [20]byte) string {
+	usernamesLock.RLock()
+	defer usernamesLock.RUnlock()
+
+	if username, ok := usernames[userid]; ok {
+		return username
+	}
+
+	return hex.EncodeToString(userid[:])
+}
@@ -10,6 +10,12 @@ type fwentry struct {
 	sessionExpiry  uint64
 	lastPacketTime uint64
 
+	// Until when the device can reach step up routes
+	stepUpExpiry uint64
+
+	// Nano seconds, 0 uses the global inactivity timeout
+	inactivityTimeout uint64
+
 	// Hash of username (sha1 20 bytes)
 	// Essentially allows us to compress all usernames, if collisions are a problem in the future we'll move to sha256 or xxhash
 	user_id [20]byte
@@ -18,34 +24,38 @@ type fwentry struct {
 }
 
 func (d fwentry) Size() int {
-	return 40 // 8 + 8 + 20 + 4
+	return 56 // 8 + 8 + 8 + 8 + 20 + 4
 }
 
 func (d fwentry) Bytes() []byte {
 
-	output := make([]byte, 40)
+	output := make([]byte, 56)
 
 	binary.LittleEndian.PutUint64(output[0:8], d.sessionExpiry)
 	binary.LittleEndian.PutUint64(output[8:16], d.lastPacketTime)
+	binary.LittleEndian.PutUint64(output[16:24], d.stepUpExpiry)
+	binary.LittleEndian.PutUint64(output[24:32], d.inactivityTimeout)
 
-	copy(output[16:36], d.user_id[:])
+	copy(output[32:52], d.user_id[:])
 
-	binary.LittleEndian.PutUint32(output[36:], d.pad)
+	binary.LittleEndian.PutUint32(output[52:], d.pad)
 
 	return output
 }
 
 func (d *fwentry) Unpack(b []byte) error {
-	if len(b) != 40 {
+	if len(b) != 56 {
 		return errors.New("too short")
 	}
 
 	d.sessionExpiry = binary.LittleEndian.Uint64(b[:8])
 	d.lastPacketTime = binary.LittleEndian.Uint64(b[8:16])
+	d.stepUpExpiry = binary.LittleEndian.Uint64(b[16:24])
+	d.inactivityTimeout = binary.LittleEndian.Uint64(b[24:32])
 
-	copy(d.user_id[:], b[16:36])
+	copy(d.user_id[:], b[32:52])
 
-	d.pad = binary.LittleEndian.Uint32(b[36:])
+	d.pad = binary.LittleEndian.Uint32(b[52:])
 
 	return nil
 }
@@ -7,9 +7,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/NHAS/wag/internal/audit"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
-	"github.com/coreos/go-iptables/iptables"
 	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 )
@@ -41,6 +41,14 @@ func Setup(error chan<- error, iptables bool) (err error) {
 		return err
 	}
 
+	err = startDropEventReader()
+	if err != nil {
+		return err
+	}
+
+	go domainResolver()
+	go ruleScheduler()
+
 	go func() {
 		startup := true
 		for {
@@ -79,6 +87,17 @@ func Setup(error chan<- error, iptables bool) (err error) {
 					//Dont try and remove rules, if we've just started
 					if !startup {
 						log.Println(ip, "endpoint changed", d.Endpoint.String(), "->", p.Endpoint.String())
+						audit.Record(audit.Event{
+							Type:     audit.EndpointChange,
+							Outcome:  audit.Success,
+							Username: d.Username,
+							Address:  ip,
+							Action:   "deauthenticate",
+							Details: map[string]string{
+								"previous": d.Endpoint.String(),
+								"current":  p.Endpoint.String(),
+							},
+						})
 						if err := Deauthenticate(ip); err != nil {
 							log.Println(ip, "unable to remove forwards for device: ", err)
 						}
@@ -97,7 +116,8 @@ func Setup(error chan<- error, iptables bool) (err error) {
 		"\t\t\tSetting filter FORWARD policy to DROP",
 		"\t\t\tXDP eBPF program managing firewall",
 		"\t\t\tAllow Iptables FORWARDS to and from wireguard device",
-		"\t\t\tAllow input to VPN host"}
+		"\t\t\tAllow input to VPN host",
+		"\t\t\tRe-resolving domain acls when their records expire"}
 
 	routeMode := "MASQUERADE (NAT)"
 	if config.Values().NAT != nil && !*config.Values().NAT {
@@ -115,69 +135,14 @@ func TearDown() {
 
 	log.Println("Removing Firewall rules...")
 
-	ipt, err := iptables.New()
+	families, err := newIptables()
 	if err != nil {
 		log.Println("Unable to clean up firewall rules: ", err)
 		return
 	}
 
-	err = ipt.Delete("filter", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
-	}
-
-	//Setup the links to the new chains
-	err = ipt.Delete("filter", "FORWARD", "-i", config.Values().Wireguard.DevName, "-j", "ACCEPT")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
-	}
-
-	err = ipt.Delete("filter", "FORWARD", "-o", config.Values().Wireguard.DevName, "-j", "ACCEPT")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
-	}
-
-	shouldNAT := config.Values().NAT == nil || (config.Values().NAT != nil && *config.Values().NAT)
-	if shouldNAT {
-		err = ipt.Delete("nat", "POSTROUTING", "-s", config.Values().Wireguard.Range.String(), "-j", "MASQUERADE")
-		if err != nil {
-			log.Println("Unable to clean up firewall rules: ", err)
-		}
-	}
-
-	if !config.Values().Proxied {
-		//Allow input to authorize web server on the tunnel
-		err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", config.Values().Wireguard.DevName, "--dport", config.Values().Webserver.Tunnel.Port, "-j", "ACCEPT")
-		if err != nil {
-			log.Println("Unable to clean up firewall rules: ", err)
-		}
-	}
-
-	for _, port := range config.Values().ExposePorts {
-		parts := strings.Split(port, "/")
-		if len(parts) < 2 {
-			log.Println(port + " is not in a valid port format. E.g 80/tcp, 100-200/tcp")
-		}
-
-		err = ipt.Delete("filter", "INPUT", "-m", parts[1], "-p", parts[1], "-i", config.Values().Wireguard.DevName, "--dport", strings.Replace(parts[0], "-", ":", 1), "-j", "ACCEPT")
-		if err != nil {
-			log.Println("unable to cleanup custom defined port", port, ":", err)
-		}
-	}
-
-	err = ipt.Delete("filter", "INPUT", "-p", "icmp", "--icmp-type", "8", "-i", config.Values().Wireguard.DevName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
-	}
-
-	err = ipt.Delete("filter", "INPUT", "-i", config.Values().Wireguard.DevName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
-	}
-
-	err = ipt.Delete("filter", "INPUT", "-i", config.Values().Wireguard.DevName, "-j", "DROP")
-	if err != nil {
-		log.Println("Unable to clean up firewall rules: ", err)
+	for _, ipt := range families {
+		teardownFamily(ipt)
 	}
 
 	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
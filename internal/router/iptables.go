@@ -2,6 +2,8 @@ package router
 
 import (
 	"errors"
+	"log"
+	"net"
 	"strings"
 
 	"github.com/NHAS/wag/internal/config"
@@ -9,19 +11,84 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// An iptables or ip6tables handle, with the tunnel ranges of its address family
+type ipFamily struct {
+	*iptables.IPTables
+	ipv6   bool
+	ranges []*net.IPNet
+}
+
+// familyRanges splits the tunnel ranges by address family
+func familyRanges(ranges []*net.IPNet) (v4, v6 []*net.IPNet) {
+	for _, r := range ranges {
+		if r.IP.To4() == nil {
+			v6 = append(v6, r)
+			continue
+		}
+
+		v4 = append(v4, r)
+	}
+
+	return
+}
+
+// Returns an iptables handle, an ip6tables handle, or both depending on the address families of the wireguard ranges
+func newIptables() (families []ipFamily, err error) {
+	v4, v6 := familyRanges(config.Values().Wireguard.Ranges)
+
+	if len(v4) > 0 {
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, err
+		}
+
+		families = append(families, ipFamily{IPTables: ipt, ranges: v4})
+	}
+
+	if len(v6) > 0 {
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return nil, err
+		}
+
+		families = append(families, ipFamily{IPTables: ipt, ipv6: true, ranges: v6})
+	}
+
+	return families, nil
+}
+
+// Match for icmp echo requests (ping) for the address family
+func (f ipFamily) echoRequestMatch() []string {
+	if f.ipv6 {
+		return []string{"-p", "ipv6-icmp", "--icmpv6-type", "128"}
+	}
+
+	return []string{"-p", "icmp", "--icmp-type", "8"}
+}
+
 func setupIptables() error {
-	ipt, err := iptables.New()
+	families, err := newIptables()
 	if err != nil {
 		return err
 	}
 
+	for _, ipt := range families {
+		if err := setupFamily(ipt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setupFamily(ipt ipFamily) error {
 	devName := config.Values().Wireguard.DevName
 
 	//So. This to the average person will look like we say "Hey server forward anything and everything from the wireguard interface"
 	//And without the xdp ebpf program it would be, however if you look at xdp.c you can see that we can manipluate maps of addresses for each user
 	//This then controls whether the packet is dropped, but we still need iptables to do the higher level routing stuffs
 
-	err = ipt.ChangePolicy("filter", "FORWARD", "DROP")
+	err := ipt.ChangePolicy("filter", "FORWARD", "DROP")
 	if err != nil {
 		return err
 	}
@@ -43,9 +110,11 @@ func setupIptables() error {
 
 	shouldNAT := config.Values().NAT == nil || (config.Values().NAT != nil && *config.Values().NAT)
 	if shouldNAT {
-		err = ipt.Append("nat", "POSTROUTING", "-s", config.Values().Wireguard.Range.String(), "-j", "MASQUERADE")
-		if err != nil {
-			return err
+		for _, r := range ipt.ranges {
+			err = ipt.Append("nat", "POSTROUTING", "-s", r.String(), "-j", "MASQUERADE")
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -79,7 +148,7 @@ func setupIptables() error {
 		}
 	}
 
-	err = ipt.Append("filter", "INPUT", "-p", "icmp", "--icmp-type", "8", "-i", devName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")
+	err = ipt.Append("filter", "INPUT", append(ipt.echoRequestMatch(), "-i", devName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")...)
 	if err != nil {
 		return err
 	}
@@ -96,3 +165,68 @@ func setupIptables() error {
 
 	return nil
 }
+
+// teardownFamily removes the rules setupFamily added, logging rather than stopping on errors so as much as possible is removed
+func teardownFamily(ipt ipFamily) {
+	err := ipt.Delete("filter", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	//Setup the links to the new chains
+	err = ipt.Delete("filter", "FORWARD", "-i", config.Values().Wireguard.DevName, "-j", "ACCEPT")
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	err = ipt.Delete("filter", "FORWARD", "-o", config.Values().Wireguard.DevName, "-j", "ACCEPT")
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	shouldNAT := config.Values().NAT == nil || (config.Values().NAT != nil && *config.Values().NAT)
+	if shouldNAT {
+		for _, r := range ipt.ranges {
+			err = ipt.Delete("nat", "POSTROUTING", "-s", r.String(), "-j", "MASQUERADE")
+			if err != nil {
+				log.Println("Unable to clean up firewall rules: ", err)
+			}
+		}
+	}
+
+	if !config.Values().Proxied {
+		//Allow input to authorize web server on the tunnel
+		err = ipt.Delete("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", config.Values().Wireguard.DevName, "--dport", config.Values().Webserver.Tunnel.Port, "-j", "ACCEPT")
+		if err != nil {
+			log.Println("Unable to clean up firewall rules: ", err)
+		}
+	}
+
+	for _, port := range config.Values().ExposePorts {
+		parts := strings.Split(port, "/")
+		if len(parts) < 2 {
+			log.Println(port + " is not in a valid port format. E.g 80/tcp, 100-200/tcp")
+			continue
+		}
+
+		err = ipt.Delete("filter", "INPUT", "-m", parts[1], "-p", parts[1], "-i", config.Values().Wireguard.DevName, "--dport", strings.Replace(parts[0], "-", ":", 1), "-j", "ACCEPT")
+		if err != nil {
+			log.Println("unable to cleanup custom defined port", port, ":", err)
+		}
+	}
+
+	err = ipt.Delete("filter", "INPUT", append(ipt.echoRequestMatch(), "-i", config.Values().Wireguard.DevName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")...)
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	err = ipt.Delete("filter", "INPUT", "-i", config.Values().Wireguard.DevName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	err = ipt.Delete("filter", "INPUT", "-i", config.Values().Wireguard.DevName, "-j", "DROP")
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestFamilyRanges(t *testing.T) {
+	var ranges []*net.IPNet
+	for _, cidr := range []string{"10.2.43.1/24", "fd00:4::1/64", "192.168.0.1/16"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ranges = append(ranges, network)
+	}
+
+	v4, v6 := familyRanges(ranges)
+
+	cidrs := func(networks []*net.IPNet) (s []string) {
+		for _, n := range networks {
+			s = append(s, n.String())
+		}
+		return
+	}
+
+	if !slices.Equal(cidrs(v4), []string{"10.2.43.0/24", "192.168.0.0/16"}) {
+		t.Fatal("wrong ipv4 ranges: ", v4)
+	}
+
+	if !slices.Equal(cidrs(v6), []string{"fd00:4::/64"}) {
+		t.Fatal("wrong ipv6 ranges: ", v6)
+	}
+
+	if v4, v6 := familyRanges(ranges[:1]); len(v4) != 1 || len(v6) != 0 {
+		t.Fatal("ipv4 only tunnel should not need ip6tables: ", v4, v6)
+	}
+
+	if (ipFamily{ipv6: true}).echoRequestMatch()[1] != "ipv6-icmp" || (ipFamily{}).echoRequestMatch()[1] != "icmp" {
+		t.Fatal("echo request match was for the wrong family")
+	}
+}
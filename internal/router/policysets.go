@@ -0,0 +1,87 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/NHAS/wag/internal/routetypes"
+)
+
+// Every distinct set of policies is stored once in the policy_sets map, and the users routes refer to it by id
+// As most users share groups, this keeps memory use down even though every set has room for MAX_POLICIES
+// These are all guarded by the router lock
+var (
+	policySetIDs   = map[string]uint32{}
+	policySetRefs  = map[uint32]int{}
+	policySetKeys  = map[uint32]string{}
+	userPolicySets = map[[20]byte][]uint32{}
+
+	nextPolicySetID uint32 = 1
+)
+
+func resetPolicySets() {
+	policySetIDs = map[string]uint32{}
+	policySetRefs = map[uint32]int{}
+	policySetKeys = map[uint32]string{}
+	userPolicySets = map[[20]byte][]uint32{}
+	nextPolicySetID = 1
+}
+
+// acquirePolicySet returns the id of the set containing policies, adding it to the firewall if no other route uses the same policies
+func acquirePolicySet(policies []routetypes.Policy) (uint32, error) {
+	if len(policies) != routetypes.MAX_POLICIES {
+		return 0, fmt.Errorf("policy set had %d entries, expected %d", len(policies), routetypes.MAX_POLICIES)
+	}
+
+	var b bytes.Buffer
+	for _, policy := range policies {
+		b.Write(policy.Bytes())
+	}
+	key := b.String()
+
+	if id, ok := policySetIDs[key]; ok {
+		policySetRefs[id]++
+		return id, nil
+	}
+
+	id := nextPolicySetID
+
+	err := xdpObjects.PolicySets.Put(id, b.Bytes())
+	if err != nil {
+		return 0, fmt.Errorf("could not add policy set: %s", err)
+	}
+
+	nextPolicySetID++
+
+	policySetIDs[key] = id
+	policySetKeys[id] = key
+	policySetRefs[id] = 1
+
+	return id, nil
+}
+
+// releasePolicySets removes sets from the firewall once no routes use them
+func releasePolicySets(ids []uint32) error {
+	var lastErr error
+	for _, id := range ids {
+		policySetRefs[id]--
+		if policySetRefs[id] > 0 {
+			continue
+		}
+
+		if err := xdpObjects.PolicySets.Delete(id); err != nil {
+			lastErr = fmt.Errorf("could not remove policy set %d: %s", id, err)
+		}
+
+		delete(policySetIDs, policySetKeys[id])
+		delete(policySetKeys, id)
+		delete(policySetRefs, id)
+	}
+
+	return lastErr
+}
+
+func lookupPolicySet(id uint32) (policies [routetypes.MAX_POLICIES]routetypes.Policy, err error) {
+	err = xdpObjects.PolicySets.Lookup(id, &policies)
+	return
+}
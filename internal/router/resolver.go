@@ -0,0 +1,129 @@
+package router
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/routetypes"
+)
+
+const resolverInterval = 5 * time.Second
+
+// Periodically re-resolves any domains used in acls, and rebuilds the policy maps of users that use a domain whose addresses have changed
+func domainResolver() {
+
+	nextLookup := map[string]time.Time{}
+	for {
+
+		domains := map[string]bool{}
+		for _, domain := range routetypes.Domains(config.GetAllRules()) {
+			domains[domain] = true
+		}
+
+		// Drop anything that has been removed from the config so it gets looked up again if it is ever re-added
+		for domain := range nextLookup {
+			if !domains[domain] {
+				delete(nextLookup, domain)
+			}
+		}
+		routetypes.ForgetResolved(domains)
+
+		for domain := range domains {
+			if time.Now().Before(nextLookup[domain]) {
+				continue
+			}
+
+			changed, ttl, err := resolveDomain(domain)
+			if err != nil {
+				log.Println("unable to re-resolve", domain, "keeping previous addresses:", err)
+				nextLookup[domain] = time.Now().Add(routetypes.MinimumTTL)
+				continue
+			}
+
+			nextLookup[domain] = time.Now().Add(ttl)
+
+			if changed {
+				if err := refreshUsersUsing(domain); err != nil {
+					log.Println("unable to update firewall rules after", domain, "changed:", err)
+				}
+			}
+		}
+
+		time.Sleep(resolverInterval)
+	}
+}
+
+func resolveDomain(domain string) (changed bool, ttl time.Duration, err error) {
+	previous, known := routetypes.GetResolved(domain)
+
+	addresses, ttl, err := routetypes.Resolve(domain)
+	if err != nil {
+		return false, 0, err
+	}
+
+	changed = routetypes.SetResolved(domain, addresses)
+
+	// The first resolution is the same as what was looked up when the rules were parsed, so there is nothing to do
+	if !known || !changed {
+		return false, ttl, nil
+	}
+
+	log.Println(domain, "addresses changed", addressList(previous), "->", addressList(addresses), "updating firewall rules")
+
+	return true, ttl, nil
+}
+
+func refreshUsersUsing(domain string) error {
+	return refreshUsersWhere(func(rules []string) bool {
+		for _, d := range routetypes.Domains(rules) {
+			if d == domain {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// Rebuilds the firewall maps of every user whose effective acl rules satisfy uses
+func refreshUsersWhere(uses func(rules []string) bool) error {
+	users, err := data.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	for _, user := range users {
+
+		acls := config.GetEffectiveAcl(user.Username)
+
+		var rules []string
+		rules = append(rules, acls.Mfa...)
+		rules = append(rules, acls.Allow...)
+		rules = append(rules, acls.Deny...)
+
+		if !uses(rules) {
+			continue
+		}
+
+		if err := refreshUserAcls(user.Username); err != nil {
+			log.Println("unable to refresh acls for", user.Username, ":", err)
+		}
+	}
+
+	return nil
+}
+
+func addressList(addresses []net.IP) []string {
+	result := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, address.String())
+	}
+
+	return result
+}
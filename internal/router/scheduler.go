@@ -0,0 +1,66 @@
+package router
+
+import (
+	"log"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+)
+
+const schedulerInterval = 15 * time.Second
+
+// The xdp program has no idea what time of day it is, so this adds and removes scheduled rules from the users policy maps as their schedules start and end
+func ruleScheduler() {
+
+	active := map[string]bool{}
+	for {
+
+		rules, err := routetypes.ScheduledRules(config.GetAllRules())
+		if err != nil {
+			log.Println("unable to parse scheduled rules:", err)
+			time.Sleep(schedulerInterval)
+			continue
+		}
+
+		var (
+			now     = time.Now()
+			current = map[string]bool{}
+			changed = map[string]bool{}
+		)
+
+		for _, rule := range rules {
+			isActive := rule.Schedule.Active(now)
+			current[rule.Rule] = isActive
+
+			// Rules that have just appeared were added with the correct state when the config was loaded
+			if previous, known := active[rule.Rule]; known && previous != isActive {
+				changed[rule.Rule] = true
+
+				state := "ended"
+				if isActive {
+					state = "started"
+				}
+				log.Println("schedule", state, "for rule", rule.Rule, "updating firewall rules")
+			}
+		}
+
+		active = current
+
+		if len(changed) > 0 {
+			err := refreshUsersWhere(func(rules []string) bool {
+				for _, rule := range rules {
+					if changed[rule] {
+						return true
+					}
+				}
+				return false
+			})
+			if err != nil {
+				log.Println("unable to update firewall rules after schedule change:", err)
+			}
+		}
+
+		time.Sleep(schedulerInterval)
+	}
+}
@@ -0,0 +1,332 @@
+package router
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf"
+)
+
+// Decision is what the firewall would do with a packet sent from one of a users devices, or sent to it if Inbound is set
+type Decision struct {
+	Device      string
+	Destination string
+	Port        uint16
+	SourcePort  uint16
+	Protocol    string
+
+	// The packet was sent to the device by the destination, and if so whether it was part of a connection the device started
+	Inbound     bool
+	Established bool
+
+	Allowed bool
+	Verdict string
+
+	// The route and policy that decided the verdict, empty if nothing matched
+	Route  string
+	Policy string
+
+	AccountLocked  bool
+	Authorised     bool
+	TimedOut       bool
+	SessionExpired bool
+	SteppedUp      bool
+}
+
+// Everything conntrack in xdp.c reads from the maps when deciding on a packet for a single user
+type firewallState struct {
+	// nil if the user does not exist in the account_locked map
+	accountLocked *uint32
+
+	inactivityTimeout     uint64
+	userInactivityTimeout uint64
+	routes                []userRoute
+	now                   uint64
+}
+
+// evaluate is a reimplementation of conntrack and check_policies in xdp.c for a packet between device and destination
+// port is the destinations port, sourcePort is the devices, inboundNew is set for packets sent to the device that are not part of a flow it started
+// If anything changes there it must change here, TestSimulatorMatchesXDP checks the two agree
+func (s *firewallState) evaluate(device fwentry, destination net.IP, proto, port, sourcePort uint16, inboundNew bool) (verdict uint32, route *userRoute, policy *routetypes.Policy) {
+
+	if s.accountLocked == nil {
+		return dropUnknownUser, nil, nil
+	}
+
+	isTimedOut := s.timedOut(device)
+
+	match, ok := longestMatch(s.routes, destination)
+	if !ok {
+		return dropNoRoute, nil, nil
+	}
+	route = &match
+
+	// Outbound only policies dont apply to connections started by the remote side
+	decider, ok := decidingPolicy(match.policies[:], func(p *routetypes.Policy) bool {
+		return p.Matches(proto, port, sourcePort) && !(inboundNew && p.Is(routetypes.OUTBOUND))
+	})
+	if !ok {
+		if outbound, ok := decidingPolicy(match.policies[:], func(p *routetypes.Policy) bool { return p.Matches(proto, port, sourcePort) }); ok && inboundNew {
+			return dropNotEstablished, route, &outbound
+		}
+
+		return dropNoMatchingPolicy, route, nil
+	}
+	policy = &decider
+
+	if decider.Is(routetypes.DENY) {
+		return dropDenyRule, route, policy
+	}
+
+	if decider.Is(routetypes.PUBLIC) {
+		return verdictAllowed, route, policy
+	}
+
+	if *s.accountLocked != 0 {
+		return dropAccountLocked, route, policy
+	}
+
+	if device.sessionExpiry == 0 {
+		return dropMfaRequired, route, policy
+	}
+
+	if isTimedOut {
+		return dropTimedOut, route, policy
+	}
+
+	if device.sessionExpiry != math.MaxUint64 && s.now >= device.sessionExpiry {
+		return dropSessionExpired, route, policy
+	}
+
+	if decider.Is(routetypes.STEPUP) && s.now >= device.stepUpExpiry {
+		return dropStepUpRequired, route, policy
+	}
+
+	return verdictAllowed, route, policy
+}
+
+func (s *firewallState) timedOut(device fwentry) bool {
+	timeout := inactivityTimeout(device, s.userInactivityTimeout, s.inactivityTimeout)
+
+	return timeout != math.MaxUint64 && s.now-device.lastPacketTime >= timeout
+}
+
+// Simulate reports whether a packet from each of the users devices to destination would pass the firewall, and why
+// If inbound is set the packet is from destination to each device instead, port is always the destinations port and sourcePort the devices
+// Nothing is sent, the users live firewall maps are read and evaluated the same way the xdp program does
+func Simulate(username string, destination net.IP, proto, port, sourcePort uint16, inbound bool) ([]Decision, error) {
+
+	if destination == nil {
+		return nil, errors.New("invalid destination address")
+	}
+
+	// The xdp program only sees ports for tcp, udp and sctp, for icmp and icmpv6 the port is the type and code as given by routetypes.ICMPPort
+	switch proto {
+	case routetypes.TCP, routetypes.UDP, routetypes.SCTP:
+	case routetypes.ICMP, routetypes.ICMPv6:
+		sourcePort = 0
+
+		// Replies sent to the device are checked as the request they answer
+		if inbound {
+			port = routetypes.ICMPPort(icmpRequestType(proto, uint8(port>>8)), uint8(port))
+		}
+	default:
+		port, sourcePort = 0, 0
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	userid := sha1.Sum([]byte(username))
+
+	state, err := readFirewallState(userid)
+	if err != nil {
+		return nil, err
+	}
+
+	if destination.To4() != nil {
+		destination = destination.To4()
+	}
+
+	var (
+		result       []Decision
+		deviceStruct fwentry
+		ipBytes      = make([]byte, net.IPv6len)
+		deviceBytes  = make([]byte, deviceStruct.Size())
+	)
+
+	devices := xdpObjects.Devices.Iterate()
+	for devices.Next(&ipBytes, &deviceBytes) {
+		if err := deviceStruct.Unpack(deviceBytes); err != nil {
+			return nil, err
+		}
+
+		if deviceStruct.user_id != userid {
+			continue
+		}
+
+		established := false
+		if inbound {
+			established, err = state.established(ipBytes, destination, proto, port, sourcePort)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		verdict, route, policy := state.evaluate(deviceStruct, destination, proto, port, sourcePort, inbound && !established)
+
+		decision := newDecision(eventAddress([16]byte(ipBytes)), destination, proto, port, sourcePort, verdict, route, policy)
+		decision.Inbound = inbound
+		decision.Established = established
+		decision.AccountLocked = state.accountLocked != nil && *state.accountLocked != 0
+		decision.Authorised = deviceStruct.sessionExpiry != 0
+		decision.TimedOut = state.timedOut(deviceStruct)
+		decision.SessionExpired = deviceStruct.sessionExpiry != 0 && deviceStruct.sessionExpiry != math.MaxUint64 && state.now >= deviceStruct.sessionExpiry
+		decision.SteppedUp = state.now < deviceStruct.stepUpExpiry
+
+		result = append(result, decision)
+	}
+
+	if devices.Err() != nil {
+		return nil, devices.Err()
+	}
+
+	// Still show which rule would apply, even though the packet would be dropped as there is no device to send it
+	if len(result) == 0 {
+		var (
+			route  *userRoute
+			policy *routetypes.Policy
+		)
+
+		if match, ok := longestMatch(state.routes, destination); ok {
+			route = &match
+			if decider, ok := decidingPolicy(match.policies[:], func(p *routetypes.Policy) bool { return p.Matches(proto, port, sourcePort) }); ok {
+				policy = &decider
+			}
+		}
+
+		decision := newDecision("", destination, proto, port, sourcePort, dropNoDevice, route, policy)
+		decision.Inbound = inbound
+
+		result = append(result, decision)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Device < result[j].Device
+	})
+
+	return result, nil
+}
+
+// icmpRequestType is icmp_request_type in xdp.c, the type of request an icmp or icmpv6 reply answers
+func icmpRequestType(proto uint16, icmpType uint8) uint8 {
+	if proto == routetypes.ICMPv6 {
+		switch icmpType {
+		case 129: // Echo reply
+			return 128
+		case 140: // Node information reply
+			return 139
+		}
+
+		return icmpType
+	}
+
+	switch icmpType {
+	case 0: // Echo reply
+		return 8
+	case 14: // Timestamp reply
+		return 13
+	case 16: // Information reply
+		return 15
+	case 18: // Address mask reply
+		return 17
+	}
+
+	return icmpType
+}
+
+// Must match FLOW_TIMEOUT_NS in xdp.c
+const flowTimeout = 5 * time.Minute
+
+// established is lookup_flow in xdp.c, whether the device started a flow with destination that packets sent to the device would be part of
+func (s *firewallState) established(device []byte, destination net.IP, proto, port, sourcePort uint16) (bool, error) {
+	// Mirrors struct flow_key, the ports are in network byte order
+	var key [40]byte
+	copy(key[:16], net.IP(device).To16())
+	copy(key[16:32], destination.To16())
+	binary.BigEndian.PutUint16(key[32:], sourcePort)
+	binary.BigEndian.PutUint16(key[34:], port)
+	binary.NativeEndian.PutUint32(key[36:], uint32(proto))
+
+	var lastSeen uint64
+	err := xdpObjects.Flows.Lookup(key, &lastSeen)
+	if err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not get flow: %s", err)
+	}
+
+	return s.now-lastSeen < uint64(flowTimeout), nil
+}
+
+func readFirewallState(userid [20]byte) (state firewallState, err error) {
+
+	err = xdpObjects.InactivityTimeoutMinutes.Lookup(uint32(0), &state.inactivityTimeout)
+	if err != nil {
+		return state, fmt.Errorf("could not get inactivity timeout: %s", err)
+	}
+
+	err = xdpObjects.UserInactivityTimeout.Lookup(userid, &state.userInactivityTimeout)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return state, fmt.Errorf("could not get user inactivity timeout: %s", err)
+	}
+
+	var locked uint32
+	err = xdpObjects.AccountLocked.Lookup(userid, &locked)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return state, fmt.Errorf("could not get account lock state: %s", err)
+	}
+
+	if err == nil {
+		state.accountLocked = &locked
+	}
+
+	state.routes, err = getUserRoutes(userid)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return state, fmt.Errorf("could not get user routes: %s", err)
+	}
+
+	state.now = GetTimeStamp()
+
+	return state, nil
+}
+
+func newDecision(device string, destination net.IP, proto, port, sourcePort uint16, verdict uint32, route *userRoute, policy *routetypes.Policy) Decision {
+	d := Decision{
+		Device:      device,
+		Destination: destination.String(),
+		Port:        port,
+		SourcePort:  sourcePort,
+		Protocol:    routetypes.LookupProtocol(proto),
+		Allowed:     verdict == verdictAllowed,
+		Verdict:     verdictString(verdict),
+	}
+
+	if route != nil {
+		d.Route = route.key.String()
+	}
+
+	if policy != nil {
+		d.Policy = policy.String()
+	}
+
+	return d
+}
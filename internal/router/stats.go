@@ -0,0 +1,269 @@
+package router
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf"
+)
+
+// Mirrors struct traffic_counters in xdp.c, the maps are per cpu so there is one of these for every cpu
+type TrafficCounters struct {
+	AllowedPackets uint64
+	AllowedBytes   uint64
+	DroppedPackets uint64
+	DroppedBytes   uint64
+}
+
+func (t *TrafficCounters) add(other TrafficCounters) {
+	t.AllowedPackets += other.AllowedPackets
+	t.AllowedBytes += other.AllowedBytes
+	t.DroppedPackets += other.DroppedPackets
+	t.DroppedBytes += other.DroppedBytes
+}
+
+func sumCounters(perCPU []TrafficCounters) (total TrafficCounters) {
+	for _, c := range perCPU {
+		total.add(c)
+	}
+
+	return
+}
+
+// Mirrors struct rule_stats_key in xdp.c
+type ruleStatsKey struct {
+	UserID [20]byte
+	Addr   [16]byte
+	Proto  uint16
+	Port   uint16
+}
+
+type DeviceStats struct {
+	Address  string
+	Username string
+	TrafficCounters
+}
+
+type RuleStats struct {
+	Username string
+	Route    string
+	Policy   string
+	TrafficCounters
+}
+
+type FirewallStats struct {
+	Devices []DeviceStats
+	Rules   []RuleStats
+}
+
+type userRoute struct {
+	key      routetypes.Key
+	policies [routetypes.MAX_POLICIES]routetypes.Policy
+}
+
+// GetStats returns the allowed and dropped traffic counters for every device, and for every rule that has seen traffic
+func GetStats() (FirewallStats, error) {
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var result FirewallStats
+
+	users, err := data.GetAllUsers()
+	if err != nil {
+		return result, errors.New("fw stats get all users: " + err.Error())
+	}
+
+	hashToUsername := make(map[string]string)
+	for _, user := range users {
+		hash := sha1.Sum([]byte(user.Username))
+		hashToUsername[hex.EncodeToString(hash[:])] = user.Username
+	}
+
+	var (
+		deviceStruct fwentry
+		ipBytes      = make([]byte, net.IPv6len)
+		deviceBytes  = make([]byte, deviceStruct.Size())
+		perCPU       []TrafficCounters
+	)
+
+	devices := xdpObjects.Devices.Iterate()
+	for devices.Next(&ipBytes, &deviceBytes) {
+		if err := deviceStruct.Unpack(deviceBytes); err != nil {
+			return result, err
+		}
+
+		stats := DeviceStats{
+			Address:  net.IP(ipBytes).String(),
+			Username: hashToUsername[hex.EncodeToString(deviceStruct.user_id[:])],
+		}
+
+		err := xdpObjects.DeviceStats.Lookup(ipBytes, &perCPU)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return result, fmt.Errorf("device stats lookup %s: %s", stats.Address, err)
+		}
+
+		if err == nil {
+			stats.TrafficCounters = sumCounters(perCPU)
+		}
+
+		result.Devices = append(result.Devices, stats)
+	}
+
+	if devices.Err() != nil {
+		return result, devices.Err()
+	}
+
+	// The xdp program records the remote address, so collapse those down into the rule that would have matched
+	var (
+		key          ruleStatsKey
+		ruleTotals   = map[RuleStats]TrafficCounters{}
+		routesByUser = map[[20]byte][]userRoute{}
+	)
+
+	rules := xdpObjects.RuleStats.Iterate()
+	for rules.Next(&key, &perCPU) {
+
+		routes, ok := routesByUser[key.UserID]
+		if !ok {
+			routes, err = getUserRoutes(key.UserID)
+			if err != nil {
+				// User has probably been removed
+				routes = nil
+			}
+			routesByUser[key.UserID] = routes
+		}
+
+		username, ok := hashToUsername[hex.EncodeToString(key.UserID[:])]
+		if !ok {
+			continue
+		}
+
+		remote := net.IP(key.Addr[:])
+		if remote.To4() != nil {
+			remote = remote.To4()
+		}
+
+		rule := RuleStats{
+			Username: username,
+			Route:    "unknown",
+			Policy:   "no matching policy",
+		}
+
+		if route, ok := longestMatch(routes, remote); ok {
+			rule.Route = route.key.String()
+
+			// The devices port is not recorded, so traffic is counted against policies as if it matched their source ports
+			if policy, ok := decidingPolicy(route.policies[:], func(p *routetypes.Policy) bool { return p.MatchesService(key.Proto, key.Port) }); ok {
+				rule.Policy = policy.String()
+			}
+		}
+
+		totals := ruleTotals[rule]
+		totals.add(sumCounters(perCPU))
+		ruleTotals[rule] = totals
+	}
+
+	if rules.Err() != nil {
+		return result, rules.Err()
+	}
+
+	for rule, totals := range ruleTotals {
+		rule.TrafficCounters = totals
+		result.Rules = append(result.Rules, rule)
+	}
+
+	sort.Slice(result.Devices, func(i, j int) bool {
+		return result.Devices[i].Address < result.Devices[j].Address
+	})
+
+	sort.Slice(result.Rules, func(i, j int) bool {
+		if result.Rules[i].Username != result.Rules[j].Username {
+			return result.Rules[i].Username < result.Rules[j].Username
+		}
+
+		if result.Rules[i].Route != result.Rules[j].Route {
+			return result.Rules[i].Route < result.Rules[j].Route
+		}
+
+		return result.Rules[i].Policy < result.Rules[j].Policy
+	})
+
+	return result, nil
+}
+
+func getUserRoutes(userid [20]byte) (routes []userRoute, err error) {
+	var innerMapID ebpf.MapID
+	err = xdpObjects.PoliciesTable.Lookup(userid, &innerMapID)
+	if err != nil {
+		return nil, err
+	}
+
+	innerMap, err := ebpf.NewMapFromID(innerMapID)
+	if err != nil {
+		return nil, fmt.Errorf("map from id: %s", err)
+	}
+	defer innerMap.Close()
+
+	var (
+		route       userRoute
+		policySetID uint32
+	)
+	iter := innerMap.Iterate()
+	for iter.Next(&route.key, &policySetID) {
+		route.policies, err = lookupPolicySet(policySetID)
+		if err != nil {
+			return nil, fmt.Errorf("policy set %d for %s: %s", policySetID, route.key.String(), err)
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, iter.Err()
+}
+
+func longestMatch(routes []userRoute, ip net.IP) (match userRoute, found bool) {
+	for _, route := range routes {
+		if route.key.IsIPv4() != (ip.To4() != nil) || !route.key.Contains(ip) {
+			continue
+		}
+
+		if !found || route.key.Prefixlen > match.key.Prefixlen {
+			match = route
+			found = true
+		}
+	}
+
+	return
+}
+
+// Returns the policy that decided whether traffic was allowed, following the same precedence as xdp.c
+// Deny and mfa policies end the search, otherwise the first public policy is what allowed the traffic
+func decidingPolicy(policies []routetypes.Policy, matches func(*routetypes.Policy) bool) (decider routetypes.Policy, found bool) {
+	for _, policy := range policies {
+		if policy.Is(routetypes.STOP) {
+			break
+		}
+
+		if !matches(&policy) {
+			continue
+		}
+
+		if policy.Is(routetypes.DENY) || !policy.Is(routetypes.PUBLIC) {
+			return policy, true
+		}
+
+		if !found {
+			decider = policy
+			found = true
+		}
+	}
+
+	return
+}
@@ -14,8 +14,6 @@ import (
 	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 
-	"github.com/NHAS/wag/internal/utils"
-
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -65,7 +63,10 @@ func setupWireguard() error {
 		if err != nil {
 			return err
 		}
-		network.IP = ip.To4()[:4] // Stop netlink freaking out at a ipv6 length ipv4 address
+		network.IP = ip
+		if ip.To4() != nil {
+			network.IP = ip.To4() // Stop netlink freaking out at a ipv6 length ipv4 address
+		}
 
 		err = addWg(conn, config.Values().Wireguard.DevName, *network, config.Values().Wireguard.MTU)
 		if err != nil {
@@ -96,7 +97,10 @@ func setupWireguard() error {
 			psk = &testKey
 		}
 
-		_, network, _ := net.ParseCIDR(device.Address + "/32")
+		network, err := hostNetwork(device.Address)
+		if err != nil {
+			return errors.New("setup wireguard device address: " + err.Error())
+		}
 
 		c.Peers = append(c.Peers, wgtypes.PeerConfig{
 			PublicKey:         pk,
@@ -191,7 +195,7 @@ func ReplacePeer(device data.Device, newPublicKey wgtypes.Key) error {
 		return err
 	}
 
-	_, network, err := net.ParseCIDR(device.Address + "/32")
+	network, err := hostNetwork(device.Address)
 	if err != nil {
 		return err
 	}
@@ -243,7 +247,7 @@ func AddPeer(public wgtypes.Key, username string) (address string, psk string, e
 	if len(dev.Peers) > 0 {
 		addresses := make([]net.IP, 0, len(dev.Peers))
 		for _, peer := range dev.Peers {
-			addresses = append(addresses, net.ParseIP(utils.GetIP(peer.AllowedIPs[0].IP.String())))
+			addresses = append(addresses, peer.AllowedIPs[0].IP.To16())
 		}
 
 		// Find the last added address
@@ -259,7 +263,7 @@ func AddPeer(public wgtypes.Key, username string) (address string, psk string, e
 		return "", "", err
 	}
 
-	_, network, err := net.ParseCIDR(newAddress.String() + "/32")
+	network, err := hostNetwork(newAddress.String())
 	if err != nil {
 		return "", "", err
 	}
@@ -298,6 +302,20 @@ func GetPeerRealIp(address string) (string, error) {
 	return "", errors.New("not found")
 }
 
+// hostNetwork returns the /32 or /128 network for a single device address
+func hostNetwork(address string) (*net.IPNet, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, errors.New("unable to parse address: " + address)
+	}
+
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 func incrementIP(origIP, cidr string) (net.IP, error) {
 	ip := net.ParseIP(origIP)
 	_, ipNet, err := net.ParseCIDR(cidr)
@@ -379,8 +397,15 @@ func setIp(c *netlink.Conn, name string, address net.IPNet) error {
 		return fmt.Errorf("wireguard network iface %s does not exist: %s", name, err)
 	}
 
+	family := uint8(unix.AF_INET)
+	ip := address.IP.To4()
+	if ip == nil {
+		family = unix.AF_INET6
+		ip = address.IP.To16()
+	}
+
 	addrMsg := IfAddrmsg{
-		Family: unix.AF_INET,
+		Family: family,
 		Index:  uint32(iface.Index),
 	}
 
@@ -390,7 +415,7 @@ func setIp(c *netlink.Conn, name string, address net.IPNet) error {
 	req.Data = addrMsg.Serialize()
 
 	ne := netlink.NewAttributeEncoder()
-	ne.Bytes(unix.IFA_LOCAL, address.IP[:4])
+	ne.Bytes(unix.IFA_LOCAL, ip)
 
 	msg, err := ne.Encode()
 	if err != nil {
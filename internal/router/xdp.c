@@ -18,7 +18,7 @@ A massive oversimplifcation of what is in this file.
                ┌───────────────────────────────┐             ┌───────────────────────────────────┐
                │      Inactivity Timeout       │             │           Devices                 │
                │                               │             │            map                    │
-               │       uint64 (minutes)        │             │     key: ipv4 (u32)               │
+               │       uint64 (minutes)        │             │     key: ipv6 (u8[16])            │
                │                               │             │     val: sizeof(struct device)    │
                └───────────────────────────────┘             │                 │                 │
                                                              └─────────────────┼─────────────────┘
@@ -29,16 +29,19 @@ A massive oversimplifcation of what is in this file.
             │                User                 │◄─────────────┼─ userid         char[20]   │
             │                                     │              │  sessionExpiry  uint64     │
             ├─────────────────────────────────────┤              │  lastPacketTime uint64     │
-            │           AccountLocked             │              │  deviceLock     uint32     │
-            │               uint32                │              └────────────────────────────┘
+            │           AccountLocked             │              │  stepUpExpiry   uint64     │
+            │               uint32                │              │  inactivity     uint64     │
+            ├─────────────────────────────────────┤              └────────────────────────────┘
+            │        Inactivity Timeout           │
+            │         uint64 (nano seconds)       │
             ├─────────────────────────────────────┤
             │           Public Routes LPM         │
-            │              key uint32             │             ┌─────────────────────────────┐
+            │         key ipv6 (u8[16])           │             ┌─────────────────────────────┐
             │         value policies[128]─────────┼───────┐     │        policy struct        │
             │                                     │       │     │     policy_type uint16      │
             ├─────────────────────────────────────┤       ├────►│     lower_port  uint16      │
             │           MFA Routes LPM            │       │     │     upper_port  uint16      │
-            │              key uint32             │       │     │     proto       uint16      │
+            │         key ipv6 (u8[16])           │       │     │     proto       uint16      │
             │         value policies[128] ────────┼───────┘     │                             │
             │                                     │             └─────────────────────────────┘
             └─────────────────────────────────────┘
@@ -53,15 +56,15 @@ A massive oversimplifcation of what is in this file.
 │                              │                                                                          │
 │                      ┌───────▼───────┐                                                                  │
 │                      │               │                                                       ┌────────┐ │
-│                      │  Decode IPv4  │                  if packet not ipv4                   │        │ │
+│                      │   Decode IP   │              if packet not ipv4 or ipv6               │        │ │
 │                      │               │  ─────────────────────────────────────────────────────►  DROP  │ │
 │                      │    Header     │                                                       │        │ │
 │                      │               │                                                       └────────┘ │
 │                      └───────┬───────┘                                                                  │
 │                              │                                                                          │
 │                              │                                                                          │
-│                   src : u32  │                                                                          │
-│                   dst : u32  │                                                                          │
+│               src : u8[16]   │                                                                          │
+│               dst : u8[16]   │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
 │                 ┌────────────▼─────────────┐                                                            │
@@ -91,7 +94,7 @@ A massive oversimplifcation of what is in this file.
 │                              │                                                                          │
 │                              │                                                                          │
 │ device.LastPacketTime : u64  │                                                                          │
-│                dst_ip : u32  │                                                                          │
+│            dst_ip : u8[16]   │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
@@ -101,7 +104,7 @@ A massive oversimplifcation of what is in this file.
 │                 └────────────┬────────────┘                                                 │        │  │
 │                              │                                                              └────────┘  │
 │                              │                                                                          │
-│  policies struct policy[128] │                                                                          │
+│  policies struct policy[1024]│                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
 │                     ┌────────┴─────────┐                                                                │
@@ -120,9 +123,11 @@ A massive oversimplifcation of what is in this file.
 └─────────────────────────────────────────────────────────────────────────────────────────────────────────┘
 */
 
-#define MAX_POLICIES 128
+#define MAX_POLICIES 1024
+#define POLICIES_PER_CHUNK 128
 #define MAX_MAP_ENTRIES 1024
 #define MAX_USERID_LENGTH 20 // Length of sha1 hash
+#define IP_ADDRESS_LENGTH 16 // Length of an ipv6 address, ipv4 addresses are stored as ipv4-mapped ipv6 addresses (::ffff:a.b.c.d)
 
 // These definitions are used for searching the trie structure to determine the type of rule we've got.
 #define STOP 0 // Signal stop searching array
@@ -132,6 +137,24 @@ A massive oversimplifcation of what is in this file.
 #define RANGE 8   // Port & protocol range e.g 22-2000
 #define SINGLE 16 // Single port & protocol
 #define DENY 32   // Deny flag
+#define OUTBOUND 64 // Only matches traffic from the device, or replies to it
+#define STEPUP 128  // Mfa policy that needs a recent mfa, not just a session
+
+// Why a packet was dropped, sent to userland in drop events so these must match the reasons in events.go
+#define ALLOWED 0
+#define DROP_MALFORMED 1
+#define DROP_NO_DEVICE 2
+#define DROP_UNKNOWN_USER 3
+#define DROP_NO_ROUTE 4
+#define DROP_NO_MATCHING_POLICY 5
+#define DROP_DENY_RULE 6
+#define DROP_ACCOUNT_LOCKED 7
+#define DROP_MFA_REQUIRED 8
+#define DROP_TIMED_OUT 9
+#define DROP_SESSION_EXPIRED 10
+#define DROP_INTERNAL_ERROR 11
+#define DROP_NOT_ESTABLISHED 12
+#define DROP_STEP_UP_REQUIRED 13
 
 struct bpf_map_def
 {
@@ -205,6 +228,8 @@ enum
     IPPROTO_MAX
 };
 
+#define IPPROTO_ICMPV6 58 /* ICMPv6 */
+
 struct iphdr
 {
     __u8 ihl : 4,
@@ -222,6 +247,20 @@ struct iphdr
     /*The options start here. */
 };
 
+struct ipv6hdr
+{
+    __u8 priority : 4,
+        version : 4;
+    __u8 flow_lbl[3];
+
+    __be16 payload_len;
+    __u8 nexthdr;
+    __u8 hop_limit;
+
+    __u8 saddr[IP_ADDRESS_LENGTH];
+    __u8 daddr[IP_ADDRESS_LENGTH];
+};
+
 struct udphdr
 {
     __be16 source;
@@ -251,6 +290,14 @@ struct tcphdr
     __be16 urg_ptr;
 };
 
+struct sctphdr
+{
+    __be16 source;
+    __be16 dest;
+    __be32 vtag;
+    __le32 checksum;
+};
+
 struct icmphdr
 {
     __u8 type;
@@ -278,6 +325,12 @@ struct device
     __u64 sessionExpiry;
     __u64 lastPacketTime;
 
+    // Until when step up policies are allowed, set to a short time after every mfa
+    __u64 stepUpExpiry;
+
+    // Inactivity timeout for this device in nano seconds, 0 uses the global inactivity_timeout_minutes
+    __u64 inactivityTimeout;
+
     // Hash of username (sha1 20 bytes)
     // Essentially allows us to compress all usernames, if collisions are a problem in the future we'll move to sha256 or xxhash
     char user_id[MAX_USERID_LENGTH];
@@ -288,10 +341,10 @@ struct device
 
 struct ip
 {
-    __u32 src_ip;
+    __u8 src_ip[IP_ADDRESS_LENGTH];
     __u16 src_port;
 
-    __u32 dst_ip;
+    __u8 dst_ip[IP_ADDRESS_LENGTH];
     __u16 dst_port;
 
     __u32 proto;
@@ -300,7 +353,7 @@ struct ip
 struct bpf_map_def SEC("maps") devices = {
     .type = BPF_MAP_TYPE_HASH,
     .max_entries = MAX_MAP_ENTRIES,
-    .key_size = sizeof(__u32),
+    .key_size = IP_ADDRESS_LENGTH,
     .value_size = sizeof(struct device),
     .map_flags = 0,
 };
@@ -315,13 +368,22 @@ struct bpf_map_def SEC("maps") account_locked = {
     .map_flags = 0,
 };
 
+// Inactivity timeout in nano seconds from the policies that apply to the user, 0 or missing uses the global inactivity_timeout_minutes
+struct bpf_map_def SEC("maps") user_inactivity_timeout = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = MAX_USERID_LENGTH,
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
 // Two tables of the same construction
 
 // Inner map is a LPM tri, so we use this as the key
-struct ip4_trie_key
+struct ip_trie_key
 {
     __u32 prefixlen; // first member must be u32
-    __u32 addr;
+    __u8 addr[IP_ADDRESS_LENGTH];
 } __attribute__((__packed__));
 
 struct policy
@@ -330,8 +392,31 @@ struct policy
     __u16 proto;
     __u16 lower_port;
     __u16 upper_port;
+    // The port on the device, both are 0 if any port is allowed
+    __u16 src_lower_port;
+    __u16 src_upper_port;
 } __attribute__((__packed__));
 
+// Wrappers so functions taking a pointer to the policies know the full size of the array
+struct policy_chunk
+{
+    struct policy policies[POLICIES_PER_CHUNK];
+};
+
+struct policies
+{
+    struct policy_chunk chunks[MAX_POLICIES / POLICIES_PER_CHUNK];
+};
+
+// Policy set id to policies. Users that share groups end up with identical policies on most routes, so each distinct set is only stored once and the users routes (LPM tries) refer to it by id
+struct bpf_map_def SEC("maps") policy_sets = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES * 16,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(struct policies),
+    .map_flags = BPF_F_NO_PREALLOC,
+};
+
 // Hahed username to LPM trie, value size *has* to be u32 as this is a HASH of MAPS
 struct bpf_map_def SEC("maps") policies_table = {
     .type = BPF_MAP_TYPE_HASH_OF_MAPS,
@@ -343,6 +428,91 @@ struct bpf_map_def SEC("maps") policies_table = {
 
 // end user
 
+// Traffic accounting, these are per cpu so they can be incremented without atomics and are summed in userspace
+struct traffic_counters
+{
+    __u64 allowed_packets;
+    __u64 allowed_bytes;
+    __u64 dropped_packets;
+    __u64 dropped_bytes;
+};
+
+// Keyed by the devices address
+struct bpf_map_def SEC("maps") device_stats = {
+    .type = BPF_MAP_TYPE_PERCPU_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = IP_ADDRESS_LENGTH,
+    .value_size = sizeof(struct traffic_counters),
+    .map_flags = 0,
+};
+
+// The remote address, port and proto of a packet that matched a route, userland works out which rule this applies to
+struct rule_stats_key
+{
+    char user_id[MAX_USERID_LENGTH];
+    __u8 addr[IP_ADDRESS_LENGTH];
+    __u16 proto;
+    __u16 port;
+} __attribute__((__packed__));
+
+// LRU as the number of distinct remote services a user can talk to is unbounded
+struct bpf_map_def SEC("maps") rule_stats = {
+    .type = BPF_MAP_TYPE_LRU_PERCPU_HASH,
+    .max_entries = MAX_MAP_ENTRIES * 8,
+    .key_size = sizeof(struct rule_stats_key),
+    .value_size = sizeof(struct traffic_counters),
+    .map_flags = 0,
+};
+
+struct drop_event
+{
+    __u8 src_ip[IP_ADDRESS_LENGTH];
+    __u8 dst_ip[IP_ADDRESS_LENGTH];
+    __u16 src_port;
+    __u16 dst_port;
+    __u32 proto;
+    __u32 reason;
+    char user_id[MAX_USERID_LENGTH];
+} __attribute__((__packed__));
+
+struct bpf_map_def SEC("maps") drop_events = {
+    .type = BPF_MAP_TYPE_RINGBUF,
+    .max_entries = 256 * 1024,
+    .key_size = 0,
+    .value_size = 0,
+    .map_flags = 0,
+};
+
+// Emit an event for 1 in N drops, 0 disables drop events
+struct bpf_map_def SEC("maps") drop_event_sample_rate = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .max_entries = 1,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u32),
+    .map_flags = 0,
+};
+
+// A connection started by a device, so replies can be allowed by outbound only policies
+struct flow_key
+{
+    __u8 device_ip[IP_ADDRESS_LENGTH];
+    __u8 remote_ip[IP_ADDRESS_LENGTH];
+    __u16 device_port;
+    __u16 remote_port;
+    __u32 proto;
+} __attribute__((__packed__));
+
+// Value is the last time a packet was seen in the flow, LRU as flows are never explicitly closed
+struct bpf_map_def SEC("maps") flows = {
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .max_entries = MAX_MAP_ENTRIES * 16,
+    .key_size = sizeof(struct flow_key),
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
+#define FLOW_TIMEOUT_NS (5 * 60 * 1000000000ULL)
+
 // A single variable in nano seconds
 struct bpf_map_def SEC("maps") inactivity_timeout_minutes = {
     .type = BPF_MAP_TYPE_ARRAY,
@@ -353,12 +523,57 @@ struct bpf_map_def SEC("maps") inactivity_timeout_minutes = {
 };
 
 /*
-Attempt to parse the IPv4 source address from the packet.
-Returns 0 if there is no IPv4 header field; otherwise returns non-zero.
+Attempt to parse the IPv4 or IPv6 source and destination addresses from the packet.
+Returns 0 if there is no IPv4/IPv6 header field; otherwise returns non-zero.
 */
 
 #define MAX_PACKET_OFF 0xffff
 
+#define ICMP_ECHOREPLY 0
+#define ICMP_ECHO 8
+#define ICMP_TIMESTAMP 13
+#define ICMP_TIMESTAMPREPLY 14
+#define ICMP_INFO_REQUEST 15
+#define ICMP_INFO_REPLY 16
+#define ICMP_ADDRESS 17
+#define ICMP_ADDRESSREPLY 18
+
+#define ICMPV6_ECHO_REQUEST 128
+#define ICMPV6_ECHO_REPLY 129
+#define ICMPV6_NI_QUERY 139
+#define ICMPV6_NI_REPLY 140
+
+// Returns the type of request that an icmp or icmpv6 reply answers, or the type itself if it is not a reply
+static __always_inline __u8 icmp_request_type(__u8 protocol, __u8 type)
+{
+    if (protocol == IPPROTO_ICMPV6)
+    {
+        switch (type)
+        {
+        case ICMPV6_ECHO_REPLY:
+            return ICMPV6_ECHO_REQUEST;
+        case ICMPV6_NI_REPLY:
+            return ICMPV6_NI_QUERY;
+        }
+
+        return type;
+    }
+
+    switch (type)
+    {
+    case ICMP_ECHOREPLY:
+        return ICMP_ECHO;
+    case ICMP_TIMESTAMPREPLY:
+        return ICMP_TIMESTAMP;
+    case ICMP_INFO_REPLY:
+        return ICMP_INFO_REQUEST;
+    case ICMP_ADDRESSREPLY:
+        return ICMP_ADDRESS;
+    }
+
+    return type;
+}
+
 static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *ip_info)
 {
     void *data_end = (void *)(long)ctx->data_end;
@@ -367,24 +582,59 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
     // As this is being attached to a wireguard interface (tun device), we dont get layer 2 frames
     // Just happy little ip packets
 
-    // Then parse the IP header.
+    // Then parse the IP header, the version nibble is in the same place for both ipv4 and ipv6
     struct iphdr *ip = data;
     if ((void *)(ip + 1) > data_end)
     {
         return 0;
     }
 
-    // We dont support ipv6
-    if (ip->version != 4)
+    __u64 ip_header_length = 0;
+    __u8 protocol = 0;
+
+    switch (ip->version)
     {
+    case 4:
+    {
+        ip_header_length = (ip->ihl * 4);
+        protocol = ip->protocol;
+
+        // Store ipv4 addresses as ipv4-mapped ipv6 addresses, so we only need one lookup path for both families
+        ip_info->src_ip[10] = 0xff;
+        ip_info->src_ip[11] = 0xff;
+        __builtin_memcpy(&ip_info->src_ip[12], &ip->saddr, sizeof(ip->saddr));
+
+        ip_info->dst_ip[10] = 0xff;
+        ip_info->dst_ip[11] = 0xff;
+        __builtin_memcpy(&ip_info->dst_ip[12], &ip->daddr, sizeof(ip->daddr));
+
+        break;
+    }
+    case 6:
+    {
+        struct ipv6hdr *ip6 = data;
+        if ((void *)(ip6 + 1) > data_end)
+        {
+            return 0;
+        }
+
+        // Extension headers are not walked, so the first next header is treated as the protocol
+        ip_header_length = sizeof(struct ipv6hdr);
+        protocol = ip6->nexthdr;
+
+        __builtin_memcpy(ip_info->src_ip, ip6->saddr, IP_ADDRESS_LENGTH);
+        __builtin_memcpy(ip_info->dst_ip, ip6->daddr, IP_ADDRESS_LENGTH);
+
+        break;
+    }
+    default:
         return 0;
     }
 
-    ip_info->proto = ip->protocol;
+    ip_info->proto = protocol;
     ip_info->dst_port = 0;
     ip_info->src_port = 0;
 
-    __u64 ip_header_length = (ip->ihl * 4);
     if (ip_header_length > MAX_PACKET_OFF)
     {
         return 0;
@@ -395,7 +645,7 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
         return 0;
     }
 
-    switch (ip->protocol)
+    switch (protocol)
     {
 
     case IPPROTO_UDP:
@@ -429,6 +679,22 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
 
         break;
     }
+    case IPPROTO_SCTP:
+    {
+
+        struct sctphdr *sctph = (data + ip_header_length);
+
+        if (sctph + 1 > (struct sctphdr *)data_end)
+        {
+            return 0;
+        }
+
+        ip_info->dst_port = sctph->dest;
+        ip_info->src_port = sctph->source;
+
+        break;
+    }
+    case IPPROTO_ICMPV6:
     case IPPROTO_ICMP:
     {
         struct icmphdr *icmph = (data + ip_header_length);
@@ -438,45 +704,208 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
             return 0;
         }
 
+        // icmpv6 keeps its own protocol number, its types overlap icmp types with different meanings
+        // The type and code take the place of the port, the same as routetypes.ICMPPort
+        ip_info->dst_port = bpf_htons((icmph->type << 8) | icmph->code);
+
+        // When checking traffic towards a device the source port is used, so replies are matched as the request they answer
+        ip_info->src_port = bpf_htons((icmp_request_type(protocol, icmph->type) << 8) | icmph->code);
+
         break;
     }
     }
 
-    // Return the source IP address in network byte order.
-    ip_info->src_ip = (__u32)(ip->saddr);
-    ip_info->dst_ip = (__u32)(ip->daddr);
-
     return 1;
 }
 
-static __always_inline int conntrack(struct ip *ip_info)
+static __always_inline struct traffic_counters *get_counters(void *map, void *key)
 {
+    struct traffic_counters *counters = bpf_map_lookup_elem(map, key);
+    if (counters == NULL)
+    {
+        struct traffic_counters empty = {0};
+        bpf_map_update_elem(map, key, &empty, BPF_NOEXIST);
 
-    __u32 address = ip_info->dst_ip;
-    __u16 port = ip_info->dst_port;
+        counters = bpf_map_lookup_elem(map, key);
+    }
 
-    // Determine which address is our device
-    struct device *current_device = bpf_map_lookup_elem(&devices, &ip_info->src_ip);
-    if (current_device == NULL)
+    return counters;
+}
+
+static __always_inline void count(struct traffic_counters *counters, int allowed, __u64 bytes)
+{
+    if (counters == NULL)
     {
-        current_device = bpf_map_lookup_elem(&devices, &ip_info->dst_ip);
-        if (current_device == NULL)
+        return;
+    }
+
+    // Branchless so the verifier doesnt have to track the decision through here, as every path out of the policy loop ends up in this function
+    __u64 is_allowed = allowed != 0;
+
+    counters->allowed_packets += is_allowed;
+    counters->allowed_bytes += bytes * is_allowed;
+
+    counters->dropped_packets += 1 - is_allowed;
+    counters->dropped_bytes += bytes * (1 - is_allowed);
+}
+
+static __always_inline void emit_drop_event(struct ip *ip_info, char *user_id, __u32 reason)
+{
+    __u32 index = 0;
+    __u32 *sample_rate = bpf_map_lookup_elem(&drop_event_sample_rate, &index);
+    if (sample_rate == NULL || *sample_rate == 0)
+    {
+        return;
+    }
+
+    if (*sample_rate > 1 && (bpf_get_prandom_u32() % *sample_rate) != 0)
+    {
+        return;
+    }
+
+    // If the ring buffer is full (userland isnt keeping up) the event is just lost
+    struct drop_event *event = bpf_ringbuf_reserve(&drop_events, sizeof(struct drop_event), 0);
+    if (event == NULL)
+    {
+        return;
+    }
+
+    __builtin_memcpy(event->src_ip, ip_info->src_ip, IP_ADDRESS_LENGTH);
+    __builtin_memcpy(event->dst_ip, ip_info->dst_ip, IP_ADDRESS_LENGTH);
+    event->src_port = bpf_ntohs(ip_info->src_port);
+    event->dst_port = bpf_ntohs(ip_info->dst_port);
+    event->proto = ip_info->proto;
+    event->reason = reason;
+
+    if (user_id != NULL)
+    {
+        __builtin_memcpy(event->user_id, user_id, MAX_USERID_LENGTH);
+    }
+    else
+    {
+        __builtin_memset(event->user_id, 0, MAX_USERID_LENGTH);
+    }
+
+    bpf_ringbuf_submit(event, 0);
+}
+
+#define POLICY_NO_MATCH 0
+#define POLICY_PUBLIC 1
+#define POLICY_MFA 2
+#define POLICY_DENY 3
+#define POLICY_DECISION 3       // Mask for the decision in the result of match_policy_chunk/match_policies
+#define POLICY_END 4            // Added to the result of match_policy_chunk when the end of the policies was reached
+#define POLICY_OUTBOUND 8       // Added when the decision came from an outbound only policy
+#define POLICY_UNESTABLISHED 16 // Added when an outbound only policy would have matched, but the traffic was not a reply
+#define POLICY_STEPUP 32        // Added when the mfa decision came from a step up policy
+
+// Global (not static) so the verifier checks this loop once on its own, rather than once for every path through conntrack that reaches it
+__attribute__((noinline)) int match_policy_chunk(struct policy_chunk *chunk, __u32 proto, __u16 port, __u16 device_port, int inbound_new)
+{
+    if (chunk == NULL)
+    {
+        return POLICY_NO_MATCH | POLICY_END;
+    }
+
+    int decision = POLICY_NO_MATCH;
+    for (__u16 i = 0; i < POLICIES_PER_CHUNK; i++)
+    {
+
+        struct policy policy = chunk->policies[i];
+
+        // As the array is static in size, we want to be able to terminate the search asap
+        if (policy.policy_type == STOP)
         {
-            return 0;
+            return decision | POLICY_END;
         }
 
-        // Our device is the dst, so what we need to check in the firewall is the src
-        address = ip_info->src_ip;
-        port = ip_info->src_port;
+        // The icmp type and code take the place of the port, but policies for any protocol only mean ports
+        __u16 policy_port = (policy.proto == ANY && (proto == IPPROTO_ICMP || proto == IPPROTO_ICMPV6)) ? 0 : port;
+
+        //      ANY = 0
+        //      If we match the protocol,
+        //      If type is SINGLE and the port is either any, or equal
+        //      OR
+        //      If type is RANGE and the port is within bounds
+        //      AND
+        //      If the policy has no source port, or the devices port is within its bounds
+        if ((policy.proto == ANY || policy.proto == proto) &&
+            ((policy.policy_type & SINGLE && (policy.lower_port == ANY || policy.lower_port == policy_port)) ||
+             (policy.policy_type & RANGE && (policy.lower_port <= policy_port && policy.upper_port >= policy_port))) &&
+            (policy.src_upper_port == ANY || (policy.src_lower_port <= device_port && policy.src_upper_port >= device_port)))
+        {
+
+            int outbound = (policy.policy_type & OUTBOUND) ? POLICY_OUTBOUND : 0;
+
+            // Outbound only policies dont apply to connections started by the remote side
+            if (outbound && inbound_new)
+            {
+                decision |= POLICY_UNESTABLISHED;
+                continue;
+            }
+
+            if (policy.policy_type & DENY)
+            {
+                // Deny rules take precedence over everything
+                return POLICY_DENY;
+            }
+            else if (policy.policy_type & PUBLIC)
+            {
+                // If a public route matches, it may still be overriden by a MFA or a Deny policy so we have to check all policies
+                decision = POLICY_PUBLIC | outbound | (decision & ~POLICY_DECISION);
+            }
+            else
+            {
+                // MFA restrictions take precedence over public rules, so if we match an MFA policy under this route
+                // Then we can fail/succeed fast
+                return POLICY_MFA | outbound | ((policy.policy_type & STEPUP) ? POLICY_STEPUP : 0);
+            }
+        }
     }
 
-    port = bpf_ntohs(port);
+    return decision;
+}
 
+// The policies are checked in chunks, as the verifier gives up on a single loop over all of them
+__attribute__((noinline)) int match_policies(struct policies *applicable_policies, __u32 proto, __u16 port, __u16 device_port, int inbound_new)
+{
+    if (applicable_policies == NULL)
+    {
+        return POLICY_NO_MATCH;
+    }
+
+    int decision = POLICY_NO_MATCH;
+    for (__u16 i = 0; i < MAX_POLICIES / POLICIES_PER_CHUNK; i++)
+    {
+        int result = match_policy_chunk(&applicable_policies->chunks[i], proto, port, device_port, inbound_new);
+
+        switch (result & POLICY_DECISION)
+        {
+        case POLICY_DENY:
+        case POLICY_MFA:
+            return result & ~POLICY_END;
+        case POLICY_PUBLIC:
+            decision = POLICY_PUBLIC | (decision & ~POLICY_DECISION);
+        }
+
+        decision |= result & (POLICY_OUTBOUND | POLICY_UNESTABLISHED);
+
+        if (result & POLICY_END)
+        {
+            break;
+        }
+    }
+
+    return decision;
+}
+
+static __always_inline __u32 check_policies(struct ip *ip_info, struct device *current_device, __u8 *address, __u16 port, __u16 device_port, int inbound_new, int *matched_route, int *outbound_only)
+{
     // Check if the account exists
     __u32 *isAccountLocked = bpf_map_lookup_elem(&account_locked, current_device->user_id);
     if (isAccountLocked == NULL)
     {
-        return 0;
+        return DROP_UNKNOWN_USER;
     }
 
     // // Our userland defined inactivity timeout
@@ -484,83 +913,208 @@ static __always_inline int conntrack(struct ip *ip_info)
     __u64 *inactivity_timeout = bpf_map_lookup_elem(&inactivity_timeout_minutes, &index);
     if (inactivity_timeout == NULL)
     {
-        return 0;
+        return DROP_INTERNAL_ERROR;
     }
 
     __u64 currentTime = bpf_ktime_get_ns();
 
+    // The device class and the users policies may have their own inactivity timeouts, if both do the shortest is used
+    __u64 *user_timeout = bpf_map_lookup_elem(&user_inactivity_timeout, current_device->user_id);
+    __u64 timeout = current_device->inactivityTimeout;
+    if (user_timeout != NULL && *user_timeout != 0 && (timeout == 0 || *user_timeout < timeout))
+    {
+        timeout = *user_timeout;
+    }
+
+    if (timeout == 0)
+    {
+        timeout = *inactivity_timeout;
+    }
+
     // If the inactivity timeout is not disabled and users session has timed out
-    __u8 isTimedOut = (*inactivity_timeout != __UINT64_MAX__ && ((currentTime - current_device->lastPacketTime) >= *inactivity_timeout));
+    __u8 isTimedOut = (timeout != __UINT64_MAX__ && ((currentTime - current_device->lastPacketTime) >= timeout));
 
-    struct ip4_trie_key key = {0};
+    struct ip_trie_key key = {0};
 
-    key.addr = address;
-    key.prefixlen = 32;
+    __builtin_memcpy(key.addr, address, IP_ADDRESS_LENGTH);
+    key.prefixlen = IP_ADDRESS_LENGTH * 8;
 
     // The inner maps must be a LPM trie
 
     // Get public and mfa policies for a user, the whole table will be searched as MFA rules take preference (and can fail early if it matches and the user is not authed)
     void *user_policies = bpf_map_lookup_elem(&policies_table, current_device->user_id);
 
-    struct policy *applicable_policies = (user_policies != NULL) ? bpf_map_lookup_elem(user_policies, &key) : NULL;
+    __u32 *policy_set_id = (user_policies != NULL) ? bpf_map_lookup_elem(user_policies, &key) : NULL;
+
+    struct policies *applicable_policies = (policy_set_id != NULL) ? bpf_map_lookup_elem(&policy_sets, policy_set_id) : NULL;
     if (applicable_policies == NULL)
     {
-        return 0;
+        return DROP_NO_ROUTE;
     }
 
+    *matched_route = 1;
+
     if (!isTimedOut)
     {
         // Doesnt matter that this isnt thread safe
         current_device->lastPacketTime = currentTime;
     }
 
-    int decision = 0;
-    for (__u16 i = 0; i < MAX_POLICIES; i++)
+    int result = match_policies(applicable_policies, ip_info->proto, port, device_port, inbound_new);
+
+    *outbound_only = (result & POLICY_OUTBOUND) != 0;
+
+    switch (result & POLICY_DECISION)
     {
+    case POLICY_PUBLIC:
+        return ALLOWED;
+    case POLICY_DENY:
+        return DROP_DENY_RULE;
+    case POLICY_MFA:
+        // The device must not belong to a locked account, must have authorised and must not be timed out
+        if (*isAccountLocked)
+        {
+            return DROP_ACCOUNT_LOCKED;
+        }
 
-        __u32 key = i;
-        struct policy policy = *(applicable_policies + key);
+        if (current_device->sessionExpiry == 0)
+        {
+            return DROP_MFA_REQUIRED;
+        }
 
-        // As the array is static in size, we want to be able to terminate the search asap
-        if (policy.policy_type == STOP)
+        if (isTimedOut)
         {
-            return decision;
+            return DROP_TIMED_OUT;
         }
 
-        //      ANY = 0
-        //      If we match the protocol,
-        //      If type is SINGLE and the port is either any, or equal
-        //      OR
-        //      If type is RANGE and the port is within bounds
-        if ((policy.proto == ANY || policy.proto == ip_info->proto) &&
-            ((policy.policy_type & SINGLE && (policy.lower_port == ANY || policy.lower_port == port)) ||
-             (policy.policy_type & RANGE && (policy.lower_port <= port && policy.upper_port >= port))))
+        // If either max session lifetime is disabled, or it is before the max lifetime of the session
+        if (current_device->sessionExpiry != __UINT64_MAX__ && currentTime >= current_device->sessionExpiry)
         {
+            return DROP_SESSION_EXPIRED;
+        }
 
-            if (policy.policy_type & DENY)
-            {
-                // Deny rules take precedence over everything
-                return 0;
-            }
-            else if (policy.policy_type & PUBLIC)
-            {
-                // If a public route matches, it may still be overriden by a MFA or a Deny policy so we have to check all policies
-                decision = 1;
-            }
-            else
-            {
-                // MFA restrictions take precedence over public rules, so if we match an MFA policy under this route
-                // Then we can fail/succeed fast
+        // Step up policies need the mfa to have been done recently, not just at some point in the session
+        if ((result & POLICY_STEPUP) && currentTime >= current_device->stepUpExpiry)
+        {
+            return DROP_STEP_UP_REQUIRED;
+        }
 
-                // If device does not belong to a locked account, the device itself isnt locked and if it isnt timed out
-                return (!*isAccountLocked && !isTimedOut && current_device->sessionExpiry != 0 &&
-                        // If either max session lifetime is disabled, or it is before the max lifetime of the session
-                        (current_device->sessionExpiry == __UINT64_MAX__ || currentTime < current_device->sessionExpiry));
-            }
+        return ALLOWED;
+    }
+
+    if (result & POLICY_UNESTABLISHED)
+    {
+        return DROP_NOT_ESTABLISHED;
+    }
+
+    return DROP_NO_MATCHING_POLICY;
+}
+
+// Returns whether traffic towards a device is part of a flow the device started, and builds the key for the flow
+static __always_inline int lookup_flow(struct ip *ip_info, int inbound, struct flow_key *key)
+{
+    if (inbound)
+    {
+        __builtin_memcpy(key->device_ip, ip_info->dst_ip, IP_ADDRESS_LENGTH);
+        __builtin_memcpy(key->remote_ip, ip_info->src_ip, IP_ADDRESS_LENGTH);
+        key->device_port = ip_info->dst_port;
+        key->remote_port = ip_info->src_port;
+    }
+    else
+    {
+        __builtin_memcpy(key->device_ip, ip_info->src_ip, IP_ADDRESS_LENGTH);
+        __builtin_memcpy(key->remote_ip, ip_info->dst_ip, IP_ADDRESS_LENGTH);
+        key->device_port = ip_info->src_port;
+        key->remote_port = ip_info->dst_port;
+    }
+
+    key->proto = ip_info->proto;
+
+    // icmp replies have a different type to their request, the remote "port" is already the request type in both directions
+    if (ip_info->proto == IPPROTO_ICMP || ip_info->proto == IPPROTO_ICMPV6)
+    {
+        key->device_port = 0;
+    }
+
+    if (!inbound)
+    {
+        return 0;
+    }
+
+    __u64 *last_seen = bpf_map_lookup_elem(&flows, key);
+
+    return last_seen != NULL && (bpf_ktime_get_ns() - *last_seen) < FLOW_TIMEOUT_NS;
+}
+
+static __always_inline int conntrack(struct ip *ip_info, __u64 packet_length)
+{
+
+    __u8 *address = ip_info->dst_ip;
+    __u8 *device_address = ip_info->src_ip;
+    __u16 port = ip_info->dst_port;
+    __u16 device_port = ip_info->src_port;
+    int inbound = 0;
+
+    // Determine which address is our device
+    struct device *current_device = bpf_map_lookup_elem(&devices, ip_info->src_ip);
+    if (current_device == NULL)
+    {
+        current_device = bpf_map_lookup_elem(&devices, ip_info->dst_ip);
+        if (current_device == NULL)
+        {
+            emit_drop_event(ip_info, NULL, DROP_NO_DEVICE);
+            return 0;
         }
+
+        // Our device is the dst, so what we need to check in the firewall is the src
+        address = ip_info->src_ip;
+        device_address = ip_info->dst_ip;
+        port = ip_info->src_port;
+        device_port = ip_info->dst_port;
+        inbound = 1;
+    }
+
+    port = bpf_ntohs(port);
+    device_port = bpf_ntohs(device_port);
+
+    // Stop clang from turning inbound back into a test of the device pointer, which the verifier rejects
+    asm volatile("" : "+r"(inbound));
+
+    struct flow_key flow = {0};
+    int established = lookup_flow(ip_info, inbound, &flow);
+
+    int matched_route = 0;
+    int outbound_only = 0;
+    __u32 verdict = check_policies(ip_info, current_device, address, port, device_port, inbound && !established, &matched_route, &outbound_only);
+    int allowed = verdict == ALLOWED;
+
+    // Start or refresh the flow, so replies to the device are allowed by outbound only policies
+    if (allowed && ((!inbound && outbound_only) || established))
+    {
+        __u64 now = bpf_ktime_get_ns();
+        bpf_map_update_elem(&flows, &flow, &now, BPF_ANY);
+    }
+
+    count(get_counters(&device_stats, device_address), allowed, packet_length);
+
+    if (matched_route)
+    {
+        struct rule_stats_key rule_key = {0};
+
+        __builtin_memcpy(rule_key.user_id, current_device->user_id, MAX_USERID_LENGTH);
+        __builtin_memcpy(rule_key.addr, address, IP_ADDRESS_LENGTH);
+        rule_key.proto = ip_info->proto;
+        rule_key.port = port;
+
+        count(get_counters(&rule_stats, &rule_key), allowed, packet_length);
+    }
+
+    if (!allowed)
+    {
+        emit_drop_event(ip_info, current_device->user_id, verdict);
     }
 
-    return 0;
+    return allowed;
 }
 
 SEC("xdp")
@@ -569,10 +1123,11 @@ int xdp_wag_firewall(struct xdp_md *ctx)
     struct ip ip_info = {0};
     if (!parse_ip_src_dst_addr(ctx, &ip_info))
     {
+        emit_drop_event(&ip_info, NULL, DROP_MALFORMED);
         return XDP_DROP;
     }
 
-    if (conntrack(&ip_info))
+    if (conntrack(&ip_info, ctx->data_end - ctx->data))
     {
         return XDP_PASS;
     }
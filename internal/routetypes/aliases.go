@@ -0,0 +1,175 @@
+package routetypes
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aliases are named sets of services (e.g "ssh": ["22/tcp"]) and hosts (e.g "db-tier": ["10.1.0.0/24", "db.internal"]) that rules can use instead of repeating ports and addresses
+type Aliases struct {
+	Services map[string][]string
+	Hosts    map[string][]string
+}
+
+var (
+	aliasesLock    sync.RWMutex
+	currentAliases Aliases
+)
+
+// SetAliases sets the aliases that ParseRules, ValidateRules and friends will expand
+func SetAliases(a Aliases) {
+	aliasesLock.Lock()
+	defer aliasesLock.Unlock()
+
+	currentAliases = a
+}
+
+func getAliases() Aliases {
+	aliasesLock.RLock()
+	defer aliasesLock.RUnlock()
+
+	return currentAliases
+}
+
+// Validate checks alias names are usable in rules and that every service and host they contain is valid
+func (a Aliases) Validate() error {
+	for _, name := range sortedKeys(a.Services) {
+		if _, ok := portlessProtocols[strings.ToLower(name)]; ok {
+			return fmt.Errorf("service alias %q is not a valid name, it cannot be a protocol", name)
+		}
+
+		if _, ok := directions[strings.ToLower(name)]; ok {
+			return fmt.Errorf("service alias %q is not a valid name, it cannot be a direction", name)
+		}
+
+		if name == "" || strings.ContainsAny(name, "/: \t@") {
+			return fmt.Errorf("service alias %q is not a valid name, it cannot contain '/', ':', '@' or spaces", name)
+		}
+
+		if len(a.Services[name]) == 0 {
+			return fmt.Errorf("service alias %q has no services", name)
+		}
+
+		for _, service := range a.Services[name] {
+			if _, err := parseService(service); err != nil {
+				return fmt.Errorf("service alias %q: %s", name, err)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(a.Hosts) {
+		if name == "" || strings.ContainsAny(name, " \t") || net.ParseIP(name) != nil {
+			return fmt.Errorf("host alias %q is not a valid name, it cannot be an address or contain spaces", name)
+		}
+
+		if _, _, err := net.ParseCIDR(name); err == nil {
+			return fmt.Errorf("host alias %q is not a valid name, it cannot be an address", name)
+		}
+
+		if len(a.Hosts[name]) == 0 {
+			return fmt.Errorf("host alias %q has no hosts", name)
+		}
+
+		for _, host := range a.Hosts[name] {
+			if _, ok := a.Hosts[host]; ok {
+				return fmt.Errorf("host alias %q: cannot contain another alias (%s)", name, host)
+			}
+
+			if _, err := parseAddress(host); err != nil {
+				return fmt.Errorf("host alias %q: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateRules is the same as the package level ValidateRules, but expands these aliases rather than the current ones
+func (a Aliases) ValidateRules(mfa, public, deny []string) error {
+	_, err := a.parseRules(time.Now(), mfa, public, deny)
+	return err
+}
+
+// expandRule turns a rule using aliases into the rules it represents, e.g `db-tier ssh` into `10.1.0.0/24 22/tcp` and `db.internal 22/tcp`
+func (a Aliases) expandRule(rule string) []string {
+	fields := strings.Fields(rule)
+	if len(fields) < 1 {
+		return []string{rule}
+	}
+
+	var services []string
+	for i, field := range fields[1:] {
+		// Anything after the schedule is left untouched
+		if isScheduleField(field) {
+			services = append(services, fields[1+i:]...)
+			break
+		}
+
+		if expanded, ok := a.Services[field]; ok {
+			services = append(services, expanded...)
+			continue
+		}
+
+		services = append(services, field)
+	}
+
+	hosts := []string{fields[0]}
+	if expanded, ok := a.Hosts[fields[0]]; ok {
+		hosts = expanded
+	}
+
+	result := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		result = append(result, strings.Join(append([]string{host}, services...), " "))
+	}
+
+	return result
+}
+
+// expandRules expands the aliases in every rule
+func (a Aliases) expandRules(rules []string) (result []string) {
+	for _, rule := range rules {
+		result = append(result, a.expandRule(rule)...)
+	}
+
+	return result
+}
+
+// aliasFor describes where an expanded rule came from, so errors can name the alias
+func (a Aliases) aliasFor(rule string) string {
+	fields := strings.Fields(rule)
+	if len(fields) < 1 {
+		return ""
+	}
+
+	var used []string
+	if _, ok := a.Hosts[fields[0]]; ok {
+		used = append(used, "host alias "+fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		if isScheduleField(field) {
+			break
+		}
+
+		if _, ok := a.Services[field]; ok {
+			used = append(used, "service alias "+field)
+		}
+	}
+
+	return strings.Join(used, ", ")
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
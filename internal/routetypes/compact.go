@@ -0,0 +1,150 @@
+package routetypes
+
+import (
+	"math"
+	"sort"
+)
+
+type portRange struct {
+	lower, upper int
+}
+
+// compactPolicies removes duplicate policies, and merges overlapping or adjacent port ranges of the same type and protocol
+//
+// The firewall stops at the first mfa or deny policy that matches, and otherwise allows if any public policy matched.
+// So the order of policies only matters between types, mfa, public then deny as ParseRules adds them, and within a type
+// any policies can be combined as long as they still cover exactly the same protocols, ports and source ports.
+// Step up policies are moved ahead of the other mfa policies, so they win when both cover the same port.
+func compactPolicies(policies []Policy) []Policy {
+
+	// Policies are only merged with others of the same type and source ports
+	type group struct {
+		restriction uint16
+		source      portRange
+	}
+
+	var (
+		order  []group
+		byType = map[group]map[uint16][]portRange{}
+	)
+
+	for _, policy := range policies {
+		g := group{
+			restriction: policy.PolicyType &^ uint16(RANGE|SINGLE),
+			source:      portRange{int(policy.SourceLowerPort), int(policy.SourceUpperPort)},
+		}
+
+		if _, ok := byType[g]; !ok {
+			byType[g] = map[uint16][]portRange{}
+			order = append(order, g)
+		}
+
+		pr := portRange{int(policy.LowerPort), int(policy.UpperPort)}
+		if policy.Is(SINGLE) {
+			pr.upper = pr.lower
+			if policy.LowerPort == ANY {
+				pr = portRange{0, math.MaxUint16}
+			}
+		}
+
+		byType[g][policy.Proto] = append(byType[g][policy.Proto], pr)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].restriction&uint16(STEPUP) != 0 && order[j].restriction&uint16(STEPUP) == 0
+	})
+
+	result := make([]Policy, 0, len(policies))
+	for _, g := range order {
+
+		protocols := byType[g]
+
+		anyProto := mergeRanges(protocols[ANY])
+
+		var protos []int
+		for proto := range protocols {
+			protos = append(protos, int(proto))
+		}
+		sort.Ints(protos)
+
+		for _, proto := range protos {
+
+			ranges := mergeRanges(protocols[uint16(proto)])
+			switch proto {
+			case ANY:
+			case ICMP, ICMPv6:
+				ranges = withoutCovered(ranges, icmpCovering(anyProto))
+			default:
+				ranges = withoutCovered(ranges, anyProto)
+			}
+
+			for _, pr := range ranges {
+				policy := rangeToPolicy(g.restriction, uint16(proto), pr)
+				policy.SourceLowerPort = uint16(g.source.lower)
+				policy.SourceUpperPort = uint16(g.source.upper)
+
+				result = append(result, policy)
+			}
+		}
+	}
+
+	return result
+}
+
+func mergeRanges(ranges []portRange) (merged []portRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].lower < ranges[j].lower
+	})
+
+	for _, pr := range ranges {
+		last := len(merged) - 1
+		if last >= 0 && pr.lower <= merged[last].upper+1 {
+			if pr.upper > merged[last].upper {
+				merged[last].upper = pr.upper
+			}
+			continue
+		}
+
+		merged = append(merged, pr)
+	}
+
+	return merged
+}
+
+// withoutCovered drops ranges that are entirely covered by one of the covering ranges
+func withoutCovered(ranges, covering []portRange) (result []portRange) {
+outer:
+	for _, pr := range ranges {
+		for _, c := range covering {
+			if c.lower <= pr.lower && c.upper >= pr.upper {
+				continue outer
+			}
+		}
+
+		result = append(result, pr)
+	}
+
+	return result
+}
+
+// icmpCovering returns the icmp types and codes covered by policies for any protocol, which match icmp as if it were port 0
+func icmpCovering(anyProto []portRange) []portRange {
+	for _, pr := range anyProto {
+		if pr.lower == 0 {
+			return []portRange{{0, math.MaxUint16}}
+		}
+	}
+
+	return nil
+}
+
+func rangeToPolicy(restriction, proto uint16, pr portRange) Policy {
+	switch {
+	case pr.lower == 0 && pr.upper == math.MaxUint16:
+		return Policy{PolicyType: restriction | SINGLE, Proto: proto, LowerPort: ANY}
+	case pr.lower == pr.upper && pr.lower != ANY:
+		return Policy{PolicyType: restriction | SINGLE, Proto: proto, LowerPort: uint16(pr.lower)}
+	default:
+		return Policy{PolicyType: restriction | RANGE, Proto: proto, LowerPort: uint16(pr.lower), UpperPort: uint16(pr.upper)}
+	}
+}
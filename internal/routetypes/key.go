@@ -5,55 +5,134 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
+// ipv4 addresses are stored in the trie as ipv4-mapped ipv6 addresses (::ffff:a.b.c.d) so that both families can share one LPM trie
+const ipv4MappedPrefixLen = 96
+
 type Key struct {
 
-	// first member must be a prefix u32 wide
-	// rest can are arbitrary
+	// Prefix length relative to the address family, e.g 24 for an ipv4 /24 and 64 for an ipv6 /64
 	Prefixlen uint32
-	IP        [4]byte
+	IP        [16]byte
+}
+
+func NewKey(address net.IPNet) Key {
+	maskLength, _ := address.Mask.Size()
+
+	var k Key
+	k.Prefixlen = uint32(maskLength)
+	copy(k.IP[:], address.IP.To16())
+
+	return k
+}
+
+// IsIPv4 is decided by the prefix length as well as the address, an ipv6 rule inside ::ffff:0:0/96 has a mapped address but
+// its prefix length is always longer than an ipv4 one, as anything of /80 or shorter masks away the ffff
+func (l *Key) IsIPv4() bool {
+	return l.Prefixlen <= net.IPv4len*8 && net.IP(l.IP[:]).To4() != nil
 }
 
 func (l *Key) AsIP() net.IP {
-	return net.IP(l.IP[:]).To4()
+	if l.IsIPv4() {
+		return net.IP(l.IP[:]).To4()
+	}
+
+	return net.IP(l.IP[:])
+}
+
+// Contains returns true if ip falls within the prefix described by this key
+func (l *Key) Contains(ip net.IP) bool {
+	bits := net.IPv6len * 8
+	if l.IsIPv4() {
+		bits = net.IPv4len * 8
+	}
+
+	network := net.IPNet{
+		IP:   l.AsIP(),
+		Mask: net.CIDRMask(int(l.Prefixlen), bits),
+	}
+
+	return network.Contains(ip)
 }
 
 func (l Key) Bytes() []byte {
-	output := make([]byte, 8)
-	binary.LittleEndian.PutUint32(output[0:4], l.Prefixlen)
+	prefixlen := l.Prefixlen
+	if l.IsIPv4() {
+		prefixlen += ipv4MappedPrefixLen
+	}
+
+	output := make([]byte, 20)
+	binary.LittleEndian.PutUint32(output[0:4], prefixlen)
 	copy(output[4:], l.IP[:])
 
 	return output
 }
 
 func (l *Key) Unpack(b []byte) error {
-	if len(b) != 8 {
+	if len(b) != 20 {
 		return errors.New("too short")
 	}
 
 	l.Prefixlen = binary.LittleEndian.Uint32(b[:4])
 
-	copy(l.IP[:], b[4:8])
+	copy(l.IP[:], b[4:20])
+
+	// The stored prefix length is relative to the whole trie, so any mapped address with at least the mapped prefix is an ipv4 key
+	if net.IP(l.IP[:]).To4() != nil && l.Prefixlen >= ipv4MappedPrefixLen {
+		l.Prefixlen -= ipv4MappedPrefixLen
+	}
 
 	return nil
 }
 
+// MarshalBinary and UnmarshalBinary are used by the ebpf library when Key is used directly with map operations
+func (l Key) MarshalBinary() ([]byte, error) {
+	return l.Bytes(), nil
+}
+
+func (l *Key) UnmarshalBinary(b []byte) error {
+	return l.Unpack(b)
+}
+
 func (l Key) String() string {
-	return fmt.Sprintf("%s/%d", net.IP(l.IP[:]).To4().String(), l.Prefixlen)
+	return fmt.Sprintf("%s/%d", l.AsIP().String(), l.Prefixlen)
 }
 
-func lookupProtocol(t uint16) string {
-	switch t {
-	case ANY:
+// LookupProtocol returns the name of the protocol number as used in rules
+func LookupProtocol(t uint16) string {
+	if t == ANY {
 		return "any"
-	case TCP:
-		return "tcp"
-	case UDP:
-		return "udp"
-	case ICMP:
-		return "icmp"
-	default:
-		return fmt.Sprintf("unknown(%d)", t)
 	}
+
+	for _, protocols := range []map[string]uint16{portProtocols, portlessProtocols} {
+		for name, number := range protocols {
+			if number == t {
+				return name
+			}
+		}
+	}
+
+	return fmt.Sprintf("proto/%d", t)
+}
+
+// ProtocolNumber is the inverse of LookupProtocol, returning the protocol number for a protocol name used in rules
+func ProtocolNumber(name string) (uint16, error) {
+	name = strings.ToLower(name)
+
+	if number, ok := portProtocols[name]; ok {
+		return number, nil
+	}
+
+	if number, ok := portlessProtocols[name]; ok {
+		return number, nil
+	}
+
+	if strings.HasPrefix(name, "proto/") {
+		policy, err := parseProtocolNumber(name, []string{strings.TrimPrefix(name, "proto/")})
+		return policy.Proto, err
+	}
+
+	return 0, errors.New("unknown protocol: " + name)
 }
@@ -4,104 +4,198 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	MAX_POLICIES = 128
-
-	ICMP = 1  // Internet Control Message
-	TCP  = 6  // Transmission Control
-	UDP  = 17 // User Datagram
+	MAX_POLICIES = 1024
+
+	ICMP   = 1   // Internet Control Message
+	TCP    = 6   // Transmission Control
+	UDP    = 17  // User Datagram
+	GRE    = 47  // Generic Routing Encapsulation
+	ESP    = 50  // Encapsulating Security Payload
+	ICMPv6 = 58  // Internet Control Message for IPv6
+	SCTP   = 132 // Stream Control Transmission
 )
 
+// Protocols that have ports, and so can be used with port numbers and ranges in rules
+var portProtocols = map[string]uint16{
+	"any":  ANY,
+	"tcp":  TCP,
+	"udp":  UDP,
+	"sctp": SCTP,
+}
+
+// Rule keywords that set which direction connections can be started in, bidirectional is the default
+var directions = map[string]PolicyType{
+	"outbound":      OUTBOUND,
+	"bidirectional": 0,
+}
+
+// Protocols that have no ports, and so can be used on their own in rules, e.g `gre`
+var portlessProtocols = map[string]uint16{
+	"icmp":   ICMP,
+	"icmpv6": ICMPv6,
+	"gre":    GRE,
+	"esp":    ESP,
+}
+
 type Rule struct {
 	//We may have multiple keys in the instance where a domain with multiple A/AAA records is passed in
 	Keys []Key
 
 	NumPolicies int
 	Values      []Policy
+
+	// nil if the rule always applies
+	Schedule *Schedule
 }
 
+// ParseRules parses acl rules into what the firewall needs, rules with a schedule that is not currently active are left out
 func ParseRules(mfa, public, deny []string) (result []Rule, err error) {
+	return ParseRulesAt(time.Now(), mfa, public, deny)
+}
+
+// ParseRulesAt is ParseRules for rules as they would be at time now
+func ParseRulesAt(now time.Time, mfa, public, deny []string) (result []Rule, err error) {
+	return getAliases().parseRules(now, mfa, public, deny)
+}
+
+func (a Aliases) parseRules(now time.Time, mfa, public, deny []string) (result []Rule, err error) {
 
 	cache := map[string]int{}
-	// Add
-	for _, rule := range mfa {
-		r, err := parseRule(0, rule)
-		if err != nil {
-			return nil, err
-		}
 
-		for i := range r.Keys {
-			if index, ok := cache[r.Keys[i].String()]; ok {
-				// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
-				result[index].Values = append(result[index].Values, r.Values...)
-				continue
-			}
+	// Order matters here, the firewall stops at the first mfa or deny policy that matches, so mfa policies must come first
+	for _, restrictions := range []struct {
+		policyType PolicyType
+		rules      []string
+	}{
+		{0, mfa},
+		{PUBLIC, public},
+		{DENY, deny},
+	} {
+		for _, aliasedRule := range restrictions.rules {
+			for _, rule := range a.expandRule(aliasedRule) {
+				r, err := parseRule(restrictions.policyType, rule)
+				if err != nil {
+					if alias := a.aliasFor(aliasedRule); alias != "" {
+						return nil, fmt.Errorf("rule %q using %s: %s", aliasedRule, alias, err)
+					}
+					return nil, err
+				}
+
+				if r.Schedule != nil && !r.Schedule.Active(now) {
+					continue
+				}
 
-			result = append(result, r)
-			cache[r.Keys[i].String()] = len(result) - 1
+				for i := range r.Keys {
+					// Rules are only merged with others that have the same schedule, so each result keeps the schedule it applies under
+					mergeKey := r.Keys[i].String()
+					if r.Schedule != nil {
+						mergeKey += " " + r.Schedule.String()
+					}
+
+					if index, ok := cache[mergeKey]; ok {
+						result[index].Values = append(result[index].Values, r.Values...)
+						continue
+					}
+
+					// Each key gets its own copy, as a domain rule may have many keys which will be merged with different rules
+					result = append(result, Rule{
+						Keys:     []Key{r.Keys[i]},
+						Values:   append([]Policy{}, r.Values...),
+						Schedule: r.Schedule,
+					})
+					cache[mergeKey] = len(result) - 1
+				}
+			}
 		}
 	}
 
-	for _, rule := range public {
-		r, err := parseRule(PUBLIC, rule)
-		if err != nil {
-			return nil, err
-		}
+	if err := finaliseRules(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
 
-		for i := range r.Keys {
-			if index, ok := cache[r.Keys[i].String()]; ok {
-				// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
-				result[index].Values = append(result[index].Values, r.Values...)
+// MergeSchedules combines rules for the same route that ParseRules kept apart because of their schedules, as the firewall
+// only has one policy set per route. The merged rules have no schedule, as ParseRules only returns rules that are active
+func MergeSchedules(rules []Rule) ([]Rule, error) {
+	var (
+		merged []Rule
+		cache  = map[string]int{}
+	)
+
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			if index, ok := cache[key.String()]; ok {
+				merged[index].Values = append(merged[index].Values, rule.Values[:rule.NumPolicies]...)
 				continue
 			}
 
-			result = append(result, r)
-			cache[r.Keys[i].String()] = len(result) - 1
+			merged = append(merged, Rule{
+				Keys:   []Key{key},
+				Values: append([]Policy{}, rule.Values[:rule.NumPolicies]...),
+			})
+			cache[key.String()] = len(merged) - 1
 		}
 	}
 
-	for _, rule := range deny {
-		r, err := parseRule(DENY, rule)
-		if err != nil {
-			return nil, err
-		}
+	// Each rule has its mfa, public then deny policies in order, which has to still hold once they are combined
+	for i := range merged {
+		sort.SliceStable(merged[i].Values, func(a, b int) bool {
+			return restrictionOrder(merged[i].Values[a]) < restrictionOrder(merged[i].Values[b])
+		})
+	}
 
-		for i := range r.Keys {
-			if index, ok := cache[r.Keys[i].String()]; ok {
-				// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
-				result[index].Values = append(result[index].Values, r.Values...)
-				continue
-			}
+	if err := finaliseRules(merged); err != nil {
+		return nil, err
+	}
 
-			result = append(result, r)
-			cache[r.Keys[i].String()] = len(result) - 1
-		}
+	return merged, nil
+}
+
+func restrictionOrder(p Policy) int {
+	switch {
+	case p.Is(DENY):
+		return 2
+	case p.Is(PUBLIC):
+		return 1
 	}
 
-	for i := range result {
-		if len(result[i].Values) > MAX_POLICIES {
-			return nil, errors.New("number of policies defined was greather than max")
+	return 0
+}
+
+// finaliseRules compacts the policies of each rule, and pads them out to the fixed size the firewall expects
+func finaliseRules(rules []Rule) error {
+	for i := range rules {
+		// Many groups often add the same or overlapping ports to a route, so squash them down before checking against the limit
+		rules[i].Values = compactPolicies(rules[i].Values)
+
+		if len(rules[i].Values) > MAX_POLICIES {
+			return fmt.Errorf("number of policies for %s was %d after merging duplicate and overlapping ports, greater than the max of %d", rules[i].Keys[0].String(), len(rules[i].Values), MAX_POLICIES)
 		}
 
 		temp := make([]Policy, 0, MAX_POLICIES)
-		temp = append(temp, result[i].Values...)
+		temp = append(temp, rules[i].Values...)
 
-		result[i].NumPolicies = len(result[i].Values)
+		rules[i].NumPolicies = len(rules[i].Values)
 
-		result[i].Values = temp[:cap(temp)]
+		rules[i].Values = temp[:cap(temp)]
 	}
 
-	return
+	return nil
 }
 
 func AclsToRoutes(rules []string) (routes []string, err error) {
 
 	deduplication := map[string]bool{}
-	for _, rule := range rules {
+	for _, rule := range getAliases().expandRules(rules) {
 		ruleParts := strings.Fields(rule)
 		if len(ruleParts) < 1 {
 			return nil, errors.New("could not split correct number of rules")
@@ -152,7 +246,54 @@ func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error)
 
 	} else {
 
-		for _, field := range ruleParts[1:] {
+		var (
+			direction  *PolicyType
+			stepUp     bool
+			sourcePort *portRange
+		)
+		for i, field := range ruleParts[1:] {
+			if isScheduleField(field) {
+				rules.Schedule, err = parseSchedule(ruleParts[1+i:])
+				if err != nil {
+					return rules, err
+				}
+				break
+			}
+
+			if d, ok := directions[strings.ToLower(field)]; ok {
+				if restrictionType&DENY != 0 {
+					return rules, errors.New("deny rules cannot have a direction: " + field)
+				}
+
+				if direction != nil && *direction != d {
+					return rules, errors.New("rule has conflicting directions: " + rule)
+				}
+
+				direction = &d
+				continue
+			}
+
+			if strings.HasPrefix(strings.ToLower(field), "sport/") {
+				if sourcePort != nil {
+					return rules, errors.New("rule has more than one source port: " + rule)
+				}
+
+				sourcePort, err = parseSourcePort(field)
+				if err != nil {
+					return rules, err
+				}
+				continue
+			}
+
+			if strings.ToLower(field) == "stepup" {
+				if restrictionType&(PUBLIC|DENY) != 0 {
+					return rules, errors.New("only mfa rules can require step up: " + rule)
+				}
+
+				stepUp = true
+				continue
+			}
+
 			policy, err := parseService(field)
 			if err != nil {
 				return rules, err
@@ -162,6 +303,46 @@ func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error)
 
 			rules.Values = append(rules.Values, policy)
 		}
+
+		// Source ports only make sense for services with ports, and an any/any rule would silently drop everything else
+		if sourcePort != nil {
+			if len(rules.Values) == 0 {
+				return rules, errors.New("source ports can only be used with tcp, udp or sctp services: " + rule)
+			}
+
+			for i := range rules.Values {
+				switch rules.Values[i].Proto {
+				case TCP, UDP, SCTP:
+				default:
+					return rules, errors.New("source ports can only be used with tcp, udp or sctp services: " + rule)
+				}
+
+				rules.Values[i].SourceLowerPort = uint16(sourcePort.lower)
+				rules.Values[i].SourceUpperPort = uint16(sourcePort.upper)
+			}
+		}
+
+		// Only a schedule, direction or step up was given, so it is an any/any rule
+		if len(rules.Values) == 0 {
+			rules.Values = append(rules.Values, Policy{
+				PolicyType: uint16(restrictionType) | SINGLE,
+				Proto:      ANY,
+				LowerPort:  ANY,
+			})
+		}
+
+		// The direction applies to every service in the rule, wherever it was given
+		if direction != nil {
+			for i := range rules.Values {
+				rules.Values[i].PolicyType |= uint16(*direction)
+			}
+		}
+
+		if stepUp {
+			for i := range rules.Values {
+				rules.Values[i].PolicyType |= uint16(STEPUP)
+			}
+		}
 	}
 
 	return
@@ -174,15 +355,7 @@ func parseKeys(address string) (keys []Key, err error) {
 	}
 
 	for _, ip := range resultingAddresses {
-
-		maskLength, _ := ip.Mask.Size()
-
-		keys = append(keys,
-			Key{
-				Prefixlen: uint32(maskLength),
-				IP:        [4]byte{ip.IP.To4()[0], ip.IP.To4()[1], ip.IP.To4()[2], ip.IP.To4()[3]},
-			},
-		)
+		keys = append(keys, NewKey(ip))
 	}
 
 	return
@@ -197,19 +370,25 @@ func parseService(service string) (Policy, error) {
 	parts := strings.Split(service, "/")
 	if len(parts) == 1 {
 		// are declarations like `icmp` which dont have a port
-		switch parts[0] {
-		case "icmp":
-
-			return Policy{
-				PolicyType: SINGLE,
-				Proto:      ICMP,
-				LowerPort:  0,
-			}, nil
-
-		default:
+		proto, ok := portlessProtocols[strings.ToLower(parts[0])]
+		if !ok {
 			return Policy{}, errors.New("malformed port/service declaration: " + service)
 		}
 
+		return Policy{
+			PolicyType: SINGLE,
+			Proto:      proto,
+			LowerPort:  ANY,
+		}, nil
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "proto":
+		return parseProtocolNumber(service, parts[1:])
+	case "icmp":
+		return parseICMP(ICMP, service, parts[1:])
+	case "icmpv6":
+		return parseICMP(ICMPv6, service, parts[1:])
 	}
 
 	portRange := strings.Split(parts[0], "-")
@@ -222,82 +401,139 @@ func parseService(service string) (Policy, error) {
 	return parsePortRange(portRange[0], portRange[1], proto)
 }
 
-func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
-	lowerPortNum, err := strconv.Atoi(lowerPort)
-	if err != nil {
-		return Policy{}, errors.New("could not convert lower port defintion to number: " + lowerPort)
+// parseSourcePort parses `sport/<port>` and `sport/<lower>-<upper>`, the port the device sends from
+func parseSourcePort(field string) (*portRange, error) {
+	ports := strings.SplitN(field[len("sport/"):], "-", 2)
+
+	lower, err := strconv.Atoi(ports[0])
+	if err != nil || lower < 1 || lower > 65535 {
+		return nil, errors.New("invalid source port, expected 1-65535: " + field)
 	}
 
-	upperPortNum, err := strconv.Atoi(upperPort)
-	if err != nil {
-		return Policy{}, errors.New("could not convert upper port defintion to number: " + upperPort)
+	upper := lower
+	if len(ports) == 2 {
+		upper, err = strconv.Atoi(ports[1])
+		if err != nil || upper < 1 || upper > 65535 {
+			return nil, errors.New("invalid source port, expected 1-65535: " + field)
+		}
 	}
 
-	if lowerPortNum > upperPortNum {
-		return Policy{}, errors.New("lower port cannot be higher than upper power: lower: " + lowerPort + " upper: " + upperPort)
+	if lower > upper {
+		return nil, errors.New("lower source port cannot be higher than the upper port: " + field)
+	}
+
+	return &portRange{lower, upper}, nil
+}
+
+// parseProtocolNumber parses `proto/47`, which allows all traffic of that ip protocol
+func parseProtocolNumber(service string, parts []string) (Policy, error) {
+	if len(parts) != 1 {
+		return Policy{}, errors.New("malformed protocol declaration, expected proto/<number>: " + service)
 	}
 
-	switch proto {
-	case "any":
+	proto, err := strconv.Atoi(parts[0])
+	if err != nil || proto < 1 || proto > 255 {
+		return Policy{}, errors.New("invalid protocol number, expected 1-255: " + service)
+	}
 
-		return Policy{
-			PolicyType: RANGE,
-			Proto:      ANY,
+	return Policy{
+		PolicyType: SINGLE,
+		Proto:      uint16(proto),
+		LowerPort:  ANY,
+	}, nil
+}
 
-			LowerPort: uint16(lowerPortNum),
-			UpperPort: uint16(upperPortNum),
-		}, nil
+// parseICMP parses `icmp/<type>` and `icmp/<type>/<code>`, or the same for `icmpv6` which has its own type numbers
+func parseICMP(proto uint16, service string, parts []string) (Policy, error) {
+	name := LookupProtocol(proto)
 
-	case "tcp", "udp":
+	if len(parts) > 2 {
+		return Policy{}, fmt.Errorf("malformed %s declaration, expected %s/<type> or %s/<type>/<code>: %s", name, name, name, service)
+	}
 
-		service := TCP
-		if proto == "udp" {
-			service = UDP
-		}
+	icmpType, err := strconv.Atoi(parts[0])
+	if err != nil || icmpType < 0 || icmpType > 255 {
+		return Policy{}, fmt.Errorf("invalid %s type, expected 0-255: %s", name, service)
+	}
 
+	if len(parts) == 1 {
 		return Policy{
 			PolicyType: RANGE,
-
-			Proto:     uint16(service),
-			LowerPort: uint16(lowerPortNum),
-			UpperPort: uint16(upperPortNum),
+			Proto:      proto,
+			LowerPort:  ICMPPort(uint8(icmpType), 0),
+			UpperPort:  ICMPPort(uint8(icmpType), 255),
 		}, nil
 	}
 
-	return Policy{}, errors.New("unknown service: " + proto)
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 0 || code > 255 {
+		return Policy{}, fmt.Errorf("invalid %s code, expected 0-255: %s", name, service)
+	}
+
+	// Always a range, as a single port of 0 means any
+	return Policy{
+		PolicyType: RANGE,
+		Proto:      proto,
+		LowerPort:  ICMPPort(uint8(icmpType), uint8(code)),
+		UpperPort:  ICMPPort(uint8(icmpType), uint8(code)),
+	}, nil
+}
 
+// ICMPPort is how the firewall matches icmp messages, the type and code take the place of the port
+func ICMPPort(icmpType, code uint8) uint16 {
+	return uint16(icmpType)<<8 | uint16(code)
 }
 
-func parseSinglePort(port, proto string) (Policy, error) {
-	portNumber, err := strconv.Atoi(port)
+// IsICMP returns true for the protocols whose type and code are matched with ICMPPort
+func IsICMP(proto uint16) bool {
+	return proto == ICMP || proto == ICMPv6
+}
+
+func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
+	lowerPortNum, err := strconv.Atoi(lowerPort)
 	if err != nil {
-		return Policy{}, errors.New("could not convert port defintion to number: " + port)
+		return Policy{}, errors.New("could not convert lower port defintion to number: " + lowerPort)
 	}
 
-	switch proto {
-	case "any":
+	upperPortNum, err := strconv.Atoi(upperPort)
+	if err != nil {
+		return Policy{}, errors.New("could not convert upper port defintion to number: " + upperPort)
+	}
 
-		return Policy{
-			PolicyType: SINGLE,
-			Proto:      ANY,
-			LowerPort:  uint16(portNumber),
-		}, nil
+	if lowerPortNum > upperPortNum {
+		return Policy{}, errors.New("lower port cannot be higher than upper power: lower: " + lowerPort + " upper: " + upperPort)
+	}
 
-	case "tcp", "udp":
+	service, ok := portProtocols[proto]
+	if !ok {
+		return Policy{}, errors.New("unknown service: " + proto)
+	}
 
-		service := TCP
-		if proto == "udp" {
-			service = UDP
-		}
+	return Policy{
+		PolicyType: RANGE,
 
-		return Policy{
-			PolicyType: SINGLE,
-			Proto:      uint16(service),
-			LowerPort:  uint16(portNumber),
-		}, nil
+		Proto:     service,
+		LowerPort: uint16(lowerPortNum),
+		UpperPort: uint16(upperPortNum),
+	}, nil
+}
+
+func parseSinglePort(port, proto string) (Policy, error) {
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return Policy{}, errors.New("could not convert port defintion to number: " + port)
 	}
 
-	return Policy{}, errors.New("unknown service: " + port + "/" + proto)
+	service, ok := portProtocols[proto]
+	if !ok {
+		return Policy{}, errors.New("unknown service: " + port + "/" + proto)
+	}
+
+	return Policy{
+		PolicyType: SINGLE,
+		Proto:      service,
+		LowerPort:  uint16(portNumber),
+	}, nil
 }
 
 func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
@@ -309,7 +545,7 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 		if err != nil {
 
 			//If we suspect this is a domain
-			addresses, err := net.LookupIP(address)
+			addresses, err := lookupDomain(address)
 			if err != nil {
 				return nil, fmt.Errorf("unable to resolve address from: %s", address)
 			}
@@ -318,16 +554,8 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 				return nil, fmt.Errorf("no addresses for %s", address)
 			}
 
-			addedSomething := false
 			for _, addr := range addresses {
-				if addr.To4() != nil {
-					addedSomething = true
-					resultAddresses = append(resultAddresses, net.IPNet{IP: addr.To4(), Mask: net.IPv4Mask(255, 255, 255, 255)})
-				}
-			}
-
-			if !addedSomething {
-				return nil, fmt.Errorf("no addresses for domain %s were added, potentially because they were all ipv6 which is unsupported", address)
+				resultAddresses = append(resultAddresses, hostNetwork(addr))
 			}
 
 			return resultAddresses, nil
@@ -336,11 +564,20 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 		return []net.IPNet{*cidr}, nil
 	}
 
-	// /32
-	return []net.IPNet{
-		{
+	// /32 or /128
+	return []net.IPNet{hostNetwork(ip)}, nil
+}
+
+func hostNetwork(ip net.IP) net.IPNet {
+	if ip.To4() != nil {
+		return net.IPNet{
 			IP:   ip.To4(),
-			Mask: net.IPv4Mask(255, 255, 255, 255),
-		},
-	}, nil
+			Mask: net.CIDRMask(32, 32),
+		}
+	}
+
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(128, 128),
+	}
 }
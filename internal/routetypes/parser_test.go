@@ -3,7 +3,10 @@ package routetypes
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 	"testing"
+	"time"
 )
 
 func checkKey(reality Key, expectedKey Key) error {
@@ -47,7 +50,7 @@ func checkPolicy(reality Policy, expectedValue Policy) error {
 func TestParseEasyRules(t *testing.T) {
 
 	expected := Key{
-		IP:        [4]byte{1, 1, 1, 1},
+		IP:        netip.MustParseAddr("1.1.1.1").As16(),
 		Prefixlen: 32,
 	}
 
@@ -127,7 +130,7 @@ func TestParseSimpleSingles(t *testing.T) {
 
 	expectedKey := Key{
 		Prefixlen: 32,
-		IP:        [4]byte{1, 2, 1, 2},
+		IP:        netip.MustParseAddr("1.2.1.2").As16(),
 	}
 
 	expectedValues := []Policy{
@@ -154,14 +157,14 @@ func TestParseSimpleSingles(t *testing.T) {
 	}
 
 	for _, key := range br.Keys {
-		if len(key.Bytes()) != 8 {
-			t.Fatal("rules generated key was not 8 bytes")
+		if len(key.Bytes()) != 20 {
+			t.Fatal("rules generated key was not 20 bytes")
 		}
 	}
 
 	for _, policy := range br.Values {
-		if len(policy.Bytes()) != 8 {
-			t.Fatal("policy generated was not 8 bytes")
+		if len(policy.Bytes()) != 12 {
+			t.Fatal("policy generated was not 12 bytes")
 		}
 	}
 
@@ -210,7 +213,7 @@ func TestParsePortRange(t *testing.T) {
 
 	expected := Key{
 		Prefixlen: 32,
-		IP:        [4]byte{1, 3, 1, 3},
+		IP:        netip.MustParseAddr("1.3.1.3").As16(),
 	}
 
 	expectedValue := Policy{
@@ -235,7 +238,7 @@ func TestParsePortRange(t *testing.T) {
 
 	expected = Key{
 		Prefixlen: 32,
-		IP:        [4]byte{1, 4, 1, 4},
+		IP:        netip.MustParseAddr("1.4.1.4").As16(),
 	}
 
 	expectedValue = Policy{
@@ -275,6 +278,49 @@ func TestParsePortRange(t *testing.T) {
 
 }
 
+func TestParseIPv6Rules(t *testing.T) {
+	br, err := parseRule(0, "fd00:1::/64 443/tcp")
+	if err != nil {
+		t.Fatal("failed to parse fd00:1::/64", err)
+	}
+
+	expected := Key{
+		Prefixlen: 64,
+		IP:        netip.MustParseAddr("fd00:1::").As16(),
+	}
+
+	if err := checkKey(br.Keys[0], expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkPolicy(br.Values[0], Policy{PolicyType: SINGLE, Proto: TCP, LowerPort: 443}); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err = parseRule(0, "fd00:1::5")
+	if err != nil {
+		t.Fatal("failed to parse fd00:1::5", err)
+	}
+
+	expected = Key{
+		Prefixlen: 128,
+		IP:        netip.MustParseAddr("fd00:1::5").As16(),
+	}
+
+	if err := checkKey(br.Keys[0], expected); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := AclsToRoutes([]string{"fd00:1::5", "fd00:2::/48 22/tcp", "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 3 || routes[0] != "fd00:1::5/128" || routes[1] != "fd00:2::/48" || routes[2] != "1.1.1.1/32" {
+		t.Fatal("mixed ipv4 and ipv6 routes were incorrect: ", routes)
+	}
+}
+
 func TestParseDomainRules(t *testing.T) {
 	_, err := parseRule(0, "google.com 443/tcp")
 	if err != nil {
@@ -329,3 +375,709 @@ func TestParseMalformed(t *testing.T) {
 	}
 
 }
+
+func TestParseProtocols(t *testing.T) {
+
+	br, err := parseRule(PUBLIC, "1.1.1.1 22/sctp 100-200/SCTP proto/47 gre esp icmp/8 icmp/3/4 icmp/0/0 icmpv6/128 proto/58 icmpv6/1/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Policy{
+		{PolicyType: PUBLIC | SINGLE, Proto: SCTP, LowerPort: 22},
+		{PolicyType: PUBLIC | RANGE, Proto: SCTP, LowerPort: 100, UpperPort: 200},
+		{PolicyType: PUBLIC | SINGLE, Proto: GRE, LowerPort: ANY},
+		{PolicyType: PUBLIC | SINGLE, Proto: GRE, LowerPort: ANY},
+		{PolicyType: PUBLIC | SINGLE, Proto: ESP, LowerPort: ANY},
+		{PolicyType: PUBLIC | RANGE, Proto: ICMP, LowerPort: 8 << 8, UpperPort: 8<<8 | 255},
+		{PolicyType: PUBLIC | RANGE, Proto: ICMP, LowerPort: 3<<8 | 4, UpperPort: 3<<8 | 4},
+		{PolicyType: PUBLIC | RANGE, Proto: ICMP, LowerPort: 0, UpperPort: 0},
+		{PolicyType: PUBLIC | RANGE, Proto: ICMPv6, LowerPort: 128 << 8, UpperPort: 128<<8 | 255},
+		{PolicyType: PUBLIC | SINGLE, Proto: ICMPv6, LowerPort: ANY},
+		{PolicyType: PUBLIC | RANGE, Proto: ICMPv6, LowerPort: 1<<8 | 4, UpperPort: 1<<8 | 4},
+	}
+
+	if len(br.Values) != len(expected) {
+		t.Fatalf("expected %d policies got %d: %+v", len(expected), len(br.Values), br.Values)
+	}
+
+	for i := range expected {
+		if br.Values[i] != expected[i] {
+			t.Fatalf("policy %d was %+v expected %+v", i, br.Values[i], expected[i])
+		}
+	}
+
+	if !br.Values[5].Matches(ICMP, ICMPPort(8, 0), 0) || br.Values[5].Matches(ICMP, ICMPPort(0, 0), 0) {
+		t.Fatal("icmp type policy matched the wrong types")
+	}
+
+	if !br.Values[7].Matches(ICMP, 0, 0) || br.Values[7].Matches(ICMP, ICMPPort(0, 1), 0) {
+		t.Fatal("icmp type 0 code 0 should only match echo reply")
+	}
+
+	// icmpv6 types overlap icmp types with different meanings, so neither protocol matches the others rules
+	if !br.Values[8].Matches(ICMPv6, ICMPPort(128, 0), 0) || br.Values[5].Matches(ICMPv6, ICMPPort(8, 0), 0) || br.Values[8].Matches(ICMP, ICMPPort(128, 0), 0) {
+		t.Fatal("icmp and icmpv6 policies should only match their own protocol")
+	}
+
+	if !br.Values[10].Matches(ICMPv6, ICMPPort(1, 4), 0) || br.Values[6].Matches(ICMPv6, ICMPPort(3, 4), 0) {
+		t.Fatal("icmpv6 destination unreachable was not matched by its own type")
+	}
+
+	anyPorts := Policy{PolicyType: RANGE, Proto: ANY, LowerPort: 1, UpperPort: 100}
+	if anyPorts.Matches(ICMP, ICMPPort(0, 50), 0) || anyPorts.Matches(ICMPv6, ICMPPort(1, 4), 0) || !anyPorts.Matches(SCTP, 50, 0) {
+		t.Fatal("port ranges for any protocol should apply to sctp but not icmp types")
+	}
+
+	for policy, str := range map[Policy]string{
+		expected[5]: " icmp/8",
+		expected[6]: " icmp/3/4",
+		expected[8]: " icmpv6/128",
+		expected[9]: " any/icmpv6",
+		expected[2]: " any/gre",
+		{PolicyType: SINGLE, Proto: 99, LowerPort: ANY}:        " any/proto/99",
+		{PolicyType: SINGLE, Proto: ICMP, LowerPort: 3<<8 | 4}: " icmp/3/4",
+	} {
+		if !strings.HasSuffix(policy.String(), str) {
+			t.Fatalf("expected %q got %q", str, policy.String())
+		}
+	}
+
+	for _, name := range []string{"sctp", "gre", "esp", "icmp", "proto/99"} {
+		number, err := ProtocolNumber(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if LookupProtocol(number) != name {
+			t.Fatalf("protocol %s did not round trip, got %s", name, LookupProtocol(number))
+		}
+	}
+
+	for _, malformed := range []string{"proto/0", "proto/256", "proto/gre", "proto/47/1", "icmp/256", "icmp/8/256", "icmp/a", "icmp/8/0/1", "22/gre", "sctp"} {
+		if _, err := parseService(malformed); err == nil {
+			t.Fatalf("%s should have failed to parse", malformed)
+		}
+	}
+
+	// Any protocol only covers icmp when it includes port 0
+	rules, err := ParseRules(nil, []string{"1.1.1.1 1-65535/any icmp/8", "2.2.2.2 0-10/any icmp/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules[0].NumPolicies != 2 || rules[1].NumPolicies != 1 {
+		t.Fatalf("icmp policies were not compacted correctly: %+v %+v", rules[0].Values[:rules[0].NumPolicies], rules[1].Values[:rules[1].NumPolicies])
+	}
+}
+
+func TestParseDirections(t *testing.T) {
+
+	br, err := parseRule(PUBLIC, "1.1.1.1 53/udp OUTBOUND 443/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(br.Values) != 2 || !br.Values[0].Is(OUTBOUND) || !br.Values[1].Is(OUTBOUND) {
+		t.Fatalf("direction should apply to every service in the rule: %+v", br.Values)
+	}
+
+	br, err = parseRule(0, "1.1.1.1 outbound @weekdays")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(br.Values) != 1 || br.Values[0] != (Policy{PolicyType: OUTBOUND | SINGLE, Proto: ANY, LowerPort: ANY}) {
+		t.Fatalf("direction on its own should be an any/any rule: %+v", br.Values)
+	}
+
+	br, err = parseRule(PUBLIC, "1.1.1.1 22/tcp bidirectional")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if br.Values[0].Is(OUTBOUND) {
+		t.Fatal("bidirectional rule should not be outbound")
+	}
+
+	if !strings.Contains((Policy{PolicyType: PUBLIC | OUTBOUND | SINGLE, Proto: TCP, LowerPort: 22}).String(), "outbound") {
+		t.Fatal("outbound policies should say so")
+	}
+
+	if _, err := parseRule(DENY, "1.1.1.1 outbound"); err == nil {
+		t.Fatal("deny rules should not be able to have a direction")
+	}
+
+	if _, err := parseRule(PUBLIC, "1.1.1.1 outbound 22/tcp bidirectional"); err == nil {
+		t.Fatal("conflicting directions should fail")
+	}
+
+	// Outbound and bidirectional policies for the same route are kept apart
+	rules, err := ParseRules(nil, []string{"1.1.1.1 22/tcp outbound", "1.1.1.1 23/tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules[0].NumPolicies != 2 || !rules[0].Values[0].Is(OUTBOUND) || rules[0].Values[1].Is(OUTBOUND) {
+		t.Fatalf("outbound policy was merged with bidirectional policy: %+v", rules[0].Values[:rules[0].NumPolicies])
+	}
+}
+
+func TestParseSourcePorts(t *testing.T) {
+
+	br, err := parseRule(PUBLIC, "1.1.1.1 123/udp sport/123 53/udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range br.Values {
+		if policy.SourceLowerPort != 123 || policy.SourceUpperPort != 123 {
+			t.Fatalf("source port should apply to every service in the rule: %+v", br.Values)
+		}
+	}
+
+	br, err = parseRule(0, "1.1.1.1 SPORT/1024-65535 22/tcp outbound")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if br.Values[0] != (Policy{PolicyType: OUTBOUND | SINGLE, Proto: TCP, LowerPort: 22, SourceLowerPort: 1024, SourceUpperPort: 65535}) {
+		t.Fatalf("source port range was wrong: %+v", br.Values[0])
+	}
+
+	if !br.Values[0].Matches(TCP, 22, 1024) || !br.Values[0].Matches(TCP, 22, 65535) || br.Values[0].Matches(TCP, 22, 1023) {
+		t.Fatal("source port range did not match the right ports")
+	}
+
+	if s := br.Values[0].String(); !strings.HasSuffix(s, "22/tcp sport/1024-65535") {
+		t.Fatal("source port range should be shown: ", s)
+	}
+
+	anySource := Policy{PolicyType: PUBLIC | SINGLE, Proto: UDP, LowerPort: 53}
+	if !anySource.Matches(UDP, 53, 0) || !anySource.Matches(UDP, 53, 40000) {
+		t.Fatal("policy without a source port should match any source port")
+	}
+
+	for _, rule := range []string{
+		"1.1.1.1 sport/53",               // No service, would be any/any
+		"1.1.1.1 icmp sport/53",          // No ports
+		"1.1.1.1 53/any sport/53",        // Includes protocols without ports
+		"1.1.1.1 53/udp sport/0",         // Not a port
+		"1.1.1.1 53/udp sport/65536",     //
+		"1.1.1.1 53/udp sport/2000-1000", // Backwards
+		"1.1.1.1 53/udp sport/a",         //
+		"1.1.1.1 53/udp sport/",          //
+		"1.1.1.1 53/udp sport/1 sport/2", // Conflicting
+	} {
+		if _, err := parseRule(PUBLIC, rule); err == nil {
+			t.Errorf("%q should have failed", rule)
+		}
+	}
+
+	// Policies with different source ports are kept apart, and the same source ports are merged
+	rules, err := ParseRules(nil, []string{"1.1.1.1 53/udp sport/53", "1.1.1.1 54/udp sport/53", "1.1.1.1 53/udp", "1.1.1.1 55/udp sport/1000-2000"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Policy{
+		{PolicyType: PUBLIC | RANGE, Proto: UDP, LowerPort: 53, UpperPort: 54, SourceLowerPort: 53, SourceUpperPort: 53},
+		{PolicyType: PUBLIC | SINGLE, Proto: UDP, LowerPort: 53},
+		{PolicyType: PUBLIC | SINGLE, Proto: UDP, LowerPort: 55, SourceLowerPort: 1000, SourceUpperPort: 2000},
+	}
+
+	if rules[0].NumPolicies != len(expected) {
+		t.Fatalf("expected %d policies got %+v", len(expected), rules[0].Values[:rules[0].NumPolicies])
+	}
+
+	for i := range expected {
+		if rules[0].Values[i] != expected[i] {
+			t.Fatalf("policy %d expected %+v got %+v", i, expected[i], rules[0].Values[i])
+		}
+	}
+}
+
+func TestParseStepUp(t *testing.T) {
+
+	br, err := parseRule(0, "1.1.1.1 22/tcp StepUp 3389/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(br.Values) != 2 || !br.Values[0].Is(STEPUP) || !br.Values[1].Is(STEPUP) {
+		t.Fatalf("step up should apply to every service in the rule: %+v", br.Values)
+	}
+
+	br, err = parseRule(0, "1.1.1.1 stepup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(br.Values) != 1 || br.Values[0] != (Policy{PolicyType: STEPUP | SINGLE, Proto: ANY, LowerPort: ANY}) {
+		t.Fatalf("step up on its own should be an any/any rule: %+v", br.Values)
+	}
+
+	if !strings.Contains(br.Values[0].String(), "stepup") {
+		t.Fatal("step up policies should say so")
+	}
+
+	if _, err := parseRule(PUBLIC, "1.1.1.1 22/tcp stepup"); err == nil {
+		t.Fatal("public rules should not be able to require step up")
+	}
+
+	if _, err := parseRule(DENY, "1.1.1.1 stepup"); err == nil {
+		t.Fatal("deny rules should not be able to require step up")
+	}
+
+	// Where a plain mfa policy and a step up policy cover the same port, the step up policy must be found first
+	rules, err := ParseRules([]string{"1.1.1.1 20-30/tcp", "1.1.1.1 22/tcp stepup"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules[0].NumPolicies != 2 || !rules[0].Values[0].Is(STEPUP) || rules[0].Values[1].Is(STEPUP) {
+		t.Fatalf("step up policy was not placed before the plain mfa policy: %+v", rules[0].Values[:rules[0].NumPolicies])
+	}
+}
+
+func TestResolvedDomainRules(t *testing.T) {
+
+	domains := Domains([]string{"1.1.1.1", "internal.example 443/tcp", "fd00::/64", "internal.example 22/tcp", "other.example"})
+	if len(domains) != 2 || domains[0] != "internal.example" || domains[1] != "other.example" {
+		t.Fatal("domains were not extracted from rules correctly: ", domains)
+	}
+
+	if !SetResolved("internal.example", []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2"), net.ParseIP("10.0.0.2")}) {
+		t.Fatal("first resolution should count as a change")
+	}
+	defer ForgetResolved(nil)
+
+	br, err := parseRule(0, "internal.example 443/tcp")
+	if err != nil {
+		t.Fatal("failed to parse resolved domain: ", err)
+	}
+
+	if len(br.Keys) != 2 {
+		t.Fatal("expected duplicate addresses to be removed, got keys: ", br.Keys)
+	}
+
+	if err := checkKey(br.Keys[0], Key{Prefixlen: 32, IP: netip.MustParseAddr("10.0.0.2").As16()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkKey(br.Keys[1], Key{Prefixlen: 128, IP: netip.MustParseAddr("fd00::2").As16()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if SetResolved("internal.example", []net.IP{net.ParseIP("fd00::2"), net.ParseIP("10.0.0.2")}) {
+		t.Fatal("the same addresses in a different order should not count as a change")
+	}
+
+	if !SetResolved("internal.example", []net.IP{net.ParseIP("10.0.0.3")}) {
+		t.Fatal("a different address set should count as a change")
+	}
+
+	ForgetResolved(map[string]bool{})
+	if _, ok := GetResolved("internal.example"); ok {
+		t.Fatal("forgotten domain was still resolved")
+	}
+}
+
+func TestParseScheduledRules(t *testing.T) {
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	br, err := parseRule(PUBLIC, "10.0.0.0/24 22/tcp @weekdays 08:00-18:00 Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if br.Schedule == nil {
+		t.Fatal("rule should have had a schedule")
+	}
+
+	if len(br.Values) != 1 {
+		t.Fatal("schedule should not have been parsed as a service: ", br.Values)
+	}
+
+	if err := checkPolicy(br.Values[0], Policy{PolicyType: PUBLIC | SINGLE, Proto: TCP, LowerPort: 22}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday 2nd of January 2023
+	monday := time.Date(2023, 1, 2, 0, 0, 0, 0, london)
+
+	activity := map[time.Time]bool{
+		monday.Add(7 * time.Hour):                    false,
+		monday.Add(8 * time.Hour):                    true,
+		monday.Add(17*time.Hour + 59*time.Minute):    true,
+		monday.Add(18 * time.Hour):                   false,
+		monday.Add(5*24*time.Hour + 12*time.Hour):    false, // Saturday
+		monday.Add(9 * time.Hour).In(time.UTC):       true,
+		monday.Add(4*24*time.Hour + 10*time.Hour):    true,  // Friday
+		monday.Add(6*24*time.Hour + 10*time.Hour):    false, // Sunday
+		monday.Add(7*24*time.Hour + 8*time.Hour + 1): true,
+	}
+
+	for when, expected := range activity {
+		if br.Schedule.Active(when) != expected {
+			t.Fatalf("schedule %s at %s should have been active=%t", br.Schedule, when, expected)
+		}
+	}
+
+	overnight, err := parseRule(0, "10.0.0.1 @fri 22:00-06:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkPolicy(overnight.Values[0], Policy{PolicyType: SINGLE, Proto: ANY, LowerPort: ANY}); err != nil {
+		t.Fatal(err)
+	}
+
+	friday := time.Date(2023, 1, 6, 0, 0, 0, 0, time.UTC)
+	if !overnight.Schedule.Active(friday.Add(23*time.Hour)) || !overnight.Schedule.Active(friday.Add(29*time.Hour)) {
+		t.Fatal("overnight schedule should continue into the next day")
+	}
+
+	if overnight.Schedule.Active(friday.Add(5*time.Hour)) || overnight.Schedule.Active(friday.Add(31*time.Hour)) {
+		t.Fatal("overnight schedule should only start on the days given")
+	}
+
+	days, err := parseRule(0, "10.0.0.1 80/tcp @sat-mon,wed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []bool{true, true, false, true, false, false, true} {
+		if days.Schedule.Days[i] != expected {
+			t.Fatalf("day %s should have been %t in %s", time.Weekday(i), expected, days.Schedule)
+		}
+	}
+
+	rules, err := ParseRulesAt(monday.Add(7*time.Hour), nil, []string{
+		"10.0.0.0/24 22/tcp @weekdays 08:00-18:00 Europe/London",
+		"10.0.0.0/24 443/tcp",
+		"10.0.1.0/24 @weekdays 08:00-18:00 Europe/London",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 1 || rules[0].NumPolicies != 1 || rules[0].Values[0].LowerPort != 443 {
+		t.Fatalf("inactive scheduled rules should not be included: %+v", rules)
+	}
+
+	rules, err = ParseRulesAt(monday.Add(9*time.Hour), nil, []string{
+		"10.0.0.0/24 22/tcp @weekdays 08:00-18:00 Europe/London",
+		"10.0.0.0/24 443/tcp",
+		"10.0.1.0/24 @weekdays 08:00-18:00 Europe/London",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 3 {
+		t.Fatal("active scheduled rules should be included: ", len(rules))
+	}
+
+	rules, err = MergeSchedules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 || rules[0].NumPolicies != 2 {
+		t.Fatal("active scheduled rules should be merged with the other rules for their route")
+	}
+
+	scheduled, err := ScheduledRules([]string{"10.0.0.0/24 22/tcp @weekdays 08:00-18:00 Europe/London", "10.0.0.0/24 443/tcp", "fd00::1 @weekends"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scheduled) != 2 || scheduled[0].Schedule.String() != "@weekdays 08:00-18:00 Europe/London" || scheduled[1].Schedule.String() != "@weekends" {
+		t.Fatalf("scheduled rules were not found correctly: %+v", scheduled)
+	}
+
+	for _, malformed := range []string{
+		"10.0.0.1 22/tcp @someday",
+		"10.0.0.1 22/tcp @weekdays 08:00",
+		"10.0.0.1 22/tcp @weekdays 25:00-26:00",
+		"10.0.0.1 22/tcp @weekdays 08:00-08:00",
+		"10.0.0.1 22/tcp @weekdays 08:00-18:00 Not/AZone",
+		"10.0.0.1 22/tcp @weekdays 08:00-18:00 UTC extra",
+		"10.0.0.1 22/tcp @mon-someday",
+	} {
+		if _, err := parseRule(0, malformed); err == nil {
+			t.Fatal("should fail to parse malformed schedule: ", malformed)
+		}
+	}
+}
+
+func TestScheduledIPv6Rules(t *testing.T) {
+
+	for field, expected := range map[string]bool{
+		"@weekdays":      true,
+		"08:00-18:00":    true,
+		"8:00-18:00":     true,
+		"fd00::1":        false,
+		"fd00::/64":      false,
+		"::ffff:1.2.3.4": false,
+		"22/tcp":         false,
+		"08:00":          false,
+		"8:00-18:0":      false,
+	} {
+		if isScheduleField(field) != expected {
+			t.Fatalf("%q should have been a schedule field=%t", field, expected)
+		}
+	}
+
+	aliases := Aliases{
+		Hosts: map[string][]string{
+			"v6-tier": {"fd00:1::/64", "fd00:2::1"},
+		},
+	}
+
+	SetAliases(aliases)
+	defer SetAliases(Aliases{})
+
+	// Monday 2nd of January 2023
+	monday := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	acls := []string{
+		"fd00::1 22/tcp @weekdays 08:00-18:00 UTC",
+		"v6-tier 443/tcp 08:00-18:00 UTC",
+	}
+
+	rules, err := ParseRulesAt(monday.Add(9*time.Hour), nil, acls, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 3 {
+		t.Fatalf("active scheduled ipv6 rules should be included: %+v", rules)
+	}
+
+	for _, rule := range rules {
+		if rule.Schedule == nil || rule.NumPolicies != 1 || rule.Keys[0].IsIPv4() {
+			t.Fatalf("ipv6 rule was not parsed with its schedule: %s %+v", rule.Keys[0].String(), rule)
+		}
+	}
+
+	rules, err = ParseRulesAt(monday.Add(19*time.Hour), nil, acls, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 0 {
+		t.Fatalf("inactive scheduled ipv6 rules should not be included: %+v", rules)
+	}
+
+	scheduled, err := ScheduledRules([]string{"fd00::1 22/tcp", "fd00::1/128 53/udp @weekends"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scheduled) != 1 || scheduled[0].Schedule.String() != "@weekends" {
+		t.Fatalf("ipv6 addresses should not start a schedule: %+v", scheduled)
+	}
+}
+
+func TestScheduledRuleMerging(t *testing.T) {
+
+	// Monday 2nd of January 2023
+	monday := time.Date(2023, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	scheduled := "10.0.0.1 22/tcp @weekdays UTC"
+	always := "10.0.0.1 443/tcp"
+
+	for _, order := range [][]string{{scheduled, always}, {always, scheduled}} {
+		rules, err := ParseRulesAt(monday, order, []string{"10.0.0.1 80/tcp @daily UTC"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rules) != 3 {
+			t.Fatalf("%q: rules with different schedules should not be merged, got %d rules", order, len(rules))
+		}
+
+		for _, rule := range rules {
+			expected := map[uint16]string{22: "@weekdays UTC", 80: "@daily UTC", 443: ""}[rule.Values[0].LowerPort]
+
+			if (rule.Schedule == nil) != (expected == "") || (rule.Schedule != nil && rule.Schedule.String() != expected) {
+				t.Fatalf("%q: rule for port %d had the wrong schedule: %v", order, rule.Values[0].LowerPort, rule.Schedule)
+			}
+		}
+
+		merged, err := MergeSchedules(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(merged) != 1 || merged[0].Schedule != nil {
+			t.Fatalf("%q: rules for one route should be merged for the firewall, got %d rules", order, len(merged))
+		}
+
+		// Mfa policies come before public ones however the schedules were ordered
+		expected := []Policy{
+			{PolicyType: SINGLE, Proto: TCP, LowerPort: 22},
+			{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+			{PolicyType: PUBLIC | SINGLE, Proto: TCP, LowerPort: 80},
+		}
+		if merged[0].NumPolicies != len(expected) {
+			t.Fatalf("%q: expected %d policies got %d: %+v", order, len(expected), merged[0].NumPolicies, merged[0].Values[:merged[0].NumPolicies])
+		}
+
+		for i := range expected {
+			if err := checkPolicy(merged[0].Values[i], expected[i]); err != nil {
+				t.Fatalf("%q: policy %d: %s", order, i, err)
+			}
+		}
+	}
+}
+
+func TestCompactPolicies(t *testing.T) {
+
+	rules, err := ParseRules(
+		[]string{"10.0.0.1 22/tcp", "10.0.0.1 22/tcp 23/tcp"},
+		[]string{
+			"10.0.0.1 80/tcp 80/tcp 81/tcp 82-90/tcp 85-100/tcp",
+			"10.0.0.1 443/any 443/tcp 443/udp",
+			"10.0.0.1 200-300/udp 301-400/udp 1000/udp",
+			"10.0.0.1 icmp icmp",
+		},
+		[]string{"10.0.0.1 8080/tcp", "10.0.0.1 8080/tcp"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 1 {
+		t.Fatal("expected one route got: ", len(rules))
+	}
+
+	expected := []Policy{
+		{PolicyType: RANGE, Proto: TCP, LowerPort: 22, UpperPort: 23},
+		{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: 443},
+		{PolicyType: PUBLIC | SINGLE, Proto: ICMP, LowerPort: ANY},
+		{PolicyType: PUBLIC | RANGE, Proto: TCP, LowerPort: 80, UpperPort: 100},
+		{PolicyType: PUBLIC | RANGE, Proto: UDP, LowerPort: 200, UpperPort: 400},
+		{PolicyType: PUBLIC | SINGLE, Proto: UDP, LowerPort: 1000},
+		{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 8080},
+	}
+
+	if rules[0].NumPolicies != len(expected) {
+		t.Fatalf("expected %d policies after compaction got %d: %+v", len(expected), rules[0].NumPolicies, rules[0].Values[:rules[0].NumPolicies])
+	}
+
+	for i := range expected {
+		if rules[0].Values[i] != expected[i] {
+			t.Fatalf("policy %d was %s expected %s", i, rules[0].Values[i], expected[i])
+		}
+	}
+
+	if !rules[0].Values[len(expected)].Is(STOP) {
+		t.Fatal("policies should have been terminated with stop")
+	}
+
+	// Previously more than 128 policies on a route was an error, even when most were duplicates
+	var public []string
+	for i := 0; i < 500; i++ {
+		public = append(public, fmt.Sprintf("10.0.0.0/24 %d/tcp", 1000+i*2))
+		public = append(public, "10.0.0.0/24 22/tcp")
+	}
+
+	rules, err = ParseRules(nil, public, nil)
+	if err != nil {
+		t.Fatal("should be able to have more than 128 policies: ", err)
+	}
+
+	if rules[0].NumPolicies != 501 {
+		t.Fatal("duplicates were not removed: ", rules[0].NumPolicies)
+	}
+
+	public = nil
+	for i := 0; i <= MAX_POLICIES; i++ {
+		public = append(public, fmt.Sprintf("10.0.0.0/24 %d/tcp", 1000+i*2))
+	}
+
+	if _, err := ParseRules(nil, public, nil); err == nil {
+		t.Fatal("should fail when there are more distinct policies than the max")
+	}
+}
+
+func TestAliases(t *testing.T) {
+
+	aliases := Aliases{
+		Services: map[string][]string{
+			"ssh": {"22/tcp"},
+			"web": {"80/tcp", "443/tcp"},
+		},
+		Hosts: map[string][]string{
+			"db-tier": {"10.1.0.0/24", "10.2.0.1"},
+		},
+	}
+
+	if err := aliases.Validate(); err != nil {
+		t.Fatal("valid aliases were rejected: ", err)
+	}
+
+	SetAliases(aliases)
+	defer SetAliases(Aliases{})
+
+	rules, err := ParseRules(nil, []string{"db-tier ssh web 8080/tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 {
+		t.Fatal("alias should expand to two routes got: ", len(rules))
+	}
+
+	for i, address := range []string{"10.1.0.0/24", "10.2.0.1/32"} {
+		if rules[i].Keys[0].String() != address {
+			t.Fatalf("route %d was %s expected %s", i, rules[i].Keys[0].String(), address)
+		}
+
+		if rules[i].NumPolicies != 4 {
+			t.Fatalf("expected 4 policies for %s got %d", address, rules[i].NumPolicies)
+		}
+	}
+
+	expanded := aliases.expandRule("db-tier web @weekdays 08:00-18:00 Europe/London")
+	if len(expanded) != 2 || expanded[0] != "10.1.0.0/24 80/tcp 443/tcp @weekdays 08:00-18:00 Europe/London" {
+		t.Fatal("schedule was not kept when expanding aliases: ", expanded)
+	}
+
+	routes, err := AclsToRoutes([]string{"db-tier ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 2 || routes[0] != "10.1.0.0/24" || routes[1] != "10.2.0.1/32" {
+		t.Fatal("host alias was not expanded into routes: ", routes)
+	}
+
+	_, err = ParseRules(nil, []string{"db-tier ssh 22/nope"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "host alias db-tier") || !strings.Contains(err.Error(), "service alias ssh") {
+		t.Fatal("error should name the aliases used by the rule: ", err)
+	}
+
+	invalid := []Aliases{
+		{Services: map[string][]string{"bad": {"22/nope"}}},
+		{Services: map[string][]string{"empty": {}}},
+		{Services: map[string][]string{"22/tcp": {"22/tcp"}}},
+		{Hosts: map[string][]string{"10.0.0.1": {"10.0.0.2"}}},
+		{Hosts: map[string][]string{"10.0.0.0/24": {"10.0.0.2"}}},
+		{Hosts: map[string][]string{"a": {"b"}, "b": {"10.0.0.1"}}},
+		{Hosts: map[string][]string{"bad": {"10.0.0.1/99"}}},
+	}
+
+	for _, a := range invalid {
+		if err := a.Validate(); err == nil {
+			t.Fatalf("aliases should have been rejected: %+v", a)
+		}
+	}
+}
@@ -17,6 +17,10 @@ const (
 	SINGLE
 
 	DENY // Deny flag which is additional to RANGE/SINGLE types
+
+	OUTBOUND // Only matches traffic started by the device, and replies to it
+
+	STEPUP // Mfa flag, the device must have completed mfa recently even if it already has a session
 )
 
 // Format
@@ -27,6 +31,8 @@ struct range
     __u16 proto;
     __u16 lower_port;
     __u16 upper_port;
+    __u16 src_lower_port;
+    __u16 src_upper_port;
 };
 */
 type Policy struct {
@@ -34,6 +40,10 @@ type Policy struct {
 	Proto      uint16
 	LowerPort  uint16
 	UpperPort  uint16
+
+	// The port on the device, i.e the source port of traffic the device sends, both are 0 if any port is allowed
+	SourceLowerPort uint16
+	SourceUpperPort uint16
 }
 
 func (p *Policy) Is(pt PolicyType) bool {
@@ -43,19 +53,50 @@ func (p *Policy) Is(pt PolicyType) bool {
 
 	return p.PolicyType&uint16(pt) != 0
 }
+
+// Matches returns true if traffic with the given protocol, remote port and device port falls under this policy, mirroring the check in xdp.c
+func (p *Policy) Matches(proto, port, sourcePort uint16) bool {
+	if p.SourceUpperPort != ANY && (p.SourceLowerPort > sourcePort || p.SourceUpperPort < sourcePort) {
+		return false
+	}
+
+	return p.MatchesService(proto, port)
+}
+
+// MatchesService is Matches for when the devices port is not known, the source ports of the policy are ignored
+func (p *Policy) MatchesService(proto, port uint16) bool {
+	if p.Proto != ANY && p.Proto != proto {
+		return false
+	}
+
+	// The icmp type and code take the place of the port, but policies for any protocol only mean ports
+	if p.Proto == ANY && IsICMP(proto) {
+		port = 0
+	}
+
+	if p.Is(SINGLE) && (p.LowerPort == ANY || p.LowerPort == port) {
+		return true
+	}
+
+	return p.Is(RANGE) && p.LowerPort <= port && p.UpperPort >= port
+}
+
 func (r Policy) Bytes() []byte {
-	output := make([]byte, 8)
+	output := make([]byte, 12)
 	binary.LittleEndian.PutUint16(output, r.PolicyType)
 	binary.LittleEndian.PutUint16(output[2:], r.Proto)
 
 	binary.LittleEndian.PutUint16(output[4:], r.LowerPort)
 	binary.LittleEndian.PutUint16(output[6:], r.UpperPort)
 
+	binary.LittleEndian.PutUint16(output[8:], r.SourceLowerPort)
+	binary.LittleEndian.PutUint16(output[10:], r.SourceUpperPort)
+
 	return output
 }
 
 func (r *Policy) Unpack(b []byte) error {
-	if len(b) < 8 {
+	if len(b) < 12 {
 		return errors.New("too short")
 	}
 
@@ -65,10 +106,30 @@ func (r *Policy) Unpack(b []byte) error {
 	r.LowerPort = binary.LittleEndian.Uint16(b[4:])
 	r.UpperPort = binary.LittleEndian.Uint16(b[6:])
 
+	r.SourceLowerPort = binary.LittleEndian.Uint16(b[8:])
+	r.SourceUpperPort = binary.LittleEndian.Uint16(b[10:])
+
 	return nil
 }
 
 func (r Policy) String() string {
+	if r.Is(STOP) {
+		return "stop"
+	}
+
+	result := r.service()
+	if r.SourceUpperPort == ANY {
+		return result
+	}
+
+	if r.SourceLowerPort == r.SourceUpperPort {
+		return fmt.Sprintf("%s sport/%d", result, r.SourceLowerPort)
+	}
+
+	return fmt.Sprintf("%s sport/%d-%d", result, r.SourceLowerPort, r.SourceUpperPort)
+}
+
+func (r Policy) service() string {
 
 	restrictionType := "mfa"
 
@@ -80,8 +141,28 @@ func (r Policy) String() string {
 		restrictionType = "deny"
 	}
 
-	if r.Is(STOP) {
-		return "stop"
+	if r.Is(OUTBOUND) {
+		restrictionType += " outbound"
+	}
+
+	if r.Is(STEPUP) {
+		restrictionType += " stepup"
+	}
+
+	// icmp types and codes are stored as ports, see ICMPPort
+	if IsICMP(r.Proto) && !(r.Is(SINGLE) && r.LowerPort == ANY) {
+		lower, upper := r.LowerPort, r.UpperPort
+		if r.Is(SINGLE) {
+			upper = lower
+		}
+
+		if lower == upper {
+			return fmt.Sprintf("%s(%d) %s/%d/%d", restrictionType, r.PolicyType, LookupProtocol(r.Proto), lower>>8, lower&0xff)
+		}
+
+		if lower>>8 == upper>>8 && lower&0xff == 0 && upper&0xff == 0xff {
+			return fmt.Sprintf("%s(%d) %s/%d", restrictionType, r.PolicyType, LookupProtocol(r.Proto), lower>>8)
+		}
 	}
 
 	if r.Is(SINGLE) {
@@ -89,11 +170,11 @@ func (r Policy) String() string {
 		if r.LowerPort == 0 {
 			port = "any"
 		}
-		return fmt.Sprintf("%s(%d) %s/%s", restrictionType, r.PolicyType, port, lookupProtocol(r.Proto))
+		return fmt.Sprintf("%s(%d) %s/%s", restrictionType, r.PolicyType, port, LookupProtocol(r.Proto))
 	}
 
 	if r.Is(RANGE) {
-		return fmt.Sprintf("%s(%d) %d-%d/%s", restrictionType, r.PolicyType, r.LowerPort, r.UpperPort, lookupProtocol(r.Proto))
+		return fmt.Sprintf("%s(%d) %d-%d/%s", restrictionType, r.PolicyType, r.LowerPort, r.UpperPort, LookupProtocol(r.Proto))
 	}
 
 	return "unknown policy"
@@ -0,0 +1,447 @@
+package routetypes
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Used when the system resolver has to be used, as it does not tell us the record TTL
+	DefaultTTL = 5 * time.Minute
+
+	// Stop records with very low (or zero) TTLs from causing us to rebuild the firewall tables constantly
+	MinimumTTL = 30 * time.Second
+
+	dnsTimeout = 2 * time.Second
+)
+
+var (
+	resolvedLock sync.RWMutex
+	resolved     = map[string][]net.IP{}
+
+	errNoNameservers = errors.New("no nameservers found")
+)
+
+// IsDomain returns true if the address part of a rule is not an ip address or cidr, and thus must be resolved
+func IsDomain(address string) bool {
+	if net.ParseIP(address) != nil {
+		return false
+	}
+
+	_, _, err := net.ParseCIDR(address)
+	return err != nil
+}
+
+// Domains returns the deduplicated set of domain names referenced by the address portion of rules
+func Domains(rules []string) (domains []string) {
+	seen := map[string]bool{}
+	for _, rule := range getAliases().expandRules(rules) {
+		ruleParts := strings.Fields(rule)
+		if len(ruleParts) < 1 || !IsDomain(ruleParts[0]) || seen[ruleParts[0]] {
+			continue
+		}
+
+		seen[ruleParts[0]] = true
+		domains = append(domains, ruleParts[0])
+	}
+
+	return
+}
+
+// SetResolved records the current addresses of domain, these are used instead of a fresh lookup when rules are parsed
+// Returns true if the address set differs from what was previously recorded
+func SetResolved(domain string, addresses []net.IP) bool {
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+
+	current := uniqueSorted(addresses)
+
+	previous, ok := resolved[domain]
+	resolved[domain] = current
+
+	return !ok || !sameAddresses(previous, current)
+}
+
+// GetResolved returns the last recorded addresses for domain
+func GetResolved(domain string) ([]net.IP, bool) {
+	resolvedLock.RLock()
+	defer resolvedLock.RUnlock()
+
+	addresses, ok := resolved[domain]
+	return addresses, ok
+}
+
+// ForgetResolved removes any domains that are not in keep, so that stale domains are looked up again if they are reintroduced
+func ForgetResolved(keep map[string]bool) {
+	resolvedLock.Lock()
+	defer resolvedLock.Unlock()
+
+	for domain := range resolved {
+		if !keep[domain] {
+			delete(resolved, domain)
+		}
+	}
+}
+
+// Resolve looks up the A and AAAA records for domain and returns them along with the lowest TTL of the answers
+// Names are expanded with the search domains in resolv.conf as the system resolver would. If the nameservers cannot be queried directly,
+// or none of them have an address for the name, it falls back to the system resolver (which also reads /etc/hosts) with DefaultTTL
+func Resolve(domain string) ([]net.IP, time.Duration, error) {
+	var (
+		addresses []net.IP
+		ttl       time.Duration
+	)
+
+	conf, err := readResolvConf("/etc/resolv.conf")
+	if err == nil {
+		addresses, ttl, err = queryNameservers(conf, domain)
+	}
+
+	if err != nil || len(addresses) == 0 {
+		addresses, err = net.LookupIP(domain)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ttl = DefaultTTL
+	}
+
+	if len(addresses) == 0 {
+		return nil, 0, fmt.Errorf("no addresses for %s", domain)
+	}
+
+	if ttl < MinimumTTL {
+		ttl = MinimumTTL
+	}
+
+	return uniqueSorted(addresses), ttl, nil
+}
+
+func lookupDomain(domain string) ([]net.IP, error) {
+	if addresses, ok := GetResolved(domain); ok {
+		return addresses, nil
+	}
+
+	return net.LookupIP(domain)
+}
+
+// queryNameservers tries each name the domain could refer to in turn, returning the addresses of the first one that has any
+func queryNameservers(conf resolvConf, domain string) (addresses []net.IP, ttl time.Duration, err error) {
+	for _, candidate := range conf.names(domain) {
+		name, err := dnsmessage.NewName(candidate)
+		if err != nil {
+			// Too long once the search domain is added
+			continue
+		}
+
+		for _, server := range conf.servers {
+			addresses, ttl, err = queryServer(server, name)
+			if err == nil {
+				break
+			}
+		}
+
+		// None of the servers answered, so the other names would fail the same way
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if len(addresses) > 0 {
+			return addresses, ttl, nil
+		}
+	}
+
+	return nil, 0, nil
+}
+
+func queryServer(server string, name dnsmessage.Name) (addresses []net.IP, ttl time.Duration, err error) {
+	found := false
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := exchange(server, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, answer := range answers {
+			recordTTL := time.Duration(answer.Header.TTL) * time.Second
+
+			switch r := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addresses = append(addresses, net.IP(r.A[:]))
+			case *dnsmessage.AAAAResource:
+				addresses = append(addresses, net.IP(r.AAAA[:]))
+			default:
+				// CNAMEs in the chain also bound how long the answer is valid for
+			}
+
+			if !found || recordTTL < ttl {
+				ttl = recordTTL
+				found = true
+			}
+		}
+	}
+
+	return addresses, ttl, nil
+}
+
+func exchange(server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The answers open firewall routes, so the id must not be guessable
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	question := dnsmessage.Question{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	_, err = conn.Write(packed)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buff)
+		if err != nil {
+			return nil, err
+		}
+
+		var response dnsmessage.Message
+		err = response.Unpack(buff[:n])
+		if err != nil {
+			continue
+		}
+
+		// Anything that is not the answer to this query is ignored, rather than letting a spoofed packet stop the real answer being read
+		if !response.Header.Response || response.Header.ID != id || len(response.Questions) != 1 || !sameQuestion(response.Questions[0], question) {
+			continue
+		}
+
+		if response.Header.Truncated {
+			return nil, errors.New("dns response was truncated")
+		}
+
+		// The name does not exist, which is an empty answer rather than a failure so the next search domain is tried
+		if response.Header.RCode == dnsmessage.RCodeNameError {
+			return nil, nil
+		}
+
+		if response.Header.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("dns query for %s failed: %s", name.String(), response.Header.RCode)
+		}
+
+		return answersFor(question, response.Answers), nil
+	}
+}
+
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
+
+// answersFor returns the records of the questions type for the name asked about, following any CNAME chain. Other records in the answer section are dropped
+func answersFor(question dnsmessage.Question, answers []dnsmessage.Resource) (result []dnsmessage.Resource) {
+	current := question.Name.String()
+
+	// Bounded so a CNAME loop cannot keep us here
+	for hops := 0; hops < 8; hops++ {
+		var next string
+		for _, answer := range answers {
+			if answer.Header.Class != question.Class || !strings.EqualFold(answer.Header.Name.String(), current) {
+				continue
+			}
+
+			switch {
+			case answer.Header.Type == question.Type:
+				result = append(result, answer)
+			case answer.Header.Type == dnsmessage.TypeCNAME:
+				if cname, ok := answer.Body.(*dnsmessage.CNAMEResource); ok && next == "" {
+					result = append(result, answer)
+					next = cname.CNAME.String()
+				}
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		current = next
+	}
+
+	return result
+}
+
+// The parts of resolv.conf that change which names and servers are queried
+type resolvConf struct {
+	servers []string
+	search  []string
+	ndots   int
+}
+
+func readResolvConf(path string) (conf resolvConf, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return conf, err
+	}
+	defer f.Close()
+
+	conf.ndots = 1
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			if net.ParseIP(fields[1]) == nil {
+				continue
+			}
+
+			conf.servers = append(conf.servers, net.JoinHostPort(fields[1], "53"))
+		case "domain":
+			// domain and search replace each other, the last one wins
+			conf.search = nil
+			if fields[1] != "." {
+				conf.search = []string{ensureRooted(fields[1])}
+			}
+		case "search":
+			conf.search = nil
+			for _, suffix := range fields[1:] {
+				if suffix == "." {
+					continue
+				}
+
+				conf.search = append(conf.search, ensureRooted(suffix))
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				value, ok := strings.CutPrefix(option, "ndots:")
+				if !ok {
+					continue
+				}
+
+				ndots, err := strconv.Atoi(value)
+				if err != nil || ndots < 0 {
+					continue
+				}
+
+				// Same limit as glibc
+				conf.ndots = min(ndots, 15)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return conf, err
+	}
+
+	if len(conf.servers) == 0 {
+		return conf, errNoNameservers
+	}
+
+	return conf, nil
+}
+
+// names returns the fully qualified names domain may refer to, in the order they should be tried
+// Names with at least ndots dots are tried as is first, otherwise the search domains are tried first
+func (c resolvConf) names(domain string) []string {
+	if strings.HasSuffix(domain, ".") {
+		return []string{domain}
+	}
+
+	rooted := domain + "."
+	names := []string{}
+
+	hasNdots := strings.Count(domain, ".") >= c.ndots
+	if hasNdots {
+		names = append(names, rooted)
+	}
+
+	for _, suffix := range c.search {
+		names = append(names, rooted+suffix)
+	}
+
+	if !hasNdots {
+		names = append(names, rooted)
+	}
+
+	return names
+}
+
+func ensureRooted(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
+
+func uniqueSorted(addresses []net.IP) []net.IP {
+	seen := map[string]bool{}
+	result := make([]net.IP, 0, len(addresses))
+	for _, address := range addresses {
+		if seen[address.String()] {
+			continue
+		}
+
+		seen[address.String()] = true
+		result = append(result, address)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+
+	return result
+}
+
+func sameAddresses(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,285 @@
+package routetypes
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestReadResolvConf(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected resolvConf
+	}{
+		{"nameserver 10.0.0.1\n", resolvConf{servers: []string{"10.0.0.1:53"}, ndots: 1}},
+		{"nameserver 10.0.0.1\nnameserver fd00::1\nnameserver not-an-ip\n", resolvConf{servers: []string{"10.0.0.1:53", "[fd00::1]:53"}, ndots: 1}},
+		{"search corp.example example.com\nnameserver 10.0.0.1\noptions edns0 ndots:5\n", resolvConf{servers: []string{"10.0.0.1:53"}, search: []string{"corp.example.", "example.com."}, ndots: 5}},
+		// domain and search replace each other
+		{"search corp.example\ndomain example.com\nnameserver 10.0.0.1\n", resolvConf{servers: []string{"10.0.0.1:53"}, search: []string{"example.com."}, ndots: 1}},
+		{"domain example.com\nsearch corp.example .\nnameserver 10.0.0.1\n", resolvConf{servers: []string{"10.0.0.1:53"}, search: []string{"corp.example."}, ndots: 1}},
+		{"nameserver 10.0.0.1\noptions ndots:0\n", resolvConf{servers: []string{"10.0.0.1:53"}, ndots: 0}},
+		{"nameserver 10.0.0.1\noptions ndots:40\n", resolvConf{servers: []string{"10.0.0.1:53"}, ndots: 15}},
+		{"nameserver 10.0.0.1\noptions ndots:lots\n", resolvConf{servers: []string{"10.0.0.1:53"}, ndots: 1}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "resolv.conf")
+		if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		conf, err := readResolvConf(path)
+		if err != nil {
+			t.Fatalf("%q: %s", test.contents, err)
+		}
+
+		if !slices.Equal(conf.servers, test.expected.servers) || !slices.Equal(conf.search, test.expected.search) || conf.ndots != test.expected.ndots {
+			t.Errorf("%q: got %+v, expected %+v", test.contents, conf, test.expected)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("search example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readResolvConf(path); err != errNoNameservers {
+		t.Fatal("resolv.conf without nameservers should not be used: ", err)
+	}
+}
+
+func TestResolvConfNames(t *testing.T) {
+	conf := resolvConf{search: []string{"corp.example.", "example.com."}, ndots: 1}
+
+	tests := []struct {
+		domain   string
+		ndots    int
+		expected []string
+	}{
+		{"host", 1, []string{"host.corp.example.", "host.example.com.", "host."}},
+		{"host.internal", 1, []string{"host.internal.", "host.internal.corp.example.", "host.internal.example.com."}},
+		{"host.internal", 2, []string{"host.internal.corp.example.", "host.internal.example.com.", "host.internal."}},
+		{"host.internal.", 5, []string{"host.internal."}},
+	}
+
+	for _, test := range tests {
+		conf.ndots = test.ndots
+		if got := conf.names(test.domain); !slices.Equal(got, test.expected) {
+			t.Errorf("%s with ndots %d: got %q, expected %q", test.domain, test.ndots, got, test.expected)
+		}
+	}
+
+	if got := (resolvConf{ndots: 1}).names("host"); !slices.Equal(got, []string{"host."}) {
+		t.Error("without search domains only the name itself should be tried: ", got)
+	}
+}
+
+// fakeDNS sends whatever respond returns for each query it gets
+func fakeDNS(t *testing.T, respond func(query dnsmessage.Message) []dnsmessage.Message) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buff := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if err := query.Unpack(buff[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			for _, response := range respond(query) {
+				packed, err := response.Pack()
+				if err != nil {
+					continue
+				}
+
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func aRecord(name string, address string) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(address).To4())
+
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120},
+		Body:   &dnsmessage.AResource{A: a},
+	}
+}
+
+// fakeNameserver answers A queries from records, other names get NXDOMAIN and other types an empty answer
+func fakeNameserver(t *testing.T, records map[string]net.IP) string {
+	return fakeDNS(t, func(query dnsmessage.Message) []dnsmessage.Message {
+		question := query.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+			Questions: query.Questions,
+		}
+
+		address, ok := records[question.Name.String()]
+		switch {
+		case !ok:
+			response.Header.RCode = dnsmessage.RCodeNameError
+		case question.Type == dnsmessage.TypeA && address != nil:
+			response.Answers = []dnsmessage.Resource{aRecord(question.Name.String(), address.String())}
+		}
+
+		return []dnsmessage.Message{response}
+	})
+}
+
+func TestExchangeSpoofing(t *testing.T) {
+	server := fakeDNS(t, func(query dnsmessage.Message) []dnsmessage.Message {
+		question := query.Questions[0]
+		reply := func(id uint16, q dnsmessage.Question, answers ...dnsmessage.Resource) dnsmessage.Message {
+			return dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: id, Response: true},
+				Questions: []dnsmessage.Question{q},
+				Answers:   answers,
+			}
+		}
+
+		otherName := question
+		otherName.Name = dnsmessage.MustNewName("evil.example.")
+
+		otherType := question
+		otherType.Type = dnsmessage.TypeMX
+
+		spoofed := aRecord(question.Name.String(), "10.6.6.6")
+
+		genuine := []dnsmessage.Resource{
+			{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("alias.example.")},
+			},
+			aRecord("alias.example.", "10.0.0.9"),
+			// Records that were not asked about
+			aRecord("evil.example.", "10.6.6.7"),
+			{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassCHAOS, TTL: 120},
+				Body:   &dnsmessage.AResource{A: [4]byte{10, 6, 6, 8}},
+			},
+		}
+
+		if question.Name.String() == "onlyspoofed.example." {
+			return []dnsmessage.Message{reply(query.Header.ID+1, question, spoofed)}
+		}
+
+		return []dnsmessage.Message{
+			reply(query.Header.ID+1, question, spoofed),
+			reply(query.Header.ID, otherName, spoofed),
+			reply(query.Header.ID, otherType, spoofed),
+			reply(query.Header.ID, question, genuine...),
+		}
+	})
+
+	addresses, ttl, err := queryServer(server, dnsmessage.MustNewName("host.example."))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addresses) != 1 || !addresses[0].Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatal("only the address at the end of the cname chain should be used: ", addresses)
+	}
+
+	if ttl.Seconds() != 60 {
+		t.Fatal("cname ttl should bound the answer: ", ttl)
+	}
+
+	if addresses, _, err := queryServer(server, dnsmessage.MustNewName("onlyspoofed.example.")); err == nil {
+		t.Fatal("responses with the wrong id should never be used: ", addresses)
+	}
+}
+
+func TestAnswersFor(t *testing.T) {
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("loop.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+
+	cname := func(from, to string) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(from), Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(to)},
+		}
+	}
+
+	// Loops end, and names are not case sensitive
+	answers := answersFor(question, []dnsmessage.Resource{cname("LOOP.example.", "back.example."), cname("back.example.", "loop.example."), aRecord("unrelated.example.", "10.6.6.6")})
+	for _, answer := range answers {
+		if answer.Header.Type != dnsmessage.TypeCNAME {
+			t.Fatal("unrelated record was returned: ", answer)
+		}
+	}
+
+	if len(answers) == 0 {
+		t.Fatal("case insensitive name did not match")
+	}
+}
+
+func TestQueryNameserversSearch(t *testing.T) {
+	server := fakeNameserver(t, map[string]net.IP{
+		"host.corp.example.":    net.ParseIP("10.0.0.5"),
+		"db.internal.":          net.ParseIP("10.0.0.6"),
+		"db.internal.example.":  net.ParseIP("10.0.0.7"),
+		"web.internal.":         nil,
+		"web.internal.example.": net.ParseIP("10.0.0.8"),
+	})
+
+	conf := resolvConf{servers: []string{server}, search: []string{"example.", "corp.example."}, ndots: 1}
+
+	tests := []struct {
+		domain   string
+		expected string
+	}{
+		// host.example. does not exist, so the next search domain is tried
+		{"host", "10.0.0.5"},
+		{"db.internal", "10.0.0.6"},
+		// web.internal. exists but has no addresses
+		{"web.internal", "10.0.0.8"},
+		{"host.corp.example.", "10.0.0.5"},
+		{"missing", ""},
+	}
+
+	for _, test := range tests {
+		addresses, ttl, err := queryNameservers(conf, test.domain)
+		if err != nil {
+			t.Fatalf("%s: %s", test.domain, err)
+		}
+
+		if test.expected == "" {
+			if len(addresses) != 0 {
+				t.Errorf("%s: should have no addresses, got %v", test.domain, addresses)
+			}
+			continue
+		}
+
+		if len(addresses) != 1 || !addresses[0].Equal(net.ParseIP(test.expected)) || ttl.Seconds() != 120 {
+			t.Errorf("%s: got %v (ttl %s), expected %s", test.domain, addresses, ttl, test.expected)
+		}
+	}
+
+	// With ndots the search domains go first
+	conf.ndots = 2
+	if addresses, _, err := queryNameservers(conf, "db.internal"); err != nil || len(addresses) != 1 || !addresses[0].Equal(net.ParseIP("10.0.0.7")) {
+		t.Errorf("search domain should be tried before the name with fewer than ndots dots: %v %v", addresses, err)
+	}
+
+	unreachable := resolvConf{servers: []string{"127.0.0.1:1"}, ndots: 1}
+	if _, _, err := queryNameservers(unreachable, "host"); err == nil {
+		t.Error("unreachable nameservers should be an error, so the system resolver is used")
+	}
+}
@@ -0,0 +1,243 @@
+package routetypes
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Schedule restricts a rule to certain days of the week and/or times of day, e.g `@weekdays 08:00-18:00 Europe/London`
+// The firewall itself has no concept of time, so rules are added and removed from the users maps as schedules start and end
+type Schedule struct {
+	Days [7]bool
+
+	// Minutes since midnight, if End is before Start the window wraps past midnight into the next day
+	Start, End int
+
+	Location *time.Location
+
+	definition string
+}
+
+// Active returns whether the schedule allows the rule at time t
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.Location)
+
+	minute := t.Hour()*60 + t.Minute()
+
+	if s.Start < s.End {
+		return s.Days[t.Weekday()] && minute >= s.Start && minute < s.End
+	}
+
+	// Window crosses midnight, the days qualifier applies to the day the window opened
+	yesterday := (t.Weekday() + 6) % 7
+
+	return (s.Days[t.Weekday()] && minute >= s.Start) || (s.Days[yesterday] && minute < s.End)
+}
+
+func (s *Schedule) String() string {
+	return s.definition
+}
+
+// isScheduleField returns true if a rule field is the start of a schedule, rather than a port/service
+// Only days starting with @ or a whole HH:MM-HH:MM time range start one, as other fields such as ipv6 addresses can contain ':'
+func isScheduleField(field string) bool {
+	return strings.HasPrefix(field, "@") || isTimeRange(field)
+}
+
+// isTimeRange returns true if field has the shape of HH:MM-HH:MM, the times themselves are checked by parseTimes
+func isTimeRange(field string) bool {
+	start, end, ok := strings.Cut(field, "-")
+	if !ok {
+		return false
+	}
+
+	for _, t := range []string{start, end} {
+		hours, minutes, ok := strings.Cut(t, ":")
+		if !ok || len(hours) < 1 || len(hours) > 2 || len(minutes) != 2 {
+			return false
+		}
+
+		if strings.Trim(hours+minutes, "0123456789") != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseSchedule takes the trailing fields of a rule, `[@days] [HH:MM-HH:MM] [timezone]`
+func parseSchedule(fields []string) (*Schedule, error) {
+	s := &Schedule{
+		Location:   time.Local,
+		End:        24 * 60,
+		definition: strings.Join(fields, " "),
+	}
+
+	if len(fields) == 0 {
+		return nil, errors.New("empty schedule")
+	}
+
+	if strings.HasPrefix(fields[0], "@") {
+		if err := s.parseDays(strings.TrimPrefix(fields[0], "@")); err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	} else {
+		for i := range s.Days {
+			s.Days[i] = true
+		}
+	}
+
+	if len(fields) > 0 && isTimeRange(fields[0]) {
+		if err := s.parseTimes(fields[0]); err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 {
+		location, err := time.LoadLocation(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q in schedule: %s", fields[0], err)
+		}
+		s.Location = location
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 {
+		return nil, errors.New("unexpected fields after schedule: " + strings.Join(fields, " "))
+	}
+
+	return s, nil
+}
+
+func (s *Schedule) parseDays(days string) error {
+	switch strings.ToLower(days) {
+	case "daily", "everyday":
+		for i := range s.Days {
+			s.Days[i] = true
+		}
+		return nil
+	case "weekdays":
+		for d := time.Monday; d <= time.Friday; d++ {
+			s.Days[d] = true
+		}
+		return nil
+	case "weekends":
+		s.Days[time.Saturday] = true
+		s.Days[time.Sunday] = true
+		return nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(days), ",") {
+		bounds := strings.Split(part, "-")
+
+		first, ok := dayNames[bounds[0]]
+		if !ok {
+			return errors.New("unknown day in schedule: " + bounds[0])
+		}
+
+		if len(bounds) == 1 {
+			s.Days[first] = true
+			continue
+		}
+
+		last, ok := dayNames[bounds[1]]
+		if len(bounds) != 2 || !ok {
+			return errors.New("malformed day range in schedule: " + part)
+		}
+
+		// Ranges may wrap around the end of the week, e.g fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			s.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schedule) parseTimes(times string) (err error) {
+	bounds := strings.Split(times, "-")
+	if len(bounds) != 2 {
+		return errors.New("malformed time range in schedule, expected HH:MM-HH:MM: " + times)
+	}
+
+	s.Start, err = parseTimeOfDay(bounds[0])
+	if err != nil {
+		return err
+	}
+
+	s.End, err = parseTimeOfDay(bounds[1])
+	if err != nil {
+		return err
+	}
+
+	if s.Start == s.End {
+		return errors.New("schedule start and end times cannot be the same: " + times)
+	}
+
+	return nil
+}
+
+func parseTimeOfDay(t string) (int, error) {
+	parts := strings.Split(t, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("malformed time in schedule, expected HH:MM: " + t)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.New("invalid hour in schedule: " + t)
+	}
+
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, errors.New("invalid minute in schedule: " + t)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// ScheduledRule is an acl rule that only applies while its schedule is active
+type ScheduledRule struct {
+	Rule     string
+	Schedule *Schedule
+}
+
+// ScheduledRules returns the rules that have a schedule
+func ScheduledRules(rules []string) (result []ScheduledRule, err error) {
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		for i := 1; i < len(fields); i++ {
+			if !isScheduleField(fields[i]) {
+				continue
+			}
+
+			schedule, err := parseSchedule(fields[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			result = append(result, ScheduledRule{Rule: rule, Schedule: schedule})
+			break
+		}
+	}
+
+	return
+}
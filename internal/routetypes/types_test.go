@@ -2,6 +2,7 @@ package routetypes
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 )
 
@@ -12,11 +13,15 @@ func TestPolicyMarshalAndUnmarshal(t *testing.T) {
 		Proto:      4444,
 		LowerPort:  2222,
 		UpperPort:  6666,
+
+		SourceLowerPort: 1024,
+		SourceUpperPort: 65535,
 	}
 
+	// Must match the size of struct policy in xdp.c
 	b := a.Bytes()
-	if len(b)%8 != 0 {
-		t.Fatal("the length of the marshalled bytes is not divisible by 8: ", len(b))
+	if len(b) != 12 {
+		t.Fatal("the length of the marshalled bytes is not 12: ", len(b))
 	}
 
 	var c Policy
@@ -40,18 +45,53 @@ func TestPolicyMarshalAndUnmarshal(t *testing.T) {
 		t.Fatal("the unpacked protocol number was incorrect: expected: ", a.Proto, " got: ", c.Proto)
 	}
 
+	if c.SourceLowerPort != a.SourceLowerPort || c.SourceUpperPort != a.SourceUpperPort {
+		t.Fatal("the unpacked source ports were incorrect: expected: ", a.SourceLowerPort, a.SourceUpperPort, " got: ", c.SourceLowerPort, c.SourceUpperPort)
+	}
+
 }
 
 func TestKeyMarshalAndUnmarshal(t *testing.T) {
 
 	a := Key{
 		Prefixlen: 16,
-		IP:        [4]byte{11, 11, 11, 11},
+		IP:        netip.MustParseAddr("11.11.11.11").As16(),
+	}
+
+	b := a.Bytes()
+	if len(b) != 20 {
+		t.Fatal("the length of the marshalled key bytes is not 20: ", len(b))
+	}
+
+	var c Key
+	if err := c.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Prefixlen != a.Prefixlen {
+		t.Fatal("the unpacked Prefixlen was incorrect: expected: ", a.Prefixlen, " got: ", c.Prefixlen)
+	}
+
+	if !net.IP.Equal(a.AsIP(), c.AsIP()) {
+		t.Fatal("the ip address did not unmarshal correctly: expected: ", a.AsIP(), a.IP, " got: ", c.AsIP(), c.IP)
+	}
+
+}
+
+func TestIPv6KeyMarshalAndUnmarshal(t *testing.T) {
+
+	a := Key{
+		Prefixlen: 64,
+		IP:        netip.MustParseAddr("fd00:1234::").As16(),
 	}
 
 	b := a.Bytes()
-	if len(b)%8 != 0 {
-		t.Fatal("the length of the marshalled bytes is not divisible by 8: ", len(b))
+	if len(b) != 20 {
+		t.Fatal("the length of the marshalled key bytes is not 20: ", len(b))
+	}
+
+	if b[0] != 64 {
+		t.Fatal("ipv6 prefix length should not be offset in the marshalled key: ", b[0])
 	}
 
 	var c Key
@@ -67,4 +107,57 @@ func TestKeyMarshalAndUnmarshal(t *testing.T) {
 		t.Fatal("the ip address did not unmarshal correctly: expected: ", a.AsIP(), a.IP, " got: ", c.AsIP(), c.IP)
 	}
 
+	if c.String() != "fd00:1234::/64" {
+		t.Fatal("ipv6 key string was incorrect: ", c.String())
+	}
+
+	v4 := Key{
+		Prefixlen: 16,
+		IP:        netip.MustParseAddr("11.11.11.11").As16(),
+	}
+
+	if v4.Bytes()[0] != 16+96 {
+		t.Fatal("ipv4 keys should be stored as ipv4-mapped ipv6 addresses with an offset prefix length: ", v4.Bytes()[0])
+	}
+}
+
+func TestIPv4MappedIPv6Key(t *testing.T) {
+
+	_, network, err := net.ParseCIDR("::ffff:10.0.0.0/120")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped := NewKey(*network)
+	if mapped.IsIPv4() {
+		t.Fatal("ipv6 rule inside ::ffff:0:0/96 should not be treated as ipv4")
+	}
+
+	if mapped.Bytes()[0] != 120 {
+		t.Fatal("ipv6 rule inside ::ffff:0:0/96 should not have its prefix length offset again: ", mapped.Bytes()[0])
+	}
+
+	_, network, err = net.ParseCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v4 := NewKey(*network)
+	if !v4.IsIPv4() || v4.Bytes()[0] != 120 {
+		t.Fatal("ipv4 /24 should be stored as a /120: ", v4.Bytes()[0])
+	}
+
+	// Both cover the same addresses in the trie, so they unpack to the same key
+	var c Key
+	if err := c.Unpack(mapped.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.IsIPv4() || c.Prefixlen != 24 || !c.Contains(net.ParseIP("10.0.0.20")) || c.Contains(net.ParseIP("10.0.1.20")) {
+		t.Fatal("unpacked key was incorrect: ", c.String())
+	}
+
+	if c.String() != v4.String() {
+		t.Fatal("keys for the same addresses should be equal: ", c.String(), v4.String())
+	}
 }
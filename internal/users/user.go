@@ -4,9 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
+	"github.com/NHAS/wag/internal/audit"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/metrics"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/internal/webserver/authenticators"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -36,6 +39,11 @@ func (u *user) ResetMfa() error {
 		}
 	}
 
+	err = data.DeleteMfaFactors(u.Username)
+	if err != nil {
+		return err
+	}
+
 	// the MFA column is marked as "unique" so just set it as the username as that is also unique
 	err = data.SetUserMfa(u.Username, u.Username, authenticators.UnsetMFA)
 	if err != nil {
@@ -45,6 +53,43 @@ func (u *user) ResetMfa() error {
 	return u.UnenforceMFA()
 }
 
+// RevokeMfaFactor removes a single enrolled factor and deauthenticates the users devices, if it was the last one the user must register mfa again
+func (u *user) RevokeMfaFactor(id int) error {
+	err := data.DeleteMfaFactor(u.Username, id)
+	if err != nil {
+		return err
+	}
+
+	remaining, err := data.GetMfaFactorTypes(u.Username)
+	if err != nil {
+		return err
+	}
+
+	// Recovery codes only stand in for another method, so on their own the user has to register again
+	if len(remaining) == 0 || (len(remaining) == 1 && remaining[0] == authenticators.RecoveryMFA) {
+		return u.ResetMfa()
+	}
+
+	devices, err := u.GetDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		err := router.Deauthenticate(device.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CanEnrolMFA is true if the user has no mfa yet, or device has already authorised and so may add another factor
+func (u *user) CanEnrolMFA(device string) bool {
+	return !u.IsEnforcingMFA() || router.IsAuthed(device)
+}
+
 func (u *user) SetDeviceAuthAttempts(address string, number int) error {
 	return data.SetDeviceAuthenticationAttempts(u.Username, address, number)
 }
@@ -180,15 +225,48 @@ func (u *user) Delete() error {
 	return data.DeleteUser(u.Username)
 }
 
-func (u *user) Authenticate(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error {
+func (u *user) Authenticate(device, mfaType string, authenticator authenticators.AuthenticatorFunc) (err error) {
+
+	attempts := 0
+	defer func() {
+		event := audit.Event{
+			Type:     audit.MFA,
+			Outcome:  audit.Success,
+			Username: u.Username,
+			Address:  device,
+			Action:   "authorise",
+			Details:  map[string]string{"method": mfaType},
+		}
+
+		if err != nil {
+			event.Outcome = audit.Failure
+			event.Details["error"] = err.Error()
+		}
+
+		audit.Record(event)
+		metrics.RecordMFA(mfaType, err == nil)
+
+		// Only the attempt that used up the last try locks the device, later ones are already refused
+		if err != nil && attempts == config.Values().Lockout {
+			audit.Record(audit.Event{
+				Type:     audit.Lockout,
+				Outcome:  audit.Failure,
+				Username: u.Username,
+				Address:  device,
+				Action:   "lock device",
+				Details:  map[string]string{"attempts": strconv.Itoa(attempts)},
+			})
+			metrics.RecordLockout()
+		}
+	}()
 
 	// Make sure that the attempts is always incremented first to stop race condition attacks
-	err := data.IncrementAuthenticationAttempt(u.Username, device)
+	err = data.IncrementAuthenticationAttempt(u.Username, device)
 	if err != nil {
 		return err
 	}
 
-	mfa, userMfaType, attempts, locked, err := data.GetAuthenticationDetails(u.Username, device)
+	pendingMfa, pendingType, attempts, locked, err := data.GetAuthenticationDetails(u.Username, device)
 	if err != nil {
 		return err
 	}
@@ -201,11 +279,14 @@ func (u *user) Authenticate(device, mfaType string, authenticator authenticators
 		return errors.New("account is locked")
 	}
 
-	if userMfaType != mfaType {
-		return errors.New("authenticator " + mfaType + " used for user with " + userMfaType)
+	// A new factor is only accepted from a user that has none, or from a device that has already authorised with another
+	if pendingType == mfaType && u.CanEnrolMFA(device) {
+		err = u.enrol(mfaType, pendingMfa, authenticator)
+	} else {
+		err = u.verify(mfaType, authenticator)
 	}
 
-	if err := authenticator(mfa, u.Username); err != nil {
+	if err != nil {
 		return err
 	}
 
@@ -239,16 +320,69 @@ func (u *user) Deauthenticate(device string) error {
 	return router.Deauthenticate(device)
 }
 
-func (u *user) MFA() (string, error) {
-	url, err := data.GetMFASecret(u.Username)
+func (u *user) enrol(mfaType, secret string, authenticator authenticators.AuthenticatorFunc) error {
+	updated, err := authenticator(secret, u.Username)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if updated != "" {
+		secret = updated
 	}
 
-	return url, nil
+	return data.EnrolMfaFactor(u.Username, mfaType, secret)
 }
 
+func (u *user) verify(mfaType string, authenticator authenticators.AuthenticatorFunc) error {
+	factors, err := data.GetMfaFactors(u.Username, mfaType)
+	if err != nil {
+		return err
+	}
+
+	if len(factors) == 0 {
+		return errors.New("authenticator " + mfaType + " is not enrolled for user")
+	}
+
+	var errs []error
+	for _, factor := range factors {
+		updated, err := authenticator(factor.Secret, u.Username)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		return data.SetMfaFactorUsed(u.Username, factor.ID, updated)
+	}
+
+	return errors.Join(errs...)
+}
+
+// MFAFactors returns the users enrolled factors of mfaType, or all of them if mfaType is empty
+func (u *user) MFAFactors(mfaType string) ([]data.MfaFactor, error) {
+	return data.GetMfaFactors(u.Username, mfaType)
+}
+
+// GetMFATypes returns the types of factor the user has enrolled, most recently used first
+func (u *user) GetMFATypes() []string {
+	types, err := data.GetMfaFactorTypes(u.Username)
+	if err != nil {
+		return nil
+	}
+
+	return types
+}
+
+// GetMFAType returns the type of the users most recently used factor, or the one being registered if there are none
 func (u *user) GetMFAType() string {
+	if types := u.GetMFATypes(); len(types) > 0 {
+		return types[0]
+	}
+
+	return u.PendingMFAType()
+}
+
+// PendingMFAType is the type of factor the user is part way through registering
+func (u *user) PendingMFAType() string {
 	mType, err := data.GetMFAType(u.Username)
 
 	if err != nil {
@@ -283,7 +417,7 @@ func GetUser(username string) (user, error) {
 }
 
 func GetUserFromAddress(address net.IP) (user, error) {
-	ud, err := data.GetUserDataFromAddress(address.To4().String())
+	ud, err := data.GetUserDataFromAddress(address.String())
 	if err != nil {
 		return user{}, err
 	}
@@ -24,10 +24,24 @@ func GetIPFromRequest(r *http.Request) net.IP {
 		ips := r.Header.Get("X-Forwarded-For")
 
 		addresses := strings.Split(ips, ",")
-		if ips != "" && len(addresses) > 0 && net.ParseIP(addresses[0]) != nil {
-			return net.ParseIP(addresses[0]).To4()
+		if ips != "" && len(addresses) > 0 && net.ParseIP(strings.TrimSpace(addresses[0])) != nil {
+			return shortestForm(net.ParseIP(strings.TrimSpace(addresses[0])))
 		}
 	}
 
-	return net.ParseIP(GetIP(r.RemoteAddr)).To4()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = GetIP(r.RemoteAddr)
+	}
+
+	return shortestForm(net.ParseIP(host))
+}
+
+// Returns ipv4 addresses as 4 bytes, and ipv6 addresses as 16
+func shortestForm(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return ip.To4()
+	}
+
+	return ip
 }
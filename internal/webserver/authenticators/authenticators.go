@@ -4,8 +4,9 @@ import (
 	"net/http"
 )
 
-// This is passed to the users.Authenticate(...) function
-type AuthenticatorFunc func(mfaSecret, username string) error
+// This is passed to the users.Authenticate(...) function, it is called with the secret of each of the users factors of that type until one succeeds
+// If the stored secret should change (e.g a webauthn signature counter) the new value is returned, otherwise updatedSecret is empty
+type AuthenticatorFunc func(mfaSecret, username string) (updatedSecret string, err error)
 
 // All supported mfa methods, altered in config based on users selection
 var MFA = map[string]Authenticator{}
@@ -16,6 +17,10 @@ const (
 	WebauthnMFA = "webauthn"
 	OidcMFA     = "oidc"
 	PamMFA      = "pam"
+	RecoveryMFA = "recovery"
+	RadiusMFA   = "radius"
+	LdapMFA     = "ldap"
+	WebhookMFA  = "webhook"
 )
 
 type Authenticator interface {
@@ -43,3 +48,9 @@ type Authenticator interface {
 	// Executed in /register_mfa/ path to show the UI for registration
 	RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string)
 }
+
+// Optionally implemented by authenticators that must be reachable from outside the vpn (e.g an approval callback from a users phone)
+// Automatically added under /approve/<mfa_method_name>/ on the public listener
+type PublicAuthenticator interface {
+	PublicAPI(w http.ResponseWriter, r *http.Request)
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/webserver/authenticators"
 )
 
@@ -26,6 +27,10 @@ func init() {
 	authenticators.MFA[authenticators.WebauthnMFA] = new(Webauthn)
 	authenticators.MFA[authenticators.OidcMFA] = new(Oidc)
 	authenticators.MFA[authenticators.PamMFA] = new(Pam)
+	authenticators.MFA[authenticators.RecoveryMFA] = new(Recovery)
+	authenticators.MFA[authenticators.RadiusMFA] = new(Radius)
+	authenticators.MFA[authenticators.LdapMFA] = new(Ldap)
+	authenticators.MFA[authenticators.WebhookMFA] = new(Webhook)
 }
 
 func resultMessage(err error) (string, int) {
@@ -41,3 +46,13 @@ func resultMessage(err error) (string, int) {
 	}
 	return msg, http.StatusBadRequest
 }
+
+// enrolledMethods is how many differing mfa types the user can pick between when authorising
+func enrolledMethods(username string) int {
+	types, err := data.GetMfaFactorTypes(username)
+	if err != nil {
+		return 0
+	}
+
+	return len(types)
+}
@@ -0,0 +1,57 @@
+package methods
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+)
+
+// loadTestConfig loads the in memory test config with the methods and their settings merged into Authenticators, and a fresh database
+func loadTestConfig(t *testing.T, settings map[string]interface{}) {
+	t.Helper()
+
+	contents, err := os.ReadFile("../../../config/test_in_memory_db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c map[string]interface{}
+	if err := json.Unmarshal(contents, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range settings {
+		c["Authenticators"].(map[string]interface{})[k] = v
+	}
+
+	contents, err = json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading the config removes the methods it does not enable
+	registered := maps.Clone(authenticators.MFA)
+	t.Cleanup(func() {
+		authenticators.MFA = registered
+	})
+
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(data.MfaKeyEnvVariable, "")
+	if err := data.Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+}
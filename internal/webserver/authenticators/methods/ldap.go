@@ -0,0 +1,275 @@
+package methods
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type Ldap struct {
+}
+
+func (t *Ldap) Init(settings map[string]string) error {
+	return nil
+}
+
+func (t *Ldap) Type() string {
+	return authenticators.LdapMFA
+}
+
+func (t *Ldap) FriendlyName() string {
+	return "Directory Login"
+}
+
+func (t *Ldap) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err = data.SetUserMfa(user.Username, "LDAPauth", authenticators.LdapMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save LDAP key to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		jsonResponse(w, user.Username, 200)
+
+	case "POST":
+		err = user.Authenticate(clientTunnelIp.String(), t.Type(), t.AuthoriseFunc(w, r))
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+			return
+		}
+
+		log.Println(user.Username, clientTunnelIp, "authorised")
+		user.EnforceMFA()
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (t *Ldap) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsSteppedUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	err = user.Authenticate(clientTunnelIp.String(), t.Type(), t.AuthoriseFunc(w, r))
+
+	msg, status := resultMessage(err)
+	jsonResponse(w, msg, status)
+
+	if err != nil {
+		log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+		return
+	}
+
+	log.Println(user.Username, clientTunnelIp, "authorised")
+}
+
+func (t *Ldap) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticators.AuthenticatorFunc {
+	return func(mfaSecret, username string) (string, error) {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return "", err
+		}
+
+		passwd := r.FormValue("password")
+
+		// An empty password is an unauthenticated bind, which most directories will accept
+		if passwd == "" {
+			return "", errors.New("LDAP password was empty")
+		}
+
+		settings := config.Values().Authenticators.LDAP
+
+		log.Println(username, "attempting to authorise with LDAP server", settings.URL)
+
+		conn, err := dialLdap()
+		if err != nil {
+			return "", errors.New("LDAP connection failed: " + err.Error())
+		}
+		defer conn.Close()
+
+		userDN := strings.ReplaceAll(settings.UserDN, "%s", escapeLdapDN(settings.UserDN, username))
+		if err := conn.Bind(userDN, passwd); err != nil {
+			return "", errors.New("LDAP bind failed: " + err.Error())
+		}
+
+		// Search as the user that just bound, so no service account is needed
+		result, err := conn.Search(ldap.NewSearchRequest(
+			settings.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+			ldapUserFilter(settings.UserFilter, username),
+			[]string{settings.GroupsAttribute},
+			nil,
+		))
+		if err != nil {
+			return "", errors.New("LDAP user search failed: " + err.Error())
+		}
+
+		if len(result.Entries) != 1 {
+			return "", fmt.Errorf("LDAP user search returned %d entries, expected 1", len(result.Entries))
+		}
+
+		groups := ldapGroups(result.Entries[0].GetAttributeValues(settings.GroupsAttribute))
+
+		config.SyncVirtualUser(username, groups)
+
+		return "", nil
+	}
+}
+
+func (t *Ldap) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_ldap.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render ldap prompt template: ", err)
+	}
+}
+
+func (t *Ldap) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_ldap.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render ldap mfa template: ", err)
+	}
+}
+
+func (t *Ldap) LogoutPath() string {
+	return "/"
+}
+
+func dialLdap() (*ldap.Conn, error) {
+	settings := config.Values().Authenticators.LDAP
+
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if settings.CACertPath != "" {
+		pem, err := os.ReadFile(settings.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + settings.CACertPath)
+		}
+	}
+
+	conn, err := ldap.DialURL(settings.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(10 * time.Second)
+
+	if settings.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// escapeLdapDN escapes the username if it is placed in a distinguished name, user principal names (user@domain) are left as is
+func escapeLdapDN(userDN, username string) string {
+	if strings.Contains(userDN, "=") {
+		return ldap.EscapeDN(username)
+	}
+
+	return username
+}
+
+// ldapUserFilter places the escaped username in filter, so it cannot add clauses or wildcards to the search
+func ldapUserFilter(filter, username string) string {
+	return strings.ReplaceAll(filter, "%s", ldap.EscapeFilter(username))
+}
+
+// ldapGroups turns group DNs like "CN=VPN Admins,OU=Groups,DC=example,DC=com" into wag groups, e.g "group:VPN Admins"
+func ldapGroups(values []string) []string {
+	groups := make([]string, 0, len(values))
+	for _, value := range values {
+		name := value
+
+		dn, err := ldap.ParseDN(value)
+		if err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			name = dn.RDNs[0].Attributes[0].Value
+		}
+
+		if name != "" {
+			groups = append(groups, "group:"+name)
+		}
+	}
+
+	return groups
+}
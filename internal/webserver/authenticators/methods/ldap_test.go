@@ -0,0 +1,97 @@
+package methods
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestEscapeLdapDN(t *testing.T) {
+	tests := []struct {
+		userDN   string
+		username string
+		expected string
+	}{
+		{"uid=%s,ou=people,dc=example,dc=com", "toaster", "uid=toaster,ou=people,dc=example,dc=com"},
+		{"uid=%s,ou=people,dc=example,dc=com", "toaster,ou=admins", `uid=toaster\,ou=admins,ou=people,dc=example,dc=com`},
+		{"uid=%s,ou=people,dc=example,dc=com", `to"aster+cn=x`, `uid=to\"aster\+cn=x,ou=people,dc=example,dc=com`},
+		{"uid=%s,ou=people,dc=example,dc=com", "<toaster>;", `uid=\<toaster\>\;,ou=people,dc=example,dc=com`},
+		{"uid=%s,ou=people,dc=example,dc=com", `back\slash`, `uid=back\\slash,ou=people,dc=example,dc=com`},
+		{"uid=%s,ou=people,dc=example,dc=com", " #toaster ", `uid=\ #toaster\ ,ou=people,dc=example,dc=com`},
+		{"uid=%s,ou=people,dc=example,dc=com", "to\x00aster", `uid=to\00aster,ou=people,dc=example,dc=com`},
+		// User principal names are not distinguished names, so are not escaped
+		{"%s@example.com", "toaster", "toaster@example.com"},
+		{"EXAMPLE\\%s", "toaster", "EXAMPLE\\toaster"},
+	}
+
+	for _, test := range tests {
+		got := strings.ReplaceAll(test.userDN, "%s", escapeLdapDN(test.userDN, test.username))
+		if got != test.expected {
+			t.Errorf("%q in %q: got %q, expected %q", test.username, test.userDN, got, test.expected)
+			continue
+		}
+
+		if !strings.Contains(test.userDN, "=") {
+			continue
+		}
+
+		// Whatever the username, it must stay a single value of the first RDN
+		dn, err := ldap.ParseDN(got)
+		if err != nil {
+			t.Errorf("%q: escaped DN did not parse: %v", test.username, err)
+			continue
+		}
+
+		if len(dn.RDNs) != 4 || len(dn.RDNs[0].Attributes) != 1 || dn.RDNs[0].Attributes[0].Value != test.username {
+			t.Errorf("%q: username changed the structure of the DN: %q", test.username, got)
+		}
+	}
+}
+
+func TestLdapUserFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		username string
+		expected string
+	}{
+		{"(uid=%s)", "toaster", "(uid=toaster)"},
+		{"(uid=%s)", "*", `(uid=\2a)`},
+		{"(uid=%s)", "toaster)(uid=*", `(uid=toaster\29\28uid=\2a)`},
+		{"(uid=%s)", `back\slash`, `(uid=back\5cslash)`},
+		{"(uid=%s)", "to\x00aster", `(uid=to\00aster)`},
+		{"(&(objectClass=person)(|(uid=%s)(mail=%s)))", "*)(|(uid=*", `(&(objectClass=person)(|(uid=\2a\29\28|\28uid=\2a)(mail=\2a\29\28|\28uid=\2a)))`},
+	}
+
+	for _, test := range tests {
+		if got := ldapUserFilter(test.filter, test.username); got != test.expected {
+			t.Errorf("%q in %q: got %q, expected %q", test.username, test.filter, got, test.expected)
+		}
+	}
+}
+
+func TestLdapGroups(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected []string
+	}{
+		{nil, []string{}},
+		{[]string{"CN=VPN Admins,OU=Groups,DC=example,DC=com"}, []string{"group:VPN Admins"}},
+		{[]string{"cn=nerds,ou=groups,dc=example,dc=com", "cn=toasters,ou=groups,dc=example,dc=com"}, []string{"group:nerds", "group:toasters"}},
+		// Escaped characters in the group name are unescaped
+		{[]string{`CN=Smith\, Jones,OU=Groups,DC=example,DC=com`}, []string{"group:Smith, Jones"}},
+		{[]string{`CN=a\+b\=c,DC=example`}, []string{"group:a+b=c"}},
+		// Directories that return plain names rather than DNs
+		{[]string{"nerds"}, []string{"group:nerds"}},
+		{[]string{""}, []string{}},
+		// Only the first attribute of the first RDN names the group
+		{[]string{"CN=first+OU=second,DC=example"}, []string{"group:first"}},
+	}
+
+	for _, test := range tests {
+		if got := ldapGroups(test.values); !slices.Equal(got, test.expected) {
+			t.Errorf("%q: got %q, expected %q", test.values, got, test.expected)
+		}
+	}
+}
@@ -85,12 +85,6 @@ func (o *Oidc) FriendlyName() string {
 func (o *Oidc) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -98,8 +92,8 @@ func (o *Oidc) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -130,12 +124,6 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -143,6 +131,13 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// An authorised device only returns here if it is adding sso as another mfa method, or stepping up
+	if router.IsSteppedUp(clientTunnelIp.String()) && user.PendingMFAType() != o.Type() {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
 	marshalUserinfo := func(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens, state string, rp rp.RelyingParty, info oidc.UserInfo) {
 
 		groupsIntf, ok := tokens.IDTokenClaims.GetClaim(config.Values().Authenticators.OIDC.GroupsClaimName).([]interface{})
@@ -167,25 +162,25 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Will set enforcing on first use
-		err = user.Authenticate(clientTunnelIp.String(), user.GetMFAType(), func(issuerString, username string) error {
+		err = user.Authenticate(clientTunnelIp.String(), o.Type(), func(issuerString, username string) (string, error) {
 
 			var issuerDetails issuer
 			err := json.Unmarshal([]byte(issuerString), &issuerDetails)
 			if err != nil {
-				return err
+				return "", err
 			}
 
 			if issuerDetails.Issuer != rp.Issuer() {
-				return errors.New("stored issuer " + issuerDetails.Issuer + " did not equal actual issuer: " + rp.Issuer())
+				return "", errors.New("stored issuer " + issuerDetails.Issuer + " did not equal actual issuer: " + rp.Issuer())
 			}
 
 			if info.GetPreferredUsername() != username {
-				return errors.New("returned username did not equal device associated username")
+				return "", errors.New("returned username did not equal device associated username")
 			}
 
 			config.AddVirtualUser(username, groups)
 
-			return nil
+			return "", nil
 		})
 
 		if err != nil {
@@ -35,12 +35,6 @@ func (t *Pam) FriendlyName() string {
 func (t *Pam) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -48,8 +42,8 @@ func (t *Pam) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -93,7 +87,7 @@ func (t *Pam) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsSteppedUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -126,11 +120,11 @@ func (t *Pam) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 }
 
 func (t *Pam) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticators.AuthenticatorFunc {
-	return func(mfaSecret, username string) error {
+	return func(mfaSecret, username string) (string, error) {
 		err := r.ParseForm()
 		if err != nil {
 			http.Error(w, "Bad request", 400)
-			return err
+			return "", err
 		}
 
 		passwd := r.FormValue("password")
@@ -155,24 +149,24 @@ func (t *Pam) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticato
 			return "", errors.New("unrecognized PAM message style")
 		})
 		if err != nil {
-			return errors.New("PAM start failed: " + err.Error())
+			return "", errors.New("PAM start failed: " + err.Error())
 		}
 
 		if err = t.Authenticate(0); err != nil {
-			return errors.New("PAM authentication failed: " + err.Error())
+			return "", errors.New("PAM authentication failed: " + err.Error())
 		}
 
 		if err = t.AcctMgmt(0); err != nil {
-			return errors.New("PAM account failed: " + err.Error())
+			return "", errors.New("PAM account failed: " + err.Error())
 		}
 
 		// PAM login names might suffer transformations in the PAM stack.
 		// We should take whatever the PAM stack returns for it.
 		pamUsername, err := t.GetItem(pam.User)
 		if err != nil {
-			return fmt.Errorf("PAM get user '%s' (%s) failed", pamUsername, username)
+			return "", fmt.Errorf("PAM get user '%s' (%s) failed", pamUsername, username)
 		} else {
-			return nil
+			return "", nil
 		}
 
 	}
@@ -181,7 +175,7 @@ func (t *Pam) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticato
 func (t *Pam) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
 	if err := resources.Render("prompt_mfa_pam.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render pam prompt template: ", err)
 	}
@@ -0,0 +1,285 @@
+package methods
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/radius"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+// How long a user has to answer an Access-Challenge before they have to start again
+const radiusChallengeTimeout = 5 * time.Minute
+
+type radiusChallenge struct {
+	username string
+	state    []byte
+	expires  time.Time
+}
+
+type Radius struct {
+	client radius.Client
+
+	// Outstanding challenges by device address, only the server state is kept here so the client cannot tamper with it
+	lock       sync.Mutex
+	challenges map[string]radiusChallenge
+
+	// Held for the whole of a devices login, as the server is asked before the attempt is counted
+	deviceLocks map[string]*sync.Mutex
+}
+
+func (t *Radius) Init(settings map[string]string) error {
+	t.client = radius.Client{
+		Server:        settings["Server"],
+		Secret:        settings["Secret"],
+		NASIdentifier: settings["NASIdentifier"],
+	}
+
+	t.challenges = make(map[string]radiusChallenge)
+	t.deviceLocks = make(map[string]*sync.Mutex)
+
+	return nil
+}
+
+func (t *Radius) Type() string {
+	return authenticators.RadiusMFA
+}
+
+func (t *Radius) FriendlyName() string {
+	return "RADIUS Login"
+}
+
+func (t *Radius) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err = data.SetUserMfa(user.Username, "RADIUSauth", authenticators.RadiusMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save RADIUS key to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		jsonResponse(w, user.Username, 200)
+
+	case "POST":
+		challenge, err := t.authenticate(w, r, user.Username, user.Authenticate)
+		if challenge != nil {
+			t.challenged(w, challenge)
+			log.Println(user.Username, clientTunnelIp, "was sent a RADIUS challenge")
+			return
+		}
+
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+			return
+		}
+
+		log.Println(user.Username, clientTunnelIp, "authorised")
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (t *Radius) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsSteppedUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	challenge, err := t.authenticate(w, r, user.Username, user.Authenticate)
+	if challenge != nil {
+		t.challenged(w, challenge)
+		log.Println(user.Username, clientTunnelIp, "was sent a RADIUS challenge")
+		return
+	}
+
+	msg, status := resultMessage(err)
+	jsonResponse(w, msg, status)
+
+	if err != nil {
+		log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+		return
+	}
+
+	log.Println(user.Username, clientTunnelIp, "authorised")
+}
+
+// authenticate asks the RADIUS server about the password before the attempt is counted by authenticate, so that an Access-Challenge
+// is passed on to the user without using up one of their attempts or being recorded as a failed login
+// It returns the challenge if one was sent, otherwise the result of authenticate
+func (t *Radius) authenticate(w http.ResponseWriter, r *http.Request, username string, authenticate func(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error) (*radius.ChallengeError, error) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return nil, err
+	}
+
+	device := utils.GetIPFromRequest(r).String()
+
+	// Only one login at a time for each device, so the attempts cannot be exceeded by sending many at once
+	lock := t.deviceLock(device)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// A locked device must not reach the server, being sent a challenge would show that the password was right
+	_, _, attempts, locked, err := data.GetAuthenticationDetails(username, device)
+	if err != nil {
+		return nil, err
+	}
+
+	result := errors.New("device is locked")
+	if attempts < config.Values().Lockout && !locked {
+		result = t.exchange(username, device, r.FormValue("password"))
+
+		var challenge *radius.ChallengeError
+		if errors.As(result, &challenge) {
+			return challenge, nil
+		}
+	}
+
+	return nil, authenticate(device, t.Type(), func(mfaSecret, factorUsername string) (string, error) {
+		if factorUsername != username {
+			return "", errors.New("radius result was for another user")
+		}
+
+		return "", result
+	})
+}
+
+// exchange sends the password to the server, if the last request for device was challenged the password is the answer to it
+func (t *Radius) exchange(username, device, password string) error {
+	state := t.takeChallenge(device, username)
+
+	log.Println(username, "attempting to authorise with RADIUS server", t.client.Server)
+	err := t.client.Authenticate(username, password, state)
+
+	var challenge *radius.ChallengeError
+	if errors.As(err, &challenge) {
+		t.lock.Lock()
+		t.challenges[device] = radiusChallenge{
+			username: username,
+			state:    challenge.State,
+			expires:  time.Now().Add(radiusChallengeTimeout),
+		}
+		t.lock.Unlock()
+	}
+
+	return err
+}
+
+func (t *Radius) deviceLock(device string) *sync.Mutex {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	l, ok := t.deviceLocks[device]
+	if !ok {
+		l = &sync.Mutex{}
+		t.deviceLocks[device] = l
+	}
+
+	return l
+}
+
+// takeChallenge removes and returns the outstanding challenge state for device, or nil if there is none
+func (t *Radius) takeChallenge(device, username string) []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for d, c := range t.challenges {
+		if time.Now().After(c.expires) {
+			delete(t.challenges, d)
+		}
+	}
+
+	c, ok := t.challenges[device]
+	if !ok || c.username != username {
+		return nil
+	}
+
+	delete(t.challenges, device)
+	return c.state
+}
+
+// challenged writes the challenge message for the user to answer
+func (t *Radius) challenged(w http.ResponseWriter, challenge *radius.ChallengeError) {
+	message := challenge.Message
+	if message == "" {
+		message = "Enter the next code"
+	}
+
+	jsonResponse(w, struct {
+		Challenge string
+	}{message}, http.StatusUnauthorized)
+}
+
+func (t *Radius) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_radius.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render radius prompt template: ", err)
+	}
+}
+
+func (t *Radius) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_radius.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render radius mfa template: ", err)
+	}
+}
+
+func (t *Radius) LogoutPath() string {
+	return "/"
+}
@@ -0,0 +1,227 @@
+package methods
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/radius"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	layeh "layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	radiusTestSecret = "testing123"
+	radiusTestDevice = "10.2.43.2"
+)
+
+// radiusStandIn accepts the password with a challenge for a token code, like a server fronting a hardware token
+func radiusStandIn(t *testing.T) (address string, requests *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests = new(atomic.Int32)
+	server := &layeh.PacketServer{
+		SecretSource: layeh.StaticSecretSource([]byte(radiusTestSecret)),
+		Handler: layeh.HandlerFunc(func(rw layeh.ResponseWriter, r *layeh.Request) {
+			requests.Add(1)
+
+			// wag only trusts responses with a Message-Authenticator
+			w := layeh.ResponseWriter(signedRadiusWriter{rw})
+
+			password := rfc2865.UserPassword_GetString(r.Packet)
+			state := rfc2865.State_Get(r.Packet)
+
+			switch {
+			case state == nil && password == "hunter2":
+				response := r.Response(layeh.CodeAccessChallenge)
+				rfc2865.State_Set(response, []byte("awaiting-token"))
+				rfc2865.ReplyMessage_SetString(response, "Enter your token code")
+				w.Write(response)
+			case bytes.Equal(state, []byte("awaiting-token")) && password == "123456":
+				w.Write(r.Response(layeh.CodeAccessAccept))
+			default:
+				w.Write(r.Response(layeh.CodeAccessReject))
+			}
+		}),
+	}
+
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+	})
+
+	return conn.LocalAddr().String(), requests
+}
+
+type signedRadiusWriter struct {
+	layeh.ResponseWriter
+}
+
+// The response still has the request authenticator until it is written, which the Message-Authenticator is calculated with
+func (s signedRadiusWriter) Write(response *layeh.Packet) error {
+	rfc2869.MessageAuthenticator_Set(response, make([]byte, md5.Size))
+
+	wire, err := response.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(md5.New, response.Secret)
+	mac.Write(wire)
+	rfc2869.MessageAuthenticator_Set(response, mac.Sum(nil))
+
+	return s.ResponseWriter.Write(response)
+}
+
+// countingAuthenticate stands in for user.Authenticate, counting attempts the same way
+type countingAuthenticate struct {
+	attempts int
+}
+
+func (c *countingAuthenticate) authenticate(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error {
+	if err := data.IncrementAuthenticationAttempt("toaster", device); err != nil {
+		return err
+	}
+	c.attempts++
+
+	_, _, attempts, _, err := data.GetAuthenticationDetails("toaster", device)
+	if err != nil {
+		return err
+	}
+
+	if attempts > config.Values().Lockout {
+		return errors.New("device is locked")
+	}
+
+	_, err = authenticator("", "toaster")
+	return err
+}
+
+func radiusTest(t *testing.T) (*Radius, *atomic.Int32) {
+	loadTestConfig(t, map[string]interface{}{
+		"Methods": []string{"totp"},
+	})
+
+	if _, err := data.CreateUserDataAccount("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := data.AddDevice("toaster", radiusTestDevice, "9tk6bPzDo+DgqqvQLcIGk2vgu2LGLzRxtMI3ZDNn2Vw=", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	address, requests := radiusStandIn(t)
+
+	var rd Radius
+	if err := rd.Init(map[string]string{"Server": address, "Secret": radiusTestSecret, "NASIdentifier": "wag-test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &rd, requests
+}
+
+func radiusLogin(rd *Radius, auth *countingAuthenticate, password string) (*radius.ChallengeError, error) {
+	r := httptest.NewRequest(http.MethodPost, "/authorise/radius/", strings.NewReader(url.Values{"password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = radiusTestDevice + ":1234"
+
+	return rd.authenticate(httptest.NewRecorder(), r, "toaster", auth.authenticate)
+}
+
+func TestRadiusChallengeIsNotAnAttempt(t *testing.T) {
+	rd, _ := radiusTest(t)
+
+	var auth countingAuthenticate
+
+	challenge, err := radiusLogin(rd, &auth, "hunter2")
+	if challenge == nil || err != nil {
+		t.Fatal("password was not challenged: ", err)
+	}
+
+	if challenge.Message != "Enter your token code" {
+		t.Fatal("wrong challenge message: ", challenge.Message)
+	}
+
+	if auth.attempts != 0 {
+		t.Fatal("challenge was counted as an attempt")
+	}
+
+	challenge, err = radiusLogin(rd, &auth, "123456")
+	if challenge != nil || err != nil {
+		t.Fatal("answering the challenge did not authorise: ", err)
+	}
+
+	if auth.attempts != 1 {
+		t.Fatal("login was not counted once: ", auth.attempts)
+	}
+
+	// The challenge state can only be answered once
+	if _, err := radiusLogin(rd, &auth, "123456"); err == nil {
+		t.Fatal("challenge was answered twice")
+	}
+}
+
+func TestRadiusRejectIsAnAttempt(t *testing.T) {
+	rd, _ := radiusTest(t)
+
+	var auth countingAuthenticate
+
+	challenge, err := radiusLogin(rd, &auth, "wrong")
+	if challenge != nil || err == nil {
+		t.Fatal("wrong password was not rejected")
+	}
+
+	if auth.attempts != 1 {
+		t.Fatal("rejected password was not counted: ", auth.attempts)
+	}
+
+	// A wrong answer to a challenge counts as well
+	if challenge, _ := radiusLogin(rd, &auth, "hunter2"); challenge == nil {
+		t.Fatal("password was not challenged")
+	}
+
+	if _, err := radiusLogin(rd, &auth, "654321"); err == nil {
+		t.Fatal("wrong token code was accepted")
+	}
+
+	if auth.attempts != 2 {
+		t.Fatal("wrong answer was not counted: ", auth.attempts)
+	}
+}
+
+func TestRadiusLockedDeviceIsNotSent(t *testing.T) {
+	rd, requests := radiusTest(t)
+
+	var auth countingAuthenticate
+	for i := 0; i < config.Values().Lockout; i++ {
+		radiusLogin(rd, &auth, "wrong")
+	}
+
+	sent := requests.Load()
+
+	// The right password must not be challenged, as that would show it was right
+	challenge, err := radiusLogin(rd, &auth, "hunter2")
+	if challenge != nil || err == nil {
+		t.Fatal("locked device was challenged")
+	}
+
+	if requests.Load() != sent {
+		t.Fatal("locked device reached the radius server")
+	}
+}
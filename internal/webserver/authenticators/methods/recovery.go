@@ -0,0 +1,305 @@
+package methods
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/wag/internal/audit"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+	"golang.org/x/crypto/argon2"
+)
+
+const numRecoveryCodes = 10
+
+// Only the hash of each code is stored, the user is shown the codes once when they register them
+type recoveryCode struct {
+	Salt []byte
+	Hash []byte
+}
+
+// Recovery is a set of single use codes that can be used in place of a users other mfa methods, e.g when they have lost their phone
+type Recovery struct {
+	// Each users lock is held while checking their code so that it cannot be used twice by concurrent requests
+	// Checking a code is slow, so a lock per user stops one user guessing codes from holding up everyone else
+	lock      sync.Mutex
+	userLocks map[string]*sync.Mutex
+}
+
+func (rc *Recovery) Init(settings map[string]string) error {
+	rc.userLocks = make(map[string]*sync.Mutex)
+	return nil
+}
+
+// userLock returns the lock held while checking usernames recovery codes
+func (rc *Recovery) userLock(username string) *sync.Mutex {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	l, ok := rc.userLocks[username]
+	if !ok {
+		l = &sync.Mutex{}
+		rc.userLocks[username] = l
+	}
+
+	return l
+}
+
+func (rc *Recovery) Type() string {
+	return authenticators.RecoveryMFA
+}
+
+func (rc *Recovery) FriendlyName() string {
+	return "Recovery Codes"
+}
+
+func (rc *Recovery) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	// Recovery codes stand in for another method, so they cannot be the only one
+	if !user.IsEnforcingMFA() || !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register recovery codes without authorising with another mfa method first")
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+
+		codes, hashed, err := generateRecoveryCodes()
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "generating recovery codes failed:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		err = data.SetUserMfa(user.Username, string(hashed), authenticators.RecoveryMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save recovery codes to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		jsonResponse(w, codes, 200)
+
+	case "POST":
+		lock := rc.userLock(user.Username)
+		lock.Lock()
+		err = user.Authenticate(clientTunnelIp.String(), rc.Type(), rc.AuthoriseFunc(w, r))
+		lock.Unlock()
+
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "failed to register recovery codes: ", err.Error())
+			return
+		}
+
+		// Registering a new set of codes replaces the old ones
+		factors, err := user.MFAFactors(rc.Type())
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to get previous recovery codes: ", err)
+			return
+		}
+
+		for i := 0; i < len(factors)-1; i++ {
+			if err := data.DeleteMfaFactor(user.Username, factors[i].ID); err != nil {
+				log.Println(user.Username, clientTunnelIp, "unable to remove previous recovery codes: ", err)
+			}
+		}
+
+		log.Println(user.Username, clientTunnelIp, "registered new recovery codes")
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (rc *Recovery) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsSteppedUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	lock := rc.userLock(user.Username)
+	lock.Lock()
+	err = user.Authenticate(clientTunnelIp.String(), rc.Type(), rc.AuthoriseFunc(w, r))
+	lock.Unlock()
+
+	msg, status := resultMessage(err)
+	jsonResponse(w, msg, status)
+
+	if err != nil {
+		log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+		return
+	}
+
+	recoveryCodeUsed(user.Username, clientTunnelIp.String())
+	log.Println(user.Username, clientTunnelIp, "authorised")
+}
+
+// recoveryCodeUsed alerts that a code was used, as it may mean the user has lost their device or that their codes were stolen
+// The audit event is sent to every audit sink, so it can be alerted on
+func recoveryCodeUsed(username, device string) {
+	remaining := remainingRecoveryCodes(username)
+
+	log.Println("[ALERT]", username, device, "used a recovery code to authorise,", remaining, "codes remaining")
+
+	audit.Record(audit.Event{
+		Type:     audit.Recovery,
+		Outcome:  audit.Success,
+		Username: username,
+		Address:  device,
+		Action:   "use recovery code",
+		Details:  map[string]string{"remaining": strconv.Itoa(remaining)},
+	})
+}
+
+func (rc *Recovery) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticators.AuthenticatorFunc {
+	return func(mfaSecret, username string) (string, error) {
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return "", err
+		}
+
+		code := normaliseRecoveryCode(r.FormValue("code"))
+
+		var codes []recoveryCode
+		err = json.Unmarshal([]byte(mfaSecret), &codes)
+		if err != nil {
+			return "", err
+		}
+
+		for i, c := range codes {
+			if subtle.ConstantTimeCompare(hashRecoveryCode(code, c.Salt), c.Hash) != 1 {
+				continue
+			}
+
+			// Each code can only be used once
+			remaining := append(codes[:i:i], codes[i+1:]...)
+			updated, err := json.Marshal(remaining)
+			if err != nil {
+				return "", err
+			}
+
+			return string(updated), nil
+		}
+
+		return "", errors.New("recovery code does not match")
+	}
+}
+
+func (rc *Recovery) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_recovery.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render recovery prompt template: ", err)
+	}
+}
+
+func (rc *Recovery) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_recovery.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render recovery mfa template: ", err)
+	}
+}
+
+func (rc *Recovery) LogoutPath() string {
+	return "/"
+}
+
+// generateRecoveryCodes returns the codes to show the user, and the hashes of them to store
+func generateRecoveryCodes() (codes []string, hashed []byte, err error) {
+	var stored []recoveryCode
+	for i := 0; i < numRecoveryCodes; i++ {
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw))
+
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+
+		stored = append(stored, recoveryCode{Salt: salt, Hash: hashRecoveryCode(code, salt)})
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	hashed, err = json.Marshal(stored)
+	return codes, hashed, err
+}
+
+func hashRecoveryCode(code string, salt []byte) []byte {
+	return argon2.IDKey([]byte(code), salt, 1, 10*1024, 4, 32)
+}
+
+// normaliseRecoveryCode allows codes to be entered in any case, with or without the dash
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func remainingRecoveryCodes(username string) (remaining int) {
+	factors, err := data.GetMfaFactors(username, authenticators.RecoveryMFA)
+	if err != nil {
+		return 0
+	}
+
+	for _, factor := range factors {
+		var codes []recoveryCode
+		if json.Unmarshal([]byte(factor.Secret), &codes) == nil {
+			remaining += len(codes)
+		}
+	}
+
+	return remaining
+}
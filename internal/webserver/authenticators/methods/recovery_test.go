@@ -0,0 +1,214 @@
+package methods
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/audit"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+)
+
+func submitRecoveryCode(rc *Recovery, secret, code string) (string, error) {
+	r := httptest.NewRequest(http.MethodPost, "/authorise/recovery/", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return rc.AuthoriseFunc(httptest.NewRecorder(), r)(secret, "toaster")
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, hashed, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != numRecoveryCodes {
+		t.Fatal("wrong number of codes: ", len(codes))
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Fatal("code is not in the xxxxx-xxxxx format: ", code)
+		}
+
+		if seen[code] {
+			t.Fatal("duplicate code: ", code)
+		}
+		seen[code] = true
+	}
+
+	var stored []recoveryCode
+	if err := json.Unmarshal(hashed, &stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != numRecoveryCodes {
+		t.Fatal("wrong number of hashes: ", len(stored))
+	}
+
+	for i, s := range stored {
+		if strings.Contains(string(hashed), codes[i]) || strings.Contains(string(hashed), normaliseRecoveryCode(codes[i])) {
+			t.Fatal("code was stored in plain text")
+		}
+
+		if !bytes.Equal(hashRecoveryCode(normaliseRecoveryCode(codes[i]), s.Salt), s.Hash) {
+			t.Fatal("stored hash does not match code ", i)
+		}
+
+		for j := range stored[:i] {
+			if bytes.Equal(stored[j].Salt, s.Salt) {
+				t.Fatal("codes share a salt")
+			}
+		}
+	}
+}
+
+func TestNormaliseRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"abcde-fghij":     "abcdefghij",
+		"ABCDE-FGHIJ":     "abcdefghij",
+		"abcdefghij":      "abcdefghij",
+		"abcde fghij":     "abcdefghij",
+		" abcde - fghij ": "abcdefghij",
+		"AbCdE-fGhIj":     "abcdefghij",
+		"":                "",
+	}
+
+	for input, expected := range tests {
+		if got := normaliseRecoveryCode(input); got != expected {
+			t.Errorf("%q: got %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, 16)
+	otherSalt := bytes.Repeat([]byte{2}, 16)
+
+	if !bytes.Equal(hashRecoveryCode("abcdefghij", salt), hashRecoveryCode("abcdefghij", salt)) {
+		t.Fatal("hash is not stable")
+	}
+
+	if bytes.Equal(hashRecoveryCode("abcdefghij", salt), hashRecoveryCode("abcdefghik", salt)) {
+		t.Fatal("different codes have the same hash")
+	}
+
+	if bytes.Equal(hashRecoveryCode("abcdefghij", salt), hashRecoveryCode("abcdefghij", otherSalt)) {
+		t.Fatal("hash does not depend on the salt")
+	}
+
+	if len(hashRecoveryCode("abcdefghij", salt)) != 32 {
+		t.Fatal("hash is the wrong length")
+	}
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	var rc Recovery
+	rc.Init(nil)
+
+	codes, hashed, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := string(hashed)
+
+	if _, err := submitRecoveryCode(&rc, secret, "aaaaa-aaaaa"); err == nil {
+		t.Fatal("wrong code was accepted")
+	}
+
+	// Codes can be entered in any case, without the dash
+	updated, err := submitRecoveryCode(&rc, secret, strings.ToUpper(strings.ReplaceAll(codes[3], "-", "")))
+	if err != nil {
+		t.Fatal("code was not accepted: ", err)
+	}
+
+	var remaining []recoveryCode
+	if err := json.Unmarshal([]byte(updated), &remaining); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(remaining) != numRecoveryCodes-1 {
+		t.Fatal("used code was not removed, remaining: ", len(remaining))
+	}
+
+	if _, err := submitRecoveryCode(&rc, updated, codes[3]); err == nil {
+		t.Fatal("code was accepted twice")
+	}
+
+	// The other codes still work
+	for i, code := range codes {
+		if i == 3 {
+			continue
+		}
+
+		updated, err = submitRecoveryCode(&rc, updated, code)
+		if err != nil {
+			t.Fatal("unused code was not accepted: ", err)
+		}
+	}
+
+	if updated != "[]" {
+		t.Fatal("all codes were used but some remain: ", updated)
+	}
+}
+
+func TestRecoveryUserLocks(t *testing.T) {
+	var rc Recovery
+	rc.Init(nil)
+
+	if rc.userLock("toaster") != rc.userLock("toaster") {
+		t.Fatal("a user does not always get the same lock")
+	}
+
+	if rc.userLock("toaster") == rc.userLock("tester") {
+		t.Fatal("users share a lock")
+	}
+
+	// Checking one users code does not hold up another
+	rc.userLock("toaster").Lock()
+	defer rc.userLock("toaster").Unlock()
+
+	if !rc.userLock("tester").TryLock() {
+		t.Fatal("another users lock was held")
+	}
+	rc.userLock("tester").Unlock()
+}
+
+func TestRecoveryCodeUsedAudit(t *testing.T) {
+	loadTestConfig(t, map[string]interface{}{
+		"Methods": []string{"totp", "recovery"},
+	})
+
+	_, hashed, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := data.CreateUserDataAccount("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.EnrolMfaFactor("toaster", authenticators.RecoveryMFA, string(hashed)); err != nil {
+		t.Fatal(err)
+	}
+
+	recoveryCodeUsed("toaster", "10.2.43.2")
+
+	events, err := data.GetAuditEvents(data.AuditFilter{Type: audit.Recovery, Username: "toaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Address != "10.2.43.2" || events[0].Details["remaining"] != "10" {
+		t.Fatalf("recovery code use was not audited: %+v", events)
+	}
+}
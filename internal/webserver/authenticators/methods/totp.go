@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"image/png"
 	"log"
 	"net/http"
@@ -48,12 +49,6 @@ func (t *Totp) FriendlyName() string {
 func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -61,8 +56,8 @@ func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -71,48 +66,20 @@ func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 
-		key, err := totp.Generate(totp.GenerateOpts{
-			Issuer:      config.Values().Authenticators.Issuer,
-			AccountName: user.Username,
-		})
+		secret, mfa, err := GenerateTotp(config.Values().Authenticators.Issuer, user.Username)
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "generate key failed:", err)
 			http.Error(w, "Unknown error", 500)
 			return
 		}
 
-		err = data.SetUserMfa(user.Username, key.URL(), authenticators.TotpMFA)
+		err = data.SetUserMfa(user.Username, secret, authenticators.TotpMFA)
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "unable to save totp key to db:", err)
 			http.Error(w, "Unknown error", 500)
 			return
 		}
 
-		image, err := key.Image(200, 200)
-		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "generating image failed:", err)
-			http.Error(w, "Unknown error", 500)
-			return
-		}
-
-		var buff bytes.Buffer
-		err = png.Encode(&buff, image)
-		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "encoding mfa secret as png failed:", err)
-			http.Error(w, "Unknown error", 500)
-			return
-		}
-
-		var mfa = struct {
-			ImageData   string
-			Key         string
-			AccountName string
-		}{
-			ImageData:   "data:image/png;base64, " + base64.StdEncoding.EncodeToString(buff.Bytes()),
-			Key:         key.Secret(),
-			AccountName: key.AccountName(),
-		}
-
 		jsonResponse(w, &mfa, 200)
 
 	case "POST":
@@ -142,7 +109,7 @@ func (t *Totp) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsSteppedUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -174,23 +141,60 @@ func (t *Totp) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// TotpRegistration is shown to the user so they can add the key to their authenticator app
+type TotpRegistration struct {
+	ImageData   string
+	Key         string
+	AccountName string
+}
+
+// GenerateTotp creates a new key for accountName, returning the secret to store and the details to show the user
+func GenerateTotp(issuer, accountName string) (secret string, registration TotpRegistration, err error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: accountName,
+	})
+	if err != nil {
+		return "", registration, err
+	}
+
+	image, err := key.Image(200, 200)
+	if err != nil {
+		return "", registration, fmt.Errorf("generating image failed: %s", err)
+	}
+
+	var buff bytes.Buffer
+	err = png.Encode(&buff, image)
+	if err != nil {
+		return "", registration, fmt.Errorf("encoding mfa secret as png failed: %s", err)
+	}
+
+	registration = TotpRegistration{
+		ImageData:   "data:image/png;base64, " + base64.StdEncoding.EncodeToString(buff.Bytes()),
+		Key:         key.Secret(),
+		AccountName: key.AccountName(),
+	}
+
+	return key.URL(), registration, nil
+}
+
 func (t *Totp) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticators.AuthenticatorFunc {
-	return func(mfaSecret, username string) error {
+	return func(mfaSecret, username string) (string, error) {
 		err := r.ParseForm()
 		if err != nil {
 			http.Error(w, "Bad request", 400)
-			return err
+			return "", err
 		}
 
 		code := r.FormValue("code")
 
 		key, err := otp.NewKeyFromURL(mfaSecret)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		if !totp.Validate(code, key.Secret()) {
-			return errors.New("code does not match expected")
+			return "", errors.New("code does not match expected")
 		}
 
 		lockULock.Lock()
@@ -198,19 +202,19 @@ func (t *Totp) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticat
 
 		e := usedCodes[username]
 		if e.code == code && e.usetime.Add(30*time.Second).After(time.Now()) {
-			return errors.New("code already used")
+			return "", errors.New("code already used")
 		}
 
 		usedCodes[username] = entry{code: code, usetime: time.Now()}
 
-		return nil
+		return "", nil
 	}
 }
 
 func (t *Totp) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
 	if err := resources.Render("prompt_mfa_totp.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render totp prompt template: ", err)
 	}
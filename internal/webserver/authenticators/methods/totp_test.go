@@ -0,0 +1,68 @@
+package methods
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestGenerateTotp(t *testing.T) {
+	secret, registration, err := GenerateTotp("Wag", "toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := otp.NewKeyFromURL(secret)
+	if err != nil {
+		t.Fatal("stored secret is not an otpauth url: ", err)
+	}
+
+	if key.Issuer() != "Wag" || key.AccountName() != "toaster" {
+		t.Fatal("key has the wrong issuer or account: ", key.Issuer(), key.AccountName())
+	}
+
+	if registration.Key != key.Secret() {
+		t.Fatal("key shown to the user does not match the stored secret")
+	}
+
+	if registration.AccountName != "toaster" {
+		t.Fatal("wrong account name shown to the user: ", registration.AccountName)
+	}
+
+	image, ok := strings.CutPrefix(registration.ImageData, "data:image/png;base64, ")
+	if !ok {
+		t.Fatal("qr code is not a png data url: ", registration.ImageData[:min(len(registration.ImageData), 30)])
+	}
+
+	png, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		t.Fatal("qr code is not valid base64: ", err)
+	}
+
+	if !strings.HasPrefix(string(png), "\x89PNG") {
+		t.Fatal("qr code is not a png")
+	}
+
+	// The stored secret must verify codes from an authenticator app given the shown key
+	code, err := totp.GenerateCode(registration.Key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !totp.Validate(code, key.Secret()) {
+		t.Fatal("code generated from the shown key did not validate")
+	}
+
+	other, _, err := GenerateTotp("Wag", "toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other == secret {
+		t.Fatal("generating a key twice returned the same secret")
+	}
+}
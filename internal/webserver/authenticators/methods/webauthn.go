@@ -43,12 +43,6 @@ func (wa *Webauthn) FriendlyName() string {
 func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -56,8 +50,8 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -66,29 +60,21 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 
-		webauthnUser := NewUser(user.Username, user.Username)
-
-		// generate PublicKeyCredentialCreationOptions, session data
-		options, sessionData, err := config.Values().Authenticators.Webauthn.BeginRegistration(
-			webauthnUser,
-		)
-
+		existing, err := wa.enrolledKeys(user.Username)
 		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "error creating registration request for webauthn")
+			log.Println(user.Username, clientTunnelIp, "could not get existing webauthn keys:", err)
 			jsonResponse(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		wa.sessions.StartSession(w, r, sessionData, nil)
-
-		webauthdata, err := webauthnUser.MarshalJSON()
+		options, pending, err := wa.BeginRegistration(w, r, config.Values().Authenticators.Webauthn, user.Username, existing)
 		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "cant marshal json from webauthn")
+			log.Println(user.Username, clientTunnelIp, "error creating registration request for webauthn:", err)
 			jsonResponse(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		err = data.SetUserMfa(user.Username, string(webauthdata), authenticators.WebauthnMFA)
+		err = data.SetUserMfa(user.Username, pending, authenticators.WebauthnMFA)
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "cant set user db to webauth user")
 			jsonResponse(w, "Server Error", http.StatusInternalServerError)
@@ -97,45 +83,7 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 
 		jsonResponse(w, options, http.StatusOK)
 	case "POST":
-		err = user.Authenticate(clientTunnelIp.String(), wa.Type(),
-
-			func(mfaSecret, username string) error {
-
-				var webauthnUser WebauthnUser
-				err := webauthnUser.UnmarshalJSON([]byte(mfaSecret))
-				if err != nil {
-					return err
-				}
-
-				_, sessionData := wa.sessions.GetSessionFromRequest(r)
-				if sessionData == nil {
-					return errors.New("session not found")
-				}
-
-				webauthnSession := *sessionData
-
-				credential, err := config.Values().Authenticators.Webauthn.FinishRegistration(webauthnUser, *webauthnSession, r)
-				if err != nil {
-					return err
-				}
-
-				webauthnUser.AddCredential(*credential)
-
-				webauthdata, err := webauthnUser.MarshalJSON()
-				if err != nil {
-					return err
-				}
-
-				err = data.SetUserMfa(username, string(webauthdata), authenticators.WebauthnMFA)
-				if err != nil {
-
-					return err
-				}
-
-				wa.sessions.DeleteSession(w, r)
-
-				return nil
-			})
+		err = user.Authenticate(clientTunnelIp.String(), wa.Type(), wa.FinishRegistrationFunc(w, r, config.Values().Authenticators.Webauthn))
 
 		msg, status := resultMessage(err)
 		jsonResponse(w, msg, status) // Send back an error message before we do the server side of handling it
@@ -159,7 +107,7 @@ func (wa *Webauthn) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsSteppedUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -180,75 +128,26 @@ func (wa *Webauthn) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 
-		webauthUserData, err := user.MFA()
-		if err != nil {
+		webauthnUser, err := wa.enrolledKeys(user.Username)
+		if err != nil || webauthnUser == nil {
 			log.Println(user.Username, clientTunnelIp, "could not get webauthn MFA details from db:", err)
 
 			jsonResponse(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		var webauthnUser WebauthnUser
-		err = webauthnUser.UnmarshalJSON([]byte(webauthUserData))
-		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "failed to unmarshal db object:", err)
-			jsonResponse(w, "Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		// generate PublicKeyCredentialRequestOptions, session data
-		options, sessionData, err := config.Values().Authenticators.Webauthn.BeginLogin(webauthnUser)
+		options, err := wa.BeginLogin(w, r, config.Values().Authenticators.Webauthn, webauthnUser)
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "unable to generate challenge (webauthn):", err)
 			jsonResponse(w, "Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		wa.sessions.StartSession(w, r, sessionData, nil)
-
 		jsonResponse(w, options, http.StatusOK)
 		log.Println(user.Username, clientTunnelIp, "begun webauthn login process (sent challenge)")
 	case "POST":
 
-		err = user.Authenticate(clientTunnelIp.String(), wa.Type(),
-			func(mfaSecret, username string) error {
-
-				var webauthnUser WebauthnUser
-				err := webauthnUser.UnmarshalJSON([]byte(mfaSecret))
-				if err != nil {
-					log.Println("failed to unmarshal db object:", err)
-					return err
-				}
-
-				// load the session data
-				_, sessionData := wa.sessions.GetSessionFromRequest(r)
-				if err != nil {
-					return err
-				}
-
-				c, err := config.Values().Authenticators.Webauthn.FinishLogin(webauthnUser, **sessionData, r)
-				if err != nil {
-					return err
-				}
-
-				//  check for cloned security keys
-				if c.Authenticator.CloneWarning {
-					return errors.New("cloned key detected")
-				}
-
-				webauthdata, err := webauthnUser.MarshalJSON()
-				if err != nil {
-					return err
-				}
-
-				// Store the updated credentials (credential counter incremented by one)
-				err = data.SetUserMfa(username, string(webauthdata), authenticators.WebauthnMFA)
-				if err != nil {
-					return err
-				}
-
-				return nil
-			})
+		err = user.Authenticate(clientTunnelIp.String(), wa.Type(), wa.AuthoriseFunc(r, config.Values().Authenticators.Webauthn))
 
 		msg, status := resultMessage(err)
 		jsonResponse(w, msg, status)
@@ -270,7 +169,7 @@ func (wa *Webauthn) MFAPromptUI(w http.ResponseWriter, r *http.Request, username
 
 	if err := resources.Render("prompt_mfa_webauthn.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render weauthn prompt template: ", err)
 	}
@@ -290,6 +189,158 @@ func (wa *Webauthn) LogoutPath() string {
 	return "/"
 }
 
+// BeginRegistration sends a challenge to register a new key for username with relyingParty, the key is added to existing if it is set
+// The returned pending user does not have the new key yet, it must be passed as the secret to FinishRegistrationFunc
+func (wa *Webauthn) BeginRegistration(w http.ResponseWriter, r *http.Request, relyingParty *webauthn.WebAuthn, username string, existing *WebauthnUser) (options *protocol.CredentialCreation, pending string, err error) {
+	webauthnUser := NewUser(username, username)
+
+	var opts []webauthn.RegistrationOption
+	if existing != nil {
+		// All of a users keys must share an id, as a login challenge is issued for a single user id
+		webauthnUser.id = existing.id
+		opts = append(opts, webauthn.WithExclusions(existing.CredentialExcludeList()))
+	}
+
+	// generate PublicKeyCredentialCreationOptions, session data
+	options, sessionData, err := relyingParty.BeginRegistration(webauthnUser, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	wa.sessions.StartSession(w, r, sessionData, nil)
+
+	webauthdata, err := webauthnUser.MarshalJSON()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return options, string(webauthdata), nil
+}
+
+// FinishRegistrationFunc checks the browsers response to the registration challenge, and returns the pending user with the new key added
+func (wa *Webauthn) FinishRegistrationFunc(w http.ResponseWriter, r *http.Request, relyingParty *webauthn.WebAuthn) authenticators.AuthenticatorFunc {
+	return func(mfaSecret, username string) (string, error) {
+
+		var webauthnUser WebauthnUser
+		err := webauthnUser.UnmarshalJSON([]byte(mfaSecret))
+		if err != nil {
+			return "", err
+		}
+
+		_, sessionData := wa.sessions.GetSessionFromRequest(r)
+		if sessionData == nil {
+			return "", errors.New("session not found")
+		}
+
+		webauthnSession := *sessionData
+
+		credential, err := relyingParty.FinishRegistration(webauthnUser, *webauthnSession, r)
+		if err != nil {
+			return "", err
+		}
+
+		webauthnUser.AddCredential(*credential)
+
+		webauthdata, err := webauthnUser.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+
+		wa.sessions.DeleteSession(w, r)
+
+		return string(webauthdata), nil
+	}
+}
+
+// BeginLogin sends a challenge that one of keys must sign
+func (wa *Webauthn) BeginLogin(w http.ResponseWriter, r *http.Request, relyingParty *webauthn.WebAuthn, keys *WebauthnUser) (*protocol.CredentialAssertion, error) {
+	// generate PublicKeyCredentialRequestOptions, session data
+	options, sessionData, err := relyingParty.BeginLogin(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	wa.sessions.StartSession(w, r, sessionData, nil)
+
+	return options, nil
+}
+
+// AuthoriseFunc checks the browsers response to the login challenge against each key it is called with
+// The updated key (its signature counter) is returned, and should be stored
+func (wa *Webauthn) AuthoriseFunc(r *http.Request, relyingParty *webauthn.WebAuthn) authenticators.AuthenticatorFunc {
+	// Each enrolled key is checked in turn, so the response can only be read once
+	parsedResponse, parseErr := protocol.ParseCredentialRequestResponse(r)
+
+	return func(mfaSecret, username string) (string, error) {
+		if parseErr != nil {
+			return "", parseErr
+		}
+
+		var webauthnUser WebauthnUser
+		err := webauthnUser.UnmarshalJSON([]byte(mfaSecret))
+		if err != nil {
+			log.Println("failed to unmarshal db object:", err)
+			return "", err
+		}
+
+		if webauthnUser.WebAuthnCredential(parsedResponse.RawID) == nil {
+			return "", errors.New("credential does not belong to this key")
+		}
+
+		// load the session data
+		_, sessionData := wa.sessions.GetSessionFromRequest(r)
+		if sessionData == nil {
+			return "", errors.New("session not found")
+		}
+
+		c, err := relyingParty.ValidateLogin(webauthnUser, **sessionData, parsedResponse)
+		if err != nil {
+			return "", err
+		}
+
+		//  check for cloned security keys
+		if c.Authenticator.CloneWarning {
+			return "", errors.New("cloned key detected")
+		}
+
+		webauthdata, err := webauthnUser.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+
+		// Store the updated credentials (credential counter incremented by one)
+		return string(webauthdata), nil
+	}
+}
+
+// enrolledKeys merges all of a users webauthn factors into one user, returning nil if they have none
+func (wa *Webauthn) enrolledKeys(username string) (*WebauthnUser, error) {
+	factors, err := data.GetMfaFactors(username, wa.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var merged *WebauthnUser
+	for _, factor := range factors {
+		var key WebauthnUser
+		err := key.UnmarshalJSON([]byte(factor.Secret))
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = &key
+			continue
+		}
+
+		for id, credential := range key.credentials {
+			merged.credentials[id] = credential
+		}
+	}
+
+	return merged, nil
+}
+
 // WebauthnUser represents the user model
 type WebauthnUser struct {
 	id          uint64
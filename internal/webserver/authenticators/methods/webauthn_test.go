@@ -0,0 +1,304 @@
+package methods
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NHAS/webauthn/protocol"
+	"github.com/NHAS/webauthn/protocol/webauthncbor"
+	"github.com/NHAS/webauthn/protocol/webauthncose"
+	"github.com/NHAS/webauthn/webauthn"
+)
+
+const testOrigin = "https://localhost"
+
+// virtualKey is a software security key that answers challenges the way a browser would
+type virtualKey struct {
+	id      []byte
+	private *ecdsa.PrivateKey
+	counter uint32
+}
+
+func newVirtualKey(t *testing.T) *virtualKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &virtualKey{id: id, private: private}
+}
+
+func (k *virtualKey) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge.String(),
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData
+}
+
+func (k *virtualKey) authenticatorData(rpID string, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	k.counter++
+
+	var authData bytes.Buffer
+	authData.Write(rpIDHash[:])
+	authData.WriteByte(flags)
+	binary.Write(&authData, binary.BigEndian, k.counter)
+	authData.Write(attested)
+
+	return authData.Bytes()
+}
+
+// register creates the body the browser posts after navigator.credentials.create()
+func (k *virtualKey) register(t *testing.T, options *protocol.CredentialCreation) []byte {
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: k.private.X.FillBytes(make([]byte, 32)),
+		YCoord: k.private.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attested bytes.Buffer
+	attested.Write(make([]byte, 16)) // aaguid
+	binary.Write(&attested, binary.BigEndian, uint16(len(k.id)))
+	attested.Write(k.id)
+	attested.Write(publicKey)
+
+	// user present, user verified, attested credential data included
+	authData := k.authenticatorData(options.Response.RelyingParty.ID, 0x01|0x04|0x40, attested.Bytes())
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    protocol.URLEncodedBase64(k.id).String(),
+		"rawId": protocol.URLEncodedBase64(k.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    protocol.URLEncodedBase64(k.clientData(t, "webauthn.create", options.Response.Challenge)),
+			"attestationObject": protocol.URLEncodedBase64(attestationObject),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+// login creates the body the browser posts after navigator.credentials.get()
+func (k *virtualKey) login(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	clientData := k.clientData(t, "webauthn.get", options.Response.Challenge)
+
+	// user present, user verified
+	authData := k.authenticatorData(options.Response.RelyingPartyID, 0x01|0x04, nil)
+
+	clientDataHash := sha256.Sum256(clientData)
+	signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, k.private, signed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    protocol.URLEncodedBase64(k.id).String(),
+		"rawId": protocol.URLEncodedBase64(k.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    protocol.URLEncodedBase64(clientData),
+			"authenticatorData": protocol.URLEncodedBase64(authData),
+			"signature":         protocol.URLEncodedBase64(signature),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func newTestWebauthn(t *testing.T) (*Webauthn, *webauthn.WebAuthn) {
+	var wa Webauthn
+	if err := wa.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Wag",
+		RPID:          "localhost",
+		RPOrigin:      testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &wa, relyingParty
+}
+
+// postWithCookies builds a request carrying the session cookies set on a previous response
+func postWithCookies(previous *httptest.ResponseRecorder, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	for _, c := range previous.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// registerKey runs the registration ceremony for key, returning the stored secret
+func registerKey(t *testing.T, wa *Webauthn, relyingParty *webauthn.WebAuthn, key *virtualKey, existing *WebauthnUser) string {
+	w := httptest.NewRecorder()
+	options, pending, err := wa.BeginRegistration(w, httptest.NewRequest(http.MethodGet, "/", nil), relyingParty, "toaster", existing)
+	if err != nil {
+		t.Fatal("beginning registration failed: ", err)
+	}
+
+	secret, err := wa.FinishRegistrationFunc(httptest.NewRecorder(), postWithCookies(w, key.register(t, options)), relyingParty)(pending, "toaster")
+	if err != nil {
+		t.Fatal("finishing registration failed: ", err)
+	}
+
+	return secret
+}
+
+func TestWebauthnRegistration(t *testing.T) {
+	wa, relyingParty := newTestWebauthn(t)
+
+	key := newVirtualKey(t)
+	secret := registerKey(t, wa, relyingParty, key, nil)
+
+	var user WebauthnUser
+	if err := user.UnmarshalJSON([]byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.WebAuthnName() != "toaster" {
+		t.Fatal("registered key has the wrong username: ", user.WebAuthnName())
+	}
+
+	if user.WebAuthnCredential(key.id) == nil {
+		t.Fatal("registered key was not added to the user")
+	}
+
+	// A second key must share the user id of the first, so both can answer a login challenge
+	second := newVirtualKey(t)
+	secret = registerKey(t, wa, relyingParty, second, &user)
+
+	var secondUser WebauthnUser
+	if err := secondUser.UnmarshalJSON([]byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(secondUser.WebAuthnID(), user.WebAuthnID()) {
+		t.Fatal("second key did not keep the existing user id")
+	}
+}
+
+func TestWebauthnRegistrationFailures(t *testing.T) {
+	wa, relyingParty := newTestWebauthn(t)
+	key := newVirtualKey(t)
+
+	w := httptest.NewRecorder()
+	options, pending, err := wa.BeginRegistration(w, httptest.NewRequest(http.MethodGet, "/", nil), relyingParty, "toaster", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No session cookie, so no challenge to check against
+	noSession := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(key.register(t, options)))
+	if _, err := wa.FinishRegistrationFunc(httptest.NewRecorder(), noSession, relyingParty)(pending, "toaster"); err == nil {
+		t.Fatal("registration without a session succeeded")
+	}
+
+	// Answering a different challenge
+	wrongChallenge := *options
+	wrongChallenge.Response.Challenge = protocol.URLEncodedBase64("not the challenge")
+	if _, err := wa.FinishRegistrationFunc(httptest.NewRecorder(), postWithCookies(w, key.register(t, &wrongChallenge)), relyingParty)(pending, "toaster"); err == nil {
+		t.Fatal("registration answering the wrong challenge succeeded")
+	}
+
+	// The pending user must be the one the challenge was issued for
+	other := NewUser("other", "other")
+	otherPending, err := other.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wa.FinishRegistrationFunc(httptest.NewRecorder(), postWithCookies(w, key.register(t, options)), relyingParty)(string(otherPending), "toaster"); err == nil {
+		t.Fatal("registration for a different user succeeded")
+	}
+}
+
+func TestWebauthnLogin(t *testing.T) {
+	wa, relyingParty := newTestWebauthn(t)
+
+	key := newVirtualKey(t)
+	secret := registerKey(t, wa, relyingParty, key, nil)
+
+	var keys WebauthnUser
+	if err := keys.UnmarshalJSON([]byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	options, err := wa.BeginLogin(w, httptest.NewRequest(http.MethodGet, "/", nil), relyingParty, &keys)
+	if err != nil {
+		t.Fatal("beginning login failed: ", err)
+	}
+
+	if len(options.Response.AllowedCredentials) != 1 || !bytes.Equal(options.Response.AllowedCredentials[0].CredentialID, key.id) {
+		t.Fatal("login challenge did not allow the registered key")
+	}
+
+	if _, err := wa.AuthoriseFunc(postWithCookies(w, key.login(t, options)), relyingParty)(secret, "toaster"); err != nil {
+		t.Fatal("login with the registered key failed: ", err)
+	}
+
+	// A key that was never registered
+	stranger := newVirtualKey(t)
+	if _, err := wa.AuthoriseFunc(postWithCookies(w, stranger.login(t, options)), relyingParty)(secret, "toaster"); err == nil {
+		t.Fatal("login with an unregistered key succeeded")
+	}
+
+	// Without the session there is no challenge to answer
+	noSession := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(key.login(t, options)))
+	if _, err := wa.AuthoriseFunc(noSession, relyingParty)(secret, "toaster"); err == nil {
+		t.Fatal("login without a session succeeded")
+	}
+}
+
+func TestWebauthnLoginNoKeys(t *testing.T) {
+	wa, relyingParty := newTestWebauthn(t)
+
+	if _, err := wa.BeginLogin(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), relyingParty, NewUser("toaster", "toaster")); err == nil {
+		t.Fatal("login challenge was issued for a user without keys")
+	}
+}
@@ -0,0 +1,605 @@
+package methods
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+const (
+	// The tunnel webserver has a 10 second write timeout, so waiting clients are told to poll again before then
+	webhookPollInterval = 8 * time.Second
+
+	// How many numbers the approver picks from, only one of which is shown on the login page
+	webhookChoices = 3
+
+	// Each enrolled factor gets its own ntfy topic, anyone who knows a topic can read and answer its requests so it must not be guessable
+	ntfyTopicPrefix = "wag-"
+)
+
+type approvalRequest struct {
+	id       string
+	username string
+	device   string
+	number   int
+	expires  time.Time
+
+	// The factor secrets (ntfy topics) the request was sent to, only those factors can be used to approve it
+	destinations []string
+
+	// Written once, by the approval callback
+	result chan bool
+}
+
+// Sent to Authenticators.Webhook.URL, signed with X-Wag-Signature
+// Every users requests go to the same url, so the receiver must only deliver each one to the user named by Username
+type approvalNotification struct {
+	Type     string
+	Issuer   string
+	Username string
+	Device   string
+	Expires  time.Time
+	Choices  []approvalChoice
+	DenyURL  string
+}
+
+type approvalChoice struct {
+	Number int
+	URL    string
+}
+
+// Webhook sends an approval request to an external service (e.g ntfy, or a chat bot) and waits for the user to approve it there
+// The user has to pick the number shown on their login page, so they cannot approve a request they did not make by blindly accepting it
+type Webhook struct {
+	lock sync.Mutex
+	// Outstanding requests by device address, each device may only have one so the user cannot be flooded with requests
+	pending map[string]*approvalRequest
+
+	// Signs the callback urls, these only have to be valid for as long as the request is outstanding so the key is not stored
+	urlKey []byte
+
+	client *http.Client
+}
+
+func (wh *Webhook) Init(settings map[string]string) error {
+	wh.urlKey = make([]byte, 32)
+	if _, err := rand.Read(wh.urlKey); err != nil {
+		return errors.New("failed to get random key: " + err.Error())
+	}
+
+	wh.pending = make(map[string]*approvalRequest)
+	wh.client = &http.Client{Timeout: 10 * time.Second}
+
+	return nil
+}
+
+func (wh *Webhook) Type() string {
+	return authenticators.WebhookMFA
+}
+
+func (wh *Webhook) FriendlyName() string {
+	return "Push Approval"
+}
+
+func (wh *Webhook) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		topic, err := randomTopic()
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to generate ntfy topic:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		err = data.SetUserMfa(user.Username, topic, authenticators.WebhookMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save webhook key to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		details := struct {
+			Username string
+			Server   string `json:",omitempty"`
+			Topic    string `json:",omitempty"`
+		}{Username: user.Username}
+
+		// Chat bots already know who their users are, so the topic is only needed to subscribe with ntfy
+		if config.Values().Authenticators.Webhook.Ntfy {
+			details.Server = config.Values().Authenticators.Webhook.URL
+			details.Topic = topic
+		}
+
+		jsonResponse(w, details, 200)
+
+	case "POST":
+		destinations := func() ([]string, error) {
+			pending, pendingType, _, _, err := data.GetAuthenticationDetails(user.Username, clientTunnelIp.String())
+			if err != nil {
+				return nil, err
+			}
+
+			if pendingType != authenticators.WebhookMFA || pending == "" {
+				return nil, errors.New("push approval is not being registered")
+			}
+
+			return []string{pending}, nil
+		}
+
+		if !wh.handle(w, r, user.Username, destinations, user.Authenticate) {
+			return
+		}
+
+		user.EnforceMFA()
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (wh *Webhook) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsSteppedUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	destinations := func() (topics []string, err error) {
+		factors, err := data.GetMfaFactors(user.Username, wh.Type())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, factor := range factors {
+			topics = append(topics, factor.Secret)
+		}
+
+		return topics, nil
+	}
+
+	wh.handle(w, r, user.Username, destinations, user.Authenticate)
+}
+
+// handle either sends a new approval request (action=start) or waits for the outstanding one (action=wait), it returns true once the user has authorised
+// destinations returns the secrets of the factors the request can be approved with, with ntfy each is the topic it is sent to
+func (wh *Webhook) handle(w http.ResponseWriter, r *http.Request, username string, destinations func() ([]string, error), authenticate func(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error) bool {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return false
+	}
+
+	switch r.FormValue("action") {
+	case "start":
+		topics, err := destinations()
+		if err != nil || len(topics) == 0 {
+			log.Println(username, clientTunnelIp, "has no push approval destination: ", err)
+			jsonResponse(w, "Unable to send approval request", 500)
+			return false
+		}
+
+		request, sent, err := wh.start(username, clientTunnelIp.String(), topics)
+		if err != nil {
+			log.Println(username, clientTunnelIp, "unable to send approval request: ", err)
+			jsonResponse(w, "Unable to send approval request", 500)
+			return false
+		}
+
+		if sent {
+			log.Println(username, clientTunnelIp, "sent push approval request")
+		}
+
+		jsonResponse(w, struct {
+			Number  int
+			Expires time.Time
+		}{request.number, request.expires}, 200)
+
+	case "wait":
+		wh.lock.Lock()
+		request, ok := wh.pending[clientTunnelIp.String()]
+		wh.lock.Unlock()
+
+		if !ok {
+			jsonResponse(w, "No approval request outstanding", 400)
+			return false
+		}
+
+		var approved bool
+		select {
+		case approved = <-request.result:
+		case <-time.After(time.Until(request.expires)):
+			log.Println(username, clientTunnelIp, "push approval request timed out")
+		case <-time.After(webhookPollInterval):
+			jsonResponse(w, struct{ Pending bool }{true}, 200)
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+
+		wh.lock.Lock()
+		if wh.pending[clientTunnelIp.String()] == request {
+			delete(wh.pending, clientTunnelIp.String())
+		}
+		wh.lock.Unlock()
+
+		err = authenticate(clientTunnelIp.String(), wh.Type(), func(mfaSecret, factorUsername string) (string, error) {
+			if factorUsername != request.username || !approved {
+				return "", errors.New("push approval request was not approved")
+			}
+
+			// With ntfy the request was only sent to some factors topics, the others did not approve it
+			if config.Values().Authenticators.Webhook.Ntfy && !slices.Contains(request.destinations, mfaSecret) {
+				return "", errors.New("push approval request was not sent to this factor")
+			}
+
+			return "", nil
+		})
+
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(username, clientTunnelIp, "failed to authorise: ", err.Error())
+			return false
+		}
+
+		log.Println(username, clientTunnelIp, "authorised")
+		return true
+
+	default:
+		http.Error(w, "Bad request", 400)
+	}
+
+	return false
+}
+
+// start returns the outstanding approval request for device, or sends a new one to the destinations if there is none
+func (wh *Webhook) start(username, device string, destinations []string) (request *approvalRequest, sent bool, err error) {
+	wh.lock.Lock()
+	defer wh.lock.Unlock()
+
+	for d, p := range wh.pending {
+		if time.Now().After(p.expires) {
+			delete(wh.pending, d)
+		}
+	}
+
+	if p, ok := wh.pending[device]; ok && p.username == username {
+		return p, false, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, false, err
+	}
+
+	choices, err := randomChoices()
+	if err != nil {
+		return nil, false, err
+	}
+
+	request = &approvalRequest{
+		id:       hex.EncodeToString(id),
+		username: username,
+		device:   device,
+		number:   choices[0],
+		expires:  time.Now().Add(time.Duration(config.Values().Authenticators.Webhook.TimeoutSeconds) * time.Second),
+		result:   make(chan bool, 1),
+
+		destinations: destinations,
+	}
+
+	// The correct number should not always be first
+	shuffled := make([]int, len(choices))
+	for i, n := range choices {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil, false, err
+		}
+
+		shuffled[i] = shuffled[j.Int64()]
+		shuffled[j.Int64()] = n
+	}
+
+	notification := approvalNotification{
+		Type:     "approval_request",
+		Issuer:   config.Values().Authenticators.Issuer,
+		Username: username,
+		Device:   device,
+		Expires:  request.expires,
+		DenyURL:  wh.callbackURL(request.id, "deny"),
+	}
+
+	for _, n := range shuffled {
+		notification.Choices = append(notification.Choices, approvalChoice{
+			Number: n,
+			URL:    wh.callbackURL(request.id, strconv.Itoa(n)),
+		})
+	}
+
+	if config.Values().Authenticators.Webhook.Ntfy {
+		// Only the users own topics are sent to, every topic has to be reachable or the user may not see the request
+		for _, topic := range destinations {
+			if err := wh.send(ntfyMessage(topic, notification)); err != nil {
+				return nil, false, err
+			}
+		}
+	} else if err := wh.send(notification); err != nil {
+		return nil, false, err
+	}
+
+	wh.pending[device] = request
+
+	return request, true, nil
+}
+
+func (wh *Webhook) send(message interface{}) error {
+	settings := config.Values().Authenticators.Webhook
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(settings.SigningKey))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wag-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// ntfyMessage formats the request for ntfy's json publishing api, each choice is an http action button
+func ntfyMessage(topic string, notification approvalNotification) interface{} {
+	type action struct {
+		Action string `json:"action"`
+		Label  string `json:"label"`
+		URL    string `json:"url"`
+		Method string `json:"method"`
+		Clear  bool   `json:"clear"`
+	}
+
+	var actions []action
+	for _, choice := range notification.Choices {
+		actions = append(actions, action{Action: "http", Label: strconv.Itoa(choice.Number), URL: choice.URL, Method: "POST", Clear: true})
+	}
+	actions = append(actions, action{Action: "http", Label: "Deny", URL: notification.DenyURL, Method: "POST", Clear: true})
+
+	return struct {
+		Topic   string   `json:"topic"`
+		Title   string   `json:"title"`
+		Message string   `json:"message"`
+		Tags    []string `json:"tags"`
+		Actions []action `json:"actions"`
+	}{
+		Topic:   topic,
+		Title:   notification.Issuer + " login request",
+		Message: fmt.Sprintf("%s is logging in from %s. Pick the number shown on your login page, or deny if this was not you.", notification.Username, notification.Device),
+		Tags:    []string{"key"},
+		Actions: actions,
+	}
+}
+
+func (wh *Webhook) callbackURL(id, choice string) string {
+	u, _ := url.Parse(config.Values().Authenticators.Webhook.CallbackURL)
+	u = u.JoinPath("/approve/", wh.Type(), "/")
+
+	u.RawQuery = url.Values{
+		"id":     []string{id},
+		"choice": []string{choice},
+		"sig":    []string{wh.sign(id, choice)},
+	}.Encode()
+
+	return u.String()
+}
+
+func (wh *Webhook) sign(id, choice string) string {
+	mac := hmac.New(sha256.New, wh.urlKey)
+	mac.Write([]byte(id + "|" + choice))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PublicAPI is the approval callback, it is on the public listener as the approver may not be connected to the vpn
+// Chat and link preview bots fetch the urls they see, so opening a link only shows a page to confirm the choice, which then POSTs it
+func (wh *Webhook) PublicAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	choice := r.URL.Query().Get("choice")
+
+	if subtle.ConstantTimeCompare([]byte(wh.sign(id, choice)), []byte(r.URL.Query().Get("sig"))) != 1 {
+		log.Println("unknown", utils.GetIPFromRequest(r), "push approval callback had an invalid signature")
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	var request *approvalRequest
+	wh.lock.Lock()
+	for _, p := range wh.pending {
+		if p.id == id {
+			request = p
+			break
+		}
+	}
+	wh.lock.Unlock()
+
+	if request == nil || time.Now().After(request.expires) {
+		http.Error(w, "This login request has expired", 404)
+		return
+	}
+
+	if r.Method == "GET" {
+		msg := fmt.Sprintf("Pick %s for %s logging in from %s?", choice, request.username, request.device)
+		if choice == "deny" {
+			msg = fmt.Sprintf("Deny the login request for %s from %s?", request.username, request.device)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		if err := resources.Render("approve_webhook.html", w, &resources.Msg{
+			Message:  msg,
+			URL:      r.URL.RequestURI(),
+			HelpMail: config.Values().HelpMail,
+		}); err != nil {
+			log.Println(request.username, request.device, "unable to render push approval template: ", err)
+		}
+		return
+	}
+
+	approved := choice == strconv.Itoa(request.number)
+
+	select {
+	case request.result <- approved:
+	default:
+		http.Error(w, "This login request has already been answered", 409)
+		return
+	}
+
+	if !approved {
+		if choice == "deny" {
+			log.Println("[WARNING]", request.username, request.device, "denied push approval request")
+		} else {
+			log.Println("[WARNING]", request.username, request.device, "picked the wrong number for push approval request, they may not have made it")
+		}
+
+		w.Write([]byte("Login denied"))
+		return
+	}
+
+	log.Println(request.username, request.device, "approved push approval request")
+	w.Write([]byte("Login approved"))
+}
+
+func (wh *Webhook) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_webhook.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render webhook prompt template: ", err)
+	}
+}
+
+func (wh *Webhook) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_webhook.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render webhook mfa template: ", err)
+	}
+}
+
+func (wh *Webhook) LogoutPath() string {
+	return "/"
+}
+
+// randomTopic returns a new ntfy topic for a factor, ntfy topics can be up to 64 characters of [-_A-Za-z0-9]
+func randomTopic() (string, error) {
+	topic := make([]byte, 24)
+	if _, err := rand.Read(topic); err != nil {
+		return "", err
+	}
+
+	return ntfyTopicPrefix + hex.EncodeToString(topic), nil
+}
+
+// randomChoices returns distinct two digit numbers, the first of which is the one the user must pick
+func randomChoices() ([]int, error) {
+	var choices []int
+	for len(choices) < webhookChoices {
+		n, err := rand.Int(rand.Reader, big.NewInt(90))
+		if err != nil {
+			return nil, err
+		}
+
+		number := int(n.Int64()) + 10
+
+		duplicate := false
+		for _, c := range choices {
+			duplicate = duplicate || c == number
+		}
+
+		if !duplicate {
+			choices = append(choices, number)
+		}
+	}
+
+	return choices, nil
+}
@@ -0,0 +1,366 @@
+package methods
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+)
+
+const webhookTestKey = "a test signing key"
+
+// webhookTest starts a webhook receiver, returning the method and the notifications it receives
+func webhookTest(t *testing.T, timeoutSeconds int) (*Webhook, chan approvalNotification) {
+	notifications := make(chan approvalNotification, 10)
+
+	wh := webhookReceiver(t, map[string]interface{}{"TimeoutSeconds": timeoutSeconds}, func(body []byte) {
+		var n approvalNotification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Error(err)
+		}
+		notifications <- n
+	})
+
+	return wh, notifications
+}
+
+type ntfyTestMessage struct {
+	Topic   string
+	Actions []struct {
+		Label string
+		URL   string
+	}
+}
+
+// ntfyWebhookTest is webhookTest for an ntfy server, returning the messages published to it
+func ntfyWebhookTest(t *testing.T) (*Webhook, chan ntfyTestMessage) {
+	messages := make(chan ntfyTestMessage, 10)
+
+	wh := webhookReceiver(t, map[string]interface{}{"Ntfy": true}, func(body []byte) {
+		var m ntfyTestMessage
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Error(err)
+		}
+		messages <- m
+	})
+
+	return wh, messages
+}
+
+// webhookReceiver starts a server that checks the signature of each request before passing it to receive, then enables the method with settings
+func webhookReceiver(t *testing.T, settings map[string]interface{}, receive func(body []byte)) *Webhook {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(webhookTestKey))
+		mac.Write(body)
+		if r.Header.Get("X-Wag-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("webhook had the wrong signature")
+		}
+
+		receive(body)
+	}))
+	t.Cleanup(receiver.Close)
+
+	settings["URL"] = receiver.URL
+	settings["CallbackURL"] = "https://vpn.test"
+	settings["SigningKey"] = webhookTestKey
+
+	loadTestConfig(t, map[string]interface{}{
+		"Methods": []string{"webhook"},
+		"Webhook": settings,
+	})
+
+	var wh Webhook
+	if err := wh.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return &wh
+}
+
+// callback opens a link from the notification
+func callback(wh *Webhook, method, link string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	wh.PublicAPI(w, httptest.NewRequest(method, link, nil))
+	return w
+}
+
+// wait polls for the outcome of the devices request using the factor with secret, returning the error authenticate was given
+func wait(wh *Webhook, device, secret string) (bool, error) {
+	r := httptest.NewRequest(http.MethodPost, "/authorise/webhook/", strings.NewReader("action=wait"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = device + ":1234"
+
+	var authErr error
+	authorised := wh.handle(httptest.NewRecorder(), r, "toaster", nil, func(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error {
+		_, authErr = authenticator(secret, "toaster")
+		return authErr
+	})
+
+	return authorised, authErr
+}
+
+func choiceURL(t *testing.T, n approvalNotification, number int) string {
+	for _, c := range n.Choices {
+		if c.Number == number {
+			return c.URL
+		}
+	}
+
+	t.Fatal("notification did not contain", number)
+	return ""
+}
+
+func TestWebhookSign(t *testing.T) {
+	wh, _ := webhookTest(t, 60)
+
+	if wh.sign("id", "42") != wh.sign("id", "42") {
+		t.Fatal("signature is not stable")
+	}
+
+	if wh.sign("id", "42") == wh.sign("id", "43") || wh.sign("id", "42") == wh.sign("other", "42") {
+		t.Fatal("signature does not cover the id and choice")
+	}
+
+	var other Webhook
+	other.Init(nil)
+	if other.sign("id", "42") == wh.sign("id", "42") {
+		t.Fatal("signature does not depend on the key")
+	}
+
+	u, err := url.Parse(wh.callbackURL("id", "42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Host != "vpn.test" || u.Path != "/approve/webhook/" {
+		t.Fatal("callback url is not on the public listener: ", u)
+	}
+
+	if u.Query().Get("sig") != wh.sign("id", "42") {
+		t.Fatal("callback url is not signed")
+	}
+
+	// Tampered links are refused
+	q := u.Query()
+	q.Set("choice", "43")
+	u.RawQuery = q.Encode()
+
+	if w := callback(wh, http.MethodPost, u.String()); w.Code != 400 {
+		t.Fatal("tampered callback was not refused: ", w.Code)
+	}
+}
+
+func TestWebhookCallback(t *testing.T) {
+	wh, notifications := webhookTest(t, 60)
+
+	request, sent, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"})
+	if err != nil || !sent {
+		t.Fatal("request was not sent: ", err)
+	}
+
+	n := <-notifications
+	if n.Username != "toaster" || n.Device != "10.2.43.2" || len(n.Choices) != webhookChoices {
+		t.Fatalf("notification was wrong: %+v", n)
+	}
+
+	// A device only has one request outstanding
+	again, sent, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"})
+	if err != nil || sent || again != request {
+		t.Fatal("second request was sent while one was outstanding")
+	}
+
+	link := choiceURL(t, n, request.number)
+
+	// Opening the link (or a bot unfurling it) only shows the confirmation page
+	w := callback(wh, http.MethodGet, link)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `method="POST"`) {
+		t.Fatal("opening the link did not show the confirmation page: ", w.Code)
+	}
+
+	select {
+	case <-request.result:
+		t.Fatal("opening the link answered the request")
+	default:
+	}
+
+	w = callback(wh, http.MethodPost, link)
+	if w.Code != 200 || w.Body.String() != "Login approved" {
+		t.Fatal("confirming the right number did not approve: ", w.Code, w.Body.String())
+	}
+
+	if w := callback(wh, http.MethodPost, n.DenyURL); w.Code != 409 {
+		t.Fatal("request could be answered twice: ", w.Code)
+	}
+
+	authorised, err := wait(wh, "10.2.43.2", "wag-toaster")
+	if !authorised || err != nil {
+		t.Fatal("approved request did not authorise: ", err)
+	}
+
+	if _, ok := wh.pending["10.2.43.2"]; ok {
+		t.Fatal("answered request is still outstanding")
+	}
+
+	if w := callback(wh, http.MethodPost, link); w.Code != 404 {
+		t.Fatal("finished request could still be answered: ", w.Code)
+	}
+}
+
+func TestWebhookWrongNumber(t *testing.T) {
+	wh, notifications := webhookTest(t, 60)
+
+	request, _, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := <-notifications
+
+	wrong := -1
+	for _, c := range n.Choices {
+		if c.Number != request.number {
+			wrong = c.Number
+		}
+	}
+
+	w := callback(wh, http.MethodPost, choiceURL(t, n, wrong))
+	if w.Body.String() != "Login denied" {
+		t.Fatal("wrong number was not denied: ", w.Body.String())
+	}
+
+	authorised, err := wait(wh, "10.2.43.2", "wag-toaster")
+	if authorised || err == nil {
+		t.Fatal("picking the wrong number authorised the device")
+	}
+
+	// Nor can the right number be picked after a wrong one
+	if w := callback(wh, http.MethodPost, choiceURL(t, n, request.number)); w.Code == 200 {
+		t.Fatal("right number was accepted after a wrong one: ", w.Body.String())
+	}
+}
+
+func TestWebhookDeny(t *testing.T) {
+	wh, notifications := webhookTest(t, 60)
+
+	if _, _, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := <-notifications
+
+	if w := callback(wh, http.MethodPost, n.DenyURL); w.Body.String() != "Login denied" {
+		t.Fatal("deny link did not deny: ", w.Body.String())
+	}
+
+	if authorised, _ := wait(wh, "10.2.43.2", "wag-toaster"); authorised {
+		t.Fatal("denied request authorised the device")
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	wh, notifications := webhookTest(t, 1)
+
+	request, _, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := <-notifications
+
+	started := time.Now()
+	authorised, err := wait(wh, "10.2.43.2", "wag-toaster")
+	if authorised || err == nil {
+		t.Fatal("unanswered request authorised the device")
+	}
+
+	if time.Since(started) > webhookPollInterval {
+		t.Fatal("wait did not end when the request expired")
+	}
+
+	// Answering after the timeout does nothing
+	if w := callback(wh, http.MethodPost, choiceURL(t, n, request.number)); w.Code != 404 {
+		t.Fatal("expired request could be answered: ", w.Code)
+	}
+
+	// And a new request can be made
+	if _, sent, err := wh.start("toaster", "10.2.43.2", []string{"wag-toaster"}); err != nil || !sent {
+		t.Fatal("new request was not sent after the old one expired: ", err)
+	}
+
+	<-notifications
+}
+
+func TestWebhookNtfyTopics(t *testing.T) {
+	wh, messages := ntfyWebhookTest(t)
+
+	request, _, err := wh.start("toaster", "10.2.43.2", []string{"wag-phone", "wag-tablet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each of the users factors gets the request on its own topic, and nothing else is published
+	topics := []string{(<-messages).Topic, (<-messages).Topic}
+	if !slices.Contains(topics, "wag-phone") || !slices.Contains(topics, "wag-tablet") {
+		t.Fatal("request was not published to the users topics: ", topics)
+	}
+
+	select {
+	case m := <-messages:
+		t.Fatal("request was published somewhere else: ", m.Topic)
+	default:
+	}
+
+	if w := callback(wh, http.MethodPost, wh.callbackURL(request.id, strconv.Itoa(request.number))); w.Code != 200 {
+		t.Fatal("approval was not accepted: ", w.Code)
+	}
+
+	if authorised, err := wait(wh, "10.2.43.2", "wag-someone-else"); authorised || err == nil {
+		t.Fatal("factor the request was not sent to was accepted")
+	}
+
+	request, _, err = wh.start("toaster", "10.2.43.2", []string{"wag-phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-messages
+
+	if w := callback(wh, http.MethodPost, wh.callbackURL(request.id, strconv.Itoa(request.number))); w.Code != 200 {
+		t.Fatal("approval was not accepted: ", w.Code)
+	}
+
+	if authorised, err := wait(wh, "10.2.43.2", "wag-phone"); !authorised || err != nil {
+		t.Fatal("approved request did not authorise with the factor it was sent to: ", err)
+	}
+}
+
+func TestWebhookRandomTopic(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		topic, err := randomTopic()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(topic, ntfyTopicPrefix) || len(topic) > 64 || strings.Trim(topic, "-_abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			t.Fatal("topic is not a valid ntfy topic: ", topic)
+		}
+
+		if seen[topic] {
+			t.Fatal("topic was generated twice: ", topic)
+		}
+		seen[topic] = true
+	}
+}
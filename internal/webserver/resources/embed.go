@@ -28,6 +28,8 @@ type Msg struct {
 }
 
 type Menu struct {
+	// Path the selected method is submitted to, either /register_mfa/ or /authorise/
+	Action      string
 	MFAMethods  []MenuEntry
 	LastElement int
 }
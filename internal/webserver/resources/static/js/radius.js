@@ -0,0 +1,112 @@
+document.addEventListener('DOMContentLoaded', function () {
+    let location = '/authorise/radius/';
+    if (document.getElementById("registration") !== null) {
+        location = "/register_mfa/radius/";
+        populateRadiusDetails()
+    }
+
+    document.getElementById('loginForm').onsubmit = function () {
+        loginUser(location);
+        return false;
+    };
+}, false);
+
+async function populateRadiusDetails() {
+    const response = await fetch("/register_mfa/radius/", {
+        method: 'GET',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow'
+    });
+
+    if (response.ok) {
+
+        let details;
+        try {
+            details = await response.json();
+        } catch (e) {
+            document.getElementById("error").hidden = false;
+            return
+        }
+
+        document.getElementById("AccountName").textContent = details;
+
+    }
+}
+
+async function loginUser(location) {
+
+    try {
+        const send = await fetch(location, {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Accept': 'application/json',
+                'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+            },
+            body: new URLSearchParams({
+                "password": document.getElementById("mfaPassword").value
+            })
+        });
+
+        document.getElementById("mfaPassword").value = "";
+
+        if (!send.ok) {
+            console.log("failed to send radius password")
+
+            let response;
+            try {
+                response = await send.json();
+            } catch (e) {
+                console.log("logging in failed")
+
+                document.getElementById("error").hidden = false;
+                return
+            }
+
+            // The server wants more before it will let the user in, e.g a code from a hardware token
+            if (response !== null && typeof response === "object" && "Challenge" in response) {
+                showChallenge(response.Challenge);
+                return
+            }
+
+            document.getElementById("errorMsg").textContent = response;
+            document.getElementById("error").hidden = false;
+            return
+        }
+    } catch (e) {
+        console.log("logging in user failed")
+        document.getElementById("errorMsg").textContent = e.message;
+        document.getElementById("error").hidden = false;
+        return
+    }
+
+
+    window.location.href = "/";
+}
+
+function showChallenge(message) {
+    document.getElementById("error").hidden = true;
+
+    const challenge = document.getElementById("challengeMsg");
+    challenge.textContent = message;
+    challenge.hidden = false;
+
+    const container = document.getElementById("challenge");
+    if (container !== null) {
+        container.hidden = false;
+    }
+
+    const instructions = document.getElementById("instructions");
+    if (instructions !== null) {
+        instructions.hidden = true;
+    }
+
+    const input = document.getElementById("mfaPassword");
+    input.placeholder = "Response";
+    input.focus();
+}
\ No newline at end of file
@@ -0,0 +1,88 @@
+document.addEventListener('DOMContentLoaded', function () {
+    let location = '/authorise/recovery/';
+    if (document.getElementById("registration") !== null) {
+        location = "/register_mfa/recovery/";
+        populateRecoveryCodes()
+    }
+
+    document.getElementById('loginForm').onsubmit = function () {
+        loginUser(location);
+        return false;
+    };
+}, false);
+
+async function populateRecoveryCodes() {
+    const response = await fetch("/register_mfa/recovery/", {
+        method: 'GET',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow'
+    });
+
+    if (response.ok) {
+
+        let details;
+        try {
+            details = await response.json();
+        } catch (e) {
+            document.getElementById("error").hidden = false;
+            return
+        }
+
+        document.getElementById("RecoveryCodes").textContent = details.join("\n");
+
+    } else {
+        document.getElementById("error").hidden = false;
+
+        console.log("Unable to fetch recovery codes for registration: ", response.status, response.text);
+    }
+}
+
+async function loginUser(location) {
+
+    try {
+        const send = await fetch(location, {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Accept': 'application/json',
+                'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+            },
+            body: new URLSearchParams({
+                "code": document.getElementById("mfaCode").value
+            })
+        });
+
+        document.getElementById("mfaCode").value = "";
+
+        if (!send.ok) {
+            console.log("failed to send recovery code")
+
+            let response;
+            try {
+                response = await send.json();
+            } catch (e) {
+                console.log("logging in failed")
+
+                document.getElementById("error").hidden = false;
+                return
+            }
+
+            document.getElementById("errorMsg").textContent = response;
+            document.getElementById("error").hidden = false;
+            return
+        }
+    } catch (e) {
+        console.log("logging in user failed")
+        document.getElementById("errorMsg").textContent = e.message;
+        document.getElementById("error").hidden = false;
+        return
+    }
+
+
+    window.location.href = "/";
+}
\ No newline at end of file
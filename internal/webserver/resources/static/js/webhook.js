@@ -0,0 +1,118 @@
+document.addEventListener('DOMContentLoaded', function () {
+    let location = '/authorise/webhook/';
+    let registering = null;
+    if (document.getElementById("registration") !== null) {
+        location = "/register_mfa/webhook/";
+        registering = populateWebhookDetails()
+    }
+
+    document.getElementById('loginForm').onsubmit = function () {
+        Promise.resolve(registering).then(() => approveLogin(location));
+        return false;
+    };
+}, false);
+
+async function populateWebhookDetails() {
+    const response = await fetch("/register_mfa/webhook/", {
+        method: 'GET',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow'
+    });
+
+    if (response.ok) {
+
+        let details;
+        try {
+            details = await response.json();
+        } catch (e) {
+            document.getElementById("error").hidden = false;
+            return
+        }
+
+        document.getElementById("AccountName").textContent = details.Username;
+
+        // With ntfy each registration gets its own topic, which the user has to subscribe to before sending a request
+        if (details.Topic !== undefined) {
+            document.getElementById("ntfyServer").textContent = details.Server;
+            document.getElementById("ntfyTopic").textContent = details.Topic;
+            document.getElementById("ntfyDetails").hidden = false;
+        }
+
+    }
+}
+
+function showError(message) {
+    if (message !== undefined) {
+        document.getElementById("errorMsg").textContent = message;
+    }
+    document.getElementById("error").hidden = false;
+    document.getElementById("approvalStatus").hidden = true;
+    document.getElementById("sendButton").disabled = false;
+}
+
+function post(location, action) {
+    return fetch(location, {
+        method: 'POST',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow',
+        headers: {
+            'Accept': 'application/json',
+            'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+        },
+        body: new URLSearchParams({
+            "action": action
+        })
+    });
+}
+
+async function approveLogin(location) {
+    document.getElementById("error").hidden = true;
+    document.getElementById("sendButton").disabled = true;
+
+    try {
+        const start = await post(location, "start");
+        const details = await start.json();
+        if (!start.ok) {
+            showError(details);
+            return
+        }
+
+        document.getElementById("approvalNumber").textContent = details.Number;
+        document.getElementById("approvalNumber").hidden = false;
+        document.getElementById("approvalStatus").hidden = false;
+
+        // The server holds each request open for a few seconds, then tells us to ask again
+        while (true) {
+            const wait = await post(location, "wait");
+
+            let response;
+            try {
+                response = await wait.json();
+            } catch (e) {
+                console.log("waiting for approval failed")
+                showError();
+                return
+            }
+
+            if (!wait.ok) {
+                document.getElementById("approvalNumber").hidden = true;
+                showError(response);
+                return
+            }
+
+            if (response === null || typeof response !== "object" || !response.Pending) {
+                break
+            }
+        }
+    } catch (e) {
+        console.log("approving login failed")
+        showError(e.message);
+        return
+    }
+
+    window.location.href = "/";
+}
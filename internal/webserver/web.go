@@ -13,12 +13,16 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/NHAS/wag/internal/audit"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/metrics"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/internal/routetypes"
 	"github.com/NHAS/wag/internal/users"
@@ -61,6 +65,12 @@ func Start(errChan chan<- error) error {
 	public.HandleFunc("/register_device", registerDevice)
 	public.HandleFunc("/reachability", reachability)
 
+	for method, handler := range authenticators.MFA {
+		if publicHandler, ok := handler.(authenticators.PublicAuthenticator); ok {
+			public.HandleFunc("/approve/"+method+"/", publicHandler.PublicAPI)
+		}
+	}
+
 	if config.Values().Webserver.Public.SupportsTLS() {
 
 		go func() {
@@ -145,7 +155,7 @@ func Start(errChan chan<- error) error {
 
 	tunnel.HandleFunc("/", index)
 
-	tunnelListenAddress := config.Values().Wireguard.ServerAddress.String() + ":" + config.Values().Webserver.Tunnel.Port
+	tunnelListenAddress := net.JoinHostPort(config.Values().Wireguard.ServerAddress.String(), config.Values().Webserver.Tunnel.Port)
 	if config.Values().Webserver.Tunnel.SupportsTLS() {
 
 		go func() {
@@ -171,7 +181,7 @@ func Start(errChan chan<- error) error {
 				}
 
 				srv := &http.Server{
-					Addr:         config.Values().Wireguard.ServerAddress.String() + ":80",
+					Addr:         net.JoinHostPort(config.Values().Wireguard.ServerAddress.String(), "80"),
 					ReadTimeout:  5 * time.Second,
 					WriteTimeout: 10 * time.Second,
 					IdleTimeout:  120 * time.Second,
@@ -242,13 +252,6 @@ func registerMFA(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -256,49 +259,49 @@ func registerMFA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	// Authorised devices may add another mfa method
+	if !user.CanEnrolMFA(clientTunnelIp.String()) {
+		log.Println(user.Username, clientTunnelIp, "tried to register another mfa method without authorising first")
 
 		http.Error(w, "Bad request", 400)
 		return
 	}
 
-	method := r.URL.Query().Get("method")
-	if method == "" {
-		method = config.Values().Authenticators.DefaultMethod
+	available := map[string]bool{}
+	enrolled := user.GetMFATypes()
+	for method := range authenticators.MFA {
+		available[method] = true
 	}
 
-	if method == "" || method == "select" {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-
-		var menu resources.Menu
-
-		keys := make([]string, 0, len(authenticators.MFA))
-		for k := range authenticators.MFA {
-			keys = append(keys, k)
+	// A second system login or single sign on factor would be identical to the first
+	for _, method := range enrolled {
+		if method == authenticators.PamMFA || method == authenticators.OidcMFA || method == authenticators.RadiusMFA || method == authenticators.LdapMFA {
+			delete(available, method)
 		}
-		sort.Strings(keys)
+	}
 
-		for _, method := range keys {
-			menu.MFAMethods = append(menu.MFAMethods, resources.MenuEntry{
-				Path:         authenticators.MFA[method].Type(),
-				FriendlyName: authenticators.MFA[method].FriendlyName(),
-			})
-		}
+	// Recovery codes can only be added once there is another method for them to stand in for
+	if len(enrolled) == 0 {
+		delete(available, authenticators.RecoveryMFA)
+	}
 
-		menu.LastElement = len(menu.MFAMethods) - 1
+	method := r.URL.Query().Get("method")
+	if method == "" && len(enrolled) == 0 {
+		method = config.Values().Authenticators.DefaultMethod
+	}
 
-		err = resources.Render("register_mfa.html", w, &menu)
-		if err != nil {
-			log.Println(user.Username, clientTunnelIp, "unable to build template:", err)
-			http.Error(w, "Server error", 500)
+	if method == "" || method == "select" {
+		keys := make([]string, 0, len(available))
+		for k := range available {
+			keys = append(keys, k)
 		}
 
+		renderMethodMenu(w, "/register_mfa/", keys, user.Username, clientTunnelIp.String())
 		return
 	}
 
 	mfaMethod, ok := authenticators.MFA[method]
-	if !ok {
+	if !ok || !available[method] {
 		log.Println(user.Username, clientTunnelIp, "Invalid MFA type requested: ", method)
 		http.NotFound(w, r)
 		return
@@ -307,6 +310,31 @@ func registerMFA(w http.ResponseWriter, r *http.Request) {
 	mfaMethod.RegistrationUI(w, r, user.Username, clientTunnelIp.String())
 }
 
+func renderMethodMenu(w http.ResponseWriter, action string, methods []string, username, ip string) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+
+	sort.Strings(methods)
+
+	menu := resources.Menu{
+		Action: action,
+	}
+
+	for _, method := range methods {
+		menu.MFAMethods = append(menu.MFAMethods, resources.MenuEntry{
+			Path:         authenticators.MFA[method].Type(),
+			FriendlyName: authenticators.MFA[method].FriendlyName(),
+		})
+	}
+
+	menu.LastElement = len(menu.MFAMethods) - 1
+
+	err := resources.Render("register_mfa.html", w, &menu)
+	if err != nil {
+		log.Println(username, ip, "unable to build template:", err)
+		http.Error(w, "Server error", 500)
+	}
+}
+
 func authorise(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" && r.Method != "POST" {
 		http.NotFound(w, r)
@@ -315,7 +343,9 @@ func authorise(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	// Devices with a session are only prompted again when they ask to step up, as routes marked stepup need a recent mfa
+	query := r.URL.Query()
+	if router.IsAuthed(clientTunnelIp.String()) && (router.IsSteppedUp(clientTunnelIp.String()) || !(query.Has("stepup") || query.Has("method"))) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 
@@ -334,15 +364,48 @@ func authorise(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mfaMethod, ok := authenticators.MFA[user.GetMFAType()]
-	if !ok {
-		log.Println(user.Username, clientTunnelIp, "Invalid MFA type requested: ", user.GetMFAType())
+	var enrolled []string
+	for _, method := range user.GetMFATypes() {
+		// Methods can be disabled in the config after users have enrolled them
+		if _, ok := authenticators.MFA[method]; ok {
+			enrolled = append(enrolled, method)
+		}
+	}
+
+	if len(enrolled) == 0 {
+		log.Println(user.Username, clientTunnelIp, "has no usable MFA methods enrolled")
+
+		http.NotFound(w, r)
+		return
+	}
+
+	// Default to the most recently used method, users with more than one can pick another
+	method := query.Get("method")
+	if method == "" {
+		method = enrolled[0]
+
+		// Recovery codes are a last resort, so only default to them if there is nothing else
+		for _, m := range enrolled {
+			if m != authenticators.RecoveryMFA {
+				method = m
+				break
+			}
+		}
+	}
+
+	if method == "select" {
+		renderMethodMenu(w, "/authorise/", enrolled, user.Username, clientTunnelIp.String())
+		return
+	}
+
+	if !slices.Contains(enrolled, method) {
+		log.Println(user.Username, clientTunnelIp, "Invalid MFA type requested: ", method)
 
 		http.NotFound(w, r)
 		return
 	}
 
-	mfaMethod.MFAPromptUI(w, r, user.Username, clientTunnelIp.String())
+	authenticators.MFA[method].MFAPromptUI(w, r, user.Username, clientTunnelIp.String())
 }
 
 func reachability(w http.ResponseWriter, r *http.Request) {
@@ -374,6 +437,13 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 	username, overwrites, groups, err := data.GetRegistrationToken(key)
 	if err != nil {
 		log.Println(username, remoteAddr, "failed to get registration key:", err)
+		audit.Record(audit.Event{
+			Type:    audit.Registration,
+			Outcome: audit.Failure,
+			Address: remoteAddr.String(),
+			Action:  "register",
+			Details: map[string]string{"error": "invalid registration token"},
+		})
 		http.NotFound(w, r)
 		return
 	}
@@ -476,7 +546,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 	dnsWithOutSubnet := config.Values().Wireguard.DNS
 
 	for i := 0; i < len(dnsWithOutSubnet); i++ {
-		dnsWithOutSubnet[i] = strings.TrimSuffix(dnsWithOutSubnet[i], "/32")
+		dnsWithOutSubnet[i] = strings.TrimSuffix(strings.TrimSuffix(dnsWithOutSubnet[i], "/32"), "/128")
 	}
 
 	routes, err := routetypes.AclsToRoutes(append(acl.Allow, acl.Mfa...))
@@ -571,6 +641,20 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		logMsg = "overwrote"
 	}
 	log.Println(username, remoteAddr, "successfully", logMsg, address, ":", publickey.String())
+	metrics.RecordRegistration()
+
+	audit.Record(audit.Event{
+		Type:     audit.Registration,
+		Outcome:  audit.Success,
+		Username: username,
+		Address:  remoteAddr.String(),
+		Action:   "register",
+		Details: map[string]string{
+			"device":     address,
+			"public_key": publickey.String(),
+			"overwrote":  strconv.FormatBool(overwrites != ""),
+		},
+	})
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
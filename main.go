@@ -18,6 +18,7 @@ var cmds = []commands.Command{
 	commands.Registration(),
 	commands.Devices(),
 	commands.Users(),
+	commands.MfaKey(),
 	commands.Firewall(),
 
 	commands.Webadmin(),
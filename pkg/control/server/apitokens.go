@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func listAPITokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	tokens, err := data.GetAPITokens()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func createAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	name := r.FormValue("name")
+
+	var scopes []string
+	for _, scope := range strings.Split(r.FormValue("scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	token, err := data.CreateAPIToken(name, scopes)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	log.Println("api token", name, "created with scopes:", strings.Join(scopes, ","))
+
+	w.Write([]byte(token))
+}
+
+func deleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	name := r.FormValue("name")
+
+	err = data.DeleteAPIToken(name)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	log.Println("api token", name, "deleted")
+
+	w.Write([]byte("OK"))
+}
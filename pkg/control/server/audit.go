@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/audit"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/pkg/control"
+)
+
+// Form values that are never written to the audit log
+var redactedFields = map[string]bool{
+	"password": true,
+	"token":    true,
+	"key":      true,
+}
+
+type auditRecorder struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	// Keep the start of error messages for the event, successful responses are not recorded
+	if a.status >= 400 && a.body.Len() < 512 {
+		a.body.Write(b)
+	}
+
+	return a.ResponseWriter.Write(b)
+}
+
+// audited records every change made through the control socket, read only (GET) requests are not recorded
+func audited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		details := map[string]string{}
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			if err := r.ParseForm(); err == nil {
+				for name, values := range r.PostForm {
+					if redactedFields[name] {
+						details[name] = "[redacted]"
+						continue
+					}
+
+					details[name] = strings.Join(values, ",")
+				}
+			}
+		} else {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if len(body) > 0 {
+				details["body"] = string(body)
+			}
+		}
+
+		recorder := &auditRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(recorder, r)
+
+		actor := r.Header.Get(control.ActorHeader)
+		if actor == "" {
+			actor = "control socket"
+		}
+
+		event := audit.Event{
+			Type:     audit.Control,
+			Outcome:  audit.Success,
+			Actor:    actor,
+			Username: details["username"],
+			Address:  details["address"],
+			Action:   r.URL.Path,
+			Details:  details,
+		}
+
+		if recorder.status >= 400 {
+			event.Outcome = audit.Failure
+			details["error"] = strings.TrimSpace(recorder.body.String())
+		}
+
+		audit.Record(event)
+	})
+}
+
+func auditEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	filter := data.AuditFilter{
+		Type:     r.FormValue("type"),
+		Username: r.FormValue("username"),
+		Actor:    r.FormValue("actor"),
+	}
+
+	if since := r.FormValue("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "invalid since time: "+err.Error(), 400)
+			return
+		}
+	}
+
+	if limit := r.FormValue("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "invalid limit: "+err.Error(), 400)
+			return
+		}
+	}
+
+	events, err := audit.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
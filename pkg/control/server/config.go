@@ -7,19 +7,21 @@ import (
 	"sort"
 
 	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/metrics"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/pkg/control"
 )
 
-func aclReload() error {
+func aclReload() (err error) {
 
 	errs := router.RefreshConfiguration()
 	if len(errs) > 0 {
-
-		return errs[0]
+		err = errs[0]
 	}
 
-	return nil
+	metrics.RecordConfigReload("acls", err)
+
+	return err
 }
 
 func configReload(w http.ResponseWriter, r *http.Request) {
@@ -30,12 +32,14 @@ func configReload(w http.ResponseWriter, r *http.Request) {
 
 	err := config.Reload()
 	if err != nil {
+		metrics.RecordConfigReload("full", err)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
 	errs := router.RefreshConfiguration()
 	if len(errs) > 0 {
+		metrics.RecordConfigReload("full", errs[0])
 		w.WriteHeader(500)
 		w.Header().Set("Content-Type", "text/plain")
 		for _, err := range errs {
@@ -47,6 +51,7 @@ func configReload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Println("Config fully reloaded")
+	metrics.RecordConfigReload("full", nil)
 
 	w.Write([]byte("OK!"))
 }
@@ -72,6 +77,9 @@ func policies(w http.ResponseWriter, r *http.Request) {
 			Effects:      policyName,
 			PublicRoutes: policies[policyName].Allow,
 			MfaRoutes:    policies[policyName].Mfa,
+
+			MaxSessionLifetimeMinutes:       policies[policyName].MaxSessionLifetimeMinutes,
+			SessionInactivityTimeoutMinutes: policies[policyName].SessionInactivityTimeoutMinutes,
 		})
 	}
 
@@ -95,7 +103,12 @@ func newPolicy(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if err := config.AddAcl(acl.Effects, config.Acl{Mfa: acl.MfaRoutes, Allow: acl.PublicRoutes}); err != nil {
+	if err := config.AddAcl(acl.Effects, config.Acl{
+		Mfa:                             acl.MfaRoutes,
+		Allow:                           acl.PublicRoutes,
+		MaxSessionLifetimeMinutes:       acl.MaxSessionLifetimeMinutes,
+		SessionInactivityTimeoutMinutes: acl.SessionInactivityTimeoutMinutes,
+	}); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -124,7 +137,12 @@ func editPolicy(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if err := config.EditAcl(data.Effects, config.Acl{Mfa: data.MfaRoutes, Allow: data.PublicRoutes}); err != nil {
+	if err := config.EditAcl(data.Effects, config.Acl{
+		Mfa:                             data.MfaRoutes,
+		Allow:                           data.PublicRoutes,
+		MaxSessionLifetimeMinutes:       data.MaxSessionLifetimeMinutes,
+		SessionInactivityTimeoutMinutes: data.SessionInactivityTimeoutMinutes,
+	}); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -11,6 +13,7 @@ import (
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
 	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/pkg/control"
 )
 
 func listDevices(w http.ResponseWriter, r *http.Request) {
@@ -138,6 +141,113 @@ func unlockDevice(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// setDeviceClass changes the session class of a device, which applies from the next time the device authorises
+func setDeviceClass(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	address := r.FormValue("address")
+	class := r.FormValue("class")
+
+	if _, ok := config.Values().DeviceClasses[class]; !ok && class != "" {
+		http.Error(w, "device class "+class+" is not defined in DeviceClasses", 400)
+		return
+	}
+
+	err = data.SetDeviceClass(address, class)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "device not found: "+address, 404)
+			return
+		}
+
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Println("device", address, "class set to", class)
+
+	w.Write([]byte("OK"))
+}
+
+// deauthenticateDevices forces every device of a user, a group or everyone to do mfa again
+func deauthenticateDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	by := r.FormValue("by")
+	if by == "" {
+		by = r.Header.Get(control.ActorHeader)
+	}
+
+	if by == "" {
+		by = "unknown"
+	}
+
+	var (
+		username = r.FormValue("username")
+		group    = r.FormValue("group")
+		all      = r.FormValue("all") == "true"
+
+		target          string
+		deauthenticated []string
+	)
+
+	switch {
+	case all && username == "" && group == "":
+		target = "all users"
+		deauthenticated, err = router.DeauthenticateAll()
+	case username != "" && group == "" && !all:
+		target = "user " + username
+		deauthenticated, err = router.DeauthenticateUsers([]string{username})
+	case group != "" && username == "" && !all:
+		members := config.Values().Acls.GetGroupMembers(group)
+		if len(members) == 0 {
+			http.Error(w, "group "+group+" has no members", 404)
+			return
+		}
+
+		target = "group " + group
+		deauthenticated, err = router.DeauthenticateUsers(members)
+	default:
+		http.Error(w, "exactly one of username, group or all must be set", 400)
+		return
+	}
+
+	// Log what was done even if it failed part way through, as some devices may have been deauthenticated
+	log.Println(by, "forced re-authentication of", target, "deauthenticated", len(deauthenticated), "devices", deauthenticated)
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(deauthenticated)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
 func sessions(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.NotFound(w, r)
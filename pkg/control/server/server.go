@@ -6,9 +6,11 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/routetypes"
 )
 
 func firewallRules(w http.ResponseWriter, r *http.Request) {
@@ -33,6 +35,131 @@ func firewallRules(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+func firewallStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := router.GetStats()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+func firewallTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	destination := net.ParseIP(r.FormValue("destination"))
+	if destination == nil {
+		http.Error(w, "invalid destination address: "+r.FormValue("destination"), 400)
+		return
+	}
+
+	proto, err := routetypes.ProtocolNumber(r.FormValue("protocol"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	port := 0
+	if r.FormValue("port") != "" {
+		port, err = strconv.Atoi(r.FormValue("port"))
+		if err != nil || port < 0 || port > 65535 {
+			http.Error(w, "invalid port: "+r.FormValue("port"), 400)
+			return
+		}
+	}
+
+	sourcePort := 0
+	if r.FormValue("sport") != "" {
+		sourcePort, err = strconv.Atoi(r.FormValue("sport"))
+		if err != nil || sourcePort < 0 || sourcePort > 65535 {
+			http.Error(w, "invalid source port: "+r.FormValue("sport"), 400)
+			return
+		}
+	}
+
+	inbound := r.FormValue("inbound") == "true"
+
+	// For icmp and icmpv6 the port is the type
+	if routetypes.IsICMP(uint16(proto)) {
+		if port > 255 {
+			http.Error(w, "invalid icmp type: "+r.FormValue("port"), 400)
+			return
+		}
+
+		port = int(routetypes.ICMPPort(uint8(port), 0))
+	}
+
+	decisions, err := router.Simulate(r.FormValue("username"), destination, proto, uint16(port), uint16(sourcePort), inbound)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(decisions)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+func firewallEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", 500)
+		return
+	}
+
+	events, cancel := router.SubscribeDropEvents()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func version(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.NotFound(w, r)
@@ -107,21 +234,36 @@ func StartControlSocket() error {
 	controlMux.HandleFunc("/device/unlock", unlockDevice)
 	controlMux.HandleFunc("/device/sessions", sessions)
 	controlMux.HandleFunc("/device/delete", deleteDevice)
+	controlMux.HandleFunc("/device/class", setDeviceClass)
+	controlMux.HandleFunc("/device/deauthenticate", deauthenticateDevices)
 
 	controlMux.HandleFunc("/users/list", listUsers)
 	controlMux.HandleFunc("/users/lock", lockUser)
 	controlMux.HandleFunc("/users/unlock", unlockUser)
 	controlMux.HandleFunc("/users/delete", deleteUser)
 	controlMux.HandleFunc("/users/reset", resetMfaUser)
+	controlMux.HandleFunc("/users/mfa/list", listMfaFactors)
+	controlMux.HandleFunc("/users/mfa/revoke", revokeMfaFactor)
+	controlMux.HandleFunc("/users/mfa_key/rotate", rotateMfaKey)
 
 	controlMux.HandleFunc("/webadmin/list", listAdminUsers)
 	controlMux.HandleFunc("/webadmin/lock", lockAdminUser)
 	controlMux.HandleFunc("/webadmin/unlock", unlockAdminUser)
 	controlMux.HandleFunc("/webadmin/delete", deleteAdminUser)
 	controlMux.HandleFunc("/webadmin/reset", resetAdminUser)
+	controlMux.HandleFunc("/webadmin/mfa/reset", resetAdminMfa)
+	controlMux.HandleFunc("/webadmin/oidc/link", linkAdminOIDC)
 	controlMux.HandleFunc("/webadmin/add", addAdminUser)
+	controlMux.HandleFunc("/webadmin/role", setAdminRole)
+
+	controlMux.HandleFunc("/webadmin/tokens/list", listAPITokens)
+	controlMux.HandleFunc("/webadmin/tokens/create", createAPIToken)
+	controlMux.HandleFunc("/webadmin/tokens/delete", deleteAPIToken)
 
 	controlMux.HandleFunc("/firewall/list", firewallRules)
+	controlMux.HandleFunc("/firewall/stats", firewallStats)
+	controlMux.HandleFunc("/firewall/events", firewallEvents)
+	controlMux.HandleFunc("/firewall/test", firewallTest)
 
 	controlMux.HandleFunc("/config/full_reload", configReload)
 
@@ -140,13 +282,15 @@ func StartControlSocket() error {
 
 	controlMux.HandleFunc("/shutdown", shutdown)
 
+	controlMux.HandleFunc("/audit/list", auditEvents)
+
 	controlMux.HandleFunc("/registration/list", listRegistrations)
 	controlMux.HandleFunc("/registration/create", newRegistration)
 	controlMux.HandleFunc("/registration/delete", deleteRegistration)
 
 	go func() {
 		srv := &http.Server{
-			Handler: controlMux,
+			Handler: audited(controlMux),
 		}
 
 		srv.Serve(l)
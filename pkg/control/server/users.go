@@ -2,9 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 
+	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/users"
 )
@@ -315,13 +318,107 @@ func addAdminUser(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
 	shouldChange := r.FormValue("change") == "true"
 
-	err = data.CreateAdminUser(username, password, shouldChange)
+	role := r.FormValue("role")
+	if role == "" {
+		role = data.AdminRoleAdmin
+	}
+
+	err = data.CreateAdminUser(username, password, shouldChange, role)
 	if err != nil {
 		http.Error(w, "unable to create admin user: "+err.Error(), 404)
 		return
 	}
 
-	log.Println(username, "admin added")
+	log.Println(username, "admin added with role", role)
+
+	w.Write([]byte("OK"))
+}
+
+func setAdminRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+	role := r.FormValue("role")
+
+	err = data.SetAdminRole(username, role)
+	if err != nil {
+		http.Error(w, "unable to set admin role: "+err.Error(), 404)
+		return
+	}
+
+	log.Println(username, "admin role set to", role)
+
+	w.Write([]byte("OK"))
+}
+
+func resetAdminMfa(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+
+	err = data.ResetAdminMfa(username)
+	if err != nil {
+		http.Error(w, "unable to reset admin mfa: "+err.Error(), 404)
+		return
+	}
+
+	log.Println(username, "admin mfa reset")
+
+	w.Write([]byte("OK"))
+}
+
+// linkAdminOIDC lets an existing admin sign in to the management ui with the OIDC subject, an empty subject removes the link
+func linkAdminOIDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+	subject := r.FormValue("subject")
+
+	identity := ""
+	if subject != "" {
+		issuer := config.Values().ManagementUI.OIDC.IssuerURL
+		if issuer == "" {
+			http.Error(w, "ManagementUI.OIDC is not configured", 400)
+			return
+		}
+
+		identity = data.OIDCIdentity(issuer, subject)
+	}
+
+	err = data.SetAdminOIDC(username, identity)
+	if err != nil {
+		http.Error(w, "unable to link admin: "+err.Error(), 404)
+		return
+	}
+
+	log.Println(username, "admin oidc identity set to", identity)
 
 	w.Write([]byte("OK"))
 }
@@ -356,3 +453,134 @@ func resetMfaUser(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("OK"))
 }
+
+func listMfaFactors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+
+	var factors []data.MfaFactor
+	if username != "" {
+		user, err := users.GetUser(username)
+		if err != nil {
+			http.Error(w, "not found: "+err.Error(), 404)
+			return
+		}
+
+		factors, err = user.MFAFactors("")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else {
+		factors, err = data.GetAllMfaFactors()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	b, err := json.Marshal(factors)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func revokeMfaFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "invalid factor id: "+err.Error(), 400)
+		return
+	}
+
+	user, err := users.GetUser(username)
+	if err != nil {
+		http.Error(w, "not found: "+err.Error(), 404)
+		return
+	}
+
+	err = user.RevokeMfaFactor(id)
+	if err != nil {
+		http.Error(w, "unable to revoke mfa factor: "+err.Error(), 404)
+		return
+	}
+
+	log.Println(username, "MFA factor", id, "revoked")
+
+	w.Write([]byte("OK"))
+}
+
+func rotateMfaKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// If no new key is given, the data key is rotated and wrapped with the current key
+	if r.FormValue("key") != "" {
+		key, err := data.ParseMfaKey(r.FormValue("key"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// The new key is saved to MFAEncryptionKeyFile as part of the rotation
+		err = data.ChangeMfaKey(key)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	} else {
+		key, err := data.ReadMfaKey()
+		if err == nil && key == nil {
+			err = errors.New("no mfa encryption key is configured, supply a new key to enable encryption")
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		err = data.RotateMfaKey(key)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	log.Println("MFA encryption key rotated")
+
+	w.Write([]byte("OK"))
+}
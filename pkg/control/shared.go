@@ -12,6 +12,9 @@ type PolicyData struct {
 	Effects      string   `json:"effects"`
 	PublicRoutes []string `json:"public_routes"`
 	MfaRoutes    []string `json:"mfa_routes"`
+
+	MaxSessionLifetimeMinutes       int `json:"max_session_lifetime_minutes"`
+	SessionInactivityTimeoutMinutes int `json:"session_inactivity_timeout_minutes"`
 }
 
 type GroupData struct {
@@ -20,3 +23,6 @@ type GroupData struct {
 }
 
 const DefaultWagSocket = "/tmp/wag.sock"
+
+// ActorHeader tells wag who is making a change through the control socket, so it can be recorded in the audit log
+const ActorHeader = "Wag-Actor"
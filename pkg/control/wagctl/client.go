@@ -10,7 +10,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
@@ -34,6 +36,32 @@ func NewControlClient(socketPath string) *CtrlClient {
 	}
 }
 
+type actorTransport struct {
+	actor string
+	next  http.RoundTripper
+}
+
+func (a actorTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(control.ActorHeader, a.actor)
+
+	return a.next.RoundTrip(r)
+}
+
+// As returns a client whose changes are recorded in wags audit log as made by actor
+func (c *CtrlClient) As(actor string) *CtrlClient {
+	transport := c.httpClient.Transport
+	if previous, ok := transport.(actorTransport); ok {
+		transport = previous.next
+	}
+
+	return &CtrlClient{
+		httpClient: http.Client{
+			Transport: actorTransport{actor: actor, next: transport},
+		},
+	}
+}
+
 func (c *CtrlClient) simplepost(path string, form url.Values) error {
 
 	response, err := c.httpClient.Post("http://unix/"+path, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
@@ -94,6 +122,16 @@ func (c *CtrlClient) LockDevice(address string) error {
 	return c.simplepost("device/lock", form)
 }
 
+// SetDeviceClass sets the session class of a device, an empty class uses the global session settings
+func (c *CtrlClient) SetDeviceClass(address, class string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+	form.Add("class", class)
+
+	return c.simplepost("device/class", form)
+}
+
 func (c *CtrlClient) UnlockDevice(address string) error {
 
 	form := url.Values{}
@@ -125,16 +163,43 @@ func (c *CtrlClient) ListAdminUsers(username string) (users []data.AdminModel, e
 	return
 }
 
-// Take device address to remove
-func (c *CtrlClient) AddAdminUser(username, password string, changeOnFirstUser bool) error {
+// Add an admin user with role (auditor, helpdesk or admin), an empty role is a full admin
+func (c *CtrlClient) AddAdminUser(username, password string, changeOnFirstUser bool, role string) error {
 	form := url.Values{}
 	form.Add("username", username)
 	form.Add("password", password)
 	form.Add("change", fmt.Sprintf("%t", changeOnFirstUser))
+	form.Add("role", role)
 
 	return c.simplepost("webadmin/add", form)
 }
 
+// Change what an admin user is allowed to do in the management ui
+func (c *CtrlClient) SetAdminUserRole(username, role string) error {
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("role", role)
+
+	return c.simplepost("webadmin/role", form)
+}
+
+// Remove an admin users mfa, they will need to register it again on their next login
+func (c *CtrlClient) ResetAdminUserMFA(username string) error {
+	form := url.Values{}
+	form.Add("username", username)
+
+	return c.simplepost("webadmin/mfa/reset", form)
+}
+
+// Let an admin sign in to the management ui with the OIDC subject (the "sub" claim), an empty subject removes the link
+func (c *CtrlClient) LinkAdminUserOIDC(username, subject string) error {
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("subject", subject)
+
+	return c.simplepost("webadmin/oidc/link", form)
+}
+
 // Set an existing admin users password
 func (c *CtrlClient) SetAdminUserPassword(username, password string) error {
 	form := url.Values{}
@@ -167,6 +232,60 @@ func (c *CtrlClient) UnlockAdminUser(username string) error {
 	return c.simplepost("webadmin/unlock", form)
 }
 
+// List api tokens, the tokens themselves are never returned
+func (c *CtrlClient) ListAPITokens() (tokens []data.APIToken, err error) {
+
+	response, err := c.httpClient.Get("http://unix/webadmin/tokens/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&tokens)
+
+	return
+}
+
+// Create an api token with scopes for the REST api, returns the token which cannot be retrieved again
+func (c *CtrlClient) CreateAPIToken(name string, scopes []string) (string, error) {
+	form := url.Values{}
+	form.Add("name", name)
+	form.Add("scopes", strings.Join(scopes, ","))
+
+	response, err := c.httpClient.Post("http://unix/webadmin/tokens/create", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	result, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode != 200 {
+		return "", errors.New(string(result))
+	}
+
+	return string(result), nil
+}
+
+func (c *CtrlClient) DeleteAPIToken(name string) error {
+	form := url.Values{}
+	form.Add("name", name)
+
+	return c.simplepost("webadmin/tokens/delete", form)
+}
+
 func (c *CtrlClient) ListUsers(username string) (users []data.UserModel, err error) {
 
 	response, err := c.httpClient.Get("http://unix/users/list?username=" + url.QueryEscape(username))
@@ -220,6 +339,101 @@ func (c *CtrlClient) ResetUserMFA(username string) error {
 	return c.simplepost("users/reset", form)
 }
 
+// ListUserMFA lists the mfa factors a user has enrolled, an empty username lists the factors of every user
+func (c *CtrlClient) ListUserMFA(username string) (factors []data.MfaFactor, err error) {
+
+	response, err := c.httpClient.Get("http://unix/users/mfa/list?username=" + url.QueryEscape(username))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&factors)
+
+	return
+}
+
+// RevokeUserMFA removes a single mfa factor from a user, if it was their last one they will have to register mfa again
+func (c *CtrlClient) RevokeUserMFA(username string, id int) error {
+
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("id", strconv.Itoa(id))
+
+	return c.simplepost("users/mfa/revoke", form)
+}
+
+// RotateMfaKey re-encrypts all mfa secrets with a new data key, wrapped by key (base64 encoded) which wag writes to MFAEncryptionKeyFile. If key is empty the currently configured key is used
+func (c *CtrlClient) RotateMfaKey(key string) error {
+
+	form := url.Values{}
+	form.Add("key", key)
+
+	return c.simplepost("users/mfa_key/rotate", form)
+}
+
+// DeauthenticateUser forces every device owned by username to do mfa again, by is recorded as who asked for it
+// Returns the addresses of devices that had a session
+func (c *CtrlClient) DeauthenticateUser(username, by string) ([]string, error) {
+
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("by", by)
+
+	return c.deauthenticate(form)
+}
+
+// DeauthenticateGroup forces every device owned by a member of group to do mfa again
+func (c *CtrlClient) DeauthenticateGroup(group, by string) ([]string, error) {
+
+	form := url.Values{}
+	form.Add("group", group)
+	form.Add("by", by)
+
+	return c.deauthenticate(form)
+}
+
+// DeauthenticateAll forces every device to do mfa again
+func (c *CtrlClient) DeauthenticateAll(by string) ([]string, error) {
+
+	form := url.Values{}
+	form.Add("all", "true")
+	form.Add("by", by)
+
+	return c.deauthenticate(form)
+}
+
+func (c *CtrlClient) deauthenticate(form url.Values) (out []string, err error) {
+
+	response, err := c.httpClient.Post("http://unix/device/deauthenticate", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != 200 {
+		return nil, errors.New(string(result))
+	}
+
+	err = json.Unmarshal(result, &out)
+
+	return
+}
+
 func (c *CtrlClient) Sessions() (out []string, err error) {
 
 	response, err := c.httpClient.Get("http://unix/device/sessions")
@@ -263,6 +477,101 @@ func (c *CtrlClient) FirewallRules() (rules map[string]router.FirewallRules, err
 	return
 }
 
+func (c *CtrlClient) FirewallStats() (stats router.FirewallStats, err error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/stats")
+	if err != nil {
+		return stats, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return stats, err
+		}
+
+		return stats, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&stats)
+	if err != nil {
+		return stats, err
+	}
+
+	return
+}
+
+// FirewallTest asks whether a packet from each of the users devices to destination would be allowed by the firewall
+// If inbound is set the packet is sent to the devices by destination instead, port is the destinations port and sourcePort the devices
+func (c *CtrlClient) FirewallTest(username, destination, protocol string, port, sourcePort int, inbound bool) (decisions []router.Decision, err error) {
+
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("destination", destination)
+	form.Add("protocol", protocol)
+	form.Add("port", fmt.Sprint(port))
+	form.Add("sport", fmt.Sprint(sourcePort))
+	form.Add("inbound", fmt.Sprint(inbound))
+
+	response, err := c.httpClient.Get("http://unix/firewall/test?" + form.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&decisions)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// FirewallEvents streams drop events from the firewall, calling onEvent for each one until the connection closes or onEvent returns an error
+func (c *CtrlClient) FirewallEvents(onEvent func(router.DropEvent) error) error {
+
+	response, err := c.httpClient.Get("http://unix/firewall/events")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+
+		return errors.New("Error: " + string(result))
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event router.DropEvent
+		err = decoder.Decode(&event)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		if err := onEvent(event); err != nil {
+			return err
+		}
+	}
+}
+
 func (c *CtrlClient) FullConfigReload() error {
 
 	response, err := c.httpClient.Post("http://unix/config/full_reload", "text/plain", nil)
@@ -589,3 +898,35 @@ func (c *CtrlClient) Shutdown(cleanup bool) (err error) {
 
 	return c.simplepost("shutdown", form)
 }
+
+// AuditEvents returns recorded audit events matching filter, newest first
+func (c *CtrlClient) AuditEvents(filter data.AuditFilter) (events []data.AuditEvent, err error) {
+
+	form := url.Values{}
+	form.Set("type", filter.Type)
+	form.Set("username", filter.Username)
+	form.Set("actor", filter.Actor)
+	if !filter.Since.IsZero() {
+		form.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	form.Set("limit", strconv.Itoa(filter.Limit))
+
+	response, err := c.httpClient.Get("http://unix/audit/list?" + form.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&events)
+
+	return
+}
@@ -0,0 +1,403 @@
+package ui
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NHAS/session"
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/authenticators/methods"
+)
+
+// Admins that have given their password, but still need to pass (or register) mfa
+type adminMfaState struct {
+	Username string
+
+	// Set when the admin already has a session, and is registering mfa from the settings menu
+	LoggedIn bool
+
+	PendingTotp     string
+	PendingWebauthn string
+}
+
+var (
+	mfaSessions *session.SessionStore[adminMfaState]
+
+	adminTotp     methods.Totp
+	adminWebauthn methods.Webauthn
+)
+
+func startAdminMfa() (err error) {
+	mfaSessions, err = session.NewStore[adminMfaState]("admin-mfa", "WAG-CSRF", 5*time.Minute, 300, false)
+	if err != nil {
+		return err
+	}
+
+	return adminWebauthn.Init(nil)
+}
+
+type MfaPrompt struct {
+	ErrorMessage string
+	Type         string
+
+	// Registration only
+	Totp     *methods.TotpRegistration
+	QRCode   template.URL
+	Webauthn bool
+	LoggedIn bool
+}
+
+// finishLogin gives the admin a full session, once their password and mfa (if any) have been checked
+func finishLogin(w http.ResponseWriter, r *http.Request, username, mfaType string) error {
+	if err := data.SetLastLoginInformation(username, r.RemoteAddr); err != nil {
+		return err
+	}
+
+	// Passing mfa clears the attempt CompareAdminKeys leaves in place for admins with mfa
+	if err := data.SetAdminUserUnlock(username); err != nil {
+		return err
+	}
+
+	adminDetails, err := data.GetAdminUser(username)
+	if err != nil {
+		return err
+	}
+
+	mfaSessions.DeleteSession(w, r)
+	sessionManager.StartSession(w, r, adminDetails, nil)
+
+	var details map[string]string
+	if mfaType != "" {
+		details = map[string]string{"mfa": mfaType}
+	}
+
+	log.Println(username, r.RemoteAddr, "admin logged in")
+	auditAdmin(r, username, "login", nil, details)
+
+	return nil
+}
+
+// mfaFailed counts failed attempts towards the same lockout as passwords, so knowing the password does not allow unlimited guesses
+func mfaFailed(w http.ResponseWriter, r *http.Request, state adminMfaState, mfaType string, err error) {
+	log.Println("admin mfa failed for user", state.Username, ": ", err)
+	auditAdmin(r, state.Username, "login", err, map[string]string{"mfa": mfaType})
+
+	if err := data.IncrementAdminAttempts(state.Username); err != nil {
+		log.Println("admin", state.Username, "locked after failing mfa: ", err)
+		mfaSessions.DeleteSession(w, r)
+	}
+}
+
+// mfaLocked ends the pending login if the admin has been locked, as their password was checked before the lock
+func mfaLocked(w http.ResponseWriter, r *http.Request, state adminMfaState, mfaType string) bool {
+	err := data.CheckAdminLocked(state.Username)
+	if err == nil {
+		return false
+	}
+
+	log.Println("admin mfa refused for user", state.Username, ": ", err)
+	auditAdmin(r, state.Username, "login", err, map[string]string{"mfa": mfaType})
+
+	mfaSessions.DeleteSession(w, r)
+	return true
+}
+
+func adminMfaPrompt(w http.ResponseWriter, r *http.Request) {
+	_, state := mfaSessions.GetSessionFromRequest(r)
+	if state == nil || state.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mfaType, secret, err := data.GetAdminMfa(state.Username)
+	if err != nil || mfaType == "" {
+		log.Println("unable to get admin mfa for", state.Username, ": ", err)
+		mfaSessions.DeleteSession(w, r)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if err := render(w, r, MfaPrompt{Type: mfaType}, "templates/login_mfa.html"); err != nil {
+			log.Println("unable to render mfa prompt template:", err)
+		}
+
+	case "POST":
+		if mfaType != authenticators.TotpMFA {
+			http.NotFound(w, r)
+			return
+		}
+
+		if mfaLocked(w, r, *state, mfaType) {
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
+			return
+		}
+
+		_, err := adminTotp.AuthoriseFunc(w, r)(secret, state.Username)
+		if err != nil {
+			mfaFailed(w, r, *state, mfaType, err)
+			render(w, r, MfaPrompt{Type: mfaType, ErrorMessage: "Unable to login"}, "templates/login_mfa.html")
+			return
+		}
+
+		if err := finishLogin(w, r, state.Username, mfaType); err != nil {
+			log.Println("unable to login: ", err)
+			render(w, r, MfaPrompt{Type: mfaType, ErrorMessage: "Unable to login"}, "templates/login_mfa.html")
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func adminMfaWebauthn(w http.ResponseWriter, r *http.Request) {
+	_, state := mfaSessions.GetSessionFromRequest(r)
+	if state == nil || state.LoggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	relyingParty := config.Values().ManagementUI.Webauthn
+
+	mfaType, secret, err := data.GetAdminMfa(state.Username)
+	if err != nil || mfaType != authenticators.WebauthnMFA || relyingParty == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		var keys methods.WebauthnUser
+		if err := keys.UnmarshalJSON([]byte(secret)); err != nil {
+			log.Println("unable to load webauthn keys for admin", state.Username, ": ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		options, err := adminWebauthn.BeginLogin(w, r, relyingParty, &keys)
+		if err != nil {
+			log.Println("unable to generate webauthn challenge for admin", state.Username, ": ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", JSON)
+		json.NewEncoder(w).Encode(options)
+
+	case "POST":
+		if mfaLocked(w, r, *state, mfaType) {
+			http.Error(w, "Unable to login", http.StatusUnauthorized)
+			return
+		}
+
+		updated, err := adminWebauthn.AuthoriseFunc(r, relyingParty)(secret, state.Username)
+		if err != nil {
+			mfaFailed(w, r, *state, mfaType, err)
+			http.Error(w, "Unable to login", http.StatusUnauthorized)
+			return
+		}
+
+		// Store the updated signature counter
+		if err := data.SetAdminMfa(state.Username, mfaType, updated); err != nil {
+			log.Println("unable to update webauthn keys for admin", state.Username, ": ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		if err := finishLogin(w, r, state.Username, mfaType); err != nil {
+			log.Println("unable to login: ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		w.Write([]byte("OK"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// registeringAdmin gets the admin registering mfa, either during login or from the settings menu
+func registeringAdmin(w http.ResponseWriter, r *http.Request) (string, *adminMfaState, error) {
+	key, state := mfaSessions.GetSessionFromRequest(r)
+	if state != nil {
+		return key, state, nil
+	}
+
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil || r.Method != "GET" {
+		return "", nil, errors.New("not logged in")
+	}
+
+	state = &adminMfaState{
+		Username: u.Username,
+		LoggedIn: true,
+	}
+
+	key = mfaSessions.StartSession(w, r, *state, nil)
+
+	return key, state, nil
+}
+
+// registrationFailed records a failed registration, these do not count towards the lockout as the admin is only confirming a secret they were just given
+func registrationFailed(r *http.Request, state adminMfaState, mfaType string, err error) {
+	log.Println("admin mfa registration failed for user", state.Username, ": ", err)
+	auditAdmin(r, state.Username, "register mfa", err, map[string]string{"mfa": mfaType})
+}
+
+// registered stores the admins new mfa, logging them in if they were part way through
+func registered(w http.ResponseWriter, r *http.Request, state *adminMfaState, mfaType, secret string) error {
+	err := data.SetAdminMfa(state.Username, mfaType, secret)
+	auditAdmin(r, state.Username, "register mfa", err, map[string]string{"mfa": mfaType})
+	if err != nil {
+		return err
+	}
+
+	if state.LoggedIn {
+		mfaSessions.DeleteSession(w, r)
+		return nil
+	}
+
+	return finishLogin(w, r, state.Username, mfaType)
+}
+
+func adminMfaRegister(w http.ResponseWriter, r *http.Request) {
+	key, state, err := registeringAdmin(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	mfaType, _, err := data.GetAdminMfa(state.Username)
+	if err != nil || mfaType != "" {
+		// Replacing mfa requires it to be reset first, otherwise a stolen session could be used to change it
+		mfaSessions.DeleteSession(w, r)
+
+		if state.LoggedIn {
+			http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+			return
+		}
+
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	model := MfaPrompt{
+		Webauthn: config.Values().ManagementUI.Webauthn != nil,
+		LoggedIn: state.LoggedIn,
+	}
+
+	switch r.Method {
+	case "GET":
+		secret, registration, err := methods.GenerateTotp(config.Values().Authenticators.Issuer, state.Username)
+		if err != nil {
+			log.Println("unable to generate totp key for admin", state.Username, ": ", err)
+			renderDefaults(w, r, nil, "error.html")
+			return
+		}
+
+		state.PendingTotp = secret
+		mfaSessions.UpdateSession(key, *state)
+
+		model.Totp = &registration
+		model.QRCode = template.URL(registration.ImageData)
+		if r.URL.Query().Get("failed") != "" {
+			model.ErrorMessage = "Code did not match, scan the new code and try again"
+		}
+
+		if err := render(w, r, model, "templates/register_mfa.html"); err != nil {
+			log.Println("unable to render mfa registration template:", err)
+		}
+
+	case "POST":
+		if state.PendingTotp == "" {
+			http.Redirect(w, r, "/mfa/register", http.StatusSeeOther)
+			return
+		}
+
+		_, err := adminTotp.AuthoriseFunc(w, r)(state.PendingTotp, state.Username)
+		if err != nil {
+			registrationFailed(r, *state, authenticators.TotpMFA, err)
+
+			http.Redirect(w, r, "/mfa/register?failed=true", http.StatusSeeOther)
+			return
+		}
+
+		if err := registered(w, r, state, authenticators.TotpMFA, state.PendingTotp); err != nil {
+			log.Println("unable to register admin totp: ", err)
+			renderDefaults(w, r, nil, "error.html")
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func adminMfaRegisterWebauthn(w http.ResponseWriter, r *http.Request) {
+	key, state := mfaSessions.GetSessionFromRequest(r)
+	if state == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	relyingParty := config.Values().ManagementUI.Webauthn
+
+	mfaType, _, err := data.GetAdminMfa(state.Username)
+	if err != nil || mfaType != "" || relyingParty == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		options, pending, err := adminWebauthn.BeginRegistration(w, r, relyingParty, state.Username, nil)
+		if err != nil {
+			log.Println("unable to generate webauthn registration for admin", state.Username, ": ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		state.PendingWebauthn = pending
+		mfaSessions.UpdateSession(key, *state)
+
+		w.Header().Set("Content-Type", JSON)
+		json.NewEncoder(w).Encode(options)
+
+	case "POST":
+		if state.PendingWebauthn == "" {
+			http.Error(w, "Bad Request", 400)
+			return
+		}
+
+		secret, err := adminWebauthn.FinishRegistrationFunc(w, r, relyingParty)(state.PendingWebauthn, state.Username)
+		if err != nil {
+			registrationFailed(r, *state, authenticators.WebauthnMFA, err)
+			http.Error(w, "Unable to register key", 400)
+			return
+		}
+
+		if err := registered(w, r, state, authenticators.WebauthnMFA, secret); err != nil {
+			log.Println("unable to register admin webauthn key: ", err)
+			http.Error(w, "Server Error", 500)
+			return
+		}
+
+		w.Write([]byte("OK"))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
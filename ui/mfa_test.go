@@ -0,0 +1,188 @@
+package ui
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NHAS/session"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/authenticators/methods"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const testAdminPassword = "a very long test password"
+
+// mfaTestAdmin creates an admin with totp enrolled, returning the totp key
+func mfaTestAdmin(t *testing.T) string {
+	loadTestConfig(t, map[string]interface{}{
+		"Domain": "https://admin.test",
+	})
+
+	var err error
+	sessionManager, err = session.NewStore[data.AdminModel]("admin", "WAG-CSRF", 1*time.Hour, 28800, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := startAdminMfa(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.CreateAdminUser("admin", testAdminPassword, false, data.AdminRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _, err := methods.GenerateTotp("Wag", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.SetAdminMfa("admin", authenticators.TotpMFA, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := otp.NewKeyFromURL(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key.Secret()
+}
+
+// wrongCode is a code that is not valid for key in any window totp.Validate accepts
+func wrongCode(t *testing.T, key string) string {
+	valid := map[string]bool{}
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		code, err := totp.GenerateCode(key, time.Now().Add(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid[code] = true
+	}
+
+	for i := 0; ; i++ {
+		code := fmt.Sprintf("%06d", i)
+		if !valid[code] {
+			return code
+		}
+	}
+}
+
+func postForm(handler http.HandlerFunc, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func passwordLogin(t *testing.T, password string) *httptest.ResponseRecorder {
+	return postForm(doLogin, "/login", url.Values{"username": {"admin"}, "password": {password}}, nil)
+}
+
+func TestAdminMfaLogin(t *testing.T) {
+	key := mfaTestAdmin(t)
+
+	w := passwordLogin(t, testAdminPassword)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/mfa" {
+		t.Fatal("password login did not redirect to the mfa prompt: ", w.Code, w.Header().Get("Location"))
+	}
+
+	pending := w.Result().Cookies()
+
+	// The password alone must not give a session
+	r := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	for _, c := range pending {
+		r.AddCookie(c)
+	}
+	if _, u := sessionManager.GetSessionFromRequest(r); u != nil {
+		t.Fatal("admin was logged in before passing mfa")
+	}
+
+	code, err := totp.GenerateCode(key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = postForm(adminMfaPrompt, "/mfa", url.Values{"code": {code}}, pending)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/dashboard" {
+		t.Fatal("correct code did not redirect to the dashboard: ", w.Code, w.Header().Get("Location"))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil || u.Username != "admin" {
+		t.Fatal("admin was not given a session after passing mfa")
+	}
+
+	admin, err := data.GetAdminUser("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if admin.Attempts != 0 {
+		t.Fatal("attempts were not cleared after passing mfa: ", admin.Attempts)
+	}
+}
+
+func TestAdminMfaLockout(t *testing.T) {
+	key := mfaTestAdmin(t)
+
+	bad := wrongCode(t, key)
+
+	// Logging in again with the password must not reset the failed codes
+	for i := 0; i < 2; i++ {
+		w := passwordLogin(t, testAdminPassword)
+		if w.Header().Get("Location") != "/mfa" {
+			t.Fatal("password login failed before lockout: ", w.Code)
+		}
+
+		w = postForm(adminMfaPrompt, "/mfa", url.Values{"code": {bad}}, w.Result().Cookies())
+		if w.Code == http.StatusSeeOther {
+			t.Fatal("wrong code was accepted")
+		}
+	}
+
+	w := passwordLogin(t, testAdminPassword)
+	if w.Header().Get("Location") != "/mfa" {
+		t.Fatal("password login failed before lockout: ", w.Code)
+	}
+
+	pending := w.Result().Cookies()
+	postForm(adminMfaPrompt, "/mfa", url.Values{"code": {bad}}, pending)
+
+	// Locked, so even the correct code is refused
+	code, err := totp.GenerateCode(key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = postForm(adminMfaPrompt, "/mfa", url.Values{"code": {code}}, pending)
+	if w.Header().Get("Location") == "/dashboard" {
+		t.Fatal("correct code was accepted after the admin was locked")
+	}
+
+	w = passwordLogin(t, testAdminPassword)
+	if w.Header().Get("Location") == "/mfa" {
+		t.Fatal("locked admin was sent to the mfa prompt")
+	}
+
+	if err := data.CheckAdminLocked("admin"); err == nil {
+		t.Fatal("admin was not locked after failing mfa")
+	}
+}
@@ -0,0 +1,209 @@
+package ui
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/zitadel/oidc/pkg/client/rp"
+	httphelper "github.com/zitadel/oidc/pkg/http"
+	"github.com/zitadel/oidc/pkg/oidc"
+)
+
+// Set when admins can sign in with OIDC
+var adminProvider rp.RelyingParty
+
+func startAdminOidc() error {
+	settings := config.Values().ManagementUI.OIDC
+	if settings.IssuerURL == "" {
+		return nil
+	}
+
+	if !slices.Contains(data.AdminRoles, settings.Role) {
+		return fmt.Errorf("ManagementUI.OIDC.Role (%q) is not a valid role, valid roles are: %s", settings.Role, strings.Join(data.AdminRoles, ", "))
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return errors.New("failed to get random key: " + err.Error())
+	}
+
+	cookieHandler := httphelper.NewCookieHandler(key, key, httphelper.WithUnsecure())
+
+	options := []rp.Option{
+		rp.WithCookieHandler(cookieHandler),
+		rp.WithVerifierOpts(rp.WithIssuedAtOffset(5 * time.Second)),
+	}
+
+	u, err := url.Parse(config.Values().ManagementUI.Domain)
+	if err != nil {
+		return err
+	}
+
+	u.Path = path.Join(u.Path, "/login/oidc/callback")
+	log.Println("Management UI OIDC callback: ", u.String())
+
+	log.Println("Connecting to management UI OIDC provider")
+	adminProvider, err = rp.NewRelyingPartyOIDC(settings.IssuerURL, settings.ClientID, settings.ClientSecret, u.String(), settings.Scopes, options...)
+	return err
+}
+
+func oidcState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func adminOidcLogin(w http.ResponseWriter, r *http.Request) {
+	if adminProvider == nil || r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	rp.AuthURLHandler(oidcState, adminProvider)(w, r)
+}
+
+// oidcGroups converts the group claim from the id token, a missing claim means the user is in no groups
+func oidcGroups(claim interface{}) ([]string, error) {
+	if claim == nil {
+		return nil, nil
+	}
+
+	groupsIntf, ok := claim.([]interface{})
+	if !ok {
+		return nil, errors.New("could not convert group claim to []string, probably error in oidc idP configuration")
+	}
+
+	groups := []string{}
+	for i := range groupsIntf {
+		conv, ok := groupsIntf[i].(string)
+		if !ok {
+			return nil, errors.New("could not convert group claim to string, probably error in oidc idP configuration")
+		}
+		groups = append(groups, conv)
+	}
+
+	return groups, nil
+}
+
+// provisionAdmin creates the admin through the control socket, so it is recorded in the audit log
+var provisionAdmin = func(username, password, role string) error {
+	return ctrl.As(username+" (oidc)").AddAdminUser(username, password, false, role)
+}
+
+// oidcAdmin finds the admin linked to the OIDC identity, or creates one if AutoProvision is set
+// Admins are never matched on username alone, as users can often change their preferred username with the provider
+func oidcAdmin(identity, preferredUsername string, groups []string) (username string, provisioned bool, err error) {
+	settings := config.Values().ManagementUI.OIDC
+
+	if settings.AdminGroup != "" && !slices.Contains(groups, settings.AdminGroup) {
+		return "", false, fmt.Errorf("not a member of the admin group %q", settings.AdminGroup)
+	}
+
+	admin, err := data.GetAdminUserByOIDC(identity)
+	if err == nil {
+		// Same lockout as CompareAdminKeys
+		if admin.Attempts > 5 {
+			return "", false, errors.New("account locked")
+		}
+
+		return admin.Username, false, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", false, err
+	}
+
+	if !settings.AutoProvision {
+		return "", false, errors.New("no admin is linked to this oidc identity and auto provisioning is disabled")
+	}
+
+	if preferredUsername == "" {
+		return "", false, errors.New("oidc provider did not return a preferred username")
+	}
+
+	if _, err := data.GetAdminUser(preferredUsername); err == nil {
+		return "", false, fmt.Errorf("admin %q already exists but is not linked to this oidc identity, use 'wag webadmin -linkoidc' to link it", preferredUsername)
+	}
+
+	// Provisioned admins sign in through the provider, so the password is never used
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+
+	err = provisionAdmin(preferredUsername, hex.EncodeToString(b), settings.Role)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to provision admin: %s", err)
+	}
+
+	err = data.SetAdminOIDC(preferredUsername, identity)
+	if err != nil {
+		return "", false, err
+	}
+
+	return preferredUsername, true, nil
+}
+
+func adminOidcCallback(w http.ResponseWriter, r *http.Request) {
+	if adminProvider == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	marshalUserinfo := func(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens, state string, provider rp.RelyingParty, info oidc.UserInfo) {
+		username := info.GetPreferredUsername()
+
+		var err error
+		subject := tokens.IDTokenClaims.GetSubject()
+		if subject == "" {
+			err = errors.New("oidc provider did not return a subject")
+		}
+
+		var groups []string
+		if err == nil {
+			groups, err = oidcGroups(tokens.IDTokenClaims.GetClaim(config.Values().ManagementUI.OIDC.GroupsClaimName))
+		}
+
+		if err == nil {
+			var provisioned bool
+			username, provisioned, err = oidcAdmin(data.OIDCIdentity(config.Values().ManagementUI.OIDC.IssuerURL, subject), username, groups)
+			if provisioned {
+				log.Println(username, r.RemoteAddr, "admin provisioned by oidc with role", config.Values().ManagementUI.OIDC.Role)
+			}
+		}
+
+		if err == nil {
+			err = finishLogin(w, r, username, "oidc")
+		}
+
+		if err != nil {
+			if username == "" {
+				username = info.GetPreferredUsername()
+			}
+
+			log.Println("admin oidc login failed for user", username, "(subject", subject+"):", err)
+			auditAdmin(r, username, "login", err, map[string]string{"sso": provider.Issuer(), "subject": subject})
+
+			w.WriteHeader(http.StatusUnauthorized)
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
+			return
+		}
+
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+	}
+
+	rp.CodeExchangeHandler(rp.UserinfoCallback(marshalUserinfo), adminProvider)(w, r)
+}
@@ -0,0 +1,187 @@
+package ui
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+)
+
+// loadTestConfig loads the in memory test config with managementUI as the ManagementUI settings, and a fresh database
+func loadTestConfig(t *testing.T, managementUI map[string]interface{}) {
+	t.Helper()
+
+	contents, err := os.ReadFile("../internal/config/test_in_memory_db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c map[string]interface{}
+	if err := json.Unmarshal(contents, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every method is registered by importing them, so only enable the ones that need no settings
+	c["Authenticators"].(map[string]interface{})["Methods"] = []string{"totp"}
+	c["ManagementUI"] = managementUI
+
+	contents, err = json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(data.MfaKeyEnvVariable, "")
+	if err := data.Load(filepath.Join(t.TempDir(), "devices.db")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func oidcTestConfig(t *testing.T, adminGroup string, autoProvision bool) {
+	loadTestConfig(t, map[string]interface{}{
+		"Domain": "https://admin.test",
+		"OIDC": map[string]interface{}{
+			"IssuerURL":     "https://idp.test",
+			"ClientID":      "wag",
+			"AdminGroup":    adminGroup,
+			"AutoProvision": autoProvision,
+		},
+	})
+
+	provisionAdmin = func(username, password, role string) error {
+		return data.CreateAdminUser(username, password, false, role)
+	}
+}
+
+func TestOidcGroups(t *testing.T) {
+	groups, err := oidcGroups(nil)
+	if err != nil || len(groups) != 0 {
+		t.Fatal("missing claim should be no groups: ", groups, err)
+	}
+
+	groups, err = oidcGroups([]interface{}{"wag-admins", "staff"})
+	if err != nil || len(groups) != 2 || groups[0] != "wag-admins" || groups[1] != "staff" {
+		t.Fatal("groups were not converted: ", groups, err)
+	}
+
+	if _, err := oidcGroups("wag-admins"); err == nil {
+		t.Fatal("a string claim should be rejected")
+	}
+
+	if _, err := oidcGroups([]interface{}{"wag-admins", 1}); err == nil {
+		t.Fatal("a non string group should be rejected")
+	}
+}
+
+func TestOidcScopes(t *testing.T) {
+	oidcTestConfig(t, "wag-admins", false)
+
+	if scopes := config.Values().ManagementUI.OIDC.Scopes; len(scopes) != 3 || scopes[2] != "groups" {
+		t.Fatal("groups scope should be requested when an admin group is required: ", scopes)
+	}
+
+	oidcTestConfig(t, "", false)
+
+	if scopes := config.Values().ManagementUI.OIDC.Scopes; len(scopes) != 2 {
+		t.Fatal("unexpected default scopes: ", scopes)
+	}
+}
+
+func TestOidcAdminNotMatchedByUsername(t *testing.T) {
+	oidcTestConfig(t, "", true)
+
+	if err := data.CreateAdminUser("admin", "a very long password", false, data.AdminRoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := data.OIDCIdentity("https://idp.test", "attacker")
+
+	// Setting their preferred username to an existing admin must not give access to it
+	if _, _, err := oidcAdmin(identity, "admin", nil); err == nil {
+		t.Fatal("oidc user took over a local admin by username")
+	}
+
+	if _, err := data.GetAdminUserByOIDC(identity); err == nil {
+		t.Fatal("local admin should not have been linked")
+	}
+
+	// Once explicitly linked the admin can sign in, whatever their preferred username is
+	if err := data.SetAdminOIDC("admin", data.OIDCIdentity("https://idp.test", "owner")); err != nil {
+		t.Fatal(err)
+	}
+
+	username, provisioned, err := oidcAdmin(data.OIDCIdentity("https://idp.test", "owner"), "renamed", nil)
+	if err != nil || provisioned || username != "admin" {
+		t.Fatal("linked admin could not sign in: ", username, provisioned, err)
+	}
+
+	if err := data.SetAdminUserLock("admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := oidcAdmin(data.OIDCIdentity("https://idp.test", "owner"), "admin", nil); err == nil {
+		t.Fatal("locked admin signed in")
+	}
+}
+
+func TestOidcAdminProvisioning(t *testing.T) {
+	oidcTestConfig(t, "wag-admins", true)
+
+	identity := data.OIDCIdentity("https://idp.test", "1234")
+
+	if _, _, err := oidcAdmin(identity, "alice", []string{"staff"}); err == nil {
+		t.Fatal("user outside the admin group was allowed")
+	}
+
+	if _, _, err := oidcAdmin(identity, "", []string{"wag-admins"}); err == nil {
+		t.Fatal("admin provisioned without a username")
+	}
+
+	username, provisioned, err := oidcAdmin(identity, "alice", []string{"wag-admins"})
+	if err != nil || !provisioned || username != "alice" {
+		t.Fatal("admin was not provisioned: ", username, provisioned, err)
+	}
+
+	admin, err := data.GetAdminUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if admin.Role != data.AdminRoleAuditor || admin.OIDC != identity {
+		t.Fatalf("provisioned admin has the wrong role or identity: %+v", admin)
+	}
+
+	// The next sign in uses the link, even if the preferred username changes
+	username, provisioned, err = oidcAdmin(identity, "alice2", []string{"wag-admins"})
+	if err != nil || provisioned || username != "alice" {
+		t.Fatal("provisioned admin could not sign in again: ", username, provisioned, err)
+	}
+
+	// A different subject with the same preferred username does not get alices account
+	if _, _, err := oidcAdmin(data.OIDCIdentity("https://idp.test", "5678"), "alice", []string{"wag-admins"}); err == nil {
+		t.Fatal("second oidc user took over a provisioned admin")
+	}
+}
+
+func TestOidcAdminWithoutProvisioning(t *testing.T) {
+	oidcTestConfig(t, "", false)
+
+	if _, _, err := oidcAdmin(data.OIDCIdentity("https://idp.test", "1234"), "bob", nil); err == nil {
+		t.Fatal("unlinked user signed in without auto provisioning")
+	}
+
+	if _, err := data.GetAdminUser("bob"); err == nil {
+		t.Fatal("admin was provisioned when auto provisioning is off")
+	}
+}
@@ -3,6 +3,9 @@ package ui
 import (
 	"net/http"
 	"net/url"
+	"slices"
+
+	"github.com/NHAS/wag/internal/data"
 )
 
 type security struct {
@@ -39,6 +42,41 @@ func setSecurityHeaders(f http.Handler) http.Handler {
 
 const JSON = "application/json"
 
+// Changes a helpdesk admin can make, by path then method
+var helpdeskChanges = map[string][]string{
+	// lock, unlock, reset and revoke mfa, but not delete
+	"/management/users/data": {"PUT"},
+	// lock and unlock, but not delete
+	"/management/devices/data":             {"PUT"},
+	"/management/sessions/data":            {"POST"},
+	"/management/registration_tokens/data": {"POST", "DELETE"},
+}
+
+// Every admin can manage their own account
+var ownAccount = []string{"/change_password", "/logout"}
+
+// roleAllows checks whether an admin with role can make this request, every role can view everything
+func roleAllows(role string, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || slices.Contains(ownAccount, r.URL.Path) {
+		return true
+	}
+
+	switch role {
+	case data.AdminRoleAdmin:
+		return true
+	case data.AdminRoleHelpdesk:
+		return slices.Contains(helpdeskChanges[r.URL.Path], r.Method)
+	}
+
+	return false
+}
+
+// canSeeSecrets is whether an admin with role can view values that grant access, such as registration tokens
+// Auditors could otherwise use a token they can see to register a device as any user
+func canSeeSecrets(role string) bool {
+	return role == data.AdminRoleAdmin || role == data.AdminRoleHelpdesk
+}
+
 func contentType(handle http.HandlerFunc, contentType string) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
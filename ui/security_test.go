@@ -0,0 +1,79 @@
+package ui
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func TestRoleAllows(t *testing.T) {
+	methods := []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+
+	paths := []struct {
+		path string
+		// Methods a helpdesk admin may use, other than viewing
+		helpdesk []string
+	}{
+		{"/management/users/data", []string{"PUT"}},
+		{"/management/devices/data", []string{"PUT"}},
+		{"/management/sessions/data", []string{"POST"}},
+		{"/management/registration_tokens/data", []string{"POST", "DELETE"}},
+		{"/policy/rules/data", nil},
+		{"/policy/groups/data", nil},
+		{"/settings/general/data", nil},
+	}
+
+	contains := func(list []string, method string) bool {
+		for _, l := range list {
+			if l == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, p := range paths {
+		for _, method := range methods {
+			viewing := method == "GET" || method == "HEAD"
+
+			expected := map[string]bool{
+				data.AdminRoleAuditor:  viewing,
+				data.AdminRoleHelpdesk: viewing || contains(p.helpdesk, method),
+				data.AdminRoleAdmin:    true,
+				"unknown":              viewing,
+			}
+
+			for role, allowed := range expected {
+				r := httptest.NewRequest(method, p.path, nil)
+				if got := roleAllows(role, r); got != allowed {
+					t.Errorf("%s %s as %s: expected allowed=%v got %v", method, p.path, role, allowed, got)
+				}
+			}
+		}
+	}
+
+	// Every role can manage their own account
+	for _, path := range ownAccount {
+		for _, role := range append(data.AdminRoles, "unknown") {
+			if !roleAllows(role, httptest.NewRequest("POST", path, nil)) {
+				t.Errorf("%s should be able to POST to %s", role, path)
+			}
+		}
+	}
+}
+
+func TestCanSeeSecrets(t *testing.T) {
+	expected := map[string]bool{
+		data.AdminRoleAuditor:  false,
+		data.AdminRoleHelpdesk: true,
+		data.AdminRoleAdmin:    true,
+		"":                     false,
+	}
+
+	for role, allowed := range expected {
+		if canSeeSecrets(role) != allowed {
+			t.Errorf("canSeeSecrets(%q) expected %v", role, allowed)
+		}
+	}
+}
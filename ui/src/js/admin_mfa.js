@@ -0,0 +1,184 @@
+document.addEventListener('DOMContentLoaded', function () {
+
+    const registerButton = document.getElementById("registerButton");
+    if (registerButton !== null) {
+        registerButton.onclick = registerKey;
+    }
+
+    const loginButton = document.getElementById("loginButton");
+    if (loginButton !== null) {
+        loginButton.onclick = loginKey;
+    }
+}, false);
+
+// Base64 to ArrayBuffer
+function bufferDecode(value) {
+    return Uint8Array.from(atob(value.replace(/_/g, '/').replace(/-/g, '+')), c => c.charCodeAt(0));
+}
+
+// ArrayBuffer to URLBase64
+function bufferEncode(value) {
+    return btoa(String.fromCharCode.apply(null, new Uint8Array(value)))
+        .replace(/\+/g, "-")
+        .replace(/\//g, "_")
+        .replace(/=/g, "");
+}
+
+function showError(message) {
+    document.getElementById("errorMsg").textContent = message;
+    document.getElementById("error").hidden = false;
+}
+
+async function registerKey(event) {
+    if (event.target.disabled) {
+        return
+    }
+
+    if (!window.PublicKeyCredential) {
+        showError("This browser does not support security keys");
+        return
+    }
+
+    event.target.disabled = true;
+
+    try {
+        const challenge = await fetch("/mfa/register/webauthn", {
+            method: 'GET',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow'
+        });
+
+        if (!challenge.ok) {
+            showError("Unable to start registration");
+            return
+        }
+
+        const credentialCreationOptions = await challenge.json();
+
+        credentialCreationOptions.publicKey.challenge = bufferDecode(credentialCreationOptions.publicKey.challenge);
+        credentialCreationOptions.publicKey.user.id = bufferDecode(credentialCreationOptions.publicKey.user.id);
+        if (credentialCreationOptions.publicKey.excludeCredentials) {
+            for (var i = 0; i < credentialCreationOptions.publicKey.excludeCredentials.length; i++) {
+                credentialCreationOptions.publicKey.excludeCredentials[i].id = bufferDecode(credentialCreationOptions.publicKey.excludeCredentials[i].id);
+            }
+        }
+
+        const newCredential = await navigator.credentials.create({
+            publicKey: credentialCreationOptions.publicKey
+        });
+
+        const finalise = await fetch("/mfa/register/webauthn", {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                id: newCredential.id,
+                rawId: bufferEncode(newCredential.rawId),
+                type: newCredential.type,
+                response: {
+                    attestationObject: bufferEncode(newCredential.response.attestationObject),
+                    clientDataJSON: bufferEncode(newCredential.response.clientDataJSON),
+                },
+            })
+        });
+
+        if (!finalise.ok) {
+            showError(await finalise.text());
+            return
+        }
+    } catch (e) {
+        console.log("registering security key failed: ", e)
+        showError(e.message);
+        return
+    } finally {
+        event.target.disabled = false;
+    }
+
+    window.location.href = "/dashboard";
+}
+
+async function loginKey(event) {
+    if (event.target.disabled) {
+        return
+    }
+
+    if (!window.PublicKeyCredential) {
+        showError("This browser does not support security keys");
+        return
+    }
+
+    event.target.disabled = true;
+
+    try {
+        const challenge = await fetch("/mfa/webauthn", {
+            method: 'GET',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow'
+        });
+
+        if (!challenge.ok) {
+            // The pending login has expired, or had too many failures
+            window.location.href = "/login";
+            return
+        }
+
+        const credentialRequestOptions = await challenge.json();
+
+        credentialRequestOptions.publicKey.challenge = bufferDecode(credentialRequestOptions.publicKey.challenge);
+        credentialRequestOptions.publicKey.allowCredentials.forEach(function (listItem) {
+            listItem.id = bufferDecode(listItem.id);
+        });
+
+        const assertion = await navigator.credentials.get({
+            publicKey: credentialRequestOptions.publicKey
+        });
+
+        const finalise = await fetch("/mfa/webauthn", {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({
+                id: assertion.id,
+                rawId: bufferEncode(assertion.rawId),
+                type: assertion.type,
+                response: {
+                    authenticatorData: bufferEncode(assertion.response.authenticatorData),
+                    clientDataJSON: bufferEncode(assertion.response.clientDataJSON),
+                    signature: bufferEncode(assertion.response.signature),
+                    userHandle: bufferEncode(assertion.response.userHandle),
+                },
+            })
+        });
+
+        if (!finalise.ok) {
+            showError(await finalise.text());
+            return
+        }
+    } catch (e) {
+        console.log("logging in failed: ", e)
+        if (e.name == "InvalidStateError") {
+            showError("Incorrect security key");
+        } else {
+            showError(e.message);
+        }
+        return
+    } finally {
+        event.target.disabled = false;
+    }
+
+    window.location.href = "/dashboard";
+}
@@ -0,0 +1,59 @@
+$(function () {
+  let table = createTable('#auditTable', [
+    {
+      title: 'Time',
+      field: 'time',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Type',
+      field: 'type',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Outcome',
+      field: 'outcome',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Actor',
+      field: 'actor',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Username',
+      field: 'username',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Address',
+      field: 'address',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Action',
+      field: 'action',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Details',
+      field: 'details',
+      align: 'left',
+      escape: "true",
+    }
+  ])
+
+  $('#auditFilter').on("submit", function (e) {
+    e.preventDefault()
+
+    let params = new URLSearchParams(new FormData(this))
+
+    table.bootstrapTable('refresh', {
+      url: "/diag/audit/events?" + params.toString()
+    })
+  })
+});
@@ -0,0 +1,38 @@
+$(function () {
+  createTable('#dropEventsTable', [
+    {
+      title: 'Time',
+      field: 'time',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Username',
+      field: 'username',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Source',
+      field: 'source',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Destination',
+      field: 'destination',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Protocol',
+      field: 'protocol',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Reason',
+      field: 'reason',
+      sortable: true,
+      align: 'center',
+    }
+  ])
+});
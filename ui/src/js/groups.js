@@ -99,12 +99,40 @@ $(function () {
     'check-all.bs.table uncheck-all.bs.table',
     function () {
       $("#removeStart").prop('disabled', !table.bootstrapTable('getSelections').length)
+      $("#reauth").prop('disabled', !table.bootstrapTable('getSelections').length)
 
       // save your data, here just save the current page
       selections = getIdSelections(table)
       // push or splice the selections if you want to save all data selections
     })
 
+  $('#reauth').on("click", function () {
+    var ids = getIdSelections(table)
+
+    fetch("/management/sessions/data", {
+      method: 'POST',
+      mode: 'same-origin',
+      cache: 'no-cache',
+      credentials: 'same-origin',
+      redirect: 'follow',
+      headers: {
+        'Content-Type': 'application/json',
+        'WAG-CSRF': $("#csrf_token").val()
+      },
+      body: JSON.stringify({ "groups": ids })
+    }).then((response) => {
+      if (response.status == 200) {
+        $("#issue").hide()
+        return
+      }
+
+      response.text().then(txt => {
+        $("#issue").text(txt)
+        $("#issue").show()
+      })
+    })
+  })
+
   $remove.on("click", function () {
     var ids = getIdSelections(table)
     table.bootstrapTable('remove', {
@@ -8,6 +8,18 @@ $(function () {
       align: 'center',
       sortable: true,
       escape: "true"
+    }, {
+      field: 'role',
+      title: 'Role',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'mfa_type',
+      title: 'MFA',
+      sortable: true,
+      align: 'center',
+      escape: "true"
     }, {
       field: 'date_added',
       title: 'Date Added',
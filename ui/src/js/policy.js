@@ -42,6 +42,9 @@ window.operateEvents = {
     }
     $("#public_routes").val(public_routes_content)
 
+    $("#max_session_lifetime_minutes").val(row.max_session_lifetime_minutes)
+    $("#session_inactivity_timeout_minutes").val(row.session_inactivity_timeout_minutes)
+
 
     $("#action").val("edit")
 
@@ -163,6 +166,8 @@ $(function () {
 
     $("#mfa_routes").val("")
     $("#public_routes").val("")
+    $("#max_session_lifetime_minutes").val(0)
+    $("#session_inactivity_timeout_minutes").val(0)
 
     $("#ruleModal").modal("show")
   })
@@ -172,6 +177,8 @@ $(function () {
       "effects": $('#effects').val(),
       "mfa_routes": $('#mfa_routes').val().split("\n").filter(element => element),
       "public_routes": $('#public_routes').val().split("\n").filter(element => element),
+      "max_session_lifetime_minutes": parseInt($('#max_session_lifetime_minutes').val()) || 0,
+      "session_inactivity_timeout_minutes": parseInt($('#session_inactivity_timeout_minutes').val()) || 0,
     }
 
     let method = "POST";
@@ -0,0 +1,63 @@
+$(function () {
+  const counters = [
+    {
+      title: 'Allowed Packets',
+      field: 'allowed_packets',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Allowed Bytes',
+      field: 'allowed_bytes',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Dropped Packets',
+      field: 'dropped_packets',
+      sortable: true,
+      align: 'center',
+    }, {
+      title: 'Dropped Bytes',
+      field: 'dropped_bytes',
+      sortable: true,
+      align: 'center',
+    }
+  ]
+
+  createTable('#deviceTrafficTable', [
+    {
+      title: 'Username',
+      field: 'username',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Address',
+      field: 'address',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }
+  ].concat(counters))
+
+  createTable('#ruleTrafficTable', [
+    {
+      title: 'Username',
+      field: 'username',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Route',
+      field: 'route',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }, {
+      title: 'Policy',
+      field: 'policy',
+      sortable: true,
+      align: 'center',
+      escape: "true",
+    }
+  ].concat(counters))
+});
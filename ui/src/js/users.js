@@ -31,13 +31,36 @@ function lockedFormatter(value) {
 }
 
 
-function mfaFormatter(value) {
-  let p = document.createElement('p')
-  if (value === "unset") {
+function mfaFormatter(value, row) {
+  if (row.mfa.length == 0) {
+    let p = document.createElement('p')
     p.className = "badge badge-danger"
+    p.innerText = "unset"
+    return p.outerHTML
   }
-  p.innerText = value
-  return p.outerHTML
+
+  let result = ""
+
+  row.mfa.forEach(function (factor) {
+    let span = document.createElement('span')
+    span.className = "badge badge-primary"
+    span.title = "Added: " + factor.date_added + "\nLast used: " + (factor.last_used || "never")
+    span.innerText = factor.type + " "
+
+    let revoke = document.createElement('a')
+    revoke.href = "#"
+    revoke.className = "revoke-mfa text-white"
+    revoke.title = "Revoke"
+    revoke.dataset.username = row.username
+    revoke.dataset.factor = factor.id
+    revoke.innerHTML = '<i class="icon-trash"></i>'
+
+    span.appendChild(revoke)
+
+    result += span.outerHTML + "\n"
+  });
+
+  return result
 }
 
 function groupsFormatter(values) {
@@ -86,7 +109,7 @@ $(function () {
       formatter: devicesFormatter
     }, {
       field: 'mfa_type',
-      title: 'MFA Method',
+      title: 'MFA Methods',
       sortable: true,
       align: 'center',
       formatter: mfaFormatter
@@ -104,6 +127,7 @@ $(function () {
   var $lock = $('#lock')
   var $unlock = $('#unlock')
   var $resetMFA = $('#resetMFA')
+  var $reauth = $('#reauth')
 
 
   table.on('check.bs.table uncheck.bs.table ' +
@@ -115,6 +139,7 @@ $(function () {
       $lock.prop('disabled', enableModifications)
       $unlock.prop('disabled', enableModifications)
       $resetMFA.prop('disabled', enableModifications)
+      $reauth.prop('disabled', enableModifications)
 
       // save your data, here just save the current page
       selections = getIdSelections(table)
@@ -136,6 +161,30 @@ $(function () {
     action(ids, "resetMFA", table)
   })
 
+  $reauth.on("click", function () {
+    var ids = getIdSelections(table)
+    forceReauthentication({ "usernames": ids }, table)
+  })
+
+  $('#reauthAll').on("click", function () {
+    if (!confirm("Log out every device? All users will need to authorise again.")) {
+      return
+    }
+
+    forceReauthentication({ "all": true }, table)
+  })
+
+  $('#table').on("click", ".revoke-mfa", function (e) {
+    e.preventDefault()
+
+    let username = $(this).data("username")
+    if (!confirm("Revoke this MFA method from " + username + "? Their devices will need to authorise again.")) {
+      return
+    }
+
+    action([username], "revokeMFA", table, $(this).data("factor"))
+  })
+
   $remove.on("click", function () {
     var ids = getIdSelections(table)
     table.bootstrapTable('remove', {
@@ -194,10 +243,11 @@ $(function () {
 })
 
 
-function action(onUsers, action, table) {
+function action(onUsers, action, table, factor) {
   let data = {
     "action": action,
     "usernames": onUsers,
+    "factor": factor,
   }
 
   fetch("/management/users/data", {
@@ -223,4 +273,30 @@ function action(onUsers, action, table) {
       $("#issue").show()
     })
   })
-}
\ No newline at end of file
+}
+
+function forceReauthentication(targets, table) {
+  fetch("/management/sessions/data", {
+    method: 'POST',
+    mode: 'same-origin',
+    cache: 'no-cache',
+    credentials: 'same-origin',
+    redirect: 'follow',
+    headers: {
+      'Content-Type': 'application/json',
+      'WAG-CSRF': $("#csrf_token").val()
+    },
+    body: JSON.stringify(targets)
+  }).then((response) => {
+    if (response.status == 200) {
+      table.bootstrapTable('refresh')
+      $("#issue").hide()
+      return
+    }
+
+    response.text().then(txt => {
+      $("#issue").text(txt)
+      $("#issue").show()
+    })
+  })
+}
@@ -46,8 +46,16 @@ type GeneralSettings struct {
 	OidcEnabled, WebauthnEnabled, TotpEnabled bool
 }
 
+type RulesPage struct {
+	Page
+	Services map[string][]string
+	Hosts    map[string][]string
+}
+
 type Login struct {
-	ErrorMessage string
+	ErrorMessage  string
+	SSO           bool
+	PasswordLogin bool
 }
 
 type ChangePassword struct {
@@ -57,12 +65,20 @@ type ChangePassword struct {
 }
 
 type UsersData struct {
-	Username  string   `json:"username"`
-	Devices   int      `json:"devices"`
-	Locked    bool     `json:"locked"`
-	DateAdded string   `json:"date_added"`
-	MFAType   string   `json:"mfa_type"`
-	Groups    []string `json:"groups"`
+	Username  string    `json:"username"`
+	Devices   int       `json:"devices"`
+	Locked    bool      `json:"locked"`
+	DateAdded string    `json:"date_added"`
+	MFAType   string    `json:"mfa_type"`
+	MFA       []MFAData `json:"mfa"`
+	Groups    []string  `json:"groups"`
+}
+
+type MFAData struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type"`
+	DateAdded string `json:"date_added"`
+	LastUsed  string `json:"last_used"`
 }
 
 type DevicesData struct {
@@ -89,3 +105,42 @@ type WgDevicesData struct {
 	EndpointAddress   string `json:"last_endpoint"`
 	LastHandshakeTime string `json:"last_handshake_time"`
 }
+
+type TrafficDeviceData struct {
+	Username       string `json:"username"`
+	Address        string `json:"address"`
+	AllowedPackets uint64 `json:"allowed_packets"`
+	AllowedBytes   uint64 `json:"allowed_bytes"`
+	DroppedPackets uint64 `json:"dropped_packets"`
+	DroppedBytes   uint64 `json:"dropped_bytes"`
+}
+
+type TrafficRuleData struct {
+	Username       string `json:"username"`
+	Route          string `json:"route"`
+	Policy         string `json:"policy"`
+	AllowedPackets uint64 `json:"allowed_packets"`
+	AllowedBytes   uint64 `json:"allowed_bytes"`
+	DroppedPackets uint64 `json:"dropped_packets"`
+	DroppedBytes   uint64 `json:"dropped_bytes"`
+}
+
+type DropEventData struct {
+	Time        string `json:"time"`
+	Username    string `json:"username"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Protocol    string `json:"protocol"`
+	Reason      string `json:"reason"`
+}
+
+type AuditEventData struct {
+	Time     string `json:"time"`
+	Type     string `json:"type"`
+	Outcome  string `json:"outcome"`
+	Actor    string `json:"actor"`
+	Username string `json:"username"`
+	Address  string `json:"address"`
+	Action   string `json:"action"`
+	Details  string `json:"details"`
+}
@@ -9,14 +9,18 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/NHAS/session"
+	"github.com/NHAS/wag/internal/audit"
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
@@ -69,12 +73,52 @@ func render(w http.ResponseWriter, r *http.Request, model interface{}, content .
 	return nil
 }
 
+// adminCtrl makes changes through the control socket as the logged in admin, so the audit log shows who made them
+func adminCtrl(r *http.Request) *wagctl.CtrlClient {
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		return ctrl
+	}
+
+	return ctrl.As(u.Username + " (ui)")
+}
+
+// auditAdmin records changes made in the management ui that do not go through the control socket
+func auditAdmin(r *http.Request, admin, action string, err error, details map[string]string) {
+	event := audit.Event{
+		Type:    audit.Admin,
+		Outcome: audit.Success,
+		Actor:   admin,
+		Address: r.RemoteAddr,
+		Action:  action,
+		Details: details,
+	}
+
+	if err != nil {
+		event.Outcome = audit.Failure
+		if event.Details == nil {
+			event.Details = map[string]string{}
+		}
+		event.Details["error"] = err.Error()
+	}
+
+	audit.Record(event)
+}
+
+func loginPage(errorMessage string) Login {
+	return Login{
+		ErrorMessage:  errorMessage,
+		SSO:           adminProvider != nil,
+		PasswordLogin: !config.Values().ManagementUI.DisablePasswordLogin,
+	}
+}
+
 func doLogin(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
 
-		err := render(w, r, nil, "templates/login.html")
+		err := render(w, r, loginPage(""), "templates/login.html")
 
 		if err != nil {
 			log.Println("unable to render login template:", err)
@@ -83,40 +127,54 @@ func doLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "POST":
+		if config.Values().ManagementUI.DisablePasswordLogin {
+			http.NotFound(w, r)
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
 			log.Println("bad form value: ", err)
 
-			render(w, r, Login{ErrorMessage: "Unable to login"}, "templates/login.html")
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
 			return
 		}
 
 		err = data.CompareAdminKeys(r.Form.Get("username"), r.Form.Get("password"))
 		if err != nil {
 			log.Println("admin login failed for user", r.Form.Get("username"), ": ", err)
+			auditAdmin(r, r.Form.Get("username"), "login", err, nil)
 
-			render(w, r, Login{ErrorMessage: "Unable to login"}, "templates/login.html")
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
 			return
 		}
 
-		if err := data.SetLastLoginInformation(r.Form.Get("username"), r.RemoteAddr); err != nil {
+		mfaType, _, err := data.GetAdminMfa(r.Form.Get("username"))
+		if err != nil {
 			log.Println("unable to login: ", err)
 
-			render(w, r, Login{ErrorMessage: "Unable to login"}, "templates/login.html")
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
 			return
 		}
 
-		adminDetails, err := data.GetAdminUser(r.Form.Get("username"))
-		if err != nil {
-			log.Println("unable to login: ", err)
+		if mfaType != "" {
+			mfaSessions.StartSession(w, r, adminMfaState{Username: r.Form.Get("username")}, nil)
+			http.Redirect(w, r, "/mfa", http.StatusSeeOther)
+			return
+		}
 
-			render(w, r, Login{ErrorMessage: "Unable to login"}, "templates/login.html")
+		if config.Values().ManagementUI.EnforceMFA {
+			mfaSessions.StartSession(w, r, adminMfaState{Username: r.Form.Get("username")}, nil)
+			http.Redirect(w, r, "/mfa/register", http.StatusSeeOther)
 			return
 		}
 
-		sessionManager.StartSession(w, r, adminDetails, nil)
+		if err := finishLogin(w, r, r.Form.Get("username"), ""); err != nil {
+			log.Println("unable to login: ", err)
 
-		log.Println(r.Form.Get("username"), r.RemoteAddr, "admin logged in")
+			render(w, r, loginPage("Unable to login"), "templates/login.html")
+			return
+		}
 
 		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
 
@@ -268,7 +326,7 @@ func StartWebServer(errs chan<- error) error {
 
 		log.Println("This information will not be shown again. ")
 
-		err = ctrl.AddAdminUser(username, password, true)
+		err = ctrl.AddAdminUser(username, password, true, data.AdminRoleAdmin)
 		if err != nil {
 			return err
 		}
@@ -279,6 +337,14 @@ func StartWebServer(errs chan<- error) error {
 		return err
 	}
 
+	if err := startAdminMfa(); err != nil {
+		return err
+	}
+
+	if err := startAdminOidc(); err != nil {
+		return err
+	}
+
 	log.SetOutput(io.MultiWriter(os.Stdout, &LogQueue))
 
 	//https://blog.cloudflare.com/exposing-go-on-the-internet/
@@ -309,6 +375,12 @@ func StartWebServer(errs chan<- error) error {
 		protectedRoutes := http.NewServeMux()
 		allRoutes := http.NewServeMux()
 		allRoutes.HandleFunc("/login", doLogin)
+		allRoutes.HandleFunc("/login/oidc", adminOidcLogin)
+		allRoutes.HandleFunc("/login/oidc/callback", adminOidcCallback)
+		allRoutes.HandleFunc("/mfa", adminMfaPrompt)
+		allRoutes.HandleFunc("/mfa/webauthn", adminMfaWebauthn)
+		allRoutes.HandleFunc("/mfa/register", adminMfaRegister)
+		allRoutes.HandleFunc("/mfa/register/webauthn", adminMfaRegisterWebauthn)
 
 		allRoutes.Handle("/js/", static)
 		allRoutes.Handle("/css/", static)
@@ -329,6 +401,13 @@ func StartWebServer(errs chan<- error) error {
 
 			sessionManager.UpdateSession(key, d)
 
+			if !roleAllows(d.Role, r) {
+				auditAdmin(r, d.Username, r.URL.Path, fmt.Errorf("the %s role is not allowed to %s this", d.Role, r.Method), nil)
+
+				http.Error(w, "Forbidden, your role ("+d.Role+") does not allow this", http.StatusForbidden)
+				return false
+			}
+
 			return true
 		}))
 
@@ -450,6 +529,213 @@ func StartWebServer(errs chan<- error) error {
 
 		})
 
+		protectedRoutes.HandleFunc("/diag/traffic", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			_, u := sessionManager.GetSessionFromRequest(r)
+			if u == nil {
+				http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+				return
+			}
+
+			d := Page{
+				Update:      getUpdate(),
+				Description: "Traffic accounting",
+				Title:       "Traffic",
+				User:        u.Username,
+				WagVersion:  WagVersion,
+			}
+
+			renderDefaults(w, r, d, "diagnostics/traffic.html")
+		})
+
+		protectedRoutes.HandleFunc("/diag/traffic/devices", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			stats, err := ctrl.FirewallStats()
+			if err != nil {
+				log.Println("unable to get firewall stats: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			data := []TrafficDeviceData{}
+			for _, device := range stats.Devices {
+				data = append(data, TrafficDeviceData{
+					Username:       device.Username,
+					Address:        device.Address,
+					AllowedPackets: device.AllowedPackets,
+					AllowedBytes:   device.AllowedBytes,
+					DroppedPackets: device.DroppedPackets,
+					DroppedBytes:   device.DroppedBytes,
+				})
+			}
+
+			result, err := json.Marshal(data)
+			if err != nil {
+				log.Println("unable to marshal device traffic data: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+		})
+
+		protectedRoutes.HandleFunc("/diag/traffic/rules", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			stats, err := ctrl.FirewallStats()
+			if err != nil {
+				log.Println("unable to get firewall stats: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			data := []TrafficRuleData{}
+			for _, rule := range stats.Rules {
+				data = append(data, TrafficRuleData{
+					Username:       rule.Username,
+					Route:          rule.Route,
+					Policy:         rule.Policy,
+					AllowedPackets: rule.AllowedPackets,
+					AllowedBytes:   rule.AllowedBytes,
+					DroppedPackets: rule.DroppedPackets,
+					DroppedBytes:   rule.DroppedBytes,
+				})
+			}
+
+			result, err := json.Marshal(data)
+			if err != nil {
+				log.Println("unable to marshal rule traffic data: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+		})
+
+		protectedRoutes.HandleFunc("/diag/firewall/drops", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			data := []DropEventData{}
+			for _, event := range router.RecentDropEvents() {
+				data = append(data, DropEventData{
+					Time:        event.Time.Format(time.RFC3339),
+					Username:    event.Username,
+					Source:      net.JoinHostPort(event.Source, fmt.Sprint(event.SourcePort)),
+					Destination: net.JoinHostPort(event.Destination, fmt.Sprint(event.DestinationPort)),
+					Protocol:    event.Protocol,
+					Reason:      event.Reason,
+				})
+			}
+
+			result, err := json.Marshal(data)
+			if err != nil {
+				log.Println("unable to marshal drop events: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+		})
+
+		protectedRoutes.HandleFunc("/diag/audit", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			_, u := sessionManager.GetSessionFromRequest(r)
+			if u == nil {
+				http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+				return
+			}
+
+			d := Page{
+				Update:      getUpdate(),
+				Description: "Audit log",
+				Title:       "Audit Log",
+				User:        u.Username,
+				WagVersion:  WagVersion,
+			}
+
+			renderDefaults(w, r, d, "diagnostics/audit.html")
+		})
+
+		protectedRoutes.HandleFunc("/diag/audit/events", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				http.NotFound(w, r)
+				return
+			}
+
+			filter := data.AuditFilter{
+				Type:     r.URL.Query().Get("type"),
+				Username: r.URL.Query().Get("username"),
+				Actor:    r.URL.Query().Get("actor"),
+			}
+
+			if since := r.URL.Query().Get("since"); since != "" {
+				var err error
+				filter.Since, err = time.ParseInLocation("2006-01-02T15:04", since, time.Local)
+				if err != nil {
+					http.Error(w, "invalid since time", 400)
+					return
+				}
+			}
+
+			events, err := ctrl.AuditEvents(filter)
+			if err != nil {
+				log.Println("unable to get audit events: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			data := []AuditEventData{}
+			for _, event := range events {
+				details := []string{}
+				for name, value := range event.Details {
+					details = append(details, name+"="+value)
+				}
+				sort.Strings(details)
+
+				data = append(data, AuditEventData{
+					Time:     event.Time.Format(time.RFC3339),
+					Type:     event.Type,
+					Outcome:  event.Outcome,
+					Actor:    event.Actor,
+					Username: event.Username,
+					Address:  event.Address,
+					Action:   event.Action,
+					Details:  strings.Join(details, " "),
+				})
+			}
+
+			result, err := json.Marshal(data)
+			if err != nil {
+				log.Println("unable to marshal audit events: ", err)
+				http.Error(w, "Server error", 500)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(result)
+		})
+
 		protectedRoutes.HandleFunc("/management/users/", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method != "GET" {
 				http.NotFound(w, r)
@@ -482,6 +768,7 @@ func StartWebServer(errs chan<- error) error {
 		})
 
 		protectedRoutes.HandleFunc("/management/users/data", contentType(manageUsers, JSON))
+		protectedRoutes.HandleFunc("/management/sessions/data", contentType(forceReauthentication, JSON))
 
 		protectedRoutes.HandleFunc("/management/devices/", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method != "GET" {
@@ -559,12 +846,17 @@ func StartWebServer(errs chan<- error) error {
 				http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 				return
 			}
-			d := Page{
-				Update:      getUpdate(),
-				Description: "Firewall rules",
-				Title:       "Rules",
-				User:        u.Username,
-				WagVersion:  WagVersion,
+			acls := config.Values().Acls
+			d := RulesPage{
+				Page: Page{
+					Update:      getUpdate(),
+					Description: "Firewall rules",
+					Title:       "Rules",
+					User:        u.Username,
+					WagVersion:  WagVersion,
+				},
+				Services: acls.Services,
+				Hosts:    acls.Hosts,
 			}
 
 			err := renderDefaults(w, r, d, "policy/rules.html", "delete_modal.html")
@@ -808,6 +1100,7 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		err = data.CompareAdminKeys(u.Username, r.FormValue("current_password"))
 		if err != nil {
 			log.Println("bad password for admin")
+			auditAdmin(r, u.Username, "change password", err, nil)
 
 			d.Message = "Current password is incorrect"
 			d.Type = 1
@@ -827,6 +1120,7 @@ func changePassword(w http.ResponseWriter, r *http.Request) {
 		}
 
 		err = data.SetAdminPassword(u.Username, r.FormValue("password2"))
+		auditAdmin(r, u.Username, "change password", err, nil)
 		if err != nil {
 			log.Println("unable to set new admin password for ", u.Username)
 
@@ -883,6 +1177,12 @@ func general(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		auditAdmin(r, u.Username, "change general settings", nil, map[string]string{
+			"help_mail":        general.HelpMail,
+			"external_address": general.ExternalAddress,
+			"dns":              strings.Join(general.DNS, ","),
+		})
+
 		w.Write([]byte("OK"))
 		return
 	case "login":
@@ -913,6 +1213,12 @@ func general(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		auditAdmin(r, u.Username, "change login settings", nil, map[string]string{
+			"session_lifetime":   strconv.Itoa(login.SessionLifetime),
+			"session_inactivity": strconv.Itoa(login.InactivityTimeout),
+			"lockout":            strconv.Itoa(login.Lockout),
+		})
+
 		w.Write([]byte("OK"))
 		return
 	default:
@@ -950,7 +1256,7 @@ func groups(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.RemoveGroup(groupsToRemove); err != nil {
+		if err := adminCtrl(r).RemoveGroup(groupsToRemove); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error removing groups: ", err)
 			return
@@ -966,7 +1272,7 @@ func groups(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.EditGroup(group); err != nil {
+		if err := adminCtrl(r).EditGroup(group); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error editing group: ", err)
 			return
@@ -982,7 +1288,7 @@ func groups(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.AddGroup(group); err != nil {
+		if err := adminCtrl(r).AddGroup(group); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error adding group: ", err)
 			return
@@ -1025,7 +1331,7 @@ func policies(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.RemovePolicies(policiesToRemove); err != nil {
+		if err := adminCtrl(r).RemovePolicies(policiesToRemove); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error removing policy: ", err)
 			return
@@ -1041,7 +1347,7 @@ func policies(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.EditPolicies(group); err != nil {
+		if err := adminCtrl(r).EditPolicies(group); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error editing policy: ", err)
 			return
@@ -1057,7 +1363,7 @@ func policies(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if err := ctrl.AddPolicy(policy); err != nil {
+		if err := adminCtrl(r).AddPolicy(policy); err != nil {
 			http.Error(w, err.Error(), 500)
 			log.Println("error adding policy: ", err)
 			return
@@ -1083,12 +1389,20 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		_, u := sessionManager.GetSessionFromRequest(r)
+		hideTokens := u == nil || !canSeeSecrets(u.Role)
+
 		data := []TokensData{}
 
 		for _, reg := range registrations {
+			token := reg.Token
+			if hideTokens {
+				token = "(hidden)"
+			}
+
 			data = append(data, TokensData{
 				Username:   reg.Username,
-				Token:      reg.Token,
+				Token:      token,
 				Groups:     reg.Groups,
 				Overwrites: reg.Overwrites,
 				Uses:       reg.NumUses,
@@ -1117,7 +1431,7 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, token := range tokens {
-			err := ctrl.DeleteRegistration(token)
+			err := adminCtrl(r).DeleteRegistration(token)
 			if err != nil {
 				log.Println("Error deleting registration token: ", token, "err:", err)
 			}
@@ -1157,7 +1471,7 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			groups = strings.Split(b.Groups, ",")
 		}
 
-		_, err = ctrl.NewRegistration(b.Token, b.Username, b.Overwrites, uses, groups...)
+		_, err = adminCtrl(r).NewRegistration(b.Token, b.Username, b.Overwrites, uses, groups...)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -1182,19 +1496,59 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Fetch devices and factors for everyone at once, rather than asking the control socket for each user
+		devices, err := ctrl.ListDevice("")
+		if err != nil {
+			log.Println("error getting devices: ", err)
+		}
+
+		devicesPerUser := map[string]int{}
+		for _, d := range devices {
+			devicesPerUser[d.Username]++
+		}
+
+		allFactors, err := ctrl.ListUserMFA("")
+		if err != nil {
+			log.Println("error getting mfa factors: ", err)
+		}
+
+		factorsPerUser := map[string][]data.MfaFactor{}
+		for _, f := range allFactors {
+			factorsPerUser[f.Username] = append(factorsPerUser[f.Username], f)
+		}
+
 		data := []UsersData{}
 
 		for _, u := range users {
-			devices, _ := ctrl.ListDevice(u.Username)
-
 			groups := append([]string{"*"}, config.Values().Acls.GetUserGroups(u.Username)...)
 
+			mfa := []MFAData{}
+			types := []string{}
+			for _, f := range factorsPerUser[u.Username] {
+				mfa = append(mfa, MFAData{
+					ID:        f.ID,
+					Type:      f.Type,
+					DateAdded: f.DateAdded,
+					LastUsed:  f.LastUsed,
+				})
+
+				if !slices.Contains(types, f.Type) {
+					types = append(types, f.Type)
+				}
+			}
+
+			mfaType := strings.Join(types, ", ")
+			if len(types) == 0 {
+				mfaType = u.MfaType
+			}
+
 			data = append(data, UsersData{
 				Username: u.Username,
 				Locked:   u.Locked,
-				Devices:  len(devices),
+				Devices:  devicesPerUser[u.Username],
 				Groups:   groups,
-				MFAType:  u.MfaType,
+				MFAType:  mfaType,
+				MFA:      mfa,
 			})
 		}
 
@@ -1212,6 +1566,7 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 		var action struct {
 			Action    string   `json:"action"`
 			Usernames []string `json:"usernames"`
+			Factor    int      `json:"factor"`
 		}
 
 		err := json.NewDecoder(r.Body).Decode(&action)
@@ -1225,13 +1580,16 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 			var err error
 			switch action.Action {
 			case "lock":
-				err = ctrl.LockUser(username)
+				err = adminCtrl(r).LockUser(username)
 
 			case "unlock":
-				err = ctrl.UnlockUser(username)
+				err = adminCtrl(r).UnlockUser(username)
 
 			case "resetMFA":
-				err = ctrl.ResetUserMFA(username)
+				err = adminCtrl(r).ResetUserMFA(username)
+
+			case "revokeMFA":
+				err = adminCtrl(r).RevokeUserMFA(username, action.Factor)
 
 			default:
 				http.Error(w, "invalid action", 400)
@@ -1260,7 +1618,7 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, user := range usernames {
-			err := ctrl.DeleteUser(user)
+			err := adminCtrl(r).DeleteUser(user)
 			if err != nil {
 				log.Println("Error deleting user: ", user, "err: ", err)
 			}
@@ -1273,6 +1631,69 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func forceReauthentication(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, u := sessionManager.GetSessionFromRequest(r)
+	if u == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var targets struct {
+		Usernames []string `json:"usernames"`
+		Groups    []string `json:"groups"`
+		All       bool     `json:"all"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&targets)
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	by := u.Username + " (ui)"
+
+	var (
+		errs  []string
+		count int
+	)
+
+	if targets.All {
+		deauthenticated, err := adminCtrl(r).DeauthenticateAll(by)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		count += len(deauthenticated)
+	}
+
+	for _, username := range targets.Usernames {
+		deauthenticated, err := adminCtrl(r).DeauthenticateUser(username, by)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		count += len(deauthenticated)
+	}
+
+	for _, group := range targets.Groups {
+		deauthenticated, err := adminCtrl(r).DeauthenticateGroup(group, by)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		count += len(deauthenticated)
+	}
+
+	if len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("%d failed with errors:\n%s", len(errs), strings.Join(errs, "\n")), 400)
+		return
+	}
+
+	w.Write([]byte(fmt.Sprintf("%d devices must authorise again", count)))
+}
+
 func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
@@ -1325,12 +1746,12 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 		for _, address := range action.Addresses {
 			switch action.Action {
 			case "lock":
-				err := ctrl.LockDevice(address)
+				err := adminCtrl(r).LockDevice(address)
 				if err != nil {
 					log.Println("Error locking device: ", address, " err:", err)
 				}
 			case "unlock":
-				err := ctrl.UnlockDevice(address)
+				err := adminCtrl(r).UnlockDevice(address)
 				if err != nil {
 					log.Println("Error unlocking device: ", address, " err:", err)
 				}
@@ -1352,7 +1773,7 @@ func devicesMgmt(w http.ResponseWriter, r *http.Request) {
 		}
 
 		for _, address := range addresses {
-			err := ctrl.DeleteDevice(address)
+			err := adminCtrl(r).DeleteDevice(address)
 			if err != nil {
 				log.Println("Error Deleting device: ", address, "err:", err)
 			}